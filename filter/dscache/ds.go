@@ -41,12 +41,50 @@ func (d *dsCache) DeleteMulti(keys []*ds.Key, cb ds.DeleteMultiCB) error {
 }
 
 func (d *dsCache) PutMulti(keys []*ds.Key, vals []ds.PropertyMap, cb ds.NewKeyCB) error {
-	return d.mutation(keys, func() error {
-		return d.RawInterface.PutMulti(keys, vals, cb)
+	var newKeys []*ds.Key
+	err := d.mutation(keys, func() error {
+		var err error
+		newKeys, err = putMulti(d.RawInterface, keys, vals, cb)
+		return err
+	})
+	// The cache may hold the absence of the entities which got the keys that
+	// were allocated for the incomplete keys.
+	if mcKeys := d.mkAllKeys(newKeys); len(mcKeys) > 0 {
+		if err := errors.Filter(mc.Delete(d.c, mcKeys...), mc.ErrCacheMiss); err != nil {
+			(log.Fields{log.ErrorKey: err}).Debugf(
+				d.c, "dscache: PutMulti: mc.Delete")
+		}
+	}
+	return err
+}
+
+// putMulti calls PutMulti of rds, and returns the keys which were allocated for
+// the incomplete keys.
+func putMulti(rds ds.RawInterface, keys []*ds.Key, vals []ds.PropertyMap, cb ds.NewKeyCB) ([]*ds.Key, error) {
+	// The callbacks of the batches may run in parallel.
+	allocated := make([]*ds.Key, len(keys))
+	err := rds.PutMulti(keys, vals, func(idx int, key *ds.Key, err error) error {
+		if err == nil && keys[idx].IsIncomplete() {
+			allocated[idx] = key
+		}
+		return cb(idx, key, err)
 	})
+	var ret []*ds.Key
+	for _, key := range allocated {
+		if key != nil {
+			ret = append(ret, key)
+		}
+	}
+	return ret, err
 }
 
 func (d *dsCache) GetMulti(keys []*ds.Key, metas ds.MultiMetaGetter, cb ds.GetMultiCB) error {
+	if !ds.GetReadTime(d.c).IsZero() {
+		// The cache only holds the current entities. Reads at a past time go
+		// straight to the datastore, and must not fill the cache either.
+		return d.RawInterface.GetMulti(keys, metas, cb)
+	}
+
 	lockItems, nonce := d.mkRandLockItems(keys, metas)
 	if len(lockItems) == 0 {
 		return d.RawInterface.GetMulti(keys, metas, cb)
@@ -35,7 +35,9 @@ func (d *dsTxnCache) DeleteMulti(keys []*ds.Key, cb ds.DeleteMultiCB) error {
 
 func (d *dsTxnCache) PutMulti(keys []*ds.Key, metas []ds.PropertyMap, cb ds.NewKeyCB) error {
 	d.state.add(d.sc, keys)
-	return d.RawInterface.PutMulti(keys, metas, cb)
+	newKeys, err := putMulti(d.RawInterface, keys, metas, cb)
+	d.state.add(d.sc, newKeys)
+	return err
 }
 
 // TODO(riannucci): on GetAll, Load from memcache and invalidate entries if the
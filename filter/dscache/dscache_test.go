@@ -160,6 +160,56 @@ func TestDSCache(t *testing.T) {
 				})
 			})
 
+			Convey("putting an incomplete key forgets the absence of its entity", func() {
+				o := object{ID: 1}
+				So(ds.Get(c, &o), ShouldEqual, ds.ErrNoSuchEntity)
+
+				o = object{Value: "hi"}
+				So(ds.Put(c, &o), ShouldBeNil)
+				So(o.ID, ShouldEqual, 1)
+
+				o = object{ID: 1}
+				So(ds.Get(c, &o), ShouldBeNil)
+				So(o.Value, ShouldEqual, "hi")
+
+				Convey("in transactions too", func() {
+					So(ds.Get(c, &object{ID: 2}), ShouldEqual, ds.ErrNoSuchEntity)
+					So(ds.RunInTransaction(c, func(c context.Context) error {
+						return ds.Put(c, &object{Value: "there"})
+					}, nil), ShouldBeNil)
+
+					o := object{ID: 2}
+					So(ds.Get(c, &o), ShouldBeNil)
+					So(o.Value, ShouldEqual, "there")
+				})
+			})
+
+			Convey("reads at a past time bypass it", func() {
+				ds.GetTestable(c).SetReadTimeRetention(time.Hour)
+				past := clock.Now(c)
+				So(ds.Put(underCtx, &object{ID: 1, Value: "old"}), ShouldBeNil)
+				clk.Add(time.Minute)
+
+				So(ds.Put(c, &object{ID: 1, Value: "hi"}), ShouldBeNil)
+				o := object{ID: 1}
+				So(ds.Get(c, &o), ShouldBeNil)
+				So(o.Value, ShouldEqual, "hi")
+				itm, err := mc.GetKey(c, MakeMemcacheKey(0, ds.KeyForObj(c, &o)))
+				So(err, ShouldBeNil)
+
+				o = object{ID: 1}
+				So(ds.Get(ds.WithReadTime(c, past), &o), ShouldBeNil)
+				So(o.Value, ShouldEqual, "old")
+
+				after, err := mc.GetKey(c, itm.Key())
+				So(err, ShouldBeNil)
+				So(after.Value(), ShouldResemble, itm.Value())
+
+				o = object{ID: 1}
+				So(ds.Get(c, &o), ShouldBeNil)
+				So(o.Value, ShouldEqual, "hi")
+			})
+
 			Convey("compression works", func() {
 				o := object{ID: 2, Value: `¯\_(ツ)_/¯`}
 				data := make([]byte, 4000)
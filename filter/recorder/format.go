@@ -0,0 +1,269 @@
+// Copyright 2018 The LUCI Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package recorder
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	ds "go.chromium.org/gae/service/datastore"
+	"go.chromium.org/gae/service/datastore/serialize"
+
+	"go.chromium.org/luci/common/data/cmpbin"
+	"go.chromium.org/luci/common/errors"
+
+	"golang.org/x/net/context"
+)
+
+// formatVersion is the version of the recording format, written in its header.
+const formatVersion = 1
+
+// header is the first line of a recording.
+type header struct {
+	Version     int            `json:"version"`
+	Constraints ds.Constraints `json:"constraints"`
+}
+
+// call is a recorded RawInterface call, one line of a recording.
+type call struct {
+	Method string `json:"method"`
+
+	// Request is the serialized arguments of the call, which the replay compares
+	// to the arguments of the calls it serves. Desc describes them, for errors.
+	Request []byte `json:"request"`
+	Desc    string `json:"desc"`
+
+	// Results are the results passed to the callback, in the order of the
+	// callbacks.
+	Results []*result `json:"results,omitempty"`
+
+	// Count is the result of Count.
+	Count int64 `json:"count,omitempty"`
+
+	// Attempts is the number of times the function of RunInTransaction ran.
+	Attempts int `json:"attempts,omitempty"`
+
+	// Err is the error returned by the call.
+	Err *recordedError `json:"err,omitempty"`
+}
+
+// result is a result of a call, passed to its callback.
+type result struct {
+	Index int `json:"index,omitempty"`
+
+	// Key and Value are the serialized key and PropertyMap, if not nil.
+	Key   []byte `json:"key,omitempty"`
+	Value []byte `json:"value,omitempty"`
+
+	// Cursor is the cursor of a query result, if the callback got it.
+	Cursor string `json:"cursor,omitempty"`
+
+	Err *recordedError `json:"err,omitempty"`
+}
+
+// recordedError is a recorded error. The errors of the datastore which code
+// usually checks for keep their identity.
+type recordedError struct {
+	Kind    string `json:"kind,omitempty"`
+	Message string `json:"message"`
+}
+
+const (
+	kindNoSuchEntity          = "NoSuchEntity"
+	kindConcurrentTransaction = "ConcurrentTransaction"
+	kindInvalidKey            = "InvalidKey"
+	kindStop                  = "Stop"
+)
+
+func encodeError(err error) *recordedError {
+	if err == nil {
+		return nil
+	}
+	ret := &recordedError{Message: err.Error()}
+	switch {
+	case err == ds.ErrNoSuchEntity:
+		ret.Kind = kindNoSuchEntity
+	case err == ds.ErrConcurrentTransaction:
+		ret.Kind = kindConcurrentTransaction
+	case err == ds.Stop:
+		ret.Kind = kindStop
+	case ds.IsErrInvalidKey(err):
+		ret.Kind = kindInvalidKey
+	}
+	return ret
+}
+
+func (e *recordedError) decode() error {
+	if e == nil {
+		return nil
+	}
+	switch e.Kind {
+	case kindNoSuchEntity:
+		return ds.ErrNoSuchEntity
+	case kindConcurrentTransaction:
+		return ds.ErrConcurrentTransaction
+	case kindStop:
+		return ds.Stop
+	case kindInvalidKey:
+		return ds.MakeErrInvalidKey("%s", e.Message).Err()
+	default:
+		return errors.New(e.Message)
+	}
+}
+
+func encodeKey(k *ds.Key) []byte {
+	if k == nil {
+		return nil
+	}
+	buf := bytes.Buffer{}
+	_ = serialize.WriteKey(&buf, serialize.WithContext, k)
+	return buf.Bytes()
+}
+
+func decodeKey(b []byte) (*ds.Key, error) {
+	if b == nil {
+		return nil, nil
+	}
+	return serialize.ReadKey(bytes.NewBuffer(b), serialize.WithContext, ds.KeyContext{})
+}
+
+func encodePropertyMap(pm ds.PropertyMap) []byte {
+	if pm == nil {
+		return nil
+	}
+	pm, _ = pm.Save(false)
+	buf := bytes.Buffer{}
+	// errs can't happen, since we're using a byte buffer.
+	_ = serialize.WritePropertyMap(&buf, serialize.WithContext, pm)
+	return buf.Bytes()
+}
+
+func decodePropertyMap(b []byte) (ds.PropertyMap, error) {
+	if b == nil {
+		return nil, nil
+	}
+	return serialize.ReadPropertyMap(bytes.NewBuffer(b), serialize.WithContext, ds.KeyContext{})
+}
+
+// request builds the serialized arguments of a call.
+//
+// The errors of the writes can't happen, since they write to a byte buffer.
+type request struct {
+	buf  bytes.Buffer
+	desc []string
+}
+
+// newRequest starts a request in the context ic of a RawInterface, whose
+// namespace, transaction and read time are a part of the arguments of every
+// call.
+func newRequest(ic context.Context, inTxn bool) *request {
+	r := &request{}
+	kc := ds.GetKeyContext(ic)
+	_, _ = cmpbin.WriteString(&r.buf, kc.Namespace)
+	if inTxn {
+		_ = r.buf.WriteByte(1)
+	} else {
+		_ = r.buf.WriteByte(0)
+	}
+	r.time(ds.GetReadTime(ic))
+	return r
+}
+
+func (r *request) time(t time.Time) {
+	if t.IsZero() {
+		_, _ = cmpbin.WriteInt(&r.buf, 0)
+	} else {
+		_, _ = cmpbin.WriteInt(&r.buf, t.UnixNano())
+	}
+}
+
+func (r *request) keys(keys []*ds.Key) *request {
+	_, _ = cmpbin.WriteUint(&r.buf, uint64(len(keys)))
+	descs := make([]string, len(keys))
+	for i, k := range keys {
+		_ = serialize.WriteKey(&r.buf, serialize.WithContext, k)
+		descs[i] = k.String()
+	}
+	r.desc = append(r.desc, "["+strings.Join(descs, ", ")+"]")
+	return r
+}
+
+// values writes the PropertyMaps with their properties sorted by name, unlike
+// serialize.WritePropertyMap, so that the same values always have the same
+// serialized form.
+func (r *request) values(vals []ds.PropertyMap) *request {
+	_, _ = cmpbin.WriteUint(&r.buf, uint64(len(vals)))
+	for _, pm := range vals {
+		names := make([]string, 0, len(pm))
+		for name := range pm {
+			if !strings.HasPrefix(name, "$") {
+				names = append(names, name)
+			}
+		}
+		sort.Strings(names)
+
+		_, _ = cmpbin.WriteUint(&r.buf, uint64(len(names)))
+		for _, name := range names {
+			_, _ = cmpbin.WriteString(&r.buf, name)
+			vals := pm.Slice(name)
+			_, _ = cmpbin.WriteUint(&r.buf, uint64(len(vals)))
+			for _, v := range vals {
+				_ = serialize.WriteProperty(&r.buf, serialize.WithContext, v)
+			}
+		}
+	}
+	return r
+}
+
+func (r *request) query(fq *ds.FinalizedQuery) *request {
+	_, _ = cmpbin.WriteString(&r.buf, fq.GQL())
+	start, end := fq.Bounds()
+	for _, cur := range []ds.Cursor{start, end} {
+		s := ""
+		if cur != nil {
+			s = cur.String()
+		}
+		_, _ = cmpbin.WriteString(&r.buf, s)
+	}
+	if fq.EventuallyConsistent() {
+		_ = r.buf.WriteByte(1)
+	} else {
+		_ = r.buf.WriteByte(0)
+	}
+	r.desc = append(r.desc, fq.String())
+	return r
+}
+
+func (r *request) txnOptions(opts *ds.TransactionOptions) *request {
+	if opts == nil {
+		opts = &ds.TransactionOptions{}
+	}
+	_, _ = cmpbin.WriteInt(&r.buf, int64(opts.Attempts))
+	if opts.ReadOnly {
+		_ = r.buf.WriteByte(1)
+	} else {
+		_ = r.buf.WriteByte(0)
+	}
+	r.time(opts.ReadTime)
+	r.desc = append(r.desc, fmt.Sprintf("%+v", *opts))
+	return r
+}
+
+func (r *request) String() string {
+	return strings.Join(r.desc, " ")
+}
@@ -0,0 +1,109 @@
+// Copyright 2018 The LUCI Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package recorder
+
+import (
+	ds "go.chromium.org/gae/service/datastore"
+
+	"golang.org/x/net/context"
+)
+
+// recordingDS is a datastore.RawInterface implementation which records the
+// calls to the inner RawInterface.
+type recordingDS struct {
+	ds.RawInterface
+
+	ic  context.Context
+	rec *Recorder
+}
+
+var _ ds.RawInterface = (*recordingDS)(nil)
+
+func (d *recordingDS) request() *request {
+	return newRequest(d.ic, d.RawInterface.CurrentTransaction() != nil)
+}
+
+func (d *recordingDS) AllocateIDs(keys []*ds.Key, cb ds.NewKeyCB) error {
+	cl := d.rec.begin("AllocateIDs", d.request().keys(keys))
+	err := d.RawInterface.AllocateIDs(keys, func(idx int, key *ds.Key, err error) error {
+		d.rec.addResult(cl, &result{Index: idx, Key: encodeKey(key), Err: encodeError(err)})
+		return cb(idx, key, err)
+	})
+	d.rec.end(cl, 0, err)
+	return err
+}
+
+func (d *recordingDS) RunInTransaction(f func(c context.Context) error, opts *ds.TransactionOptions) error {
+	cl := d.rec.begin("RunInTransaction", d.request().txnOptions(opts))
+	err := d.RawInterface.RunInTransaction(func(c context.Context) error {
+		d.rec.addAttempt(cl)
+		return f(c)
+	}, opts)
+	d.rec.end(cl, 0, err)
+	return err
+}
+
+func (d *recordingDS) Run(fq *ds.FinalizedQuery, cb ds.RawRunCB) error {
+	cl := d.rec.begin("Run", d.request().query(fq))
+	err := d.RawInterface.Run(fq, func(key *ds.Key, val ds.PropertyMap, getCursor ds.CursorCB) error {
+		i := d.rec.addResult(cl, &result{Key: encodeKey(key), Value: encodePropertyMap(val)})
+		return cb(key, val, func() (ds.Cursor, error) {
+			cursor, err := getCursor()
+			if err == nil {
+				d.rec.setCursor(cl, i, cursor)
+			}
+			return cursor, err
+		})
+	})
+	d.rec.end(cl, 0, err)
+	return err
+}
+
+func (d *recordingDS) Count(fq *ds.FinalizedQuery) (int64, error) {
+	cl := d.rec.begin("Count", d.request().query(fq))
+	count, err := d.RawInterface.Count(fq)
+	d.rec.end(cl, count, err)
+	return count, err
+}
+
+func (d *recordingDS) GetMulti(keys []*ds.Key, meta ds.MultiMetaGetter, cb ds.GetMultiCB) error {
+	cl := d.rec.begin("GetMulti", d.request().keys(keys))
+	err := d.RawInterface.GetMulti(keys, meta, func(idx int, val ds.PropertyMap, err error) error {
+		d.rec.addResult(cl, &result{Index: idx, Value: encodePropertyMap(val), Err: encodeError(err)})
+		return cb(idx, val, err)
+	})
+	d.rec.end(cl, 0, err)
+	return err
+}
+
+func (d *recordingDS) PutMulti(keys []*ds.Key, vals []ds.PropertyMap, cb ds.NewKeyCB) error {
+	cl := d.rec.begin("PutMulti", d.request().keys(keys).values(vals))
+	err := d.RawInterface.PutMulti(keys, vals, func(idx int, key *ds.Key, err error) error {
+		d.rec.addResult(cl, &result{Index: idx, Key: encodeKey(key), Err: encodeError(err)})
+		return cb(idx, key, err)
+	})
+	d.rec.end(cl, 0, err)
+	return err
+}
+
+func (d *recordingDS) DeleteMulti(keys []*ds.Key, cb ds.DeleteMultiCB) error {
+	cl := d.rec.begin("DeleteMulti", d.request().keys(keys))
+	err := d.RawInterface.DeleteMulti(keys, func(idx int, err error) error {
+		d.rec.addResult(cl, &result{Index: idx, Err: encodeError(err)})
+		return cb(idx, err)
+	})
+	d.rec.end(cl, 0, err)
+	return err
+}
@@ -0,0 +1,127 @@
+// Copyright 2018 The LUCI Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package recorder records the datastore calls of code running against a real
+// datastore, and replays them later, for hermetic tests of that code without
+// the datastore.
+//
+// FilterRDS installs a filter which records every RawInterface call made
+// through it, with its arguments, results and errors, in a Recorder.
+// Recorder.Write writes them out, one JSON object per line, with the keys and
+// PropertyMaps in their serialize form.
+//
+// A Replayer reads the recording back, and Replayer.Use installs a datastore
+// which serves the recorded calls. Any call which doesn't match the recording
+// fails with ErrUnexpectedCall. By default the calls must be made in the
+// recorded order; with Unordered, each call is served by any recorded call
+// with the same arguments, e.g. for code which makes calls concurrently.
+//
+// The replay needs the context to have an info service, like the recording
+// did, since the namespace of the calls is a part of their arguments.
+//
+// LIMITATIONS
+//   - Cursors are replayed as opaque strings: only the cursors of query
+//     results which the code got while recording can be replayed.
+//   - The replayed datastore has no Testable.
+package recorder
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+
+	ds "go.chromium.org/gae/service/datastore"
+
+	"golang.org/x/net/context"
+)
+
+// Recorder records the calls made through the filters installed with
+// FilterRDS.
+//
+// The zero value is an empty Recorder.
+type Recorder struct {
+	mu          sync.Mutex
+	constraints ds.Constraints
+	calls       []*call
+}
+
+// FilterRDS installs a filter in the context which records all of the calls to
+// the datastore in rec.
+func FilterRDS(c context.Context, rec *Recorder) context.Context {
+	return ds.AddRawFilters(c, func(ic context.Context, inner ds.RawInterface) ds.RawInterface {
+		rec.setConstraints(inner.Constraints())
+		return &recordingDS{inner, ic, rec}
+	})
+}
+
+// Write writes the recorded calls to w, in the order in which they were made.
+func (r *Recorder) Write(w io.Writer) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	enc := json.NewEncoder(w)
+	if err := enc.Encode(&header{Version: formatVersion, Constraints: r.constraints}); err != nil {
+		return err
+	}
+	for _, cl := range r.calls {
+		if err := enc.Encode(cl); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *Recorder) setConstraints(c ds.Constraints) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.constraints = c
+}
+
+// begin records the start of a call. The call is recorded in the order in
+// which it started, even if its results come later.
+func (r *Recorder) begin(method string, req *request) *call {
+	cl := &call{Method: method, Request: req.buf.Bytes(), Desc: req.String()}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.calls = append(r.calls, cl)
+	return cl
+}
+
+// addResult adds a result to the call, and returns its index.
+func (r *Recorder) addResult(cl *call, res *result) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	cl.Results = append(cl.Results, res)
+	return len(cl.Results) - 1
+}
+
+func (r *Recorder) setCursor(cl *call, i int, cursor ds.Cursor) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	cl.Results[i].Cursor = cursor.String()
+}
+
+func (r *Recorder) addAttempt(cl *call) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	cl.Attempts++
+}
+
+func (r *Recorder) end(cl *call, count int64, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	cl.Count = count
+	cl.Err = encodeError(err)
+}
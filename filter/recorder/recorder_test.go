@@ -0,0 +1,183 @@
+// Copyright 2018 The LUCI Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package recorder
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	"go.chromium.org/gae/impl/memory"
+	ds "go.chromium.org/gae/service/datastore"
+
+	"go.chromium.org/luci/common/errors"
+
+	"golang.org/x/net/context"
+
+	. "github.com/smartystreets/goconvey/convey"
+	. "go.chromium.org/luci/common/testing/assertions"
+)
+
+type Item struct {
+	ID  int64 `gae:"$id"`
+	Val string
+}
+
+// handler uses the datastore like a request handler would, and returns a log
+// of what it observed.
+func handler(c context.Context) ([]string, error) {
+	var log []string
+
+	item := &Item{Val: "new"}
+	if err := ds.Put(c, item); err != nil {
+		return nil, err
+	}
+	log = append(log, fmt.Sprintf("put %d", item.ID))
+	if err := ds.Put(c, &Item{ID: 2, Val: "a"}, &Item{ID: 3, Val: "b"}); err != nil {
+		return nil, err
+	}
+
+	// ErrNoSuchEntity keeps its identity in the replay.
+	items := []*Item{{ID: 2}, {ID: 3}, {ID: 1000}}
+	err := ds.Get(c, items)
+	log = append(log, fmt.Sprintf("get %s %s missing=%v", items[0].Val, items[1].Val, ds.IsErrNoSuchEntity(err)))
+
+	var cursor ds.Cursor
+	err = ds.Run(c, ds.NewQuery("Item").Order("Val").Limit(2), func(it *Item, getCursor ds.CursorCB) error {
+		log = append(log, "query "+it.Val)
+		var err error
+		cursor, err = getCursor()
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if cursor, err = ds.DecodeCursor(c, cursor.String()); err != nil {
+		return nil, err
+	}
+	err = ds.Run(c, ds.NewQuery("Item").Order("Val").Start(cursor), func(it *Item) {
+		log = append(log, "query after cursor "+it.Val)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	n, err := ds.Count(c, ds.NewQuery("Item"))
+	if err != nil {
+		return nil, err
+	}
+	log = append(log, fmt.Sprintf("count %d", n))
+
+	err = ds.RunInTransaction(c, func(c context.Context) error {
+		it := &Item{ID: 2}
+		if err := ds.Get(c, it); err != nil {
+			return err
+		}
+		it.Val += "+"
+		return ds.Put(c, it)
+	}, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := ds.Delete(c, &Item{ID: 3}); err != nil {
+		return nil, err
+	}
+	items = []*Item{{ID: 2}, {ID: 3}}
+	err = ds.Get(c, items)
+	log = append(log, fmt.Sprintf("get %s missing=%v", items[0].Val, ds.IsErrNoSuchEntity(err)))
+
+	return log, nil
+}
+
+func TestRecorder(t *testing.T) {
+	t.Parallel()
+
+	Convey("Test recorder", t, func() {
+		c := memory.Use(context.Background())
+		ds.GetTestable(c).Consistent(true)
+
+		rec := &Recorder{}
+		want, err := handler(FilterRDS(c, rec))
+		So(err, ShouldBeNil)
+		So(want, ShouldResemble, []string{
+			"put 1",
+			"get a b missing=true",
+			"query a",
+			"query b",
+			"query after cursor new",
+			"count 3",
+			"get a+ missing=true",
+		})
+
+		recording := &bytes.Buffer{}
+		So(rec.Write(recording), ShouldBeNil)
+
+		replay := func(mode Mode) (*Replayer, context.Context) {
+			rp, err := NewReplayer(bytes.NewReader(recording.Bytes()), mode)
+			So(err, ShouldBeNil)
+			return rp, rp.Use(memory.Use(context.Background()))
+		}
+
+		Convey("Replays the calls", func() {
+			rp, c := replay(Ordered)
+			got, err := handler(c)
+			So(err, ShouldBeNil)
+			So(got, ShouldResemble, want)
+			So(rp.Check(), ShouldBeNil)
+		})
+
+		Convey("Fails on unexpected calls", func() {
+			rp, c := replay(Ordered)
+			err := ds.Put(c, &Item{ID: 1, Val: "other"})
+			So(errors.Unwrap(err), ShouldEqual, ErrUnexpectedCall)
+			So(err, ShouldErrLike, "expected PutMulti")
+			So(rp.Check(), ShouldErrLike, "unexpected datastore call")
+		})
+
+		Convey("Fails on missing calls", func() {
+			rp, c := replay(Ordered)
+			item := &Item{Val: "new"}
+			So(ds.Put(c, item), ShouldBeNil)
+			So(item.ID, ShouldEqual, 1)
+			So(rp.Check(), ShouldErrLike, "recorded calls weren't made")
+		})
+
+		Convey("Ordering", func() {
+			rec := &Recorder{}
+			c := FilterRDS(c, rec)
+			So(ds.Get(c, &Item{ID: 1}), ShouldBeNil)
+			So(ds.Get(c, &Item{ID: 2}), ShouldBeNil)
+			recording.Reset()
+			So(rec.Write(recording), ShouldBeNil)
+
+			Convey("Ordered fails on calls out of order", func() {
+				_, c := replay(Ordered)
+				So(errors.Unwrap(ds.Get(c, &Item{ID: 2})), ShouldEqual, ErrUnexpectedCall)
+			})
+
+			Convey("Unordered tolerates calls out of order", func() {
+				rp, c := replay(Unordered)
+				it := &Item{ID: 2}
+				So(ds.Get(c, it), ShouldBeNil)
+				So(it.Val, ShouldEqual, "a+")
+				So(ds.Get(c, &Item{ID: 1}), ShouldBeNil)
+				So(rp.Check(), ShouldBeNil)
+
+				So(errors.Unwrap(ds.Get(c, &Item{ID: 1})), ShouldEqual, ErrUnexpectedCall)
+			})
+		})
+	})
+}
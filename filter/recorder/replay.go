@@ -0,0 +1,305 @@
+// Copyright 2018 The LUCI Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package recorder
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"strings"
+	"sync"
+
+	ds "go.chromium.org/gae/service/datastore"
+
+	"go.chromium.org/luci/common/errors"
+
+	"golang.org/x/net/context"
+)
+
+// ErrUnexpectedCall is returned by the replayed datastore for the calls which
+// don't match the recording.
+var ErrUnexpectedCall = errors.New("recorder: unexpected datastore call")
+
+// Mode controls how a Replayer matches the calls to the recording.
+type Mode int
+
+const (
+	// Ordered requires the calls to be made in the recorded order.
+	Ordered Mode = iota
+	// Unordered serves each call with the first recorded call with the same
+	// arguments which wasn't served yet, regardless of their order.
+	Unordered
+)
+
+// Replayer serves the calls of a recording written by Recorder.Write.
+type Replayer struct {
+	mode        Mode
+	constraints ds.Constraints
+
+	mu     sync.Mutex
+	calls  []*call
+	served []bool
+	next   int // the next call to serve, in Ordered mode
+	errs   errors.MultiError
+}
+
+// NewReplayer reads a recording written by Recorder.Write.
+func NewReplayer(r io.Reader, mode Mode) (*Replayer, error) {
+	dec := json.NewDecoder(r)
+	hdr := header{}
+	if err := dec.Decode(&hdr); err != nil {
+		return nil, errors.Annotate(err, "reading the header").Err()
+	}
+	if hdr.Version != formatVersion {
+		return nil, errors.Reason("unsupported recording version %d", hdr.Version).Err()
+	}
+
+	rp := &Replayer{mode: mode, constraints: hdr.Constraints}
+	for {
+		cl := &call{}
+		switch err := dec.Decode(cl); {
+		case err == io.EOF:
+			rp.served = make([]bool, len(rp.calls))
+			return rp, nil
+		case err != nil:
+			return nil, errors.Annotate(err, "reading call #%d", len(rp.calls)).Err()
+		}
+		rp.calls = append(rp.calls, cl)
+	}
+}
+
+// Use installs a datastore in the context which serves the recorded calls.
+func (rp *Replayer) Use(c context.Context) context.Context {
+	return ds.SetRawFactory(c, func(ic context.Context) ds.RawInterface {
+		return &replayDS{ic, rp}
+	})
+}
+
+// Check returns an error if a call didn't match the recording, or if some of
+// the recorded calls weren't served.
+func (rp *Replayer) Check() error {
+	rp.mu.Lock()
+	defer rp.mu.Unlock()
+
+	errs := append(errors.MultiError(nil), rp.errs...)
+	var unserved []string
+	for i, cl := range rp.calls {
+		if !rp.served[i] {
+			unserved = append(unserved, cl.Method+" "+cl.Desc)
+		}
+	}
+	if len(unserved) > 0 {
+		errs = append(errs, errors.Reason("recorder: %d recorded calls weren't made: %s",
+			len(unserved), strings.Join(unserved, "; ")).Err())
+	}
+	if len(errs) == 0 {
+		return nil
+	}
+	return errs
+}
+
+// serve returns the recorded call which matches the method and arguments.
+func (rp *Replayer) serve(method string, req *request) (*call, error) {
+	rp.mu.Lock()
+	defer rp.mu.Unlock()
+
+	matches := func(i int) bool {
+		cl := rp.calls[i]
+		return !rp.served[i] && cl.Method == method && bytes.Equal(cl.Request, req.buf.Bytes())
+	}
+
+	var err error
+	switch rp.mode {
+	case Unordered:
+		for i, cl := range rp.calls {
+			if matches(i) {
+				rp.served[i] = true
+				return cl, nil
+			}
+		}
+		err = errors.Annotate(ErrUnexpectedCall, "%s %s", method, req).Err()
+
+	default:
+		if rp.next < len(rp.calls) && matches(rp.next) {
+			cl := rp.calls[rp.next]
+			rp.served[rp.next] = true
+			rp.next++
+			return cl, nil
+		}
+		expected := "no more calls"
+		if rp.next < len(rp.calls) {
+			cl := rp.calls[rp.next]
+			expected = cl.Method + " " + cl.Desc
+		}
+		err = errors.Annotate(ErrUnexpectedCall, "%s %s, expected %s", method, req, expected).Err()
+	}
+
+	rp.errs = append(rp.errs, err)
+	return nil, err
+}
+
+// replayTxn is the transaction of the replayed datastore.
+type replayTxn struct{}
+
+var replayTxnKey = "gae:recorder:replayTxn"
+
+// replayCursor is a cursor of the replayed datastore.
+type replayCursor string
+
+func (c replayCursor) String() string { return string(c) }
+
+// replayDS is a datastore.RawInterface implementation which serves the calls
+// of a recording.
+type replayDS struct {
+	ic context.Context
+	rp *Replayer
+}
+
+var _ ds.RawInterface = (*replayDS)(nil)
+
+func (d *replayDS) request() *request {
+	return newRequest(d.ic, d.CurrentTransaction() != nil)
+}
+
+func (d *replayDS) AllocateIDs(keys []*ds.Key, cb ds.NewKeyCB) error {
+	cl, err := d.rp.serve("AllocateIDs", d.request().keys(keys))
+	if err != nil {
+		return err
+	}
+	for _, res := range cl.Results {
+		key, err := decodeKey(res.Key)
+		if err != nil {
+			return err
+		}
+		if err := cb(res.Index, key, res.Err.decode()); err != nil {
+			return err
+		}
+	}
+	return cl.Err.decode()
+}
+
+func (d *replayDS) RunInTransaction(f func(c context.Context) error, opts *ds.TransactionOptions) error {
+	cl, err := d.rp.serve("RunInTransaction", d.request().txnOptions(opts))
+	if err != nil {
+		return err
+	}
+	// The errors of the attempts are replaced by the recorded error.
+	for i := 0; i < cl.Attempts; i++ {
+		f(context.WithValue(d.ic, &replayTxnKey, &replayTxn{}))
+	}
+	return cl.Err.decode()
+}
+
+func (d *replayDS) DecodeCursor(s string) (ds.Cursor, error) {
+	return replayCursor(s), nil
+}
+
+func (d *replayDS) Run(fq *ds.FinalizedQuery, cb ds.RawRunCB) error {
+	cl, err := d.rp.serve("Run", d.request().query(fq))
+	if err != nil {
+		return err
+	}
+	for _, res := range cl.Results {
+		key, err := decodeKey(res.Key)
+		if err != nil {
+			return err
+		}
+		val, err := decodePropertyMap(res.Value)
+		if err != nil {
+			return err
+		}
+		cursor := res.Cursor
+		getCursor := func() (ds.Cursor, error) {
+			if cursor == "" {
+				return nil, errors.Reason("recorder: the cursor of %s wasn't recorded", key).Err()
+			}
+			return replayCursor(cursor), nil
+		}
+		if err := cb(key, val, getCursor); err != nil {
+			return err
+		}
+	}
+	return cl.Err.decode()
+}
+
+func (d *replayDS) Count(fq *ds.FinalizedQuery) (int64, error) {
+	cl, err := d.rp.serve("Count", d.request().query(fq))
+	if err != nil {
+		return 0, err
+	}
+	return cl.Count, cl.Err.decode()
+}
+
+func (d *replayDS) GetMulti(keys []*ds.Key, meta ds.MultiMetaGetter, cb ds.GetMultiCB) error {
+	cl, err := d.rp.serve("GetMulti", d.request().keys(keys))
+	if err != nil {
+		return err
+	}
+	for _, res := range cl.Results {
+		val, err := decodePropertyMap(res.Value)
+		if err != nil {
+			return err
+		}
+		if err := cb(res.Index, val, res.Err.decode()); err != nil {
+			return err
+		}
+	}
+	return cl.Err.decode()
+}
+
+func (d *replayDS) PutMulti(keys []*ds.Key, vals []ds.PropertyMap, cb ds.NewKeyCB) error {
+	cl, err := d.rp.serve("PutMulti", d.request().keys(keys).values(vals))
+	if err != nil {
+		return err
+	}
+	for _, res := range cl.Results {
+		key, err := decodeKey(res.Key)
+		if err != nil {
+			return err
+		}
+		if err := cb(res.Index, key, res.Err.decode()); err != nil {
+			return err
+		}
+	}
+	return cl.Err.decode()
+}
+
+func (d *replayDS) DeleteMulti(keys []*ds.Key, cb ds.DeleteMultiCB) error {
+	cl, err := d.rp.serve("DeleteMulti", d.request().keys(keys))
+	if err != nil {
+		return err
+	}
+	for _, res := range cl.Results {
+		if err := cb(res.Index, res.Err.decode()); err != nil {
+			return err
+		}
+	}
+	return cl.Err.decode()
+}
+
+func (d *replayDS) WithoutTransaction() context.Context {
+	return context.WithValue(d.ic, &replayTxnKey, (*replayTxn)(nil))
+}
+
+func (d *replayDS) CurrentTransaction() ds.Transaction {
+	if txn, _ := d.ic.Value(&replayTxnKey).(*replayTxn); txn != nil {
+		return txn
+	}
+	return nil
+}
+
+func (d *replayDS) Constraints() ds.Constraints { return d.rp.constraints }
+
+func (d *replayDS) GetTestable() ds.Testable { return nil }
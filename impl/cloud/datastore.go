@@ -86,6 +86,9 @@ func (bds *boundDatastore) RunInTransaction(fn func(context.Context) error, opts
 		if opts.Attempts > 0 {
 			txOpts = append(txOpts, datastore.MaxAttempts(opts.Attempts))
 		}
+		if !opts.ReadTime.IsZero() {
+			txOpts = append(txOpts, datastore.WithReadTime(opts.ReadTime))
+		}
 	}
 
 	_, err := bds.client.RunInTransaction(bds, func(tx *datastore.Transaction) error {
@@ -99,8 +102,17 @@ func (bds *boundDatastore) DecodeCursor(s string) (ds.Cursor, error) {
 	return cursor, normalizeError(err)
 }
 
+// readClient returns the client to use for reads. Outside of transactions, it
+// reads at the read time installed in the Context, if any.
+func (bds *boundDatastore) readClient() *datastore.Client {
+	if t := ds.GetReadTime(bds); !t.IsZero() && bds.transaction == nil {
+		return bds.client.WithReadOptions(datastore.ReadTime(t))
+	}
+	return bds.client
+}
+
 func (bds *boundDatastore) Run(q *ds.FinalizedQuery, cb ds.RawRunCB) error {
-	it := bds.client.Run(bds, bds.prepareNativeQuery(q))
+	it := bds.readClient().Run(bds, bds.prepareNativeQuery(q))
 	cursorFn := func() (ds.Cursor, error) {
 		return it.Cursor()
 	}
@@ -132,7 +144,7 @@ func (bds *boundDatastore) Run(q *ds.FinalizedQuery, cb ds.RawRunCB) error {
 }
 
 func (bds *boundDatastore) Count(q *ds.FinalizedQuery) (int64, error) {
-	v, err := bds.client.Count(bds, bds.prepareNativeQuery(q))
+	v, err := bds.readClient().Count(bds, bds.prepareNativeQuery(q))
 	if err != nil {
 		return -1, normalizeError(err)
 	}
@@ -184,7 +196,7 @@ func (bds *boundDatastore) GetMulti(keys []*ds.Key, _meta ds.MultiMetaGetter, cb
 		err = bds.transaction.GetMulti(nativeKeys, nativePLS)
 	} else {
 		// Non-transactional GetMulti.
-		err = bds.client.GetMulti(bds, nativeKeys, nativePLS)
+		err = bds.readClient().GetMulti(bds, nativeKeys, nativePLS)
 	}
 
 	return idxCallbacker(err, len(nativePLS), func(idx int, err error) error {
@@ -18,10 +18,12 @@ import (
 	"crypto/rand"
 	"encoding/hex"
 	"fmt"
+	"net"
 	"os"
 	"testing"
 	"time"
 
+	"go.chromium.org/gae/impl/memory/dsapi"
 	ds "go.chromium.org/gae/service/datastore"
 	"go.chromium.org/gae/service/info"
 
@@ -29,6 +31,9 @@ import (
 	"go.chromium.org/luci/common/clock/testclock"
 	"go.chromium.org/luci/common/errors"
 	"golang.org/x/net/context"
+	"google.golang.org/api/option"
+	pb "google.golang.org/genproto/googleapis/datastore/v1"
+	"google.golang.org/grpc"
 
 	. "github.com/smartystreets/goconvey/convey"
 )
@@ -186,6 +191,10 @@ func TestBoundDatastore(t *testing.T) {
 // Export the DATASTORE_EMULATOR_HOST environment variable. By default:
 // $ export DATASTORE_EMULATOR_HOST=localhost:8080
 //
+// Alternatively, run the test against the in-memory datastore, served over the
+// same API by tools/ds-emulator:
+// $ go run ./tools/ds-emulator -addr localhost:8080
+//
 // If the emulator environment is not detected, this test will be skipped.
 func TestDatastore(t *testing.T) {
 	t.Parallel()
@@ -199,258 +208,288 @@ func TestDatastore(t *testing.T) {
 	}
 
 	Convey(fmt.Sprintf(`A cloud installation using datastore emulator %q`, emulatorHost), t, func() {
+		client, err := datastore.NewClient(context.Background(), "luci-gae-test")
+		So(err, ShouldBeNil)
+		defer client.Close()
+
+		testDatastore(client)
+	})
+}
+
+// TestDatastoreOverMemory runs the TestDatastore suite against the in-memory
+// datastore, served in-process over the Cloud Datastore API by
+// impl/memory/dsapi.
+func TestDatastoreOverMemory(t *testing.T) {
+	t.Parallel()
+
+	Convey(`A cloud installation using the in-memory datastore server`, t, func() {
 		c := context.Background()
-		client, err := datastore.NewClient(c, "luci-gae-test")
+
+		gs := grpc.NewServer()
+		pb.RegisterDatastoreServer(gs, dsapi.New(c))
+		l, err := net.Listen("tcp", "localhost:0")
+		So(err, ShouldBeNil)
+		go gs.Serve(l)
+		defer gs.Stop()
+
+		conn, err := grpc.Dial(l.Addr().String(), grpc.WithInsecure())
+		So(err, ShouldBeNil)
+		client, err := datastore.NewClient(c, "luci-gae-test", option.WithGRPCConn(conn))
 		So(err, ShouldBeNil)
 		defer client.Close()
 
-		testTime := ds.RoundTime(time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC))
-		_ = testTime
+		testDatastore(client)
+	})
+}
 
-		cfg := Config{ProjectID: "luci-gae-test", DS: client}
-		c = cfg.Use(c, nil)
+// testDatastore is the body of the TestDatastore suite, run against the
+// datastore client is connected to.
+func testDatastore(client *datastore.Client) {
+	testTime := ds.RoundTime(time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC))
 
-		Convey(`Supports namespaces`, func() {
-			namespaces := []string{"foo", "bar", "baz"}
+	cfg := Config{ProjectID: "luci-gae-test", DS: client}
+	c := cfg.Use(context.Background(), nil)
 
-			// Clear all used entities from all namespaces.
-			for _, ns := range namespaces {
-				nsCtx := info.MustNamespace(c, ns)
+	Convey(`Supports namespaces`, func() {
+		namespaces := []string{"foo", "bar", "baz"}
 
-				keys := make([]*ds.Key, len(namespaces))
-				for i := range keys {
-					keys[i] = ds.MakeKey(nsCtx, "Test", i+1)
-				}
-				So(errors.Filter(ds.Delete(nsCtx, keys), ds.ErrNoSuchEntity), ShouldBeNil)
+		// Clear all used entities from all namespaces.
+		for _, ns := range namespaces {
+			nsCtx := info.MustNamespace(c, ns)
+
+			keys := make([]*ds.Key, len(namespaces))
+			for i := range keys {
+				keys[i] = ds.MakeKey(nsCtx, "Test", i+1)
 			}
+			So(errors.Filter(ds.Delete(nsCtx, keys), ds.ErrNoSuchEntity), ShouldBeNil)
+		}
 
-			// Put one entity per namespace.
-			for i, ns := range namespaces {
-				nsCtx := info.MustNamespace(c, ns)
+		// Put one entity per namespace.
+		for i, ns := range namespaces {
+			nsCtx := info.MustNamespace(c, ns)
 
-				pmap := ds.PropertyMap{"$kind": mkp("Test"), "$id": mkp(i + 1), "Value": mkp(i)}
-				So(ds.Put(nsCtx, pmap), ShouldBeNil)
-			}
+			pmap := ds.PropertyMap{"$kind": mkp("Test"), "$id": mkp(i + 1), "Value": mkp(i)}
+			So(ds.Put(nsCtx, pmap), ShouldBeNil)
+		}
 
-			// Make sure that entity only exists in that namespace.
-			for _, ns := range namespaces {
-				nsCtx := info.MustNamespace(c, ns)
+		// Make sure that entity only exists in that namespace.
+		for _, ns := range namespaces {
+			nsCtx := info.MustNamespace(c, ns)
 
-				for i := range namespaces {
-					pmap := ds.PropertyMap{"$kind": mkp("Test"), "$id": mkp(i + 1)}
-					err := ds.Get(nsCtx, pmap)
+			for i := range namespaces {
+				pmap := ds.PropertyMap{"$kind": mkp("Test"), "$id": mkp(i + 1)}
+				err := ds.Get(nsCtx, pmap)
 
-					if namespaces[i] == ns {
-						So(err, ShouldBeNil)
-					} else {
-						So(err, ShouldEqual, ds.ErrNoSuchEntity)
-					}
+				if namespaces[i] == ns {
+					So(err, ShouldBeNil)
+				} else {
+					So(err, ShouldEqual, ds.ErrNoSuchEntity)
 				}
 			}
-		})
+		}
+	})
 
-		Convey(`In a clean random testing namespace`, func() {
-			// Enter a namespace for this round of tests.
-			randNamespace := make([]byte, 32)
-			if _, err := rand.Read(randNamespace); err != nil {
-				panic(err)
+	Convey(`In a clean random testing namespace`, func() {
+		// Enter a namespace for this round of tests.
+		randNamespace := make([]byte, 32)
+		if _, err := rand.Read(randNamespace); err != nil {
+			panic(err)
+		}
+		c = info.MustNamespace(c, fmt.Sprintf("testing-%s", hex.EncodeToString(randNamespace)))
+
+		// Execute a kindless query to clear the namespace.
+		q := ds.NewQuery("").KeysOnly(true)
+		var allKeys []*ds.Key
+		So(ds.GetAll(c, q, &allKeys), ShouldBeNil)
+		So(ds.Delete(c, allKeys), ShouldBeNil)
+
+		Convey(`Can allocate an ID range`, func() {
+			var keys []*ds.Key
+			keys = append(keys, ds.NewIncompleteKeys(c, 10, "Bar", ds.MakeKey(c, "Foo", 12))...)
+			keys = append(keys, ds.NewIncompleteKeys(c, 10, "Baz", ds.MakeKey(c, "Foo", 12))...)
+
+			seen := map[string]struct{}{}
+			So(ds.AllocateIDs(c, keys), ShouldBeNil)
+			for _, k := range keys {
+				So(k.IsIncomplete(), ShouldBeFalse)
+				seen[k.String()] = struct{}{}
 			}
-			c = info.MustNamespace(c, fmt.Sprintf("testing-%s", hex.EncodeToString(randNamespace)))
-
-			// Execute a kindless query to clear the namespace.
-			q := ds.NewQuery("").KeysOnly(true)
-			var allKeys []*ds.Key
-			So(ds.GetAll(c, q, &allKeys), ShouldBeNil)
-			So(ds.Delete(c, allKeys), ShouldBeNil)
-
-			Convey(`Can allocate an ID range`, func() {
-				var keys []*ds.Key
-				keys = append(keys, ds.NewIncompleteKeys(c, 10, "Bar", ds.MakeKey(c, "Foo", 12))...)
-				keys = append(keys, ds.NewIncompleteKeys(c, 10, "Baz", ds.MakeKey(c, "Foo", 12))...)
-
-				seen := map[string]struct{}{}
-				So(ds.AllocateIDs(c, keys), ShouldBeNil)
-				for _, k := range keys {
-					So(k.IsIncomplete(), ShouldBeFalse)
-					seen[k.String()] = struct{}{}
-				}
 
-				So(ds.AllocateIDs(c, keys), ShouldBeNil)
-				for _, k := range keys {
-					So(k.IsIncomplete(), ShouldBeFalse)
+			So(ds.AllocateIDs(c, keys), ShouldBeNil)
+			for _, k := range keys {
+				So(k.IsIncomplete(), ShouldBeFalse)
 
-					_, ok := seen[k.String()]
-					So(ok, ShouldBeFalse)
-				}
-			})
-
-			Convey(`Can get, put, and delete entities`, func() {
-				// Put: "foo", "bar", "baz".
-				put := []ds.PropertyMap{
-					{"$kind": mkp("test"), "$id": mkp("foo"), "Value": mkp(1337)},
-					{"$kind": mkp("test"), "$id": mkp("bar"), "Value": mkp(42)},
-					{"$kind": mkp("test"), "$id": mkp("baz"), "Value": mkp(0xd065)},
-				}
-				So(ds.Put(c, put), ShouldBeNil)
-				delete(put[0], "$key")
-				delete(put[1], "$key")
-				delete(put[2], "$key")
-
-				// Delete: "bar".
-				So(ds.Delete(c, ds.MakeKey(c, "test", "bar")), ShouldBeNil)
-
-				// Get: "foo", "bar", "baz"
-				get := []ds.PropertyMap{
-					{"$kind": mkp("test"), "$id": mkp("foo")},
-					{"$kind": mkp("test"), "$id": mkp("bar")},
-					{"$kind": mkp("test"), "$id": mkp("baz")},
-				}
+				_, ok := seen[k.String()]
+				So(ok, ShouldBeFalse)
+			}
+		})
 
-				err := ds.Get(c, get)
-				So(err, ShouldHaveSameTypeAs, errors.MultiError(nil))
+		Convey(`Can get, put, and delete entities`, func() {
+			// Put: "foo", "bar", "baz".
+			put := []ds.PropertyMap{
+				{"$kind": mkp("test"), "$id": mkp("foo"), "Value": mkp(1337)},
+				{"$kind": mkp("test"), "$id": mkp("bar"), "Value": mkp(42)},
+				{"$kind": mkp("test"), "$id": mkp("baz"), "Value": mkp(0xd065)},
+			}
+			So(ds.Put(c, put), ShouldBeNil)
+			delete(put[0], "$key")
+			delete(put[1], "$key")
+			delete(put[2], "$key")
+
+			// Delete: "bar".
+			So(ds.Delete(c, ds.MakeKey(c, "test", "bar")), ShouldBeNil)
+
+			// Get: "foo", "bar", "baz"
+			get := []ds.PropertyMap{
+				{"$kind": mkp("test"), "$id": mkp("foo")},
+				{"$kind": mkp("test"), "$id": mkp("bar")},
+				{"$kind": mkp("test"), "$id": mkp("baz")},
+			}
 
-				merr := err.(errors.MultiError)
-				So(len(merr), ShouldEqual, 3)
-				So(merr[0], ShouldBeNil)
-				So(merr[1], ShouldEqual, ds.ErrNoSuchEntity)
-				So(merr[2], ShouldBeNil)
+			err := ds.Get(c, get)
+			So(err, ShouldHaveSameTypeAs, errors.MultiError(nil))
 
-				// put[1] will not be retrieved (delete)
-				put[1] = get[1]
-				So(get, ShouldResemble, put)
-			})
+			merr := err.(errors.MultiError)
+			So(len(merr), ShouldEqual, 3)
+			So(merr[0], ShouldBeNil)
+			So(merr[1], ShouldEqual, ds.ErrNoSuchEntity)
+			So(merr[2], ShouldBeNil)
 
-			Convey(`Can put and get all supported entity fields.`, func() {
-				put := ds.PropertyMap{
-					"$id":   mkpNI("foo"),
-					"$kind": mkpNI("FooType"),
-
-					"Number":    mkp(1337),
-					"String":    mkpNI("hello"),
-					"Bytes":     mkp([]byte("world")),
-					"Time":      mkp(testTime),
-					"Float":     mkpNI(3.14),
-					"Key":       mkp(ds.MakeKey(c, "Parent", "ParentID", "Child", 1337)),
-					"Null":      mkp(nil),
-					"NullSlice": mkp(nil, nil),
-
-					"ComplexSlice": mkp(1337, "string", []byte("bytes"), testTime, float32(3.14),
-						float64(2.71), true, nil, ds.MakeKey(c, "SomeKey", "SomeID")),
-
-					"Single":      mkp("single"),
-					"SingleSlice": mkProperties(true, true, "single"), // Force a single "multi" value.
-					"EmptySlice":  ds.PropertySlice(nil),
-				}
-				So(ds.Put(c, put), ShouldBeNil)
-				delete(put, "$key")
+			// put[1] will not be retrieved (delete)
+			put[1] = get[1]
+			So(get, ShouldResemble, put)
+		})
 
-				get := ds.PropertyMap{
-					"$id":   mkpNI("foo"),
-					"$kind": mkpNI("FooType"),
-				}
-				So(ds.Get(c, get), ShouldBeNil)
-				So(get, ShouldResemble, put)
-			})
+		Convey(`Can put and get all supported entity fields.`, func() {
+			put := ds.PropertyMap{
+				"$id":   mkpNI("foo"),
+				"$kind": mkpNI("FooType"),
+
+				"Number":    mkp(1337),
+				"String":    mkpNI("hello"),
+				"Bytes":     mkp([]byte("world")),
+				"Time":      mkp(testTime),
+				"Float":     mkpNI(3.14),
+				"Key":       mkp(ds.MakeKey(c, "Parent", "ParentID", "Child", 1337)),
+				"Null":      mkp(nil),
+				"NullSlice": mkp(nil, nil),
+
+				"ComplexSlice": mkp(1337, "string", []byte("bytes"), testTime, float32(3.14),
+					float64(2.71), true, nil, ds.MakeKey(c, "SomeKey", "SomeID")),
+
+				"Single":      mkp("single"),
+				"SingleSlice": mkProperties(true, true, "single"), // Force a single "multi" value.
+				"EmptySlice":  ds.PropertySlice(nil),
+			}
+			So(ds.Put(c, put), ShouldBeNil)
+			delete(put, "$key")
 
-			Convey(`With several entities installed`, func() {
-				So(ds.Put(c, []ds.PropertyMap{
-					{"$kind": mkp("Test"), "$id": mkp("foo"), "FooBar": mkp(true)},
-					{"$kind": mkp("Test"), "$id": mkp("bar"), "FooBar": mkp(true)},
-					{"$kind": mkp("Test"), "$id": mkp("baz")},
-					{"$kind": mkp("Test"), "$id": mkp("qux")},
-					{"$kind": mkp("Test"), "$id": mkp("quux"), "$parent": mkp(ds.MakeKey(c, "Test", "baz"))},
-					{"$kind": mkp("Test"), "$id": mkp("quuz"), "$parent": mkp(ds.MakeKey(c, "Test", "baz"))},
-				}), ShouldBeNil)
-
-				q := ds.NewQuery("Test")
-
-				Convey(`Can query for entities with FooBar == true.`, func() {
-					var results []ds.PropertyMap
-					q = q.Eq("FooBar", true)
-					So(ds.GetAll(c, q, &results), ShouldBeNil)
-
-					So(results, ShouldResemble, []ds.PropertyMap{
-						{"$key": mkpNI(ds.MakeKey(c, "Test", "bar")), "FooBar": mkp(true)},
-						{"$key": mkpNI(ds.MakeKey(c, "Test", "foo")), "FooBar": mkp(true)},
-					})
-				})
+			get := ds.PropertyMap{
+				"$id":   mkpNI("foo"),
+				"$kind": mkpNI("FooType"),
+			}
+			So(ds.Get(c, get), ShouldBeNil)
+			So(get, ShouldResemble, put)
+		})
 
-				Convey(`Can query for entities whose __key__ > "baz".`, func() {
-					var results []ds.PropertyMap
-					q = q.Gt("__key__", ds.MakeKey(c, "Test", "baz"))
-					So(ds.GetAll(c, q, &results), ShouldBeNil)
-
-					So(results, ShouldResemble, []ds.PropertyMap{
-						{"$key": mkpNI(ds.MakeKey(c, "Test", "baz", "Test", "quux"))},
-						{"$key": mkpNI(ds.MakeKey(c, "Test", "baz", "Test", "quuz"))},
-						{"$key": mkpNI(ds.MakeKey(c, "Test", "foo")), "FooBar": mkp(true)},
-						{"$key": mkpNI(ds.MakeKey(c, "Test", "qux"))},
-					})
+		Convey(`With several entities installed`, func() {
+			So(ds.Put(c, []ds.PropertyMap{
+				{"$kind": mkp("Test"), "$id": mkp("foo"), "FooBar": mkp(true)},
+				{"$kind": mkp("Test"), "$id": mkp("bar"), "FooBar": mkp(true)},
+				{"$kind": mkp("Test"), "$id": mkp("baz")},
+				{"$kind": mkp("Test"), "$id": mkp("qux")},
+				{"$kind": mkp("Test"), "$id": mkp("quux"), "$parent": mkp(ds.MakeKey(c, "Test", "baz"))},
+				{"$kind": mkp("Test"), "$id": mkp("quuz"), "$parent": mkp(ds.MakeKey(c, "Test", "baz"))},
+			}), ShouldBeNil)
+
+			q := ds.NewQuery("Test")
+
+			Convey(`Can query for entities with FooBar == true.`, func() {
+				var results []ds.PropertyMap
+				q = q.Eq("FooBar", true)
+				So(ds.GetAll(c, q, &results), ShouldBeNil)
+
+				So(results, ShouldResemble, []ds.PropertyMap{
+					{"$key": mkpNI(ds.MakeKey(c, "Test", "bar")), "FooBar": mkp(true)},
+					{"$key": mkpNI(ds.MakeKey(c, "Test", "foo")), "FooBar": mkp(true)},
 				})
+			})
 
-				Convey(`Can query for entities whose ancestor is "baz".`, func() {
-					var results []ds.PropertyMap
-					q := ds.NewQuery("Test").Ancestor(ds.MakeKey(c, "Test", "baz"))
-					So(ds.GetAll(c, q, &results), ShouldBeNil)
+			Convey(`Can query for entities whose __key__ > "baz".`, func() {
+				var results []ds.PropertyMap
+				q = q.Gt("__key__", ds.MakeKey(c, "Test", "baz"))
+				So(ds.GetAll(c, q, &results), ShouldBeNil)
 
-					So(results, ShouldResemble, []ds.PropertyMap{
-						{"$key": mkpNI(ds.MakeKey(c, "Test", "baz"))},
-						{"$key": mkpNI(ds.MakeKey(c, "Test", "baz", "Test", "quux"))},
-						{"$key": mkpNI(ds.MakeKey(c, "Test", "baz", "Test", "quuz"))},
-					})
+				So(results, ShouldResemble, []ds.PropertyMap{
+					{"$key": mkpNI(ds.MakeKey(c, "Test", "baz", "Test", "quux"))},
+					{"$key": mkpNI(ds.MakeKey(c, "Test", "baz", "Test", "quuz"))},
+					{"$key": mkpNI(ds.MakeKey(c, "Test", "foo")), "FooBar": mkp(true)},
+					{"$key": mkpNI(ds.MakeKey(c, "Test", "qux"))},
 				})
+			})
 
-				Convey(`Can transactionally get and put.`, func() {
-					err := ds.RunInTransaction(c, func(c context.Context) error {
-						pmap := ds.PropertyMap{"$kind": mkp("Test"), "$id": mkp("qux")}
-						if err := ds.Get(c, pmap); err != nil {
-							return err
-						}
-
-						pmap["ExtraField"] = mkp("Present!")
-						return ds.Put(c, pmap)
-					}, nil)
-					So(err, ShouldBeNil)
+			Convey(`Can query for entities whose ancestor is "baz".`, func() {
+				var results []ds.PropertyMap
+				q := ds.NewQuery("Test").Ancestor(ds.MakeKey(c, "Test", "baz"))
+				So(ds.GetAll(c, q, &results), ShouldBeNil)
 
-					pmap := ds.PropertyMap{"$kind": mkp("Test"), "$id": mkp("qux")}
-					err = ds.RunInTransaction(c, func(c context.Context) error {
-						return ds.Get(c, pmap)
-					}, nil)
-					So(err, ShouldBeNil)
-					So(pmap, ShouldResemble, ds.PropertyMap{"$kind": mkp("Test"), "$id": mkp("qux"), "ExtraField": mkp("Present!")})
+				So(results, ShouldResemble, []ds.PropertyMap{
+					{"$key": mkpNI(ds.MakeKey(c, "Test", "baz"))},
+					{"$key": mkpNI(ds.MakeKey(c, "Test", "baz", "Test", "quux"))},
+					{"$key": mkpNI(ds.MakeKey(c, "Test", "baz", "Test", "quuz"))},
 				})
+			})
 
-				Convey(`Can fail in a transaction with no effect.`, func() {
-					testError := errors.New("test error")
-
-					noTxnPM := ds.PropertyMap{"$kind": mkp("Test"), "$id": mkp("no txn")}
-					err := ds.RunInTransaction(c, func(c context.Context) error {
-						So(ds.CurrentTransaction(c), ShouldNotBeNil)
+			Convey(`Can transactionally get and put.`, func() {
+				err := ds.RunInTransaction(c, func(c context.Context) error {
+					pmap := ds.PropertyMap{"$kind": mkp("Test"), "$id": mkp("qux")}
+					if err := ds.Get(c, pmap); err != nil {
+						return err
+					}
 
-						pmap := ds.PropertyMap{"$kind": mkp("Test"), "$id": mkp("quux")}
-						if err := ds.Put(c, pmap); err != nil {
-							return err
-						}
+					pmap["ExtraField"] = mkp("Present!")
+					return ds.Put(c, pmap)
+				}, nil)
+				So(err, ShouldBeNil)
+
+				pmap := ds.PropertyMap{"$kind": mkp("Test"), "$id": mkp("qux")}
+				err = ds.RunInTransaction(c, func(c context.Context) error {
+					return ds.Get(c, pmap)
+				}, nil)
+				So(err, ShouldBeNil)
+				So(pmap, ShouldResemble, ds.PropertyMap{"$kind": mkp("Test"), "$id": mkp("qux"), "ExtraField": mkp("Present!")})
+			})
 
-						// Put an entity outside of the transaction so we can confirm that
-						// it was added even when the transaction fails.
-						if err := ds.Put(ds.WithoutTransaction(c), noTxnPM); err != nil {
-							return err
-						}
-						return testError
-					}, nil)
-					So(err, ShouldEqual, testError)
+			Convey(`Can fail in a transaction with no effect.`, func() {
+				testError := errors.New("test error")
 
-					// Confirm that noTxnPM was added.
-					So(ds.CurrentTransaction(c), shouldBeUntypedNil)
-					So(ds.Get(c, noTxnPM), ShouldBeNil)
+				noTxnPM := ds.PropertyMap{"$kind": mkp("Test"), "$id": mkp("no txn")}
+				err := ds.RunInTransaction(c, func(c context.Context) error {
+					So(ds.CurrentTransaction(c), ShouldNotBeNil)
 
 					pmap := ds.PropertyMap{"$kind": mkp("Test"), "$id": mkp("quux")}
-					err = ds.RunInTransaction(c, func(c context.Context) error {
-						return ds.Get(c, pmap)
-					}, nil)
-					So(err, ShouldEqual, ds.ErrNoSuchEntity)
-				})
+					if err := ds.Put(c, pmap); err != nil {
+						return err
+					}
+
+					// Put an entity outside of the transaction so we can confirm that
+					// it was added even when the transaction fails.
+					if err := ds.Put(ds.WithoutTransaction(c), noTxnPM); err != nil {
+						return err
+					}
+					return testError
+				}, nil)
+				So(err, ShouldEqual, testError)
+
+				// Confirm that noTxnPM was added.
+				So(ds.CurrentTransaction(c), shouldBeUntypedNil)
+				So(ds.Get(c, noTxnPM), ShouldBeNil)
+
+				pmap := ds.PropertyMap{"$kind": mkp("Test"), "$id": mkp("quux")}
+				err = ds.RunInTransaction(c, func(c context.Context) error {
+					return ds.Get(c, pmap)
+				}, nil)
+				So(err, ShouldEqual, ds.ErrNoSuchEntity)
 			})
 		})
 	})
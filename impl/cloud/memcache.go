@@ -18,11 +18,14 @@ import (
 	"crypto/sha256"
 	"encoding/hex"
 	"strconv"
+	"strings"
 	"time"
 
 	"go.chromium.org/gae/service/info"
 	mc "go.chromium.org/gae/service/memcache"
 
+	"go.chromium.org/luci/common/errors"
+
 	"github.com/bradfitz/gomemcache/memcache"
 	"golang.org/x/net/context"
 )
@@ -198,8 +201,13 @@ func (bmc *boundMemcacheClient) DeleteMulti(keys []string, cb mc.RawCB) error {
 
 func (bmc *boundMemcacheClient) CompareAndSwapMulti(items []mc.Item, cb mc.RawCB) error {
 	for _, itm := range items {
-		err := bmc.client.CompareAndSwap(bmc.nativeItem(itm))
-		cb(bmc.translateErr(err))
+		err := bmc.translateErr(bmc.client.CompareAndSwap(bmc.nativeItem(itm)))
+		if err == mc.ErrCacheMiss {
+			// Like in the Memcache service, the condition of CompareAndSwap (the
+			// item is unchanged) is not satisfied if the item is gone.
+			err = mc.ErrNotStored
+		}
+		cb(err)
 	}
 	return nil
 }
@@ -215,9 +223,14 @@ func (bmc *boundMemcacheClient) Increment(key string, delta int64, initialValue
 		case delta < 0:
 			newValue, err = bmc.client.Decrement(key, uint64(-delta))
 		default:
-			// We don't want to change the value, but we want to return ErrNotStored
-			// if the value doesn't exist. Use Get.
-			_, err = bmc.client.Get(key)
+			// We don't want to change the value, but we want to return it, or
+			// ErrCacheMiss if the value doesn't exist. Use Get.
+			var itm *memcache.Item
+			if itm, err = bmc.client.Get(key); err == nil {
+				if newValue, err = strconv.ParseUint(strings.TrimRight(string(itm.Value), " "), 10, 64); err != nil {
+					err = errors.New("memcache Increment: got invalid current value")
+				}
+			}
 		}
 		err = bmc.translateErr(err)
 		return
@@ -265,7 +278,7 @@ func (bmc *boundMemcacheClient) Increment(key string, delta int64, initialValue
 			itm = bmc.newMemcacheItem(key)
 			itm.SetValue([]byte(strconv.FormatUint(iv, 10)))
 		}
-		switch err := bmc.client.Add(itm.native); err {
+		switch err := bmc.translateErr(bmc.client.Add(itm.native)); err {
 		case nil:
 			// Item was successfully set.
 			return iv, nil
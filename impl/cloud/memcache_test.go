@@ -18,14 +18,18 @@ import (
 	"flag"
 	"fmt"
 	"math"
+	"net"
 	"strings"
 	"testing"
 	"time"
 
+	"go.chromium.org/luci/common/clock/testclock"
 	"go.chromium.org/luci/common/errors"
 
+	"go.chromium.org/gae/impl/memory"
 	"go.chromium.org/gae/service/info"
 	mc "go.chromium.org/gae/service/memcache"
+	"go.chromium.org/gae/service/memcache/mctest"
 
 	"github.com/bradfitz/gomemcache/memcache"
 	"golang.org/x/net/context"
@@ -42,7 +46,8 @@ var memcacheServer = flag.String("test.memcache-server", "",
 // memcached cluster!
 //
 // The memcache host is passed to this test suite via the "-test.memcache-host"
-// flag. If the flag is not provided, this test suite will be skipped.
+// flag. If the flag is not provided, the test suite runs against an in-process
+// memory.MemcacheServer instead.
 //
 // Starting a local memcached server (on default port 11211) can be done with:
 //	$ memcached -l localhost -vvv
@@ -52,15 +57,22 @@ var memcacheServer = flag.String("test.memcache-server", "",
 func TestMemcache(t *testing.T) {
 	t.Parallel()
 
-	// See if a memcache server is configured. If no server is configured, we will
-	// skip this test suite.
-	if *memcacheServer == "" {
-		t.Logf("No memcache server detected (-test.memcache-server). Skipping test suite.")
-		return
+	// See if a memcache server is configured. If no server is configured, we
+	// serve the memory memcache over the memcached protocol.
+	server := *memcacheServer
+	if server == "" {
+		l, err := net.Listen("tcp", "localhost:0")
+		if err != nil {
+			t.Fatalf("failed to listen: %s", err)
+		}
+		srv := memory.NewMemcacheServer(memory.Use(context.Background()))
+		go srv.Serve(l)
+		defer srv.Close()
+		server = l.Addr().String()
 	}
 
-	Convey(fmt.Sprintf(`A memcache instance bound to %q`, *memcacheServer), t, func() {
-		client := memcache.New(*memcacheServer)
+	Convey(fmt.Sprintf(`A memcache instance bound to %q`, server), t, func() {
+		client := memcache.New(server)
 		if err := client.DeleteAll(); err != nil {
 			t.Fatalf("failed to flush memcache before running test suite: %s", err)
 		}
@@ -344,3 +356,31 @@ func TestMemcache(t *testing.T) {
 		})
 	})
 }
+
+// TestMemcacheConformance runs the memcache conformance suite against an
+// in-process memory.MemcacheServer, whose clock is a test clock.
+func TestMemcacheConformance(t *testing.T) {
+	t.Parallel()
+
+	sc, tc := testclock.UseTime(context.Background(), testclock.TestTimeUTC)
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %s", err)
+	}
+	srv := memory.NewMemcacheServer(memory.Use(sc))
+	go srv.Serve(l)
+	defer srv.Close()
+
+	client := memcache.New(l.Addr().String())
+	cfg := Config{MC: client}
+	mctest.RunConformance(t, mctest.Implementation{
+		New: func() context.Context {
+			if err := client.DeleteAll(); err != nil {
+				panic(err)
+			}
+			return cfg.Use(context.Background(), nil)
+		},
+		Advance:      func(_ context.Context, d time.Duration) { tc.Add(d) },
+		Capabilities: mctest.Capabilities{NoStats: true},
+	})
+}
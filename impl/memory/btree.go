@@ -0,0 +1,400 @@
+// Copyright 2018 The LUCI Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package memory
+
+import (
+	"bytes"
+)
+
+const (
+	// btreeDegree is the minimum number of children of the inner nodes of
+	// a btree, except for the root.
+	btreeDegree   = 16
+	btreeMaxItems = btreeDegree*2 - 1
+	btreeMinItems = btreeDegree - 1
+)
+
+// cowToken identifies the btree which owns a node. It must not be zero-sized,
+// so that distinct tokens have distinct addresses.
+type cowToken struct{ _ byte }
+
+type btreeNode struct {
+	items []storeEntry
+	// children is nil for leaves. Otherwise it has len(items)+1 elements.
+	children []*btreeNode
+	// cow is the token of the btree which may modify this node in place.
+	cow *cowToken
+}
+
+// btree is a persistent B-tree of storeEntry, ordered by key.
+//
+// btrees share their nodes with their clones. A node is only modified in place
+// by the btree which owns it (see cowToken); the others copy it first. So
+// clones are cheap, and so are repeated writes to a btree, which only copy the
+// nodes they touch once. Items are stored inline in the nodes, which keeps the
+// number of allocations low.
+//
+// A btree isn't safe for concurrent use; see memCollectionImpl.
+type btree struct {
+	root *btreeNode
+	cow  *cowToken
+}
+
+func newBtree() btree { return btree{cow: &cowToken{}} }
+
+// clone returns a btree with the same items as t. From then on, neither one
+// modifies the nodes they share.
+func (t *btree) clone() btree {
+	t.cow = &cowToken{}
+	return btree{root: t.root, cow: &cowToken{}}
+}
+
+// find returns the index of the first item of n whose key is >= key, and
+// whether that item's key is key.
+func (n *btreeNode) find(key []byte) (int, bool) {
+	lo, hi := 0, len(n.items)
+	for lo < hi {
+		m := int(uint(lo+hi) >> 1)
+		if bytes.Compare(n.items[m].key, key) < 0 {
+			lo = m + 1
+		} else {
+			hi = m
+		}
+	}
+	return lo, lo < len(n.items) && bytes.Equal(n.items[lo].key, key)
+}
+
+func (t *btree) get(key []byte) *storeEntry {
+	for n := t.root; n != nil; {
+		i, found := n.find(key)
+		if found {
+			return &n.items[i]
+		}
+		if n.children == nil {
+			return nil
+		}
+		n = n.children[i]
+	}
+	return nil
+}
+
+func (t *btree) min() *storeEntry {
+	n := t.root
+	if n == nil {
+		return nil
+	}
+	for n.children != nil {
+		n = n.children[0]
+	}
+	if len(n.items) == 0 {
+		return nil
+	}
+	return &n.items[0]
+}
+
+func (t *btree) newNode() *btreeNode {
+	return &btreeNode{cow: t.cow, items: make([]storeEntry, 0, btreeMaxItems)}
+}
+
+// mutable returns n if t owns it, or else a copy of n which t owns.
+func (t *btree) mutable(n *btreeNode) *btreeNode {
+	if n.cow == t.cow {
+		return n
+	}
+	c := t.newNode()
+	c.items = append(c.items, n.items...)
+	if n.children != nil {
+		c.children = make([]*btreeNode, 0, btreeMaxItems+1)
+		c.children = append(c.children, n.children...)
+	}
+	return c
+}
+
+// mutableChild makes the i-th child of the mutable node n mutable, and returns
+// it.
+func (t *btree) mutableChild(n *btreeNode, i int) *btreeNode {
+	c := t.mutable(n.children[i])
+	n.children[i] = c
+	return c
+}
+
+func (t *btree) set(key, value []byte) {
+	e := storeEntry{key, value}
+	if t.root == nil {
+		t.root = t.newNode()
+		t.root.items = append(t.root.items, e)
+		return
+	}
+
+	t.root = t.mutable(t.root)
+	if len(t.root.items) >= btreeMaxItems {
+		mid, right := t.split(t.root, btreeMaxItems/2)
+		root := t.newNode()
+		root.items = append(root.items, mid)
+		root.children = make([]*btreeNode, 0, btreeMaxItems+1)
+		root.children = append(root.children, t.root, right)
+		t.root = root
+	}
+
+	// Full nodes are split on the way down, so that there's always room for
+	// the item at the end.
+	for n := t.root; ; {
+		i, found := n.find(key)
+		if found {
+			n.items[i] = e
+			return
+		}
+		if n.children == nil {
+			n.items = insertItem(n.items, i, e)
+			return
+		}
+
+		child := t.mutableChild(n, i)
+		if len(child.items) >= btreeMaxItems {
+			mid, right := t.split(child, btreeMaxItems/2)
+			n.items = insertItem(n.items, i, mid)
+			n.children = insertChild(n.children, i+1, right)
+			switch c := bytes.Compare(key, mid.key); {
+			case c == 0:
+				n.items[i] = e
+				return
+			case c > 0:
+				child = right
+			}
+		}
+		n = child
+	}
+}
+
+// split moves the items of the mutable node n after the i-th one to a new
+// node, and returns the i-th item and the new node.
+func (t *btree) split(n *btreeNode, i int) (storeEntry, *btreeNode) {
+	mid := n.items[i]
+	right := t.newNode()
+	right.items = append(right.items, n.items[i+1:]...)
+	for j := i; j < len(n.items); j++ {
+		n.items[j] = storeEntry{}
+	}
+	n.items = n.items[:i]
+	if n.children != nil {
+		right.children = make([]*btreeNode, 0, btreeMaxItems+1)
+		right.children = append(right.children, n.children[i+1:]...)
+		for j := i + 1; j < len(n.children); j++ {
+			n.children[j] = nil
+		}
+		n.children = n.children[:i+1]
+	}
+	return mid, right
+}
+
+func (t *btree) delete(key []byte) {
+	if t.root == nil {
+		return
+	}
+	t.root = t.mutable(t.root)
+	t.remove(t.root, key, false)
+	if len(t.root.items) == 0 && t.root.children != nil {
+		t.root = t.root.children[0]
+	}
+}
+
+// remove removes the item with the given key (or the last item, if last is
+// true) from the subtree of the mutable node n, and returns it.
+//
+// Nodes with few items are grown on the way down, so that a node never has
+// fewer than btreeMinItems items after the removal.
+func (t *btree) remove(n *btreeNode, key []byte, last bool) (storeEntry, bool) {
+	for {
+		var i int
+		var found bool
+		switch {
+		case last && n.children == nil:
+			var e storeEntry
+			e, n.items = removeItem(n.items, len(n.items)-1)
+			return e, true
+		case last:
+			i = len(n.items)
+		default:
+			i, found = n.find(key)
+		}
+
+		if n.children == nil {
+			if !found {
+				return storeEntry{}, false
+			}
+			var e storeEntry
+			e, n.items = removeItem(n.items, i)
+			return e, true
+		}
+
+		if len(n.children[i].items) <= btreeMinItems {
+			// The items may move around while growing the child, so start over.
+			t.growChild(n, i)
+			continue
+		}
+
+		child := t.mutableChild(n, i)
+		if found {
+			// Replace the item with its predecessor, which is the last item of the
+			// subtree on its left.
+			e := n.items[i]
+			n.items[i], _ = t.remove(child, nil, true)
+			return e, true
+		}
+		n = child
+	}
+}
+
+// growChild adds an item to the i-th child of the mutable node n, by stealing
+// one from a sibling, or by merging it with a sibling.
+func (t *btree) growChild(n *btreeNode, i int) {
+	switch {
+	case i > 0 && len(n.children[i-1].items) > btreeMinItems:
+		child := t.mutableChild(n, i)
+		left := t.mutableChild(n, i-1)
+		var stolen storeEntry
+		stolen, left.items = removeItem(left.items, len(left.items)-1)
+		child.items = insertItem(child.items, 0, n.items[i-1])
+		n.items[i-1] = stolen
+		if left.children != nil {
+			var c *btreeNode
+			c, left.children = removeChild(left.children, len(left.children)-1)
+			child.children = insertChild(child.children, 0, c)
+		}
+
+	case i < len(n.items) && len(n.children[i+1].items) > btreeMinItems:
+		child := t.mutableChild(n, i)
+		right := t.mutableChild(n, i+1)
+		var stolen storeEntry
+		stolen, right.items = removeItem(right.items, 0)
+		child.items = append(child.items, n.items[i])
+		n.items[i] = stolen
+		if right.children != nil {
+			var c *btreeNode
+			c, right.children = removeChild(right.children, 0)
+			child.children = append(child.children, c)
+		}
+
+	default:
+		if i >= len(n.items) {
+			i--
+		}
+		child := t.mutableChild(n, i)
+		var mid storeEntry
+		var right *btreeNode
+		mid, n.items = removeItem(n.items, i)
+		right, n.children = removeChild(n.children, i+1)
+		child.items = append(child.items, mid)
+		child.items = append(child.items, right.items...)
+		if right.children != nil {
+			child.children = append(child.children, right.children...)
+		}
+	}
+}
+
+func insertItem(items []storeEntry, i int, e storeEntry) []storeEntry {
+	items = append(items, storeEntry{})
+	copy(items[i+1:], items[i:])
+	items[i] = e
+	return items
+}
+
+func removeItem(items []storeEntry, i int) (storeEntry, []storeEntry) {
+	e := items[i]
+	copy(items[i:], items[i+1:])
+	items[len(items)-1] = storeEntry{}
+	return e, items[:len(items)-1]
+}
+
+func insertChild(children []*btreeNode, i int, c *btreeNode) []*btreeNode {
+	children = append(children, nil)
+	copy(children[i+1:], children[i:])
+	children[i] = c
+	return children
+}
+
+func removeChild(children []*btreeNode, i int) (*btreeNode, []*btreeNode) {
+	c := children[i]
+	copy(children[i:], children[i+1:])
+	children[len(children)-1] = nil
+	return c, children[:len(children)-1]
+}
+
+// ascend calls cb with the items of t whose key is >= pivot, in order, until
+// it returns false.
+func (t *btree) ascend(pivot []byte, cb func(*storeEntry) bool) {
+	it := btreeIterator{stack: make([]btreeFrame, 0, 8)}
+	it.seek(t.root, pivot)
+	for e := it.next(); e != nil; e = it.next() {
+		if !cb(e) {
+			return
+		}
+	}
+}
+
+type btreeFrame struct {
+	n *btreeNode
+	// i is the index of the next item of n to return. The subtree on its left
+	// was already iterated over.
+	i int
+}
+
+// btreeIterator iterates over the items of a btree, in order. The btree must
+// not be modified meanwhile.
+//
+// The iterator returns pointers to the items in the nodes, and reuses its
+// stack when it's moved with seek, so iterating doesn't allocate.
+type btreeIterator struct {
+	stack []btreeFrame
+}
+
+// seek positions the iterator at the first item of the subtree of n whose key
+// is >= pivot.
+func (it *btreeIterator) seek(n *btreeNode, pivot []byte) {
+	it.stack = it.stack[:0]
+	for n != nil {
+		i, found := n.find(pivot)
+		it.stack = append(it.stack, btreeFrame{n, i})
+		if found || n.children == nil {
+			return
+		}
+		n = n.children[i]
+	}
+}
+
+func (it *btreeIterator) next() *storeEntry {
+	for len(it.stack) > 0 {
+		top := &it.stack[len(it.stack)-1]
+		if top.i >= len(top.n.items) {
+			it.stack = it.stack[:len(it.stack)-1]
+			continue
+		}
+		n, i := top.n, top.i
+		top.i++
+
+		// The items of the subtree on the right of the returned item come next.
+		if n.children != nil {
+			for c := n.children[i+1]; c != nil; {
+				it.stack = append(it.stack, btreeFrame{c, 0})
+				if c.children == nil {
+					break
+				}
+				c = c.children[0]
+			}
+		}
+		return &n.items[i]
+	}
+	return nil
+}
@@ -0,0 +1,174 @@
+// Copyright 2018 The LUCI Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package memory
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math/rand"
+	"sort"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func btreeKey(i int) []byte {
+	ret := make([]byte, 4)
+	binary.BigEndian.PutUint32(ret, uint32(i))
+	return ret
+}
+
+// btreeContents returns the keys and values of t, in order.
+func btreeContents(t *btree) (ret []string) {
+	t.ascend(nil, func(e *storeEntry) bool {
+		ret = append(ret, fmt.Sprintf("%x=%s", e.key, e.value))
+		return true
+	})
+	return
+}
+
+// mapContents returns the keys and values of m, in order.
+func mapContents(m map[int]string) (ret []string) {
+	keys := make([]int, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Ints(keys)
+	for _, k := range keys {
+		ret = append(ret, fmt.Sprintf("%x=%s", btreeKey(k), m[k]))
+	}
+	return
+}
+
+func TestBtree(t *testing.T) {
+	t.Parallel()
+
+	Convey("btree", t, func() {
+		tree := newBtree()
+
+		Convey("empty", func() {
+			So(tree.get(btreeKey(1)), ShouldBeNil)
+			So(tree.min(), ShouldBeNil)
+			tree.delete(btreeKey(1))
+			So(btreeContents(&tree), ShouldBeEmpty)
+		})
+
+		Convey("matches a map under random writes", func() {
+			r := rand.New(rand.NewSource(1))
+			m := map[int]string{}
+			for i := 0; i < 20000; i++ {
+				k := r.Intn(3000)
+				if r.Intn(3) == 0 {
+					tree.delete(btreeKey(k))
+					delete(m, k)
+				} else {
+					v := fmt.Sprint(i)
+					tree.set(btreeKey(k), []byte(v))
+					m[k] = v
+				}
+			}
+			So(btreeContents(&tree), ShouldResemble, mapContents(m))
+			for k, v := range m {
+				So(string(tree.get(btreeKey(k)).value), ShouldEqual, v)
+			}
+
+			Convey("and deleting everything", func() {
+				for k := range m {
+					tree.delete(btreeKey(k))
+				}
+				So(btreeContents(&tree), ShouldBeEmpty)
+				So(tree.min(), ShouldBeNil)
+			})
+		})
+
+		Convey("clones are isolated", func() {
+			for i := 0; i < 1000; i++ {
+				tree.set(btreeKey(i), []byte("old"))
+			}
+			clone := tree.clone()
+
+			for i := 0; i < 1000; i += 2 {
+				tree.set(btreeKey(i), []byte("new"))
+				clone.delete(btreeKey(i + 1))
+			}
+			So(btreeContents(&clone), ShouldHaveLength, 500)
+			So(string(tree.get(btreeKey(1)).value), ShouldEqual, "old")
+			So(string(clone.get(btreeKey(0)).value), ShouldEqual, "old")
+
+			Convey("including clones of clones", func() {
+				cc := clone.clone()
+				cc.set(btreeKey(0), []byte("cc"))
+				So(string(clone.get(btreeKey(0)).value), ShouldEqual, "old")
+				So(string(tree.get(btreeKey(0)).value), ShouldEqual, "new")
+			})
+		})
+
+		Convey("iterator", func() {
+			for i := 0; i < 1000; i += 2 {
+				tree.set(btreeKey(i), nil)
+			}
+			it := memIteratorImpl{root: tree.root}
+
+			it.Seek(btreeKey(501))
+			So(it.Next().key, ShouldResemble, btreeKey(502))
+			So(it.Next().key, ShouldResemble, btreeKey(504))
+
+			it.Seek(btreeKey(100))
+			So(it.Next().key, ShouldResemble, btreeKey(100))
+
+			it.Seek(btreeKey(998))
+			So(it.Next().key, ShouldResemble, btreeKey(998))
+			So(it.Next(), ShouldBeNil)
+
+			it.Seek(nil)
+			n := 0
+			for it.Next() != nil {
+				n++
+			}
+			So(n, ShouldEqual, 500)
+		})
+	})
+}
+
+func BenchmarkBtreeSet(b *testing.B) {
+	keys := make([][]byte, b.N)
+	r := rand.New(rand.NewSource(1))
+	for i := range keys {
+		keys[i] = btreeKey(r.Int())
+	}
+	tree := newBtree()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for _, k := range keys {
+		tree.set(k, k)
+	}
+}
+
+func BenchmarkBtreeScan(b *testing.B) {
+	tree := newBtree()
+	for i := 0; i < 100000; i++ {
+		tree.set(btreeKey(i), nil)
+	}
+	it := memIteratorImpl{root: tree.root}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		it.Seek(nil)
+		for it.Next() != nil {
+		}
+	}
+}
@@ -0,0 +1,183 @@
+// Copyright 2018 The LUCI Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package console implements a web development console for the services of
+// impl/memory, like the admin console of dev_appserver.
+//
+// It lets you browse the namespaces, kinds and entities of the datastore, run
+// GQL queries, edit and delete entities and view the compound indexes. It also
+// shows the memcache, the task queues and the sent mail, and lets you flush the
+// memcache and run, delete or purge tasks.
+//
+// The console serves all of its pages at relative paths, so it can be mounted
+// anywhere with http.StripPrefix, e.g. at "/_console/":
+//
+//	http.Handle("/_console/", http.StripPrefix("/_console/", console.New(c)))
+//
+// It has no access control whatsoever: only serve it on development servers.
+package console
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"sort"
+
+	"go.chromium.org/gae/service/datastore/meta"
+	"go.chromium.org/gae/service/info"
+
+	"golang.org/x/net/context"
+)
+
+// Console is the http.Handler of the console.
+type Console struct {
+	// TaskHandler, if not nil, serves the push tasks which are run from the
+	// console. Typically it's the handler of the application. If it's nil,
+	// tasks can't be run.
+	TaskHandler http.Handler
+
+	c   context.Context
+	mux *http.ServeMux
+}
+
+var _ http.Handler = (*Console)(nil)
+
+// New returns a Console for the services installed in c, which must be the
+// ones of impl/memory (see memory.Use).
+//
+// The namespace of c is ignored: pages which show namespaced data take the
+// namespace as a parameter.
+func New(c context.Context) *Console {
+	con := &Console{c: c, mux: http.NewServeMux()}
+	for path, h := range map[string]func(w http.ResponseWriter, r *http.Request) error{
+		"/":         con.index,
+		"/kinds":    con.kinds,
+		"/entities": con.entities,
+		"/entity":   con.entity,
+		"/query":    con.query,
+		"/indexes":  con.indexes,
+		"/memcache": con.memcache,
+		"/tasks":    con.tasks,
+		"/mail":     con.mail,
+	} {
+		h := h
+		con.mux.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {
+			if err := h(w, r); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+			}
+		})
+	}
+	return con
+}
+
+// ServeHTTP implements http.Handler.
+func (con *Console) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// The paths are relative, so that the console can be mounted anywhere.
+	r2 := *r
+	u := *r.URL
+	if u.Path == "" || u.Path[0] != '/' {
+		u.Path = "/" + u.Path
+	}
+	r2.URL = &u
+	con.mux.ServeHTTP(w, &r2)
+}
+
+// namespace returns the console's context in the namespace of the "ns"
+// parameter of r.
+func (con *Console) namespace(r *http.Request) (context.Context, string, error) {
+	ns := r.FormValue("ns")
+	c, err := info.Namespace(con.c, ns)
+	if err != nil {
+		return nil, "", err
+	}
+	return c, ns, nil
+}
+
+// page is the data common to all of the pages.
+type page struct {
+	Title string
+	NS    string
+	// Message is a message about the result of the last action, if any.
+	Message string
+}
+
+func newPage(r *http.Request, title, ns string) page {
+	return page{Title: title, NS: ns, Message: r.FormValue("msg")}
+}
+
+// render renders the named template with data.
+func render(w http.ResponseWriter, name string, data interface{}) error {
+	var buf bytes.Buffer
+	if err := templates.ExecuteTemplate(&buf, name, data); err != nil {
+		return err
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	_, err := buf.WriteTo(w)
+	return err
+}
+
+// seeOther redirects to the relative URL path?params, with a message.
+//
+// Unlike http.Redirect, it keeps the URL relative, so that it resolves
+// correctly wherever the console is mounted.
+func seeOther(w http.ResponseWriter, path string, params url.Values, format string, args ...interface{}) {
+	if params == nil {
+		params = url.Values{}
+	}
+	if format != "" {
+		params.Set("msg", fmt.Sprintf(format, args...))
+	}
+	if len(params) > 0 {
+		path += "?" + params.Encode()
+	}
+	w.Header().Set("Location", path)
+	w.WriteHeader(http.StatusSeeOther)
+}
+
+var funcs = template.FuncMap{
+	// q builds query parameters out of name, value pairs.
+	"q": func(kv ...string) template.URL {
+		v := url.Values{}
+		for i := 0; i+1 < len(kv); i += 2 {
+			v.Set(kv[i], kv[i+1])
+		}
+		return template.URL(v.Encode())
+	},
+}
+
+func (con *Console) index(w http.ResponseWriter, r *http.Request) error {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return nil
+	}
+
+	namespaces := meta.NamespacesCollector{""}
+	err := meta.Namespaces(con.c, func(ns string) error {
+		if ns != "" {
+			return namespaces.Callback(ns)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	sort.Strings(namespaces)
+
+	return render(w, "index", struct {
+		page
+		Namespaces []string
+	}{newPage(r, "Development console", ""), namespaces})
+}
@@ -0,0 +1,161 @@
+// Copyright 2018 The LUCI Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package console
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"go.chromium.org/gae/impl/memory"
+	ds "go.chromium.org/gae/service/datastore"
+	"go.chromium.org/gae/service/mail"
+	mc "go.chromium.org/gae/service/memcache"
+	tq "go.chromium.org/gae/service/taskqueue"
+
+	"golang.org/x/net/context"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestConsole(t *testing.T) {
+	t.Parallel()
+
+	Convey("Console", t, func() {
+		c := memory.Use(context.Background())
+		ds.GetTestable(c).Consistent(true)
+		con := New(c)
+
+		srv := httptest.NewServer(http.StripPrefix("/console/", con))
+		defer srv.Close()
+		client := &http.Client{}
+
+		get := func(path string) string {
+			resp, err := client.Get(srv.URL + "/console/" + path)
+			So(err, ShouldBeNil)
+			defer resp.Body.Close()
+			body, err := ioutil.ReadAll(resp.Body)
+			So(err, ShouldBeNil)
+			So(resp.StatusCode, ShouldEqual, http.StatusOK)
+			return string(body)
+		}
+		// post follows the redirect, and returns the resulting page.
+		post := func(path string, form url.Values) string {
+			resp, err := client.PostForm(srv.URL+"/console/"+path, form)
+			So(err, ShouldBeNil)
+			defer resp.Body.Close()
+			body, err := ioutil.ReadAll(resp.Body)
+			So(err, ShouldBeNil)
+			So(resp.StatusCode, ShouldEqual, http.StatusOK)
+			return string(body)
+		}
+
+		key := ds.MakeKey(c, "Thing", 1)
+		So(ds.Put(c, ds.PropertyMap{
+			"$key": ds.MkPropertyNI(key),
+			"Val":  ds.MkProperty(10),
+			"Tags": ds.PropertySlice{ds.MkProperty("a"), ds.MkProperty("b")},
+		}), ShouldBeNil)
+
+		Convey("lists namespaces and kinds", func() {
+			So(get(""), ShouldContainSubstring, "kinds?ns=")
+			So(get("kinds?ns="), ShouldContainSubstring, ">Thing</a>")
+			So(get("entities?ns=&kind=Thing"), ShouldContainSubstring, `&#34;Val&#34;: PTInt(10)`)
+		})
+
+		Convey("runs GQL queries", func() {
+			So(get("query?"+url.Values{"gql": {"SELECT * FROM Thing WHERE Val = 10"}}.Encode()),
+				ShouldContainSubstring, "PTString(&#34;b&#34;)")
+			So(get("query?"+url.Values{"gql": {"SELECT * FROM"}}.Encode()),
+				ShouldContainSubstring, "unexpected end of query")
+		})
+
+		Convey("edits entities", func() {
+			page := get("entity?key=" + key.Encode())
+			So(page, ShouldContainSubstring, `name="value.1" value="b"`)
+
+			post("entity?key="+key.Encode(), url.Values{
+				"action": {"save"},
+				"name.0": {"Tags"}, "type.0": {"PTString"}, "value.0": {"c"}, "indexed.0": {"on"},
+				"name.1": {""}, "type.1": {"PTString"}, "value.1": {"x"},
+				"name.2": {"Val"}, "type.2": {"PTInt"}, "value.2": {"11"},
+			})
+			pm := ds.PropertyMap{"$key": ds.MkPropertyNI(key)}
+			So(ds.Get(c, pm), ShouldBeNil)
+			So(pm, ShouldResemble, ds.PropertyMap{
+				"$key": ds.MkPropertyNI(key),
+				"Tags": ds.MkProperty("c"),
+				"Val":  ds.MkPropertyNI(11),
+			})
+
+			So(post("entity?key="+key.Encode(), url.Values{"action": {"delete"}}), ShouldContainSubstring, "Deleted")
+			So(ds.Get(c, pm), ShouldEqual, ds.ErrNoSuchEntity)
+		})
+
+		Convey("shows indexes", func() {
+			ds.GetTestable(c).AddIndexes(&ds.IndexDefinition{
+				Kind:   "Thing",
+				SortBy: []ds.IndexColumn{{Property: "Val"}, {Property: "Tags", Descending: true}},
+			})
+			So(get("indexes"), ShouldContainSubstring, "Val, -Tags")
+		})
+
+		Convey("inspects and flushes memcache", func() {
+			So(mc.Set(c, mc.NewItem(c, "k").SetValue([]byte("hello"))), ShouldBeNil)
+			So(get("memcache?ns="), ShouldContainSubstring, "&#34;hello&#34;")
+			So(post("memcache?ns=", url.Values{"action": {"flush"}}), ShouldContainSubstring, "No items.")
+		})
+
+		Convey("runs, deletes and purges tasks", func() {
+			So(tq.Add(c, "default", &tq.Task{Name: "t1", Path: "/work", Payload: []byte("p")}), ShouldBeNil)
+			So(tq.Add(c, "default", &tq.Task{Name: "t2", Path: "/work"}), ShouldBeNil)
+			So(get("tasks?ns="), ShouldContainSubstring, "t1")
+
+			var ran []string
+			con.TaskHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				ran = append(ran, r.URL.Path+" "+r.Header.Get("X-AppEngine-TaskName"))
+			})
+			page := post("tasks?ns=", url.Values{"action": {"run"}, "queue": {"default"}, "task": {"t1"}})
+			So(page, ShouldContainSubstring, "ran, with HTTP status 200")
+			So(ran, ShouldResemble, []string{"/work t1"})
+			So(tq.GetTestable(c).GetScheduledTasks()["default"], ShouldHaveLength, 1)
+
+			post("tasks?ns=", url.Values{"action": {"delete"}, "queue": {"default"}, "task": {"t2"}})
+			So(tq.GetTestable(c).GetScheduledTasks()["default"], ShouldBeEmpty)
+
+			So(tq.Add(c, "default", &tq.Task{Name: "t3", Path: "/work"}), ShouldBeNil)
+			post("tasks?ns=", url.Values{"action": {"purge"}, "queue": {"default"}})
+			So(tq.GetTestable(c).GetScheduledTasks()["default"], ShouldBeEmpty)
+		})
+
+		Convey("shows sent mail", func() {
+			So(mail.Send(c, &mail.Message{
+				Sender:  "admin@example.com",
+				To:      []string{"user@example.com"},
+				Subject: "Greetings",
+				Body:    "Hello",
+			}), ShouldBeNil)
+			page := get("mail")
+			So(page, ShouldContainSubstring, "Greetings")
+			So(page, ShouldContainSubstring, "To: user@example.com")
+
+			So(post("mail", url.Values{"action": {"reset"}}), ShouldContainSubstring, "No sent mail.")
+			So(strings.Contains(get("mail"), "Greetings"), ShouldBeFalse)
+		})
+	})
+}
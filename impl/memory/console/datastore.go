@@ -0,0 +1,443 @@
+// Copyright 2018 The LUCI Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package console
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.chromium.org/gae/service/blobstore"
+	ds "go.chromium.org/gae/service/datastore"
+	"go.chromium.org/gae/service/datastore/dumper"
+	"go.chromium.org/gae/service/info"
+
+	"golang.org/x/net/context"
+)
+
+const (
+	// pageSize is the number of entities listed on a page.
+	pageSize = 20
+
+	// maxQueryResults is the number of results shown for GQL queries without a
+	// LIMIT.
+	maxQueryResults = 100
+)
+
+func isSpecialKind(kind string) bool {
+	return strings.HasPrefix(kind, "__") && strings.HasSuffix(kind, "__")
+}
+
+// dump formats an entity with the dumper.
+func dump(key *ds.Key, pm ds.PropertyMap) (string, error) {
+	var buf bytes.Buffer
+	if _, err := (dumper.Config{OutStream: &buf}).Entity(key, pm); err != nil {
+		return "", err
+	}
+	return strings.TrimPrefix(buf.String(), "\n"), nil
+}
+
+func (con *Console) kinds(w http.ResponseWriter, r *http.Request) error {
+	c, ns, err := con.namespace(r)
+	if err != nil {
+		return err
+	}
+
+	// There are no __kind__ queries, so this looks at every key.
+	counts := map[string]int{}
+	err = ds.Run(c, ds.NewQuery("").KeysOnly(true), func(key *ds.Key) {
+		if !isSpecialKind(key.Kind()) {
+			counts[key.Kind()]++
+		}
+	})
+	if err != nil {
+		return err
+	}
+	type kind struct {
+		Name  string
+		Count int
+	}
+	kinds := make([]kind, 0, len(counts))
+	for name, n := range counts {
+		kinds = append(kinds, kind{name, n})
+	}
+	sort.Slice(kinds, func(i, j int) bool { return kinds[i].Name < kinds[j].Name })
+
+	return render(w, "kinds", struct {
+		page
+		GQL   string
+		Kinds []kind
+	}{newPage(r, "Datastore", ns), "", kinds})
+}
+
+// entityRow is an entity in a list of entities.
+type entityRow struct {
+	Key     string
+	Encoded string
+	Dump    string
+}
+
+func (con *Console) entities(w http.ResponseWriter, r *http.Request) error {
+	c, ns, err := con.namespace(r)
+	if err != nil {
+		return err
+	}
+	kind := r.FormValue("kind")
+
+	q := ds.NewQuery(kind).Limit(pageSize)
+	if s := r.FormValue("cursor"); s != "" {
+		cur, err := ds.DecodeCursor(c, s)
+		if err != nil {
+			return err
+		}
+		q = q.Start(cur)
+	}
+
+	var rows []entityRow
+	next := ""
+	err = ds.Run(c, q, func(pm ds.PropertyMap, getCursor ds.CursorCB) error {
+		key := ds.GetMetaDefault(pm, "key", nil).(*ds.Key)
+		d, err := dump(key, pm)
+		if err != nil {
+			return err
+		}
+		rows = append(rows, entityRow{key.String(), key.Encode(), d})
+		if len(rows) == pageSize {
+			cur, err := getCursor()
+			if err != nil {
+				return err
+			}
+			next = cur.String()
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	return render(w, "entities", struct {
+		page
+		Kind     string
+		Entities []entityRow
+		Next     string
+	}{newPage(r, "Kind "+kind, ns), kind, rows, next})
+}
+
+func (con *Console) query(w http.ResponseWriter, r *http.Request) error {
+	c, ns, err := con.namespace(r)
+	if err != nil {
+		return err
+	}
+	gql := r.FormValue("gql")
+
+	data := struct {
+		page
+		GQL     string
+		Error   string
+		Results string
+	}{page: newPage(r, "Query", ns), GQL: gql}
+
+	if gql != "" {
+		data.Results, err = runGQL(c, gql)
+		if err != nil {
+			data.Error = err.Error()
+		}
+	}
+	return render(w, "query", data)
+}
+
+// runGQL runs a GQL query, and returns its results formatted with the dumper.
+func runGQL(c context.Context, gql string) (string, error) {
+	q, err := ds.ParseGQL(ds.GetKeyContext(c), gql)
+	if err != nil {
+		return "", err
+	}
+	fq, err := q.Finalize()
+	if err != nil {
+		return "", err
+	}
+	if _, ok := fq.Limit(); !ok {
+		q = q.Limit(maxQueryResults)
+	}
+
+	var buf bytes.Buffer
+	if _, err := (dumper.Config{OutStream: &buf, WithSpecial: true}).Query(c, q); err != nil {
+		return "", err
+	}
+	return strings.TrimPrefix(buf.String(), "\n"), nil
+}
+
+func (con *Console) indexes(w http.ResponseWriter, r *http.Request) error {
+	t := ds.GetTestable(con.c)
+	if t == nil {
+		return fmt.Errorf("the datastore is not testable")
+	}
+
+	type index struct {
+		Kind     string
+		Ancestor bool
+		Columns  string
+		State    ds.IndexState
+		Progress string
+	}
+	var indexes []index
+	for _, st := range t.IndexStates() {
+		cols := make([]string, len(st.Index.SortBy))
+		for i, col := range st.Index.SortBy {
+			cols[i] = col.String()
+		}
+		indexes = append(indexes, index{
+			Kind:     st.Index.Kind,
+			Ancestor: st.Index.Ancestor,
+			Columns:  strings.Join(cols, ", "),
+			State:    st.State,
+			Progress: fmt.Sprintf("%.0f%%", st.Progress*100),
+		})
+	}
+
+	return render(w, "indexes", struct {
+		page
+		Indexes []index
+	}{newPage(r, "Indexes", ""), indexes})
+}
+
+// editableTypes are the property types which can be edited, in the order they
+// are offered.
+var editableTypes = []ds.PropertyType{
+	ds.PTString, ds.PTInt, ds.PTFloat, ds.PTBool, ds.PTTime, ds.PTKey,
+	ds.PTBytes, ds.PTGeoPoint, ds.PTBlobKey, ds.PTNull,
+}
+
+func isEditable(t ds.PropertyType) bool {
+	for _, e := range editableTypes {
+		if e == t {
+			return true
+		}
+	}
+	return false
+}
+
+// propertyRow is a property value in the entity editor.
+type propertyRow struct {
+	Name    string
+	Type    ds.PropertyType
+	Value   string
+	Indexed bool
+}
+
+// formatValue formats the value of p for the entity editor. See parseValue.
+func formatValue(p ds.Property) string {
+	switch v := p.Value().(type) {
+	case nil:
+		return ""
+	case time.Time:
+		return v.Format(time.RFC3339Nano)
+	case *ds.Key:
+		return v.Encode()
+	case []byte:
+		return base64.StdEncoding.EncodeToString(v)
+	case ds.GeoPoint:
+		return fmt.Sprintf("%v,%v", v.Lat, v.Lng)
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// parseValue parses a value formatted by formatValue.
+func parseValue(t ds.PropertyType, s string) (interface{}, error) {
+	switch t {
+	case ds.PTNull:
+		return nil, nil
+	case ds.PTString:
+		return s, nil
+	case ds.PTInt:
+		return strconv.ParseInt(s, 10, 64)
+	case ds.PTFloat:
+		return strconv.ParseFloat(s, 64)
+	case ds.PTBool:
+		return strconv.ParseBool(s)
+	case ds.PTTime:
+		return time.Parse(time.RFC3339Nano, s)
+	case ds.PTKey:
+		return ds.NewKeyEncoded(s)
+	case ds.PTBytes:
+		return base64.StdEncoding.DecodeString(s)
+	case ds.PTBlobKey:
+		return blobstore.Key(s), nil
+	case ds.PTGeoPoint:
+		parts := strings.Split(s, ",")
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("bad GeoPoint %q, expected lat,lng", s)
+		}
+		lat, err1 := strconv.ParseFloat(strings.TrimSpace(parts[0]), 64)
+		lng, err2 := strconv.ParseFloat(strings.TrimSpace(parts[1]), 64)
+		if err1 != nil || err2 != nil {
+			return nil, fmt.Errorf("bad GeoPoint %q, expected lat,lng", s)
+		}
+		return ds.GeoPoint{Lat: lat, Lng: lng}, nil
+	}
+	return nil, fmt.Errorf("can't edit values of type %s", t)
+}
+
+// entity shows an entity, and edits or deletes it.
+func (con *Console) entity(w http.ResponseWriter, r *http.Request) error {
+	key, err := ds.NewKeyEncoded(r.FormValue("key"))
+	if err != nil {
+		return err
+	}
+	c, err := info.Namespace(con.c, key.Namespace())
+	if err != nil {
+		return err
+	}
+	pm := ds.PropertyMap{"$key": ds.MkPropertyNI(key)}
+	if err := ds.Get(c, pm); err != nil {
+		return err
+	}
+
+	if r.Method == "POST" {
+		params := url.Values{"ns": {key.Namespace()}}
+		switch r.FormValue("action") {
+		case "delete":
+			if err := ds.Delete(c, key); err != nil {
+				return err
+			}
+			params.Set("kind", key.Kind())
+			seeOther(w, "entities", params, "Deleted %s.", key)
+			return nil
+
+		case "save":
+			if err := saveEntity(c, key, pm, r); err != nil {
+				return err
+			}
+			params.Set("key", key.Encode())
+			seeOther(w, "entity", params, "Saved %s.", key)
+			return nil
+
+		default:
+			return fmt.Errorf("unknown action %q", r.FormValue("action"))
+		}
+	}
+
+	d, err := dump(key, pm)
+	if err != nil {
+		return err
+	}
+	var props []propertyRow
+	var readOnly []string
+	saved, _ := pm.Save(false)
+	for _, name := range sortedNames(saved) {
+		for _, p := range saved.Slice(name) {
+			if !isEditable(p.Type()) {
+				readOnly = append(readOnly, name)
+				break
+			}
+			props = append(props, propertyRow{name, p.Type(), formatValue(p), p.IndexSetting() == ds.ShouldIndex})
+		}
+	}
+	// An empty row to add a property.
+	props = append(props, propertyRow{Type: ds.PTString, Indexed: true})
+
+	return render(w, "entity", struct {
+		page
+		Key      string
+		Encoded  string
+		Kind     string
+		Dump     string
+		Props    []propertyRow
+		ReadOnly []string
+		Types    []ds.PropertyType
+	}{newPage(r, "Entity "+key.String(), key.Namespace()), key.String(), key.Encode(), key.Kind(), d, props, readOnly, editableTypes})
+}
+
+func sortedNames(pm ds.PropertyMap) []string {
+	names := make([]string, 0, len(pm))
+	for name := range pm {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// saveEntity replaces the properties of an entity with the ones in the form of
+// the entity editor. The properties which can't be edited are kept.
+func saveEntity(c context.Context, key *ds.Key, cur ds.PropertyMap, r *http.Request) error {
+	pm := ds.PropertyMap{"$key": ds.MkPropertyNI(key)}
+	saved, _ := cur.Save(false)
+	for name, pdata := range saved {
+		for _, p := range pdata.Slice() {
+			if !isEditable(p.Type()) {
+				pm[name] = pdata
+				break
+			}
+		}
+	}
+
+	values := map[string]ds.PropertySlice{}
+	for i := 0; ; i++ {
+		field := func(f string) string { return r.FormValue(fmt.Sprintf("%s.%d", f, i)) }
+		if _, ok := r.Form[fmt.Sprintf("name.%d", i)]; !ok {
+			break
+		}
+		name := field("name")
+		if name == "" {
+			continue
+		}
+		if _, ok := pm[name]; ok {
+			return fmt.Errorf("property %q can't be edited", name)
+		}
+
+		t, err := parseType(field("type"))
+		if err != nil {
+			return err
+		}
+		v, err := parseValue(t, field("value"))
+		if err != nil {
+			return fmt.Errorf("property %q: %s", name, err)
+		}
+		is := ds.NoIndex
+		if field("indexed") != "" {
+			is = ds.ShouldIndex
+		}
+		var prop ds.Property
+		if err := prop.SetValue(v, is); err != nil {
+			return fmt.Errorf("property %q: %s", name, err)
+		}
+		values[name] = append(values[name], prop)
+	}
+
+	for name, vals := range values {
+		if len(vals) == 1 {
+			pm[name] = vals[0]
+		} else {
+			pm[name] = vals
+		}
+	}
+	return ds.Put(c, pm)
+}
+
+func parseType(s string) (ds.PropertyType, error) {
+	for _, t := range editableTypes {
+		if t.String() == s {
+			return t, nil
+		}
+	}
+	return ds.PTUnknown, fmt.Errorf("unknown property type %q", s)
+}
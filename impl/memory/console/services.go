@@ -0,0 +1,268 @@
+// Copyright 2018 The LUCI Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package console
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.chromium.org/gae/impl/memory"
+	"go.chromium.org/gae/service/mail"
+	mc "go.chromium.org/gae/service/memcache"
+	tq "go.chromium.org/gae/service/taskqueue"
+)
+
+// maxPreview is the length of the previews of memcache values and task
+// payloads.
+const maxPreview = 200
+
+// preview formats b as a string, truncated to maxPreview bytes.
+func preview(b []byte) string {
+	if len(b) <= maxPreview {
+		return strconv.Quote(string(b))
+	}
+	return strconv.Quote(string(b[:maxPreview])) + "..."
+}
+
+func (con *Console) memcache(w http.ResponseWriter, r *http.Request) error {
+	c, ns, err := con.namespace(r)
+	if err != nil {
+		return err
+	}
+
+	if r.Method == "POST" {
+		params := url.Values{"ns": {ns}}
+		switch r.FormValue("action") {
+		case "flush":
+			if err := mc.Flush(c); err != nil {
+				return err
+			}
+			seeOther(w, "memcache", params, "Flushed memcache.")
+		case "delete":
+			key := r.FormValue("key")
+			if err := mc.Delete(c, key); err != nil {
+				return err
+			}
+			seeOther(w, "memcache", params, "Deleted %q.", key)
+		default:
+			return fmt.Errorf("unknown action %q", r.FormValue("action"))
+		}
+		return nil
+	}
+
+	stats, err := mc.Stats(c)
+	if err != nil {
+		return err
+	}
+	type item struct {
+		Key        string
+		Flags      uint32
+		Size       int
+		Expiration string
+		Value      string
+	}
+	var items []item
+	for _, itm := range memory.MemcacheItems(c) {
+		exp := "never"
+		if d := itm.Expiration(); d != 0 {
+			exp = "in " + d.String()
+		}
+		items = append(items, item{itm.Key(), itm.Flags(), len(itm.Value()), exp, preview(itm.Value())})
+	}
+
+	return render(w, "memcache", struct {
+		page
+		Stats *mc.Statistics
+		Items []item
+	}{newPage(r, "Memcache", ns), stats, items})
+}
+
+// taskRow is a task in the list of tasks of a queue.
+type taskRow struct {
+	Name       string
+	Method     string
+	Path       string
+	ETA        string
+	RetryCount int32
+	Payload    string
+}
+
+type queueRow struct {
+	Name  string
+	Tasks []taskRow
+}
+
+func (con *Console) tasks(w http.ResponseWriter, r *http.Request) error {
+	c, ns, err := con.namespace(r)
+	if err != nil {
+		return err
+	}
+	t := tq.GetTestable(c)
+	if t == nil {
+		return fmt.Errorf("the task queue is not testable")
+	}
+
+	if r.Method == "POST" {
+		params := url.Values{"ns": {ns}}
+		queue, name := r.FormValue("queue"), r.FormValue("task")
+		switch r.FormValue("action") {
+		case "run":
+			task := t.GetScheduledTasks()[queue][name]
+			if task == nil {
+				return fmt.Errorf("no task %q in queue %q", name, queue)
+			}
+			code, err := con.runTask(queue, task)
+			if err != nil {
+				return err
+			}
+			if code < 200 || code >= 300 {
+				seeOther(w, "tasks", params, "Task %q failed with HTTP status %d, and was kept.", name, code)
+				return nil
+			}
+			if err := tq.Delete(c, queue, task); err != nil {
+				return err
+			}
+			seeOther(w, "tasks", params, "Task %q ran, with HTTP status %d.", name, code)
+		case "delete":
+			if err := tq.Delete(c, queue, &tq.Task{Name: name}); err != nil {
+				return err
+			}
+			seeOther(w, "tasks", params, "Deleted task %q.", name)
+		case "purge":
+			if err := tq.Purge(c, queue); err != nil {
+				return err
+			}
+			seeOther(w, "tasks", params, "Purged queue %q.", queue)
+		default:
+			return fmt.Errorf("unknown action %q", r.FormValue("action"))
+		}
+		return nil
+	}
+
+	var queues []queueRow
+	for qName, tasks := range t.GetScheduledTasks() {
+		q := queueRow{Name: qName}
+		for _, task := range tasks {
+			q.Tasks = append(q.Tasks, taskRow{
+				Name:       task.Name,
+				Method:     task.Method,
+				Path:       task.Path,
+				ETA:        task.ETA.Format(time.RFC3339),
+				RetryCount: task.RetryCount,
+				Payload:    preview(task.Payload),
+			})
+		}
+		sort.Slice(q.Tasks, func(i, j int) bool {
+			a, b := q.Tasks[i], q.Tasks[j]
+			if a.ETA != b.ETA {
+				return a.ETA < b.ETA
+			}
+			return a.Name < b.Name
+		})
+		queues = append(queues, q)
+	}
+	sort.Slice(queues, func(i, j int) bool { return queues[i].Name < queues[j].Name })
+
+	return render(w, "tasks", struct {
+		page
+		Queues []queueRow
+		CanRun bool
+	}{newPage(r, "Task queues", ns), queues, con.TaskHandler != nil})
+}
+
+// runTask serves a push task with the TaskHandler, like the task queue service
+// would, and returns the HTTP status code of the response.
+func (con *Console) runTask(queue string, task *tq.Task) (int, error) {
+	if con.TaskHandler == nil {
+		return 0, fmt.Errorf("tasks can't be run without a TaskHandler")
+	}
+	if task.Method == "PULL" {
+		return 0, fmt.Errorf("pull tasks can't be run")
+	}
+
+	method := task.Method
+	if method == "" {
+		method = "POST"
+	}
+	req, err := http.NewRequest(method, task.Path, bytes.NewReader(task.Payload))
+	if err != nil {
+		return 0, err
+	}
+	for k, vs := range task.Header {
+		req.Header[k] = append([]string(nil), vs...)
+	}
+	req.Header.Set("X-AppEngine-QueueName", queue)
+	req.Header.Set("X-AppEngine-TaskName", task.Name)
+	req.Header.Set("X-AppEngine-TaskRetryCount", strconv.Itoa(int(task.RetryCount)))
+	req.Header.Set("X-AppEngine-TaskExecutionCount", strconv.Itoa(int(task.RetryCount)))
+	req.Header.Set("X-AppEngine-TaskETA",
+		strconv.FormatFloat(float64(task.ETA.UnixNano())/1e9, 'f', 6, 64))
+
+	rec := httptest.NewRecorder()
+	con.TaskHandler.ServeHTTP(rec, req)
+	return rec.Code, nil
+}
+
+func (con *Console) mail(w http.ResponseWriter, r *http.Request) error {
+	t := mail.GetTestable(con.c)
+	if t == nil {
+		return fmt.Errorf("the mail service is not testable")
+	}
+
+	if r.Method == "POST" {
+		if r.FormValue("action") != "reset" {
+			return fmt.Errorf("unknown action %q", r.FormValue("action"))
+		}
+		t.Reset()
+		seeOther(w, "mail", nil, "Cleared the sent mail.")
+		return nil
+	}
+
+	type message struct {
+		*mail.TestMessage
+		Recipients  string
+		Attachments []string
+	}
+	var msgs []message
+	for _, msg := range t.SentMessages() {
+		m := message{TestMessage: msg}
+		var rcpts []string
+		for _, l := range []struct {
+			name  string
+			addrs []string
+		}{{"To", msg.To}, {"Cc", msg.Cc}, {"Bcc", msg.Bcc}} {
+			if len(l.addrs) > 0 {
+				rcpts = append(rcpts, l.name+": "+strings.Join(l.addrs, ", "))
+			}
+		}
+		m.Recipients = strings.Join(rcpts, "; ")
+		for i, a := range msg.Attachments {
+			m.Attachments = append(m.Attachments, fmt.Sprintf("%s (%s, %d bytes)", a.Name, msg.MIMETypes[i], len(a.Data)))
+		}
+		msgs = append(msgs, m)
+	}
+
+	return render(w, "mail", struct {
+		page
+		Messages []message
+	}{newPage(r, "Sent mail", ""), msgs})
+}
@@ -0,0 +1,223 @@
+// Copyright 2018 The LUCI Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package console
+
+import (
+	"html/template"
+)
+
+// templates are the templates of the pages. All of the links are relative (see
+// seeOther).
+var templates = template.Must(template.New("").Funcs(funcs).Parse(`
+{{define "header"}}<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.Title}}</title>
+<style>
+body { font-family: sans-serif; margin: 1em 2em; }
+nav a { margin-right: 1em; }
+table { border-collapse: collapse; }
+th, td { border: 1px solid #ccc; padding: 0.2em 0.5em; text-align: left; vertical-align: top; }
+pre { background: #f4f4f4; padding: 0.5em; }
+.msg { background: #ffc; padding: 0.5em; }
+form.inline { display: inline; }
+</style>
+</head>
+<body>
+<nav>
+<a href="./">Namespaces</a>
+<a href="kinds?{{q "ns" .NS}}">Datastore</a>
+<a href="query?{{q "ns" .NS}}">Query</a>
+<a href="indexes">Indexes</a>
+<a href="memcache?{{q "ns" .NS}}">Memcache</a>
+<a href="tasks?{{q "ns" .NS}}">Task queues</a>
+<a href="mail">Mail</a>
+</nav>
+<h1>{{.Title}}{{if .NS}} <small>(namespace {{.NS}})</small>{{end}}</h1>
+{{if .Message}}<p class="msg">{{.Message}}</p>{{end}}
+{{end}}
+
+{{define "footer"}}
+</body>
+</html>
+{{end}}
+
+{{define "index"}}{{template "header" .}}
+<table>
+<tr><th>Namespace</th><th></th></tr>
+{{range .Namespaces}}
+<tr>
+<td>{{if .}}{{.}}{{else}}<i>default</i>{{end}}</td>
+<td>
+<a href="kinds?{{q "ns" .}}">datastore</a>
+<a href="memcache?{{q "ns" .}}">memcache</a>
+<a href="tasks?{{q "ns" .}}">tasks</a>
+</td>
+</tr>
+{{end}}
+</table>
+{{template "footer"}}{{end}}
+
+{{define "gqlform"}}
+<form action="query" method="GET">
+<input type="hidden" name="ns" value="{{.NS}}">
+<textarea name="gql" rows="3" cols="80">{{.GQL}}</textarea><br>
+<input type="submit" value="Run GQL query">
+</form>
+{{end}}
+
+{{define "kinds"}}{{template "header" .}}
+{{template "gqlform" .}}
+<table>
+<tr><th>Kind</th><th>Entities</th></tr>
+{{range .Kinds}}
+<tr><td><a href="entities?{{q "ns" $.NS "kind" .Name}}">{{.Name}}</a></td><td>{{.Count}}</td></tr>
+{{else}}
+<tr><td colspan="2">No entities.</td></tr>
+{{end}}
+</table>
+{{template "footer"}}{{end}}
+
+{{define "entities"}}{{template "header" .}}
+{{range .Entities}}
+<p><a href="entity?{{q "key" .Encoded}}">{{.Key}}</a></p>
+<pre>{{.Dump}}</pre>
+{{else}}
+<p>No entities.</p>
+{{end}}
+{{if .Next}}<p><a href="entities?{{q "ns" .NS "kind" .Kind "cursor" .Next}}">Next page</a></p>{{end}}
+{{template "footer"}}{{end}}
+
+{{define "entity"}}{{template "header" .}}
+<pre>{{.Dump}}</pre>
+<form action="entity?{{q "key" .Encoded}}" method="POST">
+<input type="hidden" name="action" value="save">
+<table>
+<tr><th>Name</th><th>Type</th><th>Value</th><th>Indexed</th></tr>
+{{range $i, $p := .Props}}
+<tr>
+<td><input name="name.{{$i}}" value="{{$p.Name}}"></td>
+<td><select name="type.{{$i}}">
+{{range $.Types}}<option{{if eq . $p.Type}} selected{{end}}>{{.}}</option>{{end}}
+</select></td>
+<td><input name="value.{{$i}}" value="{{$p.Value}}" size="60"></td>
+<td><input type="checkbox" name="indexed.{{$i}}"{{if $p.Indexed}} checked{{end}}></td>
+</tr>
+{{end}}
+</table>
+{{if .ReadOnly}}<p>These properties can't be edited, and are kept: {{range .ReadOnly}}{{.}} {{end}}</p>{{end}}
+<p>Clear the name of a property to remove it. Add values to multi-valued
+properties with rows of the same name. Keys are encoded, times are RFC 3339,
+bytes are base64 and GeoPoints are lat,lng.</p>
+<input type="submit" value="Save">
+</form>
+<form action="entity?{{q "key" .Encoded}}" method="POST">
+<input type="hidden" name="action" value="delete">
+<input type="submit" value="Delete">
+</form>
+{{template "footer"}}{{end}}
+
+{{define "query"}}{{template "header" .}}
+{{template "gqlform" .}}
+{{if .Error}}<p class="msg">{{.Error}}</p>{{end}}
+{{if .Results}}<pre>{{.Results}}</pre>{{else if .GQL}}{{if not .Error}}<p>No results.</p>{{end}}{{end}}
+{{template "footer"}}{{end}}
+
+{{define "indexes"}}{{template "header" .}}
+<table>
+<tr><th>Kind</th><th>Ancestor</th><th>Properties</th><th>State</th><th>Progress</th></tr>
+{{range .Indexes}}
+<tr><td>{{.Kind}}</td><td>{{.Ancestor}}</td><td>{{.Columns}}</td><td>{{.State}}</td><td>{{.Progress}}</td></tr>
+{{else}}
+<tr><td colspan="5">No compound indexes.</td></tr>
+{{end}}
+</table>
+{{template "footer"}}{{end}}
+
+{{define "memcache"}}{{template "header" .}}
+<p>Hits: {{.Stats.Hits}}, misses: {{.Stats.Misses}}, items: {{.Stats.Items}}, bytes: {{.Stats.Bytes}}</p>
+<form action="memcache?{{q "ns" .NS}}" method="POST">
+<input type="hidden" name="action" value="flush">
+<input type="submit" value="Flush">
+</form>
+<table>
+<tr><th>Key</th><th>Flags</th><th>Size</th><th>Expires</th><th>Value</th><th></th></tr>
+{{range .Items}}
+<tr>
+<td>{{.Key}}</td><td>{{.Flags}}</td><td>{{.Size}}</td><td>{{.Expiration}}</td><td><code>{{.Value}}</code></td>
+<td><form class="inline" action="memcache?{{q "ns" $.NS}}" method="POST">
+<input type="hidden" name="action" value="delete">
+<input type="hidden" name="key" value="{{.Key}}">
+<input type="submit" value="Delete">
+</form></td>
+</tr>
+{{else}}
+<tr><td colspan="6">No items.</td></tr>
+{{end}}
+</table>
+{{template "footer"}}{{end}}
+
+{{define "tasks"}}{{template "header" .}}
+{{range .Queues}}{{$queue := .Name}}
+<h2>{{.Name}}</h2>
+<form action="tasks?{{q "ns" $.NS}}" method="POST">
+<input type="hidden" name="action" value="purge">
+<input type="hidden" name="queue" value="{{.Name}}">
+<input type="submit" value="Purge">
+</form>
+<table>
+<tr><th>Name</th><th>Method</th><th>Path</th><th>ETA</th><th>Retries</th><th>Payload</th><th></th></tr>
+{{range .Tasks}}
+<tr>
+<td>{{.Name}}</td><td>{{.Method}}</td><td>{{.Path}}</td><td>{{.ETA}}</td><td>{{.RetryCount}}</td><td><code>{{.Payload}}</code></td>
+<td>
+{{if and $.CanRun (ne .Method "PULL")}}<form class="inline" action="tasks?{{q "ns" $.NS}}" method="POST">
+<input type="hidden" name="action" value="run">
+<input type="hidden" name="queue" value="{{$queue}}">
+<input type="hidden" name="task" value="{{.Name}}">
+<input type="submit" value="Run">
+</form>{{end}}
+<form class="inline" action="tasks?{{q "ns" $.NS}}" method="POST">
+<input type="hidden" name="action" value="delete">
+<input type="hidden" name="queue" value="{{$queue}}">
+<input type="hidden" name="task" value="{{.Name}}">
+<input type="submit" value="Delete">
+</form>
+</td>
+</tr>
+{{else}}
+<tr><td colspan="7">No tasks.</td></tr>
+{{end}}
+</table>
+{{end}}
+{{template "footer"}}{{end}}
+
+{{define "mail"}}{{template "header" .}}
+<form action="mail" method="POST">
+<input type="hidden" name="action" value="reset">
+<input type="submit" value="Clear">
+</form>
+{{range .Messages}}
+<h2>{{.Subject}}</h2>
+<p>From: {{.Sender}}<br>{{.Recipients}}{{if .ReplyTo}}<br>Reply-To: {{.ReplyTo}}{{end}}</p>
+<pre>{{.Body}}</pre>
+{{if .HTMLBody}}<pre>{{.HTMLBody}}</pre>{{end}}
+{{if .Attachments}}<p>Attachments: {{range .Attachments}}{{.}} {{end}}</p>{{end}}
+{{else}}
+<p>No sent mail.</p>
+{{end}}
+{{template "footer"}}{{end}}
+`))
@@ -19,6 +19,7 @@ import (
 	"strings"
 
 	ds "go.chromium.org/gae/service/datastore"
+	"go.chromium.org/luci/common/clock"
 	"go.chromium.org/luci/common/logging/memlogger"
 
 	"golang.org/x/net/context"
@@ -31,7 +32,8 @@ type memContextObj interface {
 	// data represented by 'm' into self.
 	//
 	// Must be called with both m and self unlocked. There can be only one commit
-	// operation at a time.
+	// operation at a time per transaction; implementations may allow commits of
+	// different transactions to proceed concurrently, if they don't interfere.
 	//
 	// Returns nil if the commit can't be applied (e.g due to a collision).
 	//
@@ -39,7 +41,7 @@ type memContextObj interface {
 	beginCommit(c context.Context, m memContextObj) txnCommitOp
 
 	// mkTxn creates an object that holds temporary transaction data.
-	mkTxn(*ds.TransactionOptions) memContextObj
+	mkTxn(*txnOptions) memContextObj
 
 	// endTxn is used to mark the transaction represented by self as closed.
 	endTxn()
@@ -106,7 +108,7 @@ func (m memContext) endTxn() {
 	}
 }
 
-func (m memContext) mkTxn(o *ds.TransactionOptions) memContextObj {
+func (m memContext) mkTxn(o *txnOptions) memContextObj {
 	ret := make(memContext, len(m))
 	for i, itm := range m {
 		ret[i] = itm.mkTxn(o)
@@ -191,6 +193,15 @@ func cur(c context.Context) (memContext, bool) {
 	return c.Value(&memContextKey).(memContext), false
 }
 
+// txnOptions are the options of a transaction being started, as passed to
+// memContextObj.mkTxn.
+type txnOptions struct {
+	o *ds.TransactionOptions
+
+	// readStore is the state of the datastore at o.ReadTime, if one is set.
+	readStore memStore
+}
+
 var (
 	memContextKey = "gae:memory:context"
 	currentTxnKey = "gae:memory:currentTxn"
@@ -214,6 +225,13 @@ func (d *dsImpl) RunInTransaction(f func(context.Context) error, o *ds.Transacti
 	if d.data.getDisableSpecialEntities() {
 		return errors.New("special entities are disabled. no transactions for you")
 	}
+	txnOpts := &txnOptions{o: o}
+	if o != nil && !o.ReadTime.IsZero() {
+		var err error
+		if txnOpts.readStore, err = d.data.storeAt(clock.Now(d), o.ReadTime); err != nil {
+			return err
+		}
+	}
 
 	// Keep in separate function for defers.
 	loopBody := func(applyForReal bool) error {
@@ -222,7 +240,7 @@ func (d *dsImpl) RunInTransaction(f func(context.Context) error, o *ds.Transacti
 			return errors.New("datastore: nested transactions are not supported")
 		}
 
-		txnMC := curMC.mkTxn(o)
+		txnMC := curMC.mkTxn(txnOpts)
 		defer txnMC.endTxn()
 
 		if err := f(context.WithValue(d, &currentTxnKey, txnMC)); err != nil {
@@ -241,6 +259,12 @@ func (d *dsImpl) RunInTransaction(f func(context.Context) error, o *ds.Transacti
 		return nil
 	}
 
+	// Read-only transactions can't conflict with other transactions, so, like in
+	// Cloud Datastore, they are never retried.
+	if o != nil && o.ReadOnly {
+		return loopBody(true)
+	}
+
 	// From GAE docs for TransactionOptions: "If omitted, it defaults to 3."
 	attempts := 3
 	if o != nil && o.Attempts != 0 {
@@ -17,11 +17,15 @@ package memory
 import (
 	"errors"
 	"fmt"
+	"io"
+	"time"
 
 	"golang.org/x/net/context"
 
 	ds "go.chromium.org/gae/service/datastore"
 	"go.chromium.org/gae/service/info"
+
+	"go.chromium.org/luci/common/clock"
 )
 
 //////////////////////////////////// public ////////////////////////////////////
@@ -47,6 +51,7 @@ func useRDS(c context.Context) context.Context {
 //   * AutoIndex(true)
 //   * Consistent(true)
 //   * DisableSpecialEntities(true)
+//   * SetReadTimeRetention(0)
 //
 // These settings can of course be changed by using the Testable interface.
 func NewDatastore(c context.Context, inf info.RawInterface) ds.RawInterface {
@@ -62,6 +67,7 @@ func NewDatastore(c context.Context, inf info.RawInterface) ds.RawInterface {
 	t.AutoIndex(true)
 	t.Consistent(true)
 	t.DisableSpecialEntities(true)
+	t.SetReadTimeRetention(0)
 
 	return ret
 }
@@ -83,16 +89,24 @@ func (d *dsImpl) AllocateIDs(keys []*ds.Key, cb ds.NewKeyCB) error {
 }
 
 func (d *dsImpl) PutMulti(keys []*ds.Key, vals []ds.PropertyMap, cb ds.NewKeyCB) error {
-	d.data.putMulti(keys, vals, cb, false)
+	d.data.putMulti(keys, vals, cb, clock.Now(d))
 	return nil
 }
 
 func (d *dsImpl) GetMulti(keys []*ds.Key, _meta ds.MultiMetaGetter, cb ds.GetMultiCB) error {
+	if t := ds.GetReadTime(d); !t.IsZero() {
+		store, err := d.data.storeAt(clock.Now(d), t)
+		if err != nil {
+			return err
+		}
+		getMultiInner(keys, d.data.stripSpecialPropsGetCB(cb), store.GetCollection("ents:"+keys[0].Namespace()))
+		return nil
+	}
 	return d.data.getMulti(keys, cb)
 }
 
 func (d *dsImpl) DeleteMulti(keys []*ds.Key, cb ds.DeleteMultiCB) error {
-	d.data.delMulti(keys, cb, false)
+	d.data.delMulti(keys, cb, clock.Now(d))
 	return nil
 }
 
@@ -102,22 +116,38 @@ func (d *dsImpl) DecodeCursor(s string) (ds.Cursor, error) {
 
 func (d *dsImpl) Run(fq *ds.FinalizedQuery, cb ds.RawRunCB) error {
 	cb = d.data.stripSpecialPropsRunCB(cb)
+	if t := ds.GetReadTime(d); !t.IsZero() {
+		// Queries at a read time are consistent as of that time.
+		snap, err := d.data.storeAt(clock.Now(d), t)
+		if err != nil {
+			return err
+		}
+		return executeQuery(fq, d.kc, false, snap, snap, cb)
+	}
 	idx, head := d.data.getQuerySnaps(!fq.EventuallyConsistent())
 	err := executeQuery(fq, d.kc, false, idx, head, cb)
 	if d.data.maybeAutoIndex(err) {
 		idx, head = d.data.getQuerySnaps(!fq.EventuallyConsistent())
 		err = executeQuery(fq, d.kc, false, idx, head, cb)
 	}
-	return err
+	return d.data.indexNotServing(fq, d.kc, false, err)
 }
 
 func (d *dsImpl) Count(fq *ds.FinalizedQuery) (ret int64, err error) {
+	if t := ds.GetReadTime(d); !t.IsZero() {
+		snap, err := d.data.storeAt(clock.Now(d), t)
+		if err != nil {
+			return 0, err
+		}
+		return countQuery(fq, d.kc, false, snap, snap)
+	}
 	idx, head := d.data.getQuerySnaps(!fq.EventuallyConsistent())
 	ret, err = countQuery(fq, d.kc, false, idx, head)
 	if d.data.maybeAutoIndex(err) {
 		idx, head := d.data.getQuerySnaps(!fq.EventuallyConsistent())
 		ret, err = countQuery(fq, d.kc, false, idx, head)
 	}
+	err = d.data.indexNotServing(fq, d.kc, false, err)
 	return
 }
 
@@ -142,6 +172,28 @@ func (d *dsImpl) AddIndexes(idxs ...*ds.IndexDefinition) {
 	d.data.addIndexes(idxs)
 }
 
+func (d *dsImpl) DeleteIndexes(idxs ...*ds.IndexDefinition) {
+	for _, i := range idxs {
+		if !i.Compound() {
+			panic(fmt.Errorf("Attempted to delete non-compound index: %s", i))
+		}
+	}
+
+	d.data.deleteIndexes(idxs)
+}
+
+func (d *dsImpl) AsyncIndexBuilds(enable bool) {
+	d.data.setAsyncIndexBuilds(enable)
+}
+
+func (d *dsImpl) StepIndexBuilds(n int) {
+	d.data.stepIndexBuilds(n)
+}
+
+func (d *dsImpl) IndexStates() []ds.IndexStatus {
+	return d.data.indexStates()
+}
+
 func (d *dsImpl) Constraints() ds.Constraints { return d.data.getConstraints() }
 
 func (d *dsImpl) TakeIndexSnapshot() ds.TestingSnapshot {
@@ -152,6 +204,14 @@ func (d *dsImpl) SetIndexSnapshot(snap ds.TestingSnapshot) {
 	d.data.setSnapshot(snap.(memStore))
 }
 
+func (d *dsImpl) Snapshot() ds.TestingSnapshot {
+	return d.data.takeFullSnapshot()
+}
+
+func (d *dsImpl) Restore(snap ds.TestingSnapshot) {
+	d.data.restoreFullSnapshot(snap.(*dsSnapshot))
+}
+
 func (d *dsImpl) CatchupIndexes() {
 	d.data.catchupIndexes()
 }
@@ -176,6 +236,26 @@ func (d *dsImpl) ShowSpecialProperties(show bool) {
 	d.data.setShowSpecialProperties(show)
 }
 
+func (d *dsImpl) SetReadTimeRetention(retention time.Duration) {
+	d.data.setHistoryRetention(retention)
+}
+
+func (d *dsImpl) SetContentionPolicy(p *ds.ContentionPolicy) {
+	d.data.setContentionPolicy(p)
+}
+
+func (d *dsImpl) StrictLimits(enable bool) {
+	d.data.setStrictLimits(enable)
+}
+
+func (d *dsImpl) SetConsistencyPolicy(p ds.ConsistencyPolicy) {
+	d.data.setConsistencyPolicy(p)
+}
+
+func (d *dsImpl) SetIDAllocationPolicy(p ds.IDAllocationPolicy) {
+	d.data.setIDAllocationPolicy(p)
+}
+
 func (d *dsImpl) SetConstraints(c *ds.Constraints) error {
 	if c == nil {
 		c = &ds.Constraints{}
@@ -184,6 +264,18 @@ func (d *dsImpl) SetConstraints(c *ds.Constraints) error {
 	return nil
 }
 
+func (d *dsImpl) RefreshStats() {
+	d.data.refreshStats(clock.Now(d))
+}
+
+func (d *dsImpl) Export(w io.Writer) error {
+	return d.data.exportData(w)
+}
+
+func (d *dsImpl) Import(r io.Reader) error {
+	return d.data.importData(r)
+}
+
 func (d *dsImpl) GetTestable() ds.Testable { return d }
 
 ////////////////////////////////// txnDsImpl ///////////////////////////////////
@@ -198,11 +290,17 @@ type txnDsImpl struct {
 var _ ds.RawInterface = (*txnDsImpl)(nil)
 
 func (d *txnDsImpl) AllocateIDs(keys []*ds.Key, cb ds.NewKeyCB) error {
+	if err := d.data.txn.writable(); err != nil {
+		return err
+	}
 	return d.data.parent.allocateIDs(keys, cb)
 }
 
 func (d *txnDsImpl) PutMulti(keys []*ds.Key, vals []ds.PropertyMap, cb ds.NewKeyCB) error {
 	return d.data.run(func() error {
+		if err := d.data.txn.writable(); err != nil {
+			return err
+		}
 		d.data.putMulti(keys, vals, cb)
 		return nil
 	})
@@ -216,6 +314,9 @@ func (d *txnDsImpl) GetMulti(keys []*ds.Key, _meta ds.MultiMetaGetter, cb ds.Get
 
 func (d *txnDsImpl) DeleteMulti(keys []*ds.Key, cb ds.DeleteMultiCB) error {
 	return d.data.run(func() error {
+		if err := d.data.txn.writable(); err != nil {
+			return err
+		}
 		return d.data.delMulti(keys, cb)
 	})
 }
@@ -233,11 +334,14 @@ func (d *txnDsImpl) Run(q *ds.FinalizedQuery, cb ds.RawRunCB) error {
 	// that this would make sense... but at that point you should probably just
 	// add the index up front.
 	cb = d.data.parent.stripSpecialPropsRunCB(cb)
-	return executeQuery(q, d.kc, true, d.data.snap, d.data.snap, cb)
+	err := executeQuery(q, d.kc, true, d.data.snap, d.data.snap, cb)
+	return d.data.parent.indexNotServing(q, d.kc, true, err)
 }
 
 func (d *txnDsImpl) Count(fq *ds.FinalizedQuery) (ret int64, err error) {
-	return countQuery(fq, d.kc, true, d.data.snap, d.data.snap)
+	ret, err = countQuery(fq, d.kc, true, d.data.snap, d.data.snap)
+	err = d.data.parent.indexNotServing(fq, d.kc, true, err)
+	return
 }
 
 func (*txnDsImpl) RunInTransaction(func(c context.Context) error, *ds.TransactionOptions) error {
@@ -0,0 +1,166 @@
+// Copyright 2018 The LUCI Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package memory
+
+import (
+	"sync/atomic"
+	"testing"
+
+	ds "go.chromium.org/gae/service/datastore"
+
+	"golang.org/x/net/context"
+)
+
+// The parallel benchmarks write to a separate entity group in each goroutine,
+// so their throughput should scale with GOMAXPROCS:
+//   go test -run NONE -bench Parallel -cpu 1,2,4,8
+
+// benchGroups hands out a different entity group to each benchmark goroutine.
+type benchGroups struct {
+	c    context.Context
+	next int64
+}
+
+func (g *benchGroups) root() *ds.Key {
+	return ds.MakeKey(g.c, "Root", atomic.AddInt64(&g.next, 1))
+}
+
+func benchEntity(key *ds.Key, n int64) ds.PropertyMap {
+	return pmap(
+		"$key", key, Next,
+		"Value", n, Next,
+		"Tags", "a", "b", "c", Next,
+		"Name", "some entity", Next)
+}
+
+func BenchmarkPutParallel(b *testing.B) {
+	c := Use(context.Background())
+	groups := &benchGroups{c: c}
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		root := groups.root()
+		for n := int64(1); pb.Next(); n++ {
+			if err := ds.Put(c, benchEntity(ds.NewKey(c, "Ent", "", n, root), n)); err != nil {
+				b.Fatalf("failed to put: %s", err)
+			}
+		}
+	})
+}
+
+func BenchmarkGetParallel(b *testing.B) {
+	c := Use(context.Background())
+	key := ds.MakeKey(c, "Ent", 1)
+	if err := ds.Put(c, benchEntity(key, 1)); err != nil {
+		b.Fatalf("failed to put: %s", err)
+	}
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			if err := ds.Get(c, pmap("$key", key)); err != nil {
+				b.Fatalf("failed to get: %s", err)
+			}
+		}
+	})
+}
+
+func BenchmarkTransactionsParallel(b *testing.B) {
+	c := Use(context.Background())
+	groups := &benchGroups{c: c}
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		key := ds.NewKey(c, "Ent", "", 1, groups.root())
+		for pb.Next() {
+			err := ds.RunInTransaction(c, func(c context.Context) error {
+				ent := pmap("$key", key)
+				n := int64(0)
+				switch err := ds.Get(c, ent); err {
+				case nil:
+					n = ent.Slice("Value")[0].Value().(int64)
+				case ds.ErrNoSuchEntity:
+				default:
+					return err
+				}
+				return ds.Put(c, benchEntity(key, n+1))
+			}, nil)
+			if err != nil {
+				b.Fatalf("failed to run transaction: %s", err)
+			}
+		}
+	})
+}
+
+func BenchmarkPut(b *testing.B) {
+	c := Use(context.Background())
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		n := int64(i + 1)
+		if err := ds.Put(c, benchEntity(ds.MakeKey(c, "Ent", n), n)); err != nil {
+			b.Fatalf("failed to put: %s", err)
+		}
+	}
+}
+
+func BenchmarkIndexUpdate(b *testing.B) {
+	c := Use(context.Background())
+	ds.GetTestable(c).AddIndexes(
+		indx("Ent", "Value", "-Name"),
+		indx("Ent", "Tags", "Value"))
+
+	// Overwrite the same entities, so that every put replaces index rows.
+	const ents = 1000
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		key := ds.MakeKey(c, "Ent", int64(i%ents+1))
+		if err := ds.Put(c, benchEntity(key, int64(i))); err != nil {
+			b.Fatalf("failed to put: %s", err)
+		}
+	}
+}
+
+func BenchmarkQueryScan(b *testing.B) {
+	c := Use(context.Background())
+	tst := ds.GetTestable(c)
+	tst.Consistent(true)
+
+	const ents = 10000
+	batch := make([]ds.PropertyMap, 0, 500)
+	for i := int64(1); i <= ents; i++ {
+		batch = append(batch, benchEntity(ds.MakeKey(c, "Ent", i), i))
+		if len(batch) == cap(batch) {
+			if err := ds.Put(c, batch); err != nil {
+				b.Fatalf("failed to put: %s", err)
+			}
+			batch = batch[:0]
+		}
+	}
+	q := ds.NewQuery("Ent").Gt("Value", 0).KeysOnly(true)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		n := 0
+		err := ds.Run(c, q, func(*ds.Key) { n++ })
+		if err != nil || n != ents {
+			b.Fatalf("failed to scan: %d entities, %v", n, err)
+		}
+	}
+}
@@ -0,0 +1,139 @@
+// Copyright 2018 The LUCI Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package memory
+
+import (
+	"math/rand"
+	"sort"
+
+	ds "go.chromium.org/gae/service/datastore"
+)
+
+// The random consistency policy (see ds.RandomConsistency) is implemented on
+// top of the index snapshot, dataStoreData.snap: every entity written to head
+// is remembered in dataStoreData.unapplied, by entity group, and before each
+// eventually consistent query each such entity group is copied from head to
+// a fork of the index snapshot with the configured probability.
+
+func (d *dataStoreData) setConsistencyPolicy(p ds.ConsistencyPolicy) {
+	d.rwlock.Lock()
+	defer d.rwlock.Unlock()
+
+	d.consistRand, d.unapplied = nil, nil
+	if p.Strong() {
+		d.snap = nil
+		return
+	}
+	if prob, seed, ok := p.Random(); ok {
+		d.consistRand = rand.New(rand.NewSource(seed))
+		d.consistProb = prob
+		d.unapplied = map[string]map[string]*ds.Key{}
+	}
+	d.snap = d.head.Snapshot()
+}
+
+// resetUnappliedLocked forgets all unapplied writes. It must be called
+// whenever the index snapshot is caught up with head.
+func (d *dataStoreData) resetUnappliedLocked() {
+	if d.unapplied != nil {
+		d.unapplied = map[string]map[string]*ds.Key{}
+	}
+}
+
+// recordWriteLocked remembers that the entity with the given key was written
+// to head, if the random consistency policy is in use.
+func (d *dataStoreData) recordWriteLocked(key *ds.Key) {
+	if d.unapplied == nil {
+		return
+	}
+	gid := groupID(key)
+	grp := d.unapplied[gid]
+	if grp == nil {
+		grp = map[string]*ds.Key{}
+		d.unapplied[gid] = grp
+	}
+	grp[string(keyBytes(key))] = key
+}
+
+// applyRandomWritesLocked makes each entity group with unapplied writes
+// visible in the index snapshot with probability consistProb.
+//
+// Entity groups are considered in a fixed order, so that the results only
+// depend on the seed and on the sequence of datastore operations.
+func (d *dataStoreData) applyRandomWritesLocked() {
+	if len(d.unapplied) == 0 {
+		return
+	}
+
+	gids := make([]string, 0, len(d.unapplied))
+	for gid := range d.unapplied {
+		gids = append(gids, gid)
+	}
+	sort.Strings(gids)
+
+	var idx memStore
+	for _, gid := range gids {
+		if d.consistRand.Float64() >= d.consistProb {
+			continue
+		}
+		if idx == nil {
+			idx = d.snap.Fork()
+		}
+
+		grp := d.unapplied[gid]
+		kbs := make([]string, 0, len(grp))
+		for kb := range grp {
+			kbs = append(kbs, kb)
+		}
+		sort.Strings(kbs)
+		for _, kb := range kbs {
+			applyWrite(idx, d.head, grp[kb], []byte(kb))
+		}
+		delete(d.unapplied, gid)
+	}
+
+	if idx != nil {
+		d.snap = idx.Snapshot()
+	}
+}
+
+// applyWrite copies the current value of the entity with the given key from
+// head to idx, updating the indexes in idx accordingly.
+func applyWrite(idx, head memStore, key *ds.Key, kb []byte) {
+	collName := "ents:" + key.Namespace()
+	ents := idx.GetOrCreateCollection(collName)
+
+	var oldPM, newPM ds.PropertyMap
+	if old := ents.Get(kb); old != nil {
+		var err error
+		oldPM, err = readPropMap(old)
+		memoryCorruption(err)
+	}
+
+	var cur []byte
+	if headEnts := head.GetCollection(collName); headEnts != nil {
+		cur = headEnts.Get(kb)
+	}
+	if cur != nil {
+		var err error
+		newPM, err = readPropMap(cur)
+		memoryCorruption(err)
+		ents.Set(kb, cur)
+	} else {
+		ents.Delete(kb)
+	}
+
+	updateIndexes(idx, key, oldPM, newPM)
+}
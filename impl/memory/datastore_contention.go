@@ -0,0 +1,104 @@
+// Copyright 2018 The LUCI Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package memory
+
+import (
+	"time"
+
+	ds "go.chromium.org/gae/service/datastore"
+)
+
+// contentionError is returned for non-transactional writes to entity groups
+// written to too often, like production does when the writes time out. Like
+// the production error, it satisfies info.IsTimeoutError.
+type contentionError struct{}
+
+func (contentionError) Error() string {
+	return "API error 5 (datastore_v3: TIMEOUT): too much contention on these datastore entities. please try again."
+}
+
+func (contentionError) IsTimeout() bool { return true }
+
+var errTooMuchContention error = contentionError{}
+
+func (d *dataStoreData) setContentionPolicy(p *ds.ContentionPolicy) {
+	d.rwlock.Lock()
+	defer d.rwlock.Unlock()
+
+	if p == nil {
+		d.contention, d.groupWrites = nil, nil
+		return
+	}
+	cp := *p
+	if cp.MaxWrites <= 0 {
+		cp.MaxWrites = 1
+	}
+	d.contention = &cp
+	d.groupWrites = map[string][]time.Time{}
+}
+
+// groupContendedLocked returns true iff a write to the entity group gid at
+// now would exceed the write rate allowed by the contention policy.
+func (d *dataStoreData) groupContendedLocked(gid string, now time.Time) bool {
+	if d.contention == nil {
+		return false
+	}
+
+	// Forget about the writes which are out of the window.
+	writes := d.groupWrites[gid]
+	start := now.Add(-d.contention.Window)
+	i := 0
+	for i < len(writes) && !writes[i].After(start) {
+		i++
+	}
+	if writes = writes[i:]; len(writes) == 0 {
+		delete(d.groupWrites, gid)
+	} else {
+		d.groupWrites[gid] = writes
+	}
+
+	return len(writes) >= d.contention.MaxWrites
+}
+
+// recordGroupWriteLocked records a write to the entity group gid at now.
+func (d *dataStoreData) recordGroupWriteLocked(gid string, now time.Time) {
+	if d.contention != nil {
+		d.groupWrites[gid] = append(d.groupWrites[gid], now)
+	}
+}
+
+// checkGroupWriteLocked accounts for a non-transactional write to the entity
+// group of key at now, returning errTooMuchContention if it exceeds the write
+// rate.
+//
+// Like in production, a batch of writes counts as a single write to each of
+// the entity groups involved: groups remembers the outcome for the groups
+// already written to in the batch.
+func (d *dataStoreData) checkGroupWriteLocked(key *ds.Key, now time.Time, groups map[string]error) error {
+	if d.contention == nil {
+		return nil
+	}
+	gid := groupID(key)
+	err, ok := groups[gid]
+	if !ok {
+		if d.groupContendedLocked(gid, now) {
+			err = errTooMuchContention
+		} else {
+			d.recordGroupWriteLocked(gid, now)
+		}
+		groups[gid] = err
+	}
+	return err
+}
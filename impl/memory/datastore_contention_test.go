@@ -0,0 +1,120 @@
+// Copyright 2018 The LUCI Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package memory
+
+import (
+	"testing"
+	"time"
+
+	ds "go.chromium.org/gae/service/datastore"
+	"go.chromium.org/gae/service/info"
+
+	"go.chromium.org/luci/common/clock/testclock"
+
+	"golang.org/x/net/context"
+
+	. "github.com/smartystreets/goconvey/convey"
+	. "go.chromium.org/luci/common/testing/assertions"
+)
+
+func TestContentionPolicy(t *testing.T) {
+	t.Parallel()
+
+	Convey("SetContentionPolicy", t, func() {
+		c, tc := testclock.UseTime(context.Background(), testclock.TestRecentTimeUTC)
+		c = Use(c)
+		tst := ds.GetTestable(c)
+		tst.Consistent(true)
+
+		parent := ds.MakeKey(c, "Parent", 1)
+		child := func(id int64) *Foo { return &Foo{ID: id, Parent: parent} }
+		const timeout = "API error 5 (datastore_v3: TIMEOUT): too much contention"
+
+		Convey("is off by default", func() {
+			for i := int64(1); i <= 5; i++ {
+				So(ds.Put(c, child(i)), ShouldBeNil)
+			}
+		})
+
+		Convey("with one write per second", func() {
+			tst.SetContentionPolicy(&ds.ContentionPolicy{Window: time.Second})
+			So(ds.Put(c, child(1)), ShouldBeNil)
+
+			Convey("fails further writes to the group", func() {
+				err := ds.Put(c, child(2))
+				So(err, ShouldErrLike, timeout)
+				So(info.IsTimeoutError(c, err), ShouldBeTrue)
+				So(ds.Delete(c, ds.KeyForObj(c, child(1))), ShouldErrLike, timeout)
+				So(ds.Get(c, child(2)), ShouldEqual, ds.ErrNoSuchEntity)
+
+				tc.Add(999 * time.Millisecond)
+				So(ds.Put(c, child(2)), ShouldErrLike, timeout)
+
+				tc.Add(time.Millisecond)
+				So(ds.Put(c, child(2)), ShouldBeNil)
+			})
+
+			Convey("allows writes to other groups", func() {
+				So(ds.Put(c, &Foo{ID: 1}), ShouldBeNil)
+				So(ds.Put(c, &Foo{ID: 2}), ShouldBeNil)
+			})
+
+			Convey("counts a batch as a single write", func() {
+				tc.Add(time.Second)
+				So(ds.Put(c, []*Foo{child(2), child(3)}), ShouldBeNil)
+				So(ds.Put(c, child(4)), ShouldErrLike, timeout)
+			})
+
+			Convey("makes transactions conflict", func() {
+				attempts := 0
+				txn := func(c context.Context) error {
+					attempts++
+					return ds.Put(c, child(2))
+				}
+				So(ds.RunInTransaction(c, txn, nil), ShouldEqual, ds.ErrConcurrentTransaction)
+				So(attempts, ShouldEqual, 3)
+
+				tc.Add(time.Second)
+				So(ds.RunInTransaction(c, txn, nil), ShouldBeNil)
+				So(ds.Put(c, child(3)), ShouldErrLike, timeout)
+			})
+
+			Convey("doesn't affect read-only transactions", func() {
+				So(ds.RunInTransaction(c, func(c context.Context) error {
+					return ds.Get(c, child(1))
+				}, nil), ShouldBeNil)
+			})
+
+			Convey("can be turned off", func() {
+				tst.SetContentionPolicy(nil)
+				So(ds.Put(c, child(2)), ShouldBeNil)
+			})
+		})
+
+		Convey("with bursts", func() {
+			tst.SetContentionPolicy(&ds.ContentionPolicy{Window: time.Minute, MaxWrites: 3})
+			for i := int64(1); i <= 3; i++ {
+				So(ds.Put(c, child(i)), ShouldBeNil)
+				tc.Add(time.Second)
+			}
+			So(ds.Put(c, child(4)), ShouldErrLike, timeout)
+
+			// The first write leaves the window.
+			tc.Add(time.Minute - 3*time.Second)
+			So(ds.Put(c, child(4)), ShouldBeNil)
+			So(ds.Put(c, child(5)), ShouldErrLike, timeout)
+		})
+	})
+}
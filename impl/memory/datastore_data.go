@@ -19,12 +19,17 @@ import (
 	"crypto/sha256"
 	"encoding/binary"
 	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"sort"
 	"strings"
 	"sync"
+	"time"
 
 	prodConstraints "go.chromium.org/gae/impl/prod/constraints"
 	ds "go.chromium.org/gae/service/datastore"
 	"go.chromium.org/gae/service/datastore/serialize"
+	"go.chromium.org/luci/common/clock"
 	"go.chromium.org/luci/common/errors"
 
 	"golang.org/x/net/context"
@@ -33,17 +38,37 @@ import (
 //////////////////////////////// dataStoreData /////////////////////////////////
 
 type dataStoreData struct {
-	// Protects internal guts of this object, including overall consistency of the
-	// memStore.
+	// Protects internal guts of this object: the settings, and which memStore is
+	// head. Reads and writes of entities hold it for reading, so they may proceed
+	// concurrently. Operations on the datastore as a whole (building indexes,
+	// restoring snapshots, changing settings) hold it for writing.
+	//
+	// Locks are always taken in this order: rwlock, groupLocks, idLock,
+	// headLock.
+	rwlock sync.RWMutex
+
+	// groupLocks serialize the writes to each entity group (see lockGroups), so
+	// that the current value of an entity can't change while a write to it is
+	// being prepared.
+	groupLocks [numGroupLocks]sync.Mutex
+
+	// idLock serializes the allocation of IDs.
+	idLock sync.Mutex
+
+	// Protects the overall consistency of head.
 	//
 	// While memStore is consistent by itself, each individual datastore mutation
 	// (puts and deletes) actually translate into multiple memStore modifications
 	// (for example, putting an entity updates this entity's data as well as
-	// entity group version metadata entity). Thus we need additional lock around
-	// such "batch" head modifications to ensure their consistency. In particular,
-	// it is very important that any snapshots are taken under the reader lock, to
-	// make sure we are not snapshotting some intermediary inconsistent state.
-	rwlock sync.RWMutex
+	// entity group version metadata entity). Thus writes are first prepared
+	// (see prepareWrite), and then applied to head holding headLock for writing.
+	// Snapshots of head are taken holding it for reading, to make sure we are not
+	// snapshotting some intermediary inconsistent state; reads from a snapshot
+	// then need no lock at all.
+	//
+	// headLock also protects the state which is updated along with head: snap,
+	// unapplied, groupWrites and history.
+	headLock sync.RWMutex
 
 	// the 'appid' of this datastore
 	aid string
@@ -54,6 +79,15 @@ type dataStoreData struct {
 	// getQuerySnaps will return (head, head)
 	snap memStore
 
+	// consistRand decides which unapplied writes become visible to queries,
+	// with probability consistProb each. If nil, the index snapshot only changes
+	// explicitly. See SetConsistencyPolicy.
+	consistRand *rand.Rand
+	consistProb float64
+	// unapplied holds the keys of the entities written since the index snapshot
+	// was taken, by entity group. It is only maintained if consistRand is set.
+	unapplied map[string]map[string]*ds.Key
+
 	// For testing, see SetTransactionRetryCount.
 	txnFakeRetry int
 
@@ -61,6 +95,12 @@ type dataStoreData struct {
 	// and then continue instead of failing.
 	autoIndex bool
 
+	// true means that AddIndexes and DeleteIndexes only start building or
+	// deleting the indexes, which then show up in indexOps until they are
+	// completed. See datastore_index_builds.go.
+	asyncIndexBuilds bool
+	indexOps         []*indexOp
+
 	// true means that all of the __...__ keys which are normally automatically
 	// maintained will be omitted. This also means that Put with an incomplete
 	// key will become an error.
@@ -71,6 +111,27 @@ type dataStoreData struct {
 	// no way to expose them.
 	showSpecialProps bool
 
+	// true means that puts exceeding the production limits (on entity size,
+	// indexed value size, etc.) fail like they do in production.
+	strictLimits bool
+
+	// contention is the entity group contention policy, or nil if contention
+	// isn't simulated. See SetContentionPolicy.
+	contention *ds.ContentionPolicy
+	// groupWrites holds the times of the recent writes to each entity group,
+	// for the contention policy.
+	groupWrites map[string][]time.Time
+
+	// history holds the past versions of head, oldest first, for reads at a
+	// past time. Versions older than historyRetention are dropped. See
+	// datastore_history.go.
+	history          []storeVersion
+	historyRetention time.Duration
+
+	// idRand generates scattered IDs for incomplete keys. If nil, IDs are
+	// allocated sequentially. See SetIDAllocationPolicy.
+	idRand *rand.Rand
+
 	// constraints is the fake datastore constraints. By default, this will match
 	// the Constraints of the "impl/prod" datastore.
 	constraints ds.Constraints
@@ -82,12 +143,14 @@ var (
 
 func newDataStoreData(aid string) *dataStoreData {
 	head := newMemStore()
-	return &dataStoreData{
+	ret := &dataStoreData{
 		aid:         aid,
 		head:        head,
 		snap:        head.Snapshot(), // empty but better than a nil pointer.
 		constraints: prodConstraints.DS(),
 	}
+	ret.resetHistoryLocked()
+	return ret
 }
 
 func (d *dataStoreData) setTxnRetry(count int) {
@@ -97,20 +160,33 @@ func (d *dataStoreData) setTxnRetry(count int) {
 }
 
 func (d *dataStoreData) setConsistent(always bool) {
-	d.rwlock.Lock()
-	defer d.rwlock.Unlock()
-
 	if always {
-		d.snap = nil
+		d.setConsistencyPolicy(ds.StrongConsistency)
 	} else {
-		d.snap = d.head.Snapshot()
+		d.setConsistencyPolicy(ds.ManualConsistency)
 	}
 }
 
 func (d *dataStoreData) addIndexes(idxs []*ds.IndexDefinition) {
 	d.rwlock.Lock()
 	defer d.rwlock.Unlock()
+	if d.asyncIndexBuilds {
+		d.startIndexBuildsLocked(idxs)
+		return
+	}
+	d.addIndexesLocked(idxs)
+}
+
+func (d *dataStoreData) addIndexesLocked(idxs []*ds.IndexDefinition) {
+	d.dropIndexOpsLocked(idxs)
 	addIndexes(d.head, d.aid, idxs)
+	if d.consistRand != nil {
+		// Index builds aren't subject to the random consistency policy: the new
+		// indexes cover all of the writes already visible to queries.
+		idx := d.snap.Fork()
+		addIndexes(idx, d.aid, idxs)
+		d.snap = idx.Snapshot()
+	}
 }
 
 func (d *dataStoreData) setAutoIndex(enable bool) {
@@ -133,7 +209,11 @@ func (d *dataStoreData) maybeAutoIndex(err error) bool {
 		return false
 	}
 
-	d.addIndexes([]*ds.IndexDefinition{mi.Missing})
+	// Automatic indexes are always built right away, so that the query may
+	// succeed.
+	d.rwlock.Lock()
+	defer d.rwlock.Unlock()
+	d.addIndexesLocked([]*ds.IndexDefinition{mi.Missing})
 	return true
 }
 
@@ -149,6 +229,20 @@ func (d *dataStoreData) getDisableSpecialEntities() bool {
 	return d.disableSpecialEntities
 }
 
+func (d *dataStoreData) setIDAllocationPolicy(p ds.IDAllocationPolicy) {
+	d.rwlock.Lock()
+	defer d.rwlock.Unlock()
+
+	switch seed, seeded := p.Seed(); {
+	case !p.Scattered():
+		d.idRand = nil
+	case seeded:
+		d.idRand = rand.New(rand.NewSource(seed))
+	default:
+		d.idRand = rand.New(rand.NewSource(time.Now().UnixNano()))
+	}
+}
+
 func (d *dataStoreData) setShowSpecialProperties(show bool) {
 	d.rwlock.Lock()
 	defer d.rwlock.Unlock()
@@ -186,6 +280,14 @@ func (d *dataStoreData) stripSpecialPropsRunCB(cb ds.RawRunCB) ds.RawRunCB {
 func (d *dataStoreData) getQuerySnaps(consistent bool) (idx, head memStore) {
 	d.rwlock.RLock()
 	defer d.rwlock.RUnlock()
+	if d.consistRand != nil && !consistent {
+		// The random consistency policy may update the index snapshot.
+		d.headLock.Lock()
+		defer d.headLock.Unlock()
+	} else {
+		d.headLock.RLock()
+		defer d.headLock.RUnlock()
+	}
 	if d.snap == nil {
 		// we're 'always consistent'
 		snap := d.head.Snapshot()
@@ -196,6 +298,9 @@ func (d *dataStoreData) getQuerySnaps(consistent bool) (idx, head memStore) {
 	if consistent {
 		idx = head
 	} else {
+		if d.consistRand != nil {
+			d.applyRandomWritesLocked()
+		}
 		idx = d.snap
 	}
 	return
@@ -204,6 +309,14 @@ func (d *dataStoreData) getQuerySnaps(consistent bool) (idx, head memStore) {
 func (d *dataStoreData) takeSnapshot() memStore {
 	d.rwlock.RLock()
 	defer d.rwlock.RUnlock()
+	return d.headSnapshotLocked()
+}
+
+// headSnapshotLocked takes a consistent snapshot of head. Must be called with
+// rwlock held.
+func (d *dataStoreData) headSnapshotLocked() memStore {
+	d.headLock.RLock()
+	defer d.headLock.RUnlock()
 	return d.head.Snapshot()
 }
 
@@ -217,6 +330,55 @@ func (d *dataStoreData) setSnapshot(snap memStore) {
 	d.snap = snap
 }
 
+// dsSnapshot is a snapshot of the entire state of a dataStoreData.
+type dsSnapshot struct {
+	aid  string
+	head memStore
+	// idx is the index snapshot at the time, or nil if the datastore was
+	// always-consistent.
+	idx memStore
+	// indexOps are the pending index operations at the time.
+	indexOps []*indexOp
+}
+
+func (*dsSnapshot) ImATestingSnapshot() {}
+
+func (d *dataStoreData) takeFullSnapshot() *dsSnapshot {
+	d.rwlock.RLock()
+	defer d.rwlock.RUnlock()
+	d.headLock.RLock()
+	defer d.headLock.RUnlock()
+	return &dsSnapshot{
+		aid:      d.aid,
+		head:     d.head.Snapshot(),
+		idx:      d.snap,
+		indexOps: copyIndexOps(d.indexOps),
+	}
+}
+
+func (d *dataStoreData) restoreFullSnapshot(snap *dsSnapshot) {
+	d.rwlock.Lock()
+	defer d.rwlock.Unlock()
+	d.head = snap.head.Fork()
+	d.indexOps = copyIndexOps(snap.indexOps)
+	d.resetHistoryLocked()
+	if d.snap == nil {
+		// we're 'always consistent'
+		return
+	}
+	if d.consistRand != nil {
+		// The unapplied writes of the snapshot aren't known, so start caught up.
+		d.resetUnappliedLocked()
+		d.snap = snap.head
+		return
+	}
+	if snap.idx != nil {
+		d.snap = snap.idx
+	} else {
+		d.snap = snap.head
+	}
+}
+
 func (d *dataStoreData) catchupIndexes() {
 	d.rwlock.Lock()
 	defer d.rwlock.Unlock()
@@ -225,6 +387,7 @@ func (d *dataStoreData) catchupIndexes() {
 		return
 	}
 	d.snap = d.head.Snapshot()
+	d.resetUnappliedLocked()
 }
 
 func (d *dataStoreData) namespaces() []string {
@@ -252,6 +415,14 @@ func groupMetaKey(key *ds.Key) []byte {
 	return keyBytes(ds.MkKeyContext("", "").NewKey("__entity_group__", "", 1, key.Root()))
 }
 
+// groupID returns a string identifying the entity group of key, including its
+// namespace.
+func groupID(key *ds.Key) string {
+	root := key.Root()
+	// Namespaces can't contain NUL, so this is unambiguous.
+	return root.Namespace() + "\x00" + string(keyBytes(root))
+}
+
 func groupIDsKey(key *ds.Key) []byte {
 	return keyBytes(ds.MkKeyContext("", "").NewKey("__entity_group_ids__", "", 1, key.Root()))
 }
@@ -289,20 +460,28 @@ func incrementLocked(ents memCollection, key []byte, amt int) int64 {
 }
 
 func (d *dataStoreData) allocateIDs(keys []*ds.Key, cb ds.NewKeyCB) error {
-	// Map keys by entity type.
+	// Map keys by entity type, remembering the order in which the types first
+	// appear, so that seeded scattered IDs are reproducible.
+	var order []string
 	entityMap := make(map[string][]int)
 	for i, key := range keys {
 		ks := key.String()
+		if _, ok := entityMap[ks]; !ok {
+			order = append(order, ks)
+		}
 		entityMap[ks] = append(entityMap[ks], i)
 	}
 
 	// Allocate IDs for our keys. We use an inline function so we can ensure that
 	// the lock is released.
 	err := func() error {
-		d.rwlock.Lock()
-		defer d.rwlock.Unlock()
+		d.rwlock.RLock()
+		defer d.rwlock.RUnlock()
+		d.idLock.Lock()
+		defer d.idLock.Unlock()
 
-		for _, idxs := range entityMap {
+		for _, ks := range order {
+			idxs := entityMap[ks]
 			baseKey := keys[idxs[0]]
 
 			ents := d.head.GetOrCreateCollection("ents:" + baseKey.Namespace())
@@ -310,13 +489,13 @@ func (d *dataStoreData) allocateIDs(keys []*ds.Key, cb ds.NewKeyCB) error {
 			// Allocate IDs. The only possible error is when disableSpecialEntities is
 			// true, in which case we will return a full method error instead of
 			// individual callback errors.
-			start, err := d.allocateIDsLocked(ents, baseKey, len(idxs))
+			ids, err := d.allocateIDsLocked(ents, baseKey, len(idxs))
 			if err != nil {
 				return err
 			}
 
 			for i, idx := range idxs {
-				keys[idx] = baseKey.WithID("", start+int64(i))
+				keys[idx] = baseKey.WithID("", ids[i])
 			}
 		}
 		return nil
@@ -332,9 +511,33 @@ func (d *dataStoreData) allocateIDs(keys []*ds.Key, cb ds.NewKeyCB) error {
 	return nil
 }
 
-func (d *dataStoreData) allocateIDsLocked(ents memCollection, incomplete *ds.Key, n int) (int64, error) {
+// maxScatteredID is the exclusive upper bound of scattered IDs. Like in
+// production, IDs fit into 53 bits, so that they can be represented exactly
+// as floating point numbers (e.g. in JavaScript).
+const maxScatteredID = 1 << 53
+
+// allocateIDsLocked must be called with rwlock and idLock held.
+func (d *dataStoreData) allocateIDsLocked(ents memCollection, incomplete *ds.Key, n int) ([]int64, error) {
 	if d.disableSpecialEntities {
-		return 0, errors.New("disableSpecialEntities is true so allocateIDs is disabled")
+		return nil, errors.New("disableSpecialEntities is true so allocateIDs is disabled")
+	}
+
+	ids := make([]int64, n)
+	if d.idRand != nil {
+		// Skip IDs which are already taken, either by an existing entity or
+		// earlier in this batch.
+		taken := make(map[int64]bool, n)
+		for i := range ids {
+			for {
+				id := d.idRand.Int63n(maxScatteredID-1) + 1
+				if !taken[id] && ents.Get(keyBytes(incomplete.WithID("", id))) == nil {
+					taken[id] = true
+					ids[i] = id
+					break
+				}
+			}
+		}
+		return ids, nil
 	}
 
 	idKey := []byte(nil)
@@ -343,71 +546,172 @@ func (d *dataStoreData) allocateIDsLocked(ents memCollection, incomplete *ds.Key
 	} else {
 		idKey = groupIDsKey(incomplete)
 	}
-	return incrementLocked(ents, idKey, n), nil
+	start := incrementLocked(ents, idKey, n)
+	for i := range ids {
+		ids[i] = start + int64(i)
+	}
+	return ids, nil
 }
 
-func (d *dataStoreData) fixKeyLocked(ents memCollection, key *ds.Key) (*ds.Key, error) {
+// fixKeyLocked allocates an ID for key, if it's incomplete. Must be called with
+// rwlock held.
+func (d *dataStoreData) fixKeyLocked(key *ds.Key) (*ds.Key, error) {
 	if key.IsIncomplete() {
-		id, err := d.allocateIDsLocked(ents, key, 1)
+		d.idLock.Lock()
+		defer d.idLock.Unlock()
+		ents := d.head.GetOrCreateCollection("ents:" + key.Namespace())
+		ids, err := d.allocateIDsLocked(ents, key, 1)
 		if err != nil {
 			return key, err
 		}
-		key = key.KeyContext().NewKey(key.Kind(), "", id, key.Parent())
+		key = key.KeyContext().NewKey(key.Kind(), "", ids[0], key.Parent())
 	}
 	return key, nil
 }
 
 func (d *dataStoreData) fixKey(key *ds.Key) (*ds.Key, error) {
 	if key.IsIncomplete() {
-		d.rwlock.Lock()
-		defer d.rwlock.Unlock()
-		ents := d.head.GetOrCreateCollection("ents:" + key.Namespace())
-		return d.fixKeyLocked(ents, key)
+		d.rwlock.RLock()
+		defer d.rwlock.RUnlock()
+		return d.fixKeyLocked(key)
 	}
 	return key, nil
 }
 
-func (d *dataStoreData) putMulti(keys []*ds.Key, vals []ds.PropertyMap, cb ds.NewKeyCB, lockedAlready bool) error {
-	ns := keys[0].Namespace()
+// numGroupLocks is the number of locks the entity groups are spread over.
+// Writes to entity groups which share a lock are serialized.
+const numGroupLocks = 64
+
+// lockGroups locks the entity groups of the given keys, and returns a function
+// which unlocks them. Must be called with rwlock held.
+//
+// The locks are taken in a fixed order, so that concurrent commits to
+// overlapping sets of entity groups can't deadlock.
+func (d *dataStoreData) lockGroups(keys []*ds.Key) func() {
+	var locks []int
+	seen := make(map[int]bool, len(keys))
+	for _, k := range keys {
+		h := fnv.New32a()
+		h.Write([]byte(groupID(k)))
+		i := int(h.Sum32() % numGroupLocks)
+		if !seen[i] {
+			seen[i] = true
+			locks = append(locks, i)
+		}
+	}
+	sort.Ints(locks)
+
+	for _, i := range locks {
+		d.groupLocks[i].Lock()
+	}
+	return func() {
+		for j := len(locks) - 1; j >= 0; j-- {
+			d.groupLocks[locks[j]].Unlock()
+		}
+	}
+}
+
+// entityWrite is a put or a delete of an entity, prepared by prepareWrite to
+// be applied to head by applyWriteLocked.
+type entityWrite struct {
+	key     *ds.Key
+	keyBlob []byte
+	// data is the serialized new value of the entity, or nil for a delete.
+	data []byte
+	// existed is true if the entity existed before the write.
+	existed bool
+	// oldIdx and newIdx are the index rows of the entity before and after the
+	// write.
+	oldIdx, newIdx memStore
+}
+
+// prepareWrite prepares writing pm to the entity with the given complete key,
+// or deleting it if pm is nil: it does all of the work which doesn't modify
+// head, so that it may be done concurrently with other writes.
+//
+// Must be called with rwlock held and the entity group of key locked, so that
+// the entity and the compound indexes can't change until the write is applied.
+func (d *dataStoreData) prepareWrite(key *ds.Key, pm ds.PropertyMap) (*entityWrite, error) {
+	w := &entityWrite{key: key, keyBlob: keyBytes(key)}
+
+	var oldPM ds.PropertyMap
+	if ents := d.head.GetCollection("ents:" + key.Namespace()); ents != nil {
+		if old := ents.Get(w.keyBlob); old != nil {
+			var err error
+			if oldPM, err = readPropMap(old); err != nil {
+				return nil, err
+			}
+			w.existed = true
+		}
+	}
+
+	if pm != nil {
+		// Now that we have the complete key, we can use it to generate special
+		// __scatter__ property, which is a function of the key. We can't
+		// serialize pm to bytes until we've done this step.
+		ensureSpecialProps(w.keyBlob, pm)
+		w.data = serialize.ToBytesWithContext(pm)
+	}
+
+	var compIdx []*ds.IndexDefinition
+	walkCompIdxs(d.head.Snapshot(), nil, func(i *ds.IndexDefinition) bool {
+		compIdx = append(compIdx, i)
+		return true
+	})
+	w.oldIdx = indexEntriesWithBuiltins(key, oldPM, compIdx)
+	w.newIdx = indexEntriesWithBuiltins(key, pm, compIdx)
+	return w, nil
+}
+
+// applyWriteLocked applies a prepared write to head. Must be called with
+// headLock held for writing, in addition to the locks needed by prepareWrite.
+func (d *dataStoreData) applyWriteLocked(w *entityWrite) {
+	ents := d.head.GetOrCreateCollection("ents:" + w.key.Namespace())
+	if !d.disableSpecialEntities {
+		incrementLocked(ents, groupMetaKey(w.key), 1)
+	}
+	switch {
+	case w.data != nil:
+		ents.Set(w.keyBlob, w.data)
+	case w.existed:
+		ents.Delete(w.keyBlob)
+	default:
+		return // deleting an entity which doesn't exist
+	}
+	mergeIndexes(w.key.Namespace(), d.head, w.oldIdx, w.newIdx)
+	d.recordWriteLocked(w.key)
+}
+
+func (d *dataStoreData) putMulti(keys []*ds.Key, vals []ds.PropertyMap, cb ds.NewKeyCB, now time.Time) error {
+	groups := map[string]error{}
 
 	for i, k := range keys {
 		newPM, _ := vals[i].Save(false)
 
 		k, err := func() (key *ds.Key, err error) {
-			if !lockedAlready {
-				d.rwlock.Lock()
-				defer d.rwlock.Unlock()
-			}
+			d.rwlock.RLock()
+			defer d.rwlock.RUnlock()
 
-			ents := d.head.GetOrCreateCollection("ents:" + ns)
+			if key, err = d.fixKeyLocked(k); err != nil {
+				return
+			}
+			defer d.lockGroups([]*ds.Key{key})()
 
-			key, err = d.fixKeyLocked(ents, k)
-			if err != nil {
+			if err = d.checkLimitsLocked(key, newPM); err != nil {
 				return
 			}
-			if !d.disableSpecialEntities {
-				incrementLocked(ents, groupMetaKey(key), 1)
+			w, err := d.prepareWrite(key, newPM)
+			if err != nil {
+				return
 			}
-			keyBlob := keyBytes(key)
-
-			// Now that we have the complete key, we can use it to generate special
-			// __scatter__ property, which is a function of the key. We can't
-			// serialize newPM to bytes until we've done this step. Thus we do the
-			// serialization under the lock.
-			//
-			// If this is undesirable, this code can be restructured to grab the lock
-			// twice: once to generate the key, and the second time to actually store
-			// the entity and update indexes.
-			ensureSpecialProps(keyBlob, newPM)
-
-			var oldPM ds.PropertyMap
-			if old := ents.Get(keyBlob); old != nil {
-				if oldPM, err = readPropMap(old); err != nil {
-					return
-				}
+
+			d.headLock.Lock()
+			defer d.headLock.Unlock()
+			if err = d.checkGroupWriteLocked(key, now, groups); err != nil {
+				return
 			}
-			ents.Set(keyBlob, serialize.ToBytesWithContext(newPM))
-			updateIndexes(d.head, key, oldPM, newPM)
+			d.applyWriteLocked(w)
+			d.recordVersionLocked(now)
 			return
 		}()
 		if cb != nil {
@@ -444,51 +748,33 @@ func (d *dataStoreData) getMulti(keys []*ds.Key, cb ds.GetMultiCB) error {
 	return nil
 }
 
-func (d *dataStoreData) delMulti(keys []*ds.Key, cb ds.DeleteMultiCB, lockedAlready bool) error {
-	ns := keys[0].Namespace()
-
-	hasEntsInNS := func() bool {
-		if !lockedAlready {
-			d.rwlock.Lock()
-			defer d.rwlock.Unlock()
-		}
-		return d.head.GetOrCreateCollection("ents:"+ns) != nil
-	}()
-
-	if hasEntsInNS {
-		for i, k := range keys {
-			err := func() error {
-				kb := keyBytes(k)
+func (d *dataStoreData) delMulti(keys []*ds.Key, cb ds.DeleteMultiCB, now time.Time) error {
+	groups := map[string]error{}
 
-				if !lockedAlready {
-					d.rwlock.Lock()
-					defer d.rwlock.Unlock()
-				}
+	for i, k := range keys {
+		err := func() error {
+			d.rwlock.RLock()
+			defer d.rwlock.RUnlock()
+			defer d.lockGroups([]*ds.Key{k})()
 
-				ents := d.head.GetOrCreateCollection("ents:" + ns)
+			w, err := d.prepareWrite(k, nil)
+			if err != nil {
+				return err
+			}
 
-				if !d.disableSpecialEntities {
-					incrementLocked(ents, groupMetaKey(k), 1)
-				}
-				if old := ents.Get(kb); old != nil {
-					oldPM, err := readPropMap(old)
-					if err != nil {
-						return err
-					}
-					ents.Delete(kb)
-					updateIndexes(d.head, k, oldPM, nil)
-				}
-				return nil
-			}()
-			if cb != nil {
-				if err := cb(i, err); err != nil {
-					return err
-				}
+			d.headLock.Lock()
+			defer d.headLock.Unlock()
+			if err := d.checkGroupWriteLocked(k, now, groups); err != nil {
+				return err
 			}
-		}
-	} else if cb != nil {
-		for i := range keys {
-			if err := cb(i, nil); err != nil {
+			d.applyWriteLocked(w)
+			if w.existed {
+				d.recordVersionLocked(now)
+			}
+			return nil
+		}()
+		if cb != nil {
+			if err := cb(i, err); err != nil {
 				return err
 			}
 		}
@@ -502,10 +788,21 @@ func (d *dataStoreData) beginCommit(c context.Context, obj memContextObj) txnCom
 	txn := obj.(*txnDataStoreData)
 
 	txn.lock.Lock()
-	d.rwlock.Lock()
+	d.rwlock.RLock()
+
+	// Only lock the entity groups written to, so that commits to other entity
+	// groups may proceed concurrently.
+	var written []*ds.Key
+	for _, muts := range txn.muts {
+		if len(muts) > 0 {
+			written = append(written, muts[0].key)
+		}
+	}
+	unlockGroups := d.lockGroups(written)
 
 	unlock := func() {
-		d.rwlock.Unlock()
+		unlockGroups()
+		d.rwlock.RUnlock()
 		txn.lock.Unlock()
 	}
 
@@ -533,35 +830,74 @@ func (d *dataStoreData) beginCommit(c context.Context, obj memContextObj) txnCom
 		}
 	}
 
+	// Check for simulated contention.
+	now := clock.Now(c)
+	var groups []string
+	contended := func() bool {
+		d.headLock.Lock()
+		defer d.headLock.Unlock()
+		for _, k := range written {
+			gid := groupID(k)
+			if d.groupContendedLocked(gid, now) {
+				return true
+			}
+			groups = append(groups, gid)
+		}
+		return false
+	}()
+	if contended {
+		unlock()
+		return nil
+	}
+
 	return &txnCommitCallback{
 		unlock: unlock,
 		apply: func() {
+			// Prepare all of the writes before applying any, so that the whole
+			// transaction becomes visible at once.
+			var writes []*entityWrite
 			for _, muts := range txn.muts {
-				if len(muts) == 0 { // read-only
-					continue
+				// Only the last mutation of each entity matters.
+				last := make(map[string]int, len(muts))
+				for i, m := range muts {
+					last[string(keyBytes(m.key))] = i
 				}
-				// TODO(riannucci): refactor to do just 1 putMulti, and 1 delMulti
-				for _, m := range muts {
-					if m.data == nil {
-						impossible(d.delMulti([]*ds.Key{m.key},
-							func(_ int, e error) error { return e }, true))
-					} else {
-						impossible(d.putMulti([]*ds.Key{m.key}, []ds.PropertyMap{m.data},
-							func(_ int, _ *ds.Key, e error) error { return e }, true))
+				for i, m := range muts {
+					if last[string(keyBytes(m.key))] != i {
+						continue
 					}
+					w, err := d.prepareWrite(m.key, m.data)
+					impossible(err)
+					writes = append(writes, w)
 				}
 			}
+
+			d.headLock.Lock()
+			defer d.headLock.Unlock()
+			for _, gid := range groups {
+				d.recordGroupWriteLocked(gid, now)
+			}
+			for _, w := range writes {
+				d.applyWriteLocked(w)
+			}
+			if len(writes) > 0 {
+				d.recordVersionLocked(now)
+			}
 		},
 	}
 }
 
-func (d *dataStoreData) mkTxn(o *ds.TransactionOptions) memContextObj {
+func (d *dataStoreData) mkTxn(o *txnOptions) memContextObj {
+	snap := o.readStore
+	if snap == nil {
+		snap = d.takeSnapshot()
+	}
 	return &txnDataStoreData{
 		// alias to the main datastore's so that testing code can have primitive
 		// access to break features inside of transactions.
 		parent: d,
-		txn:    &transactionImpl{},
-		snap:   d.takeSnapshot(),
+		txn:    &transactionImpl{readOnly: o.o != nil && o.o.ReadOnly},
+		snap:   snap,
 		muts:   map[string][]txnMutation{},
 	}
 }
@@ -598,7 +934,7 @@ func (td *txnDataStoreData) endTxn() {
 	}
 }
 
-func (*txnDataStoreData) mkTxn(*ds.TransactionOptions) memContextObj {
+func (*txnDataStoreData) mkTxn(*txnOptions) memContextObj {
 	impossible(fmt.Errorf("cannot create a recursive transaction"))
 	return nil
 }
@@ -655,6 +991,10 @@ func (td *txnDataStoreData) writeMutation(getOnly bool, key *ds.Key, data ds.Pro
 func (td *txnDataStoreData) putMulti(keys []*ds.Key, vals []ds.PropertyMap, cb ds.NewKeyCB) {
 	for i, k := range keys {
 		k, err := td.parent.fixKey(k)
+		if err == nil {
+			pm, _ := vals[i].Save(false)
+			err = td.parent.checkLimits(k, pm)
+		}
 		if err == nil {
 			err = td.writeMutation(false, k, vals[i])
 		}
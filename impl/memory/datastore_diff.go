@@ -0,0 +1,168 @@
+// Copyright 2018 The LUCI Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package memory
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+
+	ds "go.chromium.org/gae/service/datastore"
+	"go.chromium.org/gae/service/datastore/serialize"
+)
+
+// DiffOptions controls which changes DiffSnapshots reports.
+type DiffOptions struct {
+	// IgnoreKinds lists kinds whose entities are left out of the diff.
+	IgnoreKinds []string
+
+	// IgnoreProperties lists names of properties (e.g. modification
+	// timestamps) which are left out of the comparison, in entities of any
+	// kind. An entity whose only changes are in ignored properties is not
+	// reported as modified.
+	IgnoreProperties []string
+}
+
+// StateDiff describes the changes between two snapshots of the datastore.
+//
+// The entities in each list are ordered by namespace and key.
+type StateDiff struct {
+	Added    []*EntityDiff
+	Removed  []*EntityDiff
+	Modified []*EntityDiff
+}
+
+// EntityDiff describes how a single entity changed.
+type EntityDiff struct {
+	Key *ds.Key
+
+	// Before and After are the entity before and after the change. Before is
+	// nil for added entities, and After is nil for removed ones.
+	Before ds.PropertyMap
+	After  ds.PropertyMap
+
+	// Properties lists the properties which changed, ordered by name.
+	Properties []*ds.PropertyDiff
+}
+
+// DiffSnapshots compares two snapshots of the same memory datastore, taken with
+// Testable.Snapshot, and returns the entities which were added, removed or
+// modified between them.
+//
+// Entities of special kinds (like __entity_group__) and special properties
+// (like __scatter__) are never reported. Property values are compared as by
+// ds.DiffPropertyMaps.
+func DiffSnapshots(before, after ds.TestingSnapshot, opts *DiffOptions) *StateDiff {
+	if opts == nil {
+		opts = &DiffOptions{}
+	}
+	b, a := before.(*dsSnapshot), after.(*dsSnapshot)
+
+	ignoreKinds := stringSet(opts.IgnoreKinds)
+
+	nsSet := stringSet(namespaces(b.head))
+	for _, ns := range namespaces(a.head) {
+		nsSet[ns] = true
+	}
+	nss := make([]string, 0, len(nsSet))
+	for ns := range nsSet {
+		nss = append(nss, ns)
+	}
+	sort.Strings(nss)
+
+	ret := &StateDiff{}
+	for _, ns := range nss {
+		kc := ds.MkKeyContext(a.aid, ns)
+		coll := "ents:" + ns
+		memStoreCollide(b.head.GetCollection(coll), a.head.GetCollection(coll), func(k, ov, nv []byte) {
+			if bytes.Equal(ov, nv) {
+				return
+			}
+
+			prop, err := serialize.ReadProperty(bytes.NewBuffer(k), serialize.WithoutContext, kc)
+			memoryCorruption(err)
+			key := prop.Value().(*ds.Key)
+			if isSpecialKind(key.Kind()) || ignoreKinds[key.Kind()] {
+				return
+			}
+
+			ed := &EntityDiff{Key: key}
+			if ov != nil {
+				ed.Before, err = readPropMap(ov)
+				memoryCorruption(err)
+				stripSpecialProps(ed.Before)
+			}
+			if nv != nil {
+				ed.After, err = readPropMap(nv)
+				memoryCorruption(err)
+				stripSpecialProps(ed.After)
+			}
+			ed.Properties = ds.DiffPropertyMaps(ed.Before, ed.After, opts.IgnoreProperties...)
+
+			switch {
+			case ov == nil:
+				ret.Added = append(ret.Added, ed)
+			case nv == nil:
+				ret.Removed = append(ret.Removed, ed)
+			case len(ed.Properties) > 0:
+				ret.Modified = append(ret.Modified, ed)
+			}
+		})
+	}
+	return ret
+}
+
+func stringSet(s []string) map[string]bool {
+	ret := make(map[string]bool, len(s))
+	for _, v := range s {
+		ret[v] = true
+	}
+	return ret
+}
+
+// Empty returns true iff there are no changes.
+func (d *StateDiff) Empty() bool {
+	return len(d.Added) == 0 && len(d.Removed) == 0 && len(d.Modified) == 0
+}
+
+// String renders the diff in a human readable form: one line per added ("+"),
+// removed ("-") or modified ("*") entity, each followed by one line per changed
+// property, like "Val: 1 -> 10".
+func (d *StateDiff) String() string {
+	if d.Empty() {
+		return "(no changes)\n"
+	}
+	buf := &bytes.Buffer{}
+	for _, ed := range d.Added {
+		fmt.Fprintf(buf, "+ %s\n", ed.Key)
+		for _, pd := range ed.Properties {
+			fmt.Fprintf(buf, "    %s: %s\n", pd.Name, ds.FormatPropertySlice(pd.After))
+		}
+	}
+	for _, ed := range d.Removed {
+		fmt.Fprintf(buf, "- %s\n", ed.Key)
+		for _, pd := range ed.Properties {
+			fmt.Fprintf(buf, "    %s: %s\n", pd.Name, ds.FormatPropertySlice(pd.Before))
+		}
+	}
+	for _, ed := range d.Modified {
+		fmt.Fprintf(buf, "* %s\n", ed.Key)
+		for _, pd := range ed.Properties {
+			fmt.Fprintf(buf, "    %s: %s -> %s\n", pd.Name,
+				ds.FormatPropertySlice(pd.Before), ds.FormatPropertySlice(pd.After))
+		}
+	}
+	return buf.String()
+}
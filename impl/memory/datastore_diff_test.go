@@ -0,0 +1,129 @@
+// Copyright 2018 The LUCI Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package memory
+
+import (
+	"testing"
+
+	ds "go.chromium.org/gae/service/datastore"
+	infoS "go.chromium.org/gae/service/info"
+
+	"golang.org/x/net/context"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestDiffSnapshots(t *testing.T) {
+	t.Parallel()
+
+	Convey("DiffSnapshots", t, func() {
+		c := Use(context.Background())
+		tst := ds.GetTestable(c)
+
+		put := func(c context.Context, kind string, id int64, props ...interface{}) {
+			pm := ds.PropertyMap{"$key": ds.MkPropertyNI(ds.MakeKey(c, kind, id))}
+			for i := 0; i < len(props); i += 2 {
+				pm[props[i].(string)] = ds.MkProperty(props[i+1])
+			}
+			So(ds.Put(c, pm), ShouldBeNil)
+		}
+
+		put(c, "Foo", 1, "Val", 1, "Updated", 100)
+		put(c, "Foo", 2, "Val", 2)
+		put(c, "Log", 1, "Msg", "hi")
+		before := tst.Snapshot()
+
+		Convey("no changes", func() {
+			put(c, "Foo", 1, "Val", 1, "Updated", 100) // same content, new version
+			diff := DiffSnapshots(before, tst.Snapshot(), nil)
+			So(diff.Empty(), ShouldBeTrue)
+			So(diff.String(), ShouldEqual, "(no changes)\n")
+		})
+
+		Convey("added, removed and modified", func() {
+			put(c, "Foo", 1, "Val", 10, "Updated", 200)
+			So(ds.Delete(c, ds.MakeKey(c, "Foo", 2)), ShouldBeNil)
+			put(c, "Foo", 3, "Val", 3, "Name", "three")
+			put(c, "Log", 2, "Msg", "bye")
+			put(infoS.MustNamespace(c, "ns"), "Foo", 1, "Val", 1)
+
+			diff := DiffSnapshots(before, tst.Snapshot(), nil)
+			So(diff.Empty(), ShouldBeFalse)
+			So(diff.Added, ShouldHaveLength, 3)
+			So(diff.Removed, ShouldHaveLength, 1)
+			So(diff.Modified, ShouldHaveLength, 1)
+
+			So(diff.Removed[0].Key, ShouldResemble, ds.MakeKey(c, "Foo", 2))
+			So(diff.Removed[0].After, ShouldBeNil)
+			So(diff.Removed[0].Before["Val"], ShouldResemble, ds.MkProperty(2))
+
+			mod := diff.Modified[0]
+			So(mod.Key, ShouldResemble, ds.MakeKey(c, "Foo", 1))
+			So(mod.Properties, ShouldHaveLength, 2)
+			So(mod.Properties[0], ShouldResemble, &ds.PropertyDiff{
+				Name:   "Updated",
+				Before: ds.PropertySlice{ds.MkProperty(100)},
+				After:  ds.PropertySlice{ds.MkProperty(200)},
+			})
+
+			So(diff.String(), ShouldEqual, ""+
+				"+ dev~app::/Foo,3\n"+
+				"    Name: \"three\"\n"+
+				"    Val: 3\n"+
+				"+ dev~app::/Log,2\n"+
+				"    Msg: \"bye\"\n"+
+				"+ dev~app:ns:/Foo,1\n"+
+				"    Val: 1\n"+
+				"- dev~app::/Foo,2\n"+
+				"    Val: 2\n"+
+				"* dev~app::/Foo,1\n"+
+				"    Updated: 100 -> 200\n"+
+				"    Val: 1 -> 10\n")
+
+			Convey("with filters", func() {
+				diff := DiffSnapshots(before, tst.Snapshot(), &DiffOptions{
+					IgnoreKinds:      []string{"Log"},
+					IgnoreProperties: []string{"Updated"},
+				})
+				So(diff.Added, ShouldHaveLength, 2)
+				So(diff.Modified[0].Properties, ShouldHaveLength, 1)
+				So(diff.Modified[0].Properties[0].Name, ShouldEqual, "Val")
+			})
+		})
+
+		Convey("changes only in ignored properties are not modifications", func() {
+			put(c, "Foo", 1, "Val", 1, "Updated", 300)
+			diff := DiffSnapshots(before, tst.Snapshot(), &DiffOptions{
+				IgnoreProperties: []string{"Updated"},
+			})
+			So(diff.Empty(), ShouldBeTrue)
+		})
+
+		Convey("type and index changes", func() {
+			So(ds.Put(c, ds.PropertyMap{
+				"$key": ds.MkPropertyNI(ds.MakeKey(c, "Foo", 2)),
+				"Val":  ds.MkPropertyNI(2),
+			}), ShouldBeNil)
+			put(c, "Log", 1, "Msg", []byte("hi"))
+
+			diff := DiffSnapshots(before, tst.Snapshot(), nil)
+			So(diff.String(), ShouldEqual, ""+
+				"* dev~app::/Foo,2\n"+
+				"    Val: 2 -> 2 (noindex)\n"+
+				"* dev~app::/Log,1\n"+
+				"    Msg: \"hi\" -> BLOB(\"aGk=\")\n")
+		})
+	})
+}
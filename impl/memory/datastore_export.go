@@ -0,0 +1,263 @@
+// Copyright 2018 The LUCI Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package memory
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+
+	ds "go.chromium.org/gae/service/datastore"
+	"go.chromium.org/gae/service/datastore/serialize"
+
+	"go.chromium.org/luci/common/data/cmpbin"
+	"go.chromium.org/luci/common/errors"
+)
+
+// The export format written by dataStoreData.exportData is:
+//
+//   magic ++ version ++ appID ++ indexes ++ namespaces
+//
+// Where:
+//   - magic is the cmpbin string "luci/gae/impl/memory:datastore".
+//   - version is a cmpbin uint (exportFormatVersion).
+//   - appID is a cmpbin string.
+//   - indexes is a cmpbin uint count, followed by that many compound
+//     IndexDefinitions, each serialized as cmpbin bytes.
+//   - namespaces is a cmpbin uint count, followed by, for each namespace, its
+//     name as a cmpbin string, a cmpbin uint count of rows and that many
+//     (key, value) rows of the primary table (as cmpbin bytes).
+//
+// The rows of the primary table are exported verbatim (see README.md), so the
+// export includes the __entity_group__ versions and the ID allocation counters
+// as well as the user entities. The index tables are not exported: they are
+// rebuilt from the entities and the compound index definitions on import.
+const (
+	exportMagic         = "luci/gae/impl/memory:datastore"
+	exportFormatVersion = 1
+)
+
+// isEntityGroupMetaKind returns true iff kind is one of the kinds of the
+// bookkeeping rows which live in the primary table, but which are never
+// indexed (see groupMetaKey, groupIDsKey and rootIDsKey).
+func isEntityGroupMetaKind(kind string) bool {
+	switch kind {
+	case "__entity_group__", "__entity_group_ids__", "__entity_root_ids__":
+		return true
+	}
+	return false
+}
+
+func (d *dataStoreData) exportData(w io.Writer) error {
+	// Snapshots are immutable, so only hold the lock while taking one.
+	snap := d.takeSnapshot()
+
+	bw := bufio.NewWriter(w)
+	ew := errWriter{w: bw}
+
+	ew.writeString(exportMagic)
+	ew.writeUint(exportFormatVersion)
+	ew.writeString(d.aid)
+
+	var compIdx []*ds.IndexDefinition
+	walkCompIdxs(snap, nil, func(i *ds.IndexDefinition) bool {
+		compIdx = append(compIdx, i)
+		return true
+	})
+	ew.writeUint(uint64(len(compIdx)))
+	for _, idx := range compIdx {
+		ew.writeBytes(serialize.ToBytes(*idx))
+	}
+
+	nss := namespaces(snap)
+	ew.writeUint(uint64(len(nss)))
+	for _, ns := range nss {
+		ents := snap.GetCollection("ents:" + ns)
+		count := uint64(0)
+		ents.ForEachItem(func(_, _ []byte) bool {
+			count++
+			return true
+		})
+
+		ew.writeString(ns)
+		ew.writeUint(count)
+		ents.ForEachItem(func(k, v []byte) bool {
+			ew.writeBytes(k)
+			ew.writeBytes(v)
+			return ew.err == nil
+		})
+	}
+
+	if ew.err != nil {
+		return ew.err
+	}
+	return bw.Flush()
+}
+
+func (d *dataStoreData) importData(r io.Reader) error {
+	// Load everything into a new store first, so that a bad export doesn't
+	// leave the datastore half-imported.
+	store, err := readExport(bufio.NewReader(r), d.aid)
+	if err != nil {
+		return errors.Annotate(err, "importing datastore").Err()
+	}
+
+	d.rwlock.Lock()
+	defer d.rwlock.Unlock()
+	d.head = store
+	d.indexOps = nil
+	d.resetHistoryLocked()
+	if d.snap != nil {
+		d.snap = store.Snapshot()
+		d.resetUnappliedLocked()
+	}
+	return nil
+}
+
+func readExport(r *bufio.Reader, aid string) (memStore, error) {
+	magic, _, err := cmpbin.ReadString(r)
+	if err != nil || magic != exportMagic {
+		return nil, errors.New("not a datastore export")
+	}
+	switch version, _, err := cmpbin.ReadUint(r); {
+	case err != nil:
+		return nil, err
+	case version != exportFormatVersion:
+		return nil, fmt.Errorf("unsupported export format version %d", version)
+	}
+	switch exportedAID, _, err := cmpbin.ReadString(r); {
+	case err != nil:
+		return nil, err
+	case exportedAID != aid:
+		return nil, fmt.Errorf("export is of app %q, not %q", exportedAID, aid)
+	}
+
+	store := newMemStore()
+
+	numIdx, _, err := cmpbin.ReadUint(r)
+	if err != nil {
+		return nil, err
+	}
+	var compIdx []*ds.IndexDefinition
+	for i := uint64(0); i < numIdx; i++ {
+		data, _, err := cmpbin.ReadBytes(r)
+		if err != nil {
+			return nil, err
+		}
+		idx, err := serialize.ReadIndexDefinition(bytes.NewBuffer(data))
+		if err != nil {
+			return nil, errors.Annotate(err, "bad index definition").Err()
+		}
+		compIdx = append(compIdx, &idx)
+	}
+
+	numNS, _, err := cmpbin.ReadUint(r)
+	if err != nil {
+		return nil, err
+	}
+	for i := uint64(0); i < numNS; i++ {
+		ns, _, err := cmpbin.ReadString(r)
+		if err != nil {
+			return nil, err
+		}
+		count, _, err := cmpbin.ReadUint(r)
+		if err != nil {
+			return nil, err
+		}
+		ents := store.GetOrCreateCollection("ents:" + ns)
+		for j := uint64(0); j < count; j++ {
+			k, _, err := cmpbin.ReadBytes(r)
+			if err != nil {
+				return nil, err
+			}
+			v, _, err := cmpbin.ReadBytes(r)
+			if err != nil {
+				return nil, err
+			}
+			ents.Set(k, v)
+		}
+	}
+
+	if err := rebuildIndexes(store, aid, compIdx); err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+// rebuildIndexes populates the compound index table of store with compIdx,
+// and all the index tables from the entities in the primary tables of store.
+func rebuildIndexes(store memStore, aid string, compIdx []*ds.IndexDefinition) error {
+	idxColl := store.GetOrCreateCollection("idx")
+	for _, idx := range compIdx {
+		idxColl.Set(serialize.ToBytes(*idx.Normalize().PrepForIdxTable()), []byte{})
+	}
+
+	for _, ns := range namespaces(store) {
+		kctx := ds.MkKeyContext(aid, ns)
+		var err error
+		store.Snapshot().GetCollection("ents:" + ns).ForEachItem(func(ik, iv []byte) bool {
+			var prop ds.Property
+			if prop, err = serialize.ReadProperty(bytes.NewBuffer(ik), serialize.WithoutContext, kctx); err != nil {
+				return false
+			}
+			k, ok := prop.Value().(*ds.Key)
+			if !ok {
+				err = fmt.Errorf("bad key in namespace %q", ns)
+				return false
+			}
+			if isEntityGroupMetaKind(k.Kind()) {
+				return true
+			}
+
+			var pm ds.PropertyMap
+			if pm, err = readPropMap(iv); err != nil {
+				err = errors.Annotate(err, "bad entity %s", k).Err()
+				return false
+			}
+			mergeIndexes(ns, store, newMemStore(), indexEntriesWithBuiltins(k, pm, compIdx))
+			return true
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// errWriter writes cmpbin values to w until the first error, which it
+// remembers.
+type errWriter struct {
+	w   *bufio.Writer
+	err error
+}
+
+func (ew *errWriter) writeUint(v uint64) {
+	if ew.err == nil {
+		_, ew.err = cmpbin.WriteUint(ew.w, v)
+	}
+}
+
+func (ew *errWriter) writeString(v string) {
+	if ew.err == nil {
+		_, ew.err = cmpbin.WriteString(ew.w, v)
+	}
+}
+
+func (ew *errWriter) writeBytes(v []byte) {
+	if ew.err == nil {
+		_, ew.err = cmpbin.WriteBytes(ew.w, v)
+	}
+}
@@ -0,0 +1,152 @@
+// Copyright 2018 The LUCI Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package memory
+
+import (
+	"bufio"
+	"bytes"
+	"testing"
+
+	ds "go.chromium.org/gae/service/datastore"
+	infoS "go.chromium.org/gae/service/info"
+
+	"golang.org/x/net/context"
+
+	. "github.com/smartystreets/goconvey/convey"
+	. "go.chromium.org/luci/common/testing/assertions"
+)
+
+func TestDatastoreExport(t *testing.T) {
+	t.Parallel()
+
+	Convey("Testable.Export/Import", t, func() {
+		c := UseWithAppID(context.Background(), "aid")
+		ds.GetTestable(c).Consistent(true)
+		ns := infoS.MustNamespace(c, "ns")
+
+		idx := &ds.IndexDefinition{
+			Kind:   "Foo",
+			SortBy: []ds.IndexColumn{{Property: "Val"}, {Property: "Name"}},
+		}
+		ds.GetTestable(c).AddIndexes(idx)
+
+		So(ds.Put(c, []*Foo{
+			{ID: 101, Val: 1, Name: "foo"},
+			{ID: 102, Val: 2, Name: "bar"},
+			{ID: 103, Val: 2, Name: "baz"},
+		}), ShouldBeNil)
+		So(ds.Put(c, &Foo{ID: 101, Val: 3, Name: "again"}), ShouldBeNil)
+		So(ds.Put(ns, &Foo{ID: 110, Val: 2, Name: "other"}), ShouldBeNil)
+		incomplete := &Foo{Val: 2, Name: "bat"}
+		So(ds.Put(c, incomplete), ShouldBeNil)
+
+		buf := &bytes.Buffer{}
+		So(ds.GetTestable(c).Export(buf), ShouldBeNil)
+
+		c2 := UseWithAppID(context.Background(), "aid")
+		ds.GetTestable(c2).Consistent(true)
+		ns2 := infoS.MustNamespace(c2, "ns")
+		So(ds.GetTestable(c2).Import(bytes.NewReader(buf.Bytes())), ShouldBeNil)
+
+		Convey("restores entities in all namespaces", func() {
+			foo := &Foo{ID: 101}
+			So(ds.Get(c2, foo), ShouldBeNil)
+			So(foo.Name, ShouldEqual, "again")
+
+			foo = &Foo{ID: 110}
+			So(ds.Get(ns2, foo), ShouldBeNil)
+			So(foo.Name, ShouldEqual, "other")
+		})
+
+		Convey("rebuilds builtin and compound indexes", func() {
+			var names []string
+			q := ds.NewQuery("Foo").Eq("Val", 2).Gte("Name", "bar")
+			So(ds.Run(c2, q, func(f *Foo) { names = append(names, f.Name) }), ShouldBeNil)
+			So(names, ShouldResemble, []string{"bar", "bat", "baz"})
+
+			names = nil
+			So(ds.Run(ns2, q, func(f *Foo) { names = append(names, f.Name) }), ShouldBeNil)
+			So(names, ShouldResemble, []string{"other"})
+
+			cnt, err := ds.Count(c2, ds.NewQuery("Foo").Eq("Name", "again"))
+			So(err, ShouldBeNil)
+			So(cnt, ShouldEqual, 1)
+		})
+
+		Convey("restores entity group versions", func() {
+			pm := ds.PropertyMap{"$key": ds.MkPropertyNI(ds.MakeKey(c2, "Foo", 101, "__entity_group__", 1))}
+			So(ds.Get(c2, pm), ShouldBeNil)
+			So(pm.Slice("__version__")[0].Value(), ShouldEqual, 2)
+		})
+
+		Convey("restores ID allocation state", func() {
+			f := &Foo{Val: 100}
+			So(ds.Put(c2, f), ShouldBeNil)
+			So(f.ID, ShouldEqual, incomplete.ID+1)
+		})
+
+		Convey("is deterministic", func() {
+			again := &bytes.Buffer{}
+			So(ds.GetTestable(c2).Export(again), ShouldBeNil)
+			So(again.Bytes(), ShouldResemble, buf.Bytes())
+		})
+
+		Convey("replaces existing data", func() {
+			c3 := UseWithAppID(context.Background(), "aid")
+			ds.GetTestable(c3).Consistent(true)
+			So(ds.Put(c3, &Foo{ID: 99, Val: 2, Name: "zzz"}), ShouldBeNil)
+			So(ds.GetTestable(c3).Import(bytes.NewReader(buf.Bytes())), ShouldBeNil)
+
+			So(ds.Get(c3, &Foo{ID: 99}), ShouldEqual, ds.ErrNoSuchEntity)
+			cnt, err := ds.Count(c3, ds.NewQuery("Foo").Eq("Name", "zzz"))
+			So(err, ShouldBeNil)
+			So(cnt, ShouldEqual, 0)
+		})
+
+		Convey("refuses bad data", func() {
+			bad := UseWithAppID(context.Background(), "aid")
+			So(ds.Put(bad, &Foo{ID: 99}), ShouldBeNil)
+
+			So(ds.GetTestable(bad).Import(bytes.NewReader([]byte("garbage"))),
+				ShouldErrLike, "not a datastore export")
+			So(ds.GetTestable(bad).Import(bytes.NewReader(buf.Bytes()[:buf.Len()-10])),
+				ShouldErrLike, "importing datastore")
+
+			// The datastore is unchanged.
+			So(ds.Get(bad, &Foo{ID: 99}), ShouldBeNil)
+			So(ds.Get(bad, &Foo{ID: 102}), ShouldEqual, ds.ErrNoSuchEntity)
+		})
+
+		Convey("refuses bogus counts", func() {
+			bogus := &bytes.Buffer{}
+			ew := errWriter{w: bufio.NewWriter(bogus)}
+			ew.writeString(exportMagic)
+			ew.writeUint(exportFormatVersion)
+			ew.writeString("aid")
+			ew.writeUint(1 << 62) // number of compound indexes
+			So(ew.err, ShouldBeNil)
+			So(ew.w.Flush(), ShouldBeNil)
+
+			bad := UseWithAppID(context.Background(), "aid")
+			So(ds.GetTestable(bad).Import(bogus), ShouldErrLike, "importing datastore")
+		})
+
+		Convey("refuses exports of other apps", func() {
+			other := UseWithAppID(context.Background(), "other")
+			So(ds.GetTestable(other).Import(bytes.NewReader(buf.Bytes())),
+				ShouldErrLike, `export is of app "aid", not "other"`)
+		})
+	})
+}
@@ -0,0 +1,113 @@
+// Copyright 2018 The LUCI Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package memory
+
+import (
+	"sort"
+	"time"
+
+	"go.chromium.org/luci/common/errors"
+)
+
+// storeVersion is the state of head as of some time.
+//
+// Since memStore snapshots share their structure with head, keeping a version
+// only costs the memory of the entities which were changed since.
+type storeVersion struct {
+	ts    time.Time
+	store memStore
+}
+
+// resetHistoryLocked makes the current state of head the only version in the
+// history, valid since forever.
+func (d *dataStoreData) resetHistoryLocked() {
+	if d.historyRetention <= 0 {
+		d.history = nil
+		return
+	}
+	d.history = []storeVersion{{store: d.head.Snapshot()}}
+}
+
+func (d *dataStoreData) setHistoryRetention(retention time.Duration) {
+	d.rwlock.Lock()
+	defer d.rwlock.Unlock()
+	d.historyRetention = retention
+	if retention <= 0 || d.history == nil {
+		d.resetHistoryLocked()
+	}
+}
+
+// recordVersionLocked adds the current state of head, as of now, to the
+// history, and forgets the versions which are no longer needed. Must be called
+// with headLock held for writing, or with rwlock held for writing.
+func (d *dataStoreData) recordVersionLocked(now time.Time) {
+	if d.historyRetention <= 0 {
+		return
+	}
+
+	v := storeVersion{now, d.head.Snapshot()}
+	if n := len(d.history); n > 0 && !d.history[n-1].ts.Before(now) {
+		// Several writes at the same instant (or the clock went backwards): only
+		// the last state counts.
+		v.ts = d.history[n-1].ts
+		d.history[n-1] = v
+	} else {
+		d.history = append(d.history, v)
+	}
+
+	// Keep the newest version older than the retention window: it is the state
+	// at the beginning of the window.
+	cutoff := now.Add(-d.historyRetention)
+	i := 0
+	for i+1 < len(d.history) && !d.history[i+1].ts.After(cutoff) {
+		i++
+	}
+	if i > 0 {
+		d.history = append([]storeVersion(nil), d.history[i:]...)
+	}
+}
+
+// storeAt returns the state of the datastore at time t, as seen at now.
+func (d *dataStoreData) storeAt(now, t time.Time) (memStore, error) {
+	d.rwlock.RLock()
+	defer d.rwlock.RUnlock()
+	d.headLock.RLock()
+	defer d.headLock.RUnlock()
+
+	switch {
+	case t.After(now):
+		return nil, errors.Reason("datastore: read time %s is in the future", t).Err()
+	case d.historyRetention <= 0:
+		return nil, errors.Reason("datastore: reads at a past time are disabled, see SetReadTimeRetention").Err()
+	case t.Before(now.Add(-d.historyRetention)):
+		return nil, errors.Reason("datastore: read time %s is older than the retention period (%s)",
+			t, d.historyRetention).Err()
+	}
+
+	return d.versionAtLocked(t), nil
+}
+
+// versionAtLocked returns the state of the datastore at time t, or the oldest
+// state in the history if t is older than that.
+func (d *dataStoreData) versionAtLocked(t time.Time) memStore {
+	if len(d.history) == 0 {
+		return d.head.Snapshot()
+	}
+	i := sort.Search(len(d.history), func(i int) bool { return d.history[i].ts.After(t) })
+	if i == 0 {
+		i = 1
+	}
+	return d.history[i-1].store
+}
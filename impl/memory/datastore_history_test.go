@@ -0,0 +1,124 @@
+// Copyright 2018 The LUCI Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package memory
+
+import (
+	"testing"
+	"time"
+
+	ds "go.chromium.org/gae/service/datastore"
+
+	"go.chromium.org/luci/common/clock/testclock"
+
+	"golang.org/x/net/context"
+
+	. "github.com/smartystreets/goconvey/convey"
+	. "go.chromium.org/luci/common/testing/assertions"
+)
+
+func TestReadTime(t *testing.T) {
+	t.Parallel()
+
+	Convey("Reads at a past time", t, func() {
+		t0 := testclock.TestRecentTimeUTC
+		c, tc := testclock.UseTime(context.Background(), t0)
+		c = Use(c)
+
+		// The history is off by default.
+		So(ds.Get(ds.WithReadTime(c, t0), &Foo{ID: 1}), ShouldErrLike, "reads at a past time are disabled")
+		ds.GetTestable(c).SetReadTimeRetention(time.Hour)
+
+		So(ds.Put(c, &Foo{ID: 1, Val: 1}), ShouldBeNil)
+		tc.Add(time.Minute)
+		t1 := tc.Now()
+		So(ds.Put(c, []*Foo{{ID: 1, Val: 2}, {ID: 2, Val: 2}}), ShouldBeNil)
+		tc.Add(time.Minute)
+		So(ds.Delete(c, ds.MakeKey(c, "Foo", 1)), ShouldBeNil)
+
+		val := func(c context.Context, id int64) int {
+			f := &Foo{ID: id}
+			switch err := ds.Get(c, f); {
+			case err == ds.ErrNoSuchEntity:
+				return -1
+			case err != nil:
+				panic(err)
+			}
+			return f.Val
+		}
+
+		Convey("Get", func() {
+			So(val(c, 1), ShouldEqual, -1)
+			So(val(ds.WithReadTime(c, t0.Add(-time.Second)), 1), ShouldEqual, -1)
+			So(val(ds.WithReadTime(c, t0), 1), ShouldEqual, 1)
+			So(val(ds.WithReadTime(c, t0.Add(30*time.Second)), 1), ShouldEqual, 1)
+			So(val(ds.WithReadTime(c, t0), 2), ShouldEqual, -1)
+			So(val(ds.WithReadTime(c, t1), 1), ShouldEqual, 2)
+			So(val(ds.WithReadTime(c, t1), 2), ShouldEqual, 2)
+			So(val(ds.WithReadTime(c, time.Time{}), 1), ShouldEqual, -1)
+		})
+
+		Convey("queries", func() {
+			count := func(c context.Context) int64 {
+				n, err := ds.Count(c, ds.NewQuery("Foo"))
+				So(err, ShouldBeNil)
+				return n
+			}
+			// Queries at a read time are consistent, even though the datastore is
+			// eventually consistent by default.
+			So(count(c), ShouldEqual, 0)
+			So(count(ds.WithReadTime(c, t0)), ShouldEqual, 1)
+			So(count(ds.WithReadTime(c, t1)), ShouldEqual, 2)
+
+			var vals []int
+			q := ds.NewQuery("Foo").Eq("Val", 2)
+			So(ds.Run(ds.WithReadTime(c, t1), q, func(f *Foo) {
+				vals = append(vals, int(f.ID))
+			}), ShouldBeNil)
+			So(vals, ShouldResemble, []int{1, 2})
+		})
+
+		Convey("in read-only transactions", func() {
+			So(ds.RunInTransaction(c, func(c context.Context) error {
+				So(val(c, 1), ShouldEqual, 1)
+				So(val(c, 2), ShouldEqual, -1)
+				return nil
+			}, &ds.TransactionOptions{ReadOnly: true, ReadTime: t0}), ShouldBeNil)
+
+			So(ds.RunInTransaction(c, func(c context.Context) error { return nil },
+				&ds.TransactionOptions{ReadTime: t0}), ShouldErrLike, "must be ReadOnly")
+		})
+
+		Convey("transactions ignore the context's read time", func() {
+			So(ds.RunInTransaction(ds.WithReadTime(c, t0), func(c context.Context) error {
+				So(val(c, 1), ShouldEqual, -1)
+				return nil
+			}, nil), ShouldBeNil)
+		})
+
+		Convey("restricted to the retention period", func() {
+			So(ds.Get(ds.WithReadTime(c, tc.Now().Add(time.Second)), &Foo{ID: 1}), ShouldErrLike, "in the future")
+
+			tc.Add(58*time.Minute + 30*time.Second)
+			So(ds.Get(ds.WithReadTime(c, t0), &Foo{ID: 1}), ShouldErrLike, "older than the retention period")
+			So(val(ds.WithReadTime(c, t1), 1), ShouldEqual, 2)
+
+			ds.GetTestable(c).SetReadTimeRetention(time.Minute)
+			So(ds.Get(ds.WithReadTime(c, t1), &Foo{ID: 1}), ShouldErrLike, "older than the retention period")
+
+			ds.GetTestable(c).SetReadTimeRetention(0)
+			So(ds.Get(ds.WithReadTime(c, tc.Now()), &Foo{ID: 1}), ShouldErrLike, "reads at a past time are disabled")
+		})
+	})
+}
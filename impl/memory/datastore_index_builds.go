@@ -0,0 +1,308 @@
+// Copyright 2018 The LUCI Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package memory
+
+import (
+	"bytes"
+	"fmt"
+
+	ds "go.chromium.org/gae/service/datastore"
+	"go.chromium.org/gae/service/datastore/serialize"
+)
+
+// With async index builds (see ds.Testable.AsyncIndexBuilds), an added index
+// isn't written to the "idx" collection of head until it is built, and
+// a deleted one is removed from it right away. Until they complete, such
+// operations are tracked in dataStoreData.indexOps. Queries only ever use the
+// indexes of the "idx" collection; a query which fails for the lack of an
+// index is checked against the pending operations, to fail with
+// ErrIndexNotServing instead, like in production.
+
+// ErrIndexNotServing is returned when a query needs a compound index which was
+// added, but isn't serving: it's still building, it failed to build or it's
+// being deleted.
+type ErrIndexNotServing struct {
+	Index *ds.IndexDefinition
+	State ds.IndexState
+}
+
+func (e *ErrIndexNotServing) Error() string {
+	return fmt.Sprintf(
+		"The index for this query is not ready to serve (%s): %s", e.State, e.Index)
+}
+
+// indexOp is a pending operation on a compound index.
+type indexOp struct {
+	// def is the normalized index definition.
+	def *ds.IndexDefinition
+	// state is one of ds.IndexBuilding, ds.IndexError or ds.IndexDeleting.
+	state ds.IndexState
+	// indexed is the number of entities indexed so far, while building.
+	indexed int
+}
+
+func copyIndexOps(ops []*indexOp) []*indexOp {
+	if len(ops) == 0 {
+		return nil
+	}
+	ret := make([]*indexOp, len(ops))
+	for i, op := range ops {
+		cpy := *op
+		ret[i] = &cpy
+	}
+	return ret
+}
+
+// displayIndex strips the implicit __key__ column off a normalized index
+// definition.
+func displayIndex(def *ds.IndexDefinition) *ds.IndexDefinition {
+	ret := *def
+	if n := len(ret.SortBy); n > 0 && ret.SortBy[n-1] == (ds.IndexColumn{Property: "__key__"}) {
+		ret.SortBy = ret.SortBy[:n-1]
+	}
+	return &ret
+}
+
+func (d *dataStoreData) setAsyncIndexBuilds(enable bool) {
+	d.rwlock.Lock()
+	defer d.rwlock.Unlock()
+	d.asyncIndexBuilds = enable
+}
+
+func (d *dataStoreData) findIndexOpLocked(def *ds.IndexDefinition) *indexOp {
+	for _, op := range d.indexOps {
+		if op.def.Equal(def) {
+			return op
+		}
+	}
+	return nil
+}
+
+// dropIndexOpsLocked forgets the pending operations on the given indexes.
+func (d *dataStoreData) dropIndexOpsLocked(idxs []*ds.IndexDefinition) {
+	ops := d.indexOps[:0]
+	for _, op := range d.indexOps {
+		drop := false
+		for _, idx := range idxs {
+			if op.def.Equal(idx.Normalize()) {
+				drop = true
+				break
+			}
+		}
+		if !drop {
+			ops = append(ops, op)
+		}
+	}
+	d.indexOps = ops
+}
+
+func (d *dataStoreData) isServingLocked(def *ds.IndexDefinition) bool {
+	idxColl := d.head.GetCollection("idx")
+	return idxColl != nil && idxColl.Get(serialize.ToBytes(*def.PrepForIdxTable())) != nil
+}
+
+func (d *dataStoreData) startIndexBuildsLocked(idxs []*ds.IndexDefinition) {
+	for _, idx := range idxs {
+		def := idx.Normalize()
+		if d.isServingLocked(def) {
+			continue
+		}
+		if op := d.findIndexOpLocked(def); op != nil {
+			// Adding an index back while it's being deleted restarts its build.
+			if op.state == ds.IndexDeleting {
+				op.state, op.indexed = ds.IndexBuilding, 0
+			}
+			continue
+		}
+		d.indexOps = append(d.indexOps, &indexOp{def: def, state: ds.IndexBuilding})
+	}
+}
+
+func (d *dataStoreData) deleteIndexes(idxs []*ds.IndexDefinition) {
+	d.rwlock.Lock()
+	defer d.rwlock.Unlock()
+
+	for _, idx := range idxs {
+		def := idx.Normalize()
+		serving := d.isServingLocked(def)
+		if serving {
+			removeIndex(d.head, def)
+			if d.consistRand != nil {
+				// Like index builds, deletions aren't subject to the random
+				// consistency policy.
+				snap := d.snap.Fork()
+				removeIndex(snap, def)
+				d.snap = snap.Snapshot()
+			}
+		}
+		if !d.asyncIndexBuilds {
+			d.dropIndexOpsLocked([]*ds.IndexDefinition{def})
+			continue
+		}
+		switch op := d.findIndexOpLocked(def); {
+		case op != nil:
+			op.state, op.indexed = ds.IndexDeleting, 0
+		case serving:
+			d.indexOps = append(d.indexOps, &indexOp{def: def, state: ds.IndexDeleting})
+		}
+	}
+}
+
+// removeIndex removes a compound index definition and all of its rows from
+// store.
+func removeIndex(store memStore, def *ds.IndexDefinition) {
+	idxKey := serialize.ToBytes(*def.PrepForIdxTable())
+	if idxColl := store.GetCollection("idx"); idxColl != nil {
+		idxColl.Delete(idxKey)
+	}
+	for _, ns := range namespaces(store) {
+		coll := store.GetCollection(fmt.Sprintf("idx:%s:%s", ns, idxKey))
+		if coll == nil {
+			continue
+		}
+		var rows [][]byte
+		coll.ForEachItem(func(k, _ []byte) bool {
+			rows = append(rows, k)
+			return true
+		})
+		for _, k := range rows {
+			coll.Delete(k)
+		}
+	}
+}
+
+// walkEntitiesOfKind calls cb with every entity of the given kind in store, in
+// all namespaces.
+func walkEntitiesOfKind(store memStore, aid, kind string, cb func(*ds.Key, ds.PropertyMap)) {
+	store = store.Snapshot()
+	for _, ns := range namespaces(store) {
+		kctx := ds.MkKeyContext(aid, ns)
+		store.GetCollection("ents:" + ns).ForEachItem(func(ik, iv []byte) bool {
+			prop, err := serialize.ReadProperty(bytes.NewBuffer(ik), serialize.WithoutContext, kctx)
+			memoryCorruption(err)
+			k := prop.Value().(*ds.Key)
+			if k.Kind() != kind {
+				return true
+			}
+			pm, err := readPropMap(iv)
+			memoryCorruption(err)
+			cb(k, pm)
+			return true
+		})
+	}
+}
+
+func (d *dataStoreData) countEntitiesLocked(kind string) int {
+	n := 0
+	walkEntitiesOfKind(d.head, d.aid, kind, func(*ds.Key, ds.PropertyMap) { n++ })
+	return n
+}
+
+func (d *dataStoreData) stepIndexBuilds(n int) {
+	d.rwlock.Lock()
+	defer d.rwlock.Unlock()
+
+	ops := d.indexOps
+	d.indexOps = nil
+	for _, op := range ops {
+		switch op.state {
+		case ds.IndexDeleting:
+			continue
+
+		case ds.IndexBuilding:
+			total := d.countEntitiesLocked(op.def.Kind)
+			if n > 0 && op.indexed+n < total {
+				op.indexed += n
+				break
+			}
+			if d.explodesLocked(op.def) {
+				op.state, op.indexed = ds.IndexError, 0
+				break
+			}
+			d.addIndexesLocked([]*ds.IndexDefinition{op.def})
+			continue
+		}
+		d.indexOps = append(d.indexOps, op)
+	}
+}
+
+// explodesLocked returns true if some entity would have more index entries
+// than the production datastore allows with the given index, which then fails
+// to build.
+func (d *dataStoreData) explodesLocked(def *ds.IndexDefinition) bool {
+	compIdx := []*ds.IndexDefinition{def}
+	walkCompIdxs(d.head.Snapshot(), nil, func(i *ds.IndexDefinition) bool {
+		compIdx = append(compIdx, i)
+		return true
+	})
+	explodes := false
+	walkEntitiesOfKind(d.head, d.aid, def.Kind, func(k *ds.Key, pm ds.PropertyMap) {
+		if !explodes && countIndexEntries(k, pm, compIdx) > maxIndexEntries {
+			explodes = true
+		}
+	})
+	return explodes
+}
+
+func (d *dataStoreData) indexStates() []ds.IndexStatus {
+	d.rwlock.RLock()
+	defer d.rwlock.RUnlock()
+	d.headLock.RLock()
+	defer d.headLock.RUnlock()
+
+	var ret []ds.IndexStatus
+	walkCompIdxs(d.head.Snapshot(), nil, func(def *ds.IndexDefinition) bool {
+		ret = append(ret, ds.IndexStatus{Index: displayIndex(def), State: ds.IndexServing, Progress: 1})
+		return true
+	})
+	for _, op := range d.indexOps {
+		st := ds.IndexStatus{Index: displayIndex(op.def), State: op.state}
+		if op.state == ds.IndexBuilding {
+			if total := d.countEntitiesLocked(op.def.Kind); total > 0 {
+				st.Progress = float64(op.indexed) / float64(total)
+			}
+		}
+		ret = append(ret, st)
+	}
+	return ret
+}
+
+// indexNotServing returns an ErrIndexNotServing if err is an ErrMissingIndex,
+// and the query would succeed with one of the indexes which aren't serving.
+// Otherwise it returns err.
+func (d *dataStoreData) indexNotServing(fq *ds.FinalizedQuery, kc ds.KeyContext, isTxn bool, err error) error {
+	if _, ok := err.(*ErrMissingIndex); !ok {
+		return err
+	}
+
+	d.rwlock.RLock()
+	ops := copyIndexOps(d.indexOps)
+	head := d.headSnapshotLocked()
+	d.rwlock.RUnlock()
+
+	for _, op := range ops {
+		if op.def.Kind != fq.Kind() {
+			continue
+		}
+		// The index rows don't matter, only whether the index would be picked.
+		withIdx := head.Fork()
+		withIdx.GetOrCreateCollection("idx").Set(serialize.ToBytes(*op.def.PrepForIdxTable()), []byte{})
+		withIdx = withIdx.Snapshot()
+		if _, qErr := countQuery(fq, kc, isTxn, withIdx, withIdx); qErr == nil {
+			return &ErrIndexNotServing{Index: displayIndex(op.def), State: op.state}
+		}
+	}
+	return err
+}
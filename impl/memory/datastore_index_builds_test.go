@@ -0,0 +1,182 @@
+// Copyright 2018 The LUCI Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package memory
+
+import (
+	"testing"
+
+	ds "go.chromium.org/gae/service/datastore"
+
+	"golang.org/x/net/context"
+
+	. "github.com/smartystreets/goconvey/convey"
+	. "go.chromium.org/luci/common/testing/assertions"
+)
+
+func TestAsyncIndexBuilds(t *testing.T) {
+	t.Parallel()
+
+	Convey("AsyncIndexBuilds", t, func() {
+		c := Use(context.Background())
+		tst := ds.GetTestable(c)
+		tst.Consistent(true)
+
+		for i := int64(1); i <= 4; i++ {
+			So(ds.Put(c, ds.PropertyMap{
+				"$key": ds.MkPropertyNI(ds.MakeKey(c, "Item", i)),
+				"A":    ds.MkProperty(i % 2),
+				"B":    ds.MkProperty(i),
+			}), ShouldBeNil)
+		}
+
+		idx := &ds.IndexDefinition{
+			Kind:   "Item",
+			SortBy: []ds.IndexColumn{{Property: "A"}, {Property: "B", Descending: true}},
+		}
+		q := ds.NewQuery("Item").Eq("A", 1).Order("-B")
+		query := func() ([]int64, error) {
+			var keys []*ds.Key
+			if err := ds.GetAll(c, q, &keys); err != nil {
+				return nil, err
+			}
+			ids := make([]int64, len(keys))
+			for i, k := range keys {
+				ids[i] = k.IntID()
+			}
+			return ids, nil
+		}
+		run := func() []int64 {
+			ids, err := query()
+			So(err, ShouldBeNil)
+			return ids
+		}
+		states := func() []ds.IndexState {
+			var ret []ds.IndexState
+			for _, st := range tst.IndexStates() {
+				ret = append(ret, st.State)
+			}
+			return ret
+		}
+
+		Convey("are off by default", func() {
+			tst.AddIndexes(idx)
+			So(tst.IndexStates(), ShouldResemble, []ds.IndexStatus{
+				{Index: idx, State: ds.IndexServing, Progress: 1},
+			})
+			So(run(), ShouldResemble, []int64{3, 1})
+
+			tst.DeleteIndexes(idx)
+			So(tst.IndexStates(), ShouldBeEmpty)
+			_, err := query()
+			So(err, ShouldHaveSameTypeAs, &ErrMissingIndex{})
+		})
+
+		Convey("when enabled", func() {
+			tst.AsyncIndexBuilds(true)
+			tst.AddIndexes(idx)
+
+			Convey("leave the index building", func() {
+				So(tst.IndexStates(), ShouldResemble, []ds.IndexStatus{
+					{Index: idx, State: ds.IndexBuilding, Progress: 0},
+				})
+
+				_, err := query()
+				So(err, ShouldResemble, &ErrIndexNotServing{Index: idx, State: ds.IndexBuilding})
+				_, err = ds.Count(c, q)
+				So(err, ShouldErrLike, "not ready to serve (BUILDING)")
+
+				Convey("other queries still need their own index", func() {
+					_, err := ds.Count(c, ds.NewQuery("Item").Eq("B", 1).Order("-A"))
+					So(err, ShouldHaveSameTypeAs, &ErrMissingIndex{})
+				})
+
+				Convey("until it's built", func() {
+					tst.StepIndexBuilds(1)
+					So(tst.IndexStates()[0].Progress, ShouldEqual, 0.25)
+					tst.StepIndexBuilds(2)
+					So(tst.IndexStates()[0].Progress, ShouldEqual, 0.75)
+					_, err := query()
+					So(err, ShouldErrLike, "not ready to serve")
+
+					tst.StepIndexBuilds(1)
+					So(states(), ShouldResemble, []ds.IndexState{ds.IndexServing})
+					So(run(), ShouldResemble, []int64{3, 1})
+				})
+
+				Convey("entities written meanwhile are indexed", func() {
+					So(ds.Put(c, ds.PropertyMap{
+						"$key": ds.MkPropertyNI(ds.MakeKey(c, "Item", 5)),
+						"A":    ds.MkProperty(1),
+						"B":    ds.MkProperty(5),
+					}), ShouldBeNil)
+					tst.StepIndexBuilds(0)
+					So(run(), ShouldResemble, []int64{5, 3, 1})
+				})
+
+				Convey("automatic indexes are built right away", func() {
+					tst.AutoIndex(true)
+					So(run(), ShouldResemble, []int64{3, 1})
+					So(states(), ShouldResemble, []ds.IndexState{ds.IndexServing})
+				})
+
+				Convey("snapshots keep the index state", func() {
+					snap := tst.Snapshot()
+					tst.StepIndexBuilds(0)
+					tst.Restore(snap)
+					So(states(), ShouldResemble, []ds.IndexState{ds.IndexBuilding})
+				})
+			})
+
+			Convey("deletions", func() {
+				tst.StepIndexBuilds(0)
+				tst.DeleteIndexes(idx)
+				So(states(), ShouldResemble, []ds.IndexState{ds.IndexDeleting})
+				_, err := query()
+				So(err, ShouldErrLike, "not ready to serve (DELETING)")
+
+				tst.StepIndexBuilds(1)
+				So(tst.IndexStates(), ShouldBeEmpty)
+				_, err = query()
+				So(err, ShouldHaveSameTypeAs, &ErrMissingIndex{})
+			})
+
+			Convey("indexes with too many entries fail to build", func() {
+				var as, bs ds.PropertySlice
+				for i := 0; i < 150; i++ {
+					as = append(as, ds.MkProperty(i))
+					bs = append(bs, ds.MkProperty(i))
+				}
+				So(ds.Put(c, ds.PropertyMap{
+					"$key": ds.MkPropertyNI(ds.MakeKey(c, "Item", 5)),
+					"A":    as,
+					"B":    bs,
+				}), ShouldBeNil)
+
+				tst.StepIndexBuilds(0)
+				So(states(), ShouldResemble, []ds.IndexState{ds.IndexError})
+				_, err := query()
+				So(err, ShouldErrLike, "not ready to serve (ERROR)")
+
+				tst.StepIndexBuilds(0)
+				So(states(), ShouldResemble, []ds.IndexState{ds.IndexError})
+
+				tst.DeleteIndexes(idx)
+				So(states(), ShouldResemble, []ds.IndexState{ds.IndexDeleting})
+				tst.StepIndexBuilds(0)
+				So(tst.IndexStates(), ShouldBeEmpty)
+			})
+		})
+	})
+}
@@ -0,0 +1,147 @@
+// Copyright 2018 The LUCI Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package memory
+
+import (
+	"encoding/base64"
+	"sort"
+	"strings"
+
+	ds "go.chromium.org/gae/service/datastore"
+	"go.chromium.org/gae/service/datastore/serialize"
+)
+
+// Production datastore limits, enforced when StrictLimits is enabled. See
+// https://cloud.google.com/datastore/docs/concepts/limits.
+const (
+	maxEntitySize       = 1 << 20
+	maxIndexedValueSize = 1500
+	maxIndexEntries     = 20000
+	maxKeySize          = 6 << 10
+	maxKeyDepth         = 100
+)
+
+// badRequest returns an error for a put which violates the production limits.
+// Like the production errors, it satisfies ds.IsErrBadRequest.
+func badRequest(format string, args ...interface{}) error {
+	return ds.MakeErrBadRequest(format, args...).Err()
+}
+
+func (d *dataStoreData) setStrictLimits(enable bool) {
+	d.rwlock.Lock()
+	defer d.rwlock.Unlock()
+	d.strictLimits = enable
+}
+
+func (d *dataStoreData) checkLimits(key *ds.Key, pm ds.PropertyMap) error {
+	d.rwlock.RLock()
+	defer d.rwlock.RUnlock()
+	return d.checkLimitsLocked(key, pm)
+}
+
+// checkLimitsLocked returns an error if putting pm with the given key would
+// exceed the production limits. It does nothing unless strictLimits is set.
+//
+// pm must not contain the special properties maintained by this datastore
+// (like __scatter__) yet.
+//
+// Reserved kinds (like __kind__) need no check here: the service/datastore
+// key checks reject them, in production too.
+func (d *dataStoreData) checkLimitsLocked(key *ds.Key, pm ds.PropertyMap) error {
+	if !d.strictLimits {
+		return nil
+	}
+
+	if _, _, toks := key.Split(); len(toks) > maxKeyDepth {
+		return ds.MakeErrInvalidKey("key path has %d elements, the maximum is %d", len(toks), maxKeyDepth).Err()
+	}
+	if size := base64.RawURLEncoding.DecodedLen(len(key.Encode())); size > maxKeySize {
+		return ds.MakeErrInvalidKey("key is %d bytes long, the maximum is %d", size, maxKeySize).Err()
+	}
+
+	if err := checkPropertyMap(pm, ""); err != nil {
+		return err
+	}
+
+	if size := len(serialize.ToBytesWithContext(pm)); size > maxEntitySize {
+		return badRequest("entity is too big (%d bytes, the maximum is %d)", size, maxEntitySize)
+	}
+
+	var compIdx []*ds.IndexDefinition
+	walkCompIdxs(d.head.Snapshot(), nil, func(i *ds.IndexDefinition) bool {
+		compIdx = append(compIdx, i)
+		return true
+	})
+	if n := countIndexEntries(key, pm, compIdx); n > maxIndexEntries {
+		return badRequest("too many indexed properties for entity %s (%d index entries, the maximum is %d)",
+			key, n, maxIndexEntries)
+	}
+	return nil
+}
+
+// checkPropertyMap checks the names and the sizes of the indexed values of
+// the properties in pm, and in its nested entities.
+func checkPropertyMap(pm ds.PropertyMap, prefix string) error {
+	names := make([]string, 0, len(pm))
+	for name := range pm {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		full := prefix + name
+		if strings.HasPrefix(name, "__") && strings.HasSuffix(name, "__") {
+			return badRequest("property name %q is reserved", full)
+		}
+
+		for _, p := range pm.Slice(name) {
+			if p.IndexSetting() == ds.NoIndex {
+				continue
+			}
+			switch v := p.Value().(type) {
+			case string:
+				if len(v) > maxIndexedValueSize {
+					return badRequest("the value of property %q is longer than %d bytes", full, maxIndexedValueSize)
+				}
+			case []byte:
+				if len(v) > maxIndexedValueSize {
+					return badRequest("the value of property %q is longer than %d bytes", full, maxIndexedValueSize)
+				}
+			case ds.PropertyMap:
+				if err := checkPropertyMap(v, full+"."); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// countIndexEntries returns the number of index rows an entity has, in the
+// built-in indexes and in the given compound indexes.
+func countIndexEntries(key *ds.Key, pm ds.PropertyMap, compIdx []*ds.IndexDefinition) int {
+	rows := indexEntriesWithBuiltins(key, pm, compIdx).Snapshot()
+	n := 0
+	for _, name := range rows.GetCollectionNames() {
+		if !strings.HasPrefix(name, "idx:") {
+			continue
+		}
+		rows.GetCollection(name).ForEachItem(func(_, _ []byte) bool {
+			n++
+			return true
+		})
+	}
+	return n
+}
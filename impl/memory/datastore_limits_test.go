@@ -0,0 +1,134 @@
+// Copyright 2018 The LUCI Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package memory
+
+import (
+	"strings"
+	"testing"
+
+	ds "go.chromium.org/gae/service/datastore"
+
+	"golang.org/x/net/context"
+
+	. "github.com/smartystreets/goconvey/convey"
+	. "go.chromium.org/luci/common/testing/assertions"
+)
+
+func TestStrictLimits(t *testing.T) {
+	t.Parallel()
+
+	Convey("StrictLimits", t, func() {
+		c := Use(context.Background())
+		tst := ds.GetTestable(c)
+		tst.Consistent(true)
+
+		long := strings.Repeat("x", 1501)
+		ent := func(props ...interface{}) ds.PropertyMap {
+			pm := ds.PropertyMap{"$key": ds.MkPropertyNI(ds.MakeKey(c, "Foo", 1))}
+			for i := 0; i < len(props); i += 2 {
+				pm[props[i].(string)] = props[i+1].(ds.PropertyData)
+			}
+			return pm
+		}
+
+		huge := ent("Blob", ds.MkPropertyNI([]byte(strings.Repeat("x", 1<<20))))
+		longIndexed := ent("Str", ds.MkProperty(long))
+
+		Convey("is off by default", func() {
+			So(ds.Put(c, huge), ShouldBeNil)
+			So(ds.Put(c, longIndexed), ShouldBeNil)
+		})
+
+		Convey("when enabled", func() {
+			tst.StrictLimits(true)
+
+			Convey("accepts entities within the limits", func() {
+				So(ds.Put(c, ent(
+					"Str", ds.MkProperty(long[:1500]),
+					"Text", ds.MkPropertyNI(long),
+					"Blob", ds.MkPropertyNI([]byte(strings.Repeat("x", 1<<19))),
+				)), ShouldBeNil)
+			})
+
+			Convey("rejects big entities", func() {
+				err := ds.Put(c, huge)
+				So(err, ShouldErrLike, "entity is too big")
+				So(ds.IsErrBadRequest(err), ShouldBeTrue)
+				So(ds.Get(c, ent()), ShouldEqual, ds.ErrNoSuchEntity)
+			})
+
+			Convey("rejects long indexed values", func() {
+				err := ds.Put(c, longIndexed)
+				So(err, ShouldErrLike, `the value of property "Str" is longer than 1500 bytes`)
+				So(ds.IsErrBadRequest(err), ShouldBeTrue)
+				So(ds.Put(c, ent("Bytes", ds.MkProperty([]byte(long)))), ShouldErrLike, `property "Bytes"`)
+				So(ds.Put(c, ent("Multi", ds.PropertySlice{ds.MkProperty("a"), ds.MkProperty(long)})),
+					ShouldErrLike, `property "Multi"`)
+				So(ds.Put(c, ent("Nested", ds.MkProperty(ds.PropertyMap{"Inner": ds.MkProperty(long)}))),
+					ShouldErrLike, `property "Nested.Inner"`)
+			})
+
+			Convey("rejects entities with too many index entries", func() {
+				vals := make(ds.PropertySlice, 10000)
+				for i := range vals {
+					vals[i] = ds.MkProperty(i)
+				}
+				// 2 built-in index entries per value, plus one for the kind.
+				So(ds.Put(c, ent("Vals", vals)), ShouldErrLike, "(20001 index entries")
+				So(ds.Put(c, ent("Vals", vals[:9999])), ShouldBeNil)
+
+				Convey("counting compound index entries", func() {
+					tst.AddIndexes(&ds.IndexDefinition{
+						Kind:   "Foo",
+						SortBy: []ds.IndexColumn{{Property: "Vals"}, {Property: "Other"}},
+					})
+					So(ds.Put(c, ent("Vals", vals[:9000], "Other", ds.MkProperty(1))), ShouldErrLike,
+						"too many indexed properties")
+				})
+			})
+
+			Convey("rejects bad keys", func() {
+				toks := make([]interface{}, 0, 202)
+				for i := 0; i < 101; i++ {
+					toks = append(toks, "Foo", 1)
+				}
+				err := ds.Put(c, ds.PropertyMap{"$key": ds.MkPropertyNI(ds.MakeKey(c, toks...))})
+				So(err, ShouldErrLike, "key path has 101 elements")
+				So(ds.IsErrInvalidKey(err), ShouldBeTrue)
+				So(ds.IsErrBadRequest(err), ShouldBeFalse)
+
+				longID := strings.Repeat("x", 7000)
+				err = ds.Put(c, ds.PropertyMap{"$key": ds.MkPropertyNI(ds.MakeKey(c, "Foo", longID))})
+				So(err, ShouldErrLike, "key is 7")
+				So(ds.IsErrInvalidKey(err), ShouldBeTrue)
+			})
+
+			Convey("rejects reserved property names", func() {
+				err := ds.Put(c, ent("__scatter__", ds.MkProperty(1)))
+				So(err, ShouldErrLike, `property name "__scatter__" is reserved`)
+				So(ds.IsErrBadRequest(err), ShouldBeTrue)
+				So(ds.Put(c, ent("__foo__", ds.MkPropertyNI(1))), ShouldErrLike, "reserved")
+			})
+
+			Convey("checks puts in transactions", func() {
+				err := ds.RunInTransaction(c, func(c context.Context) error {
+					return ds.Put(c, longIndexed)
+				}, nil)
+				So(ds.IsErrBadRequest(err), ShouldBeTrue)
+				So(ds.Get(c, ent()), ShouldEqual, ds.ErrNoSuchEntity)
+			})
+		})
+	})
+}
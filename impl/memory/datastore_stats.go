@@ -0,0 +1,387 @@
+// Copyright 2018 The LUCI Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package memory
+
+import (
+	"bytes"
+	"sort"
+	"strings"
+	"time"
+
+	ds "go.chromium.org/gae/service/datastore"
+	"go.chromium.org/gae/service/datastore/serialize"
+)
+
+// The datastore statistics kinds, as exposed by the production datastore.
+//
+// See https://cloud.google.com/appengine/docs/standard/go/datastore/stats
+const (
+	statTotalKind     = "__Stat_Total__"
+	statKindKind      = "__Stat_Kind__"
+	statNamespaceKind = "__Stat_Namespace__"
+	statNsTotalKind   = "__Stat_Ns_Total__"
+	statNsKindKind    = "__Stat_Ns_Kind__"
+
+	// statTotalName is the key name used by the __Stat_Total__ and
+	// __Stat_Ns_Total__ singletons.
+	statTotalName = "total_entity_usage"
+)
+
+// isStatKind returns true iff kind is one of the statistics kinds maintained
+// by refreshStats.
+func isStatKind(kind string) bool {
+	return strings.HasPrefix(kind, "__Stat_") && strings.HasSuffix(kind, "__")
+}
+
+// isSpecialKind returns true iff kind is a datastore-internal kind (i.e.
+// "__entity_group__" or one of the statistics kinds).
+func isSpecialKind(kind string) bool {
+	return strings.HasPrefix(kind, "__") && strings.HasSuffix(kind, "__")
+}
+
+// statEntry accumulates the storage usage for some group of entities.
+type statEntry struct {
+	count int64
+
+	entityBytes int64
+
+	builtinIndexBytes int64
+	builtinIndexCount int64
+
+	compositeIndexBytes int64
+	compositeIndexCount int64
+}
+
+func (s *statEntry) add(o *statEntry) {
+	s.count += o.count
+	s.entityBytes += o.entityBytes
+	s.builtinIndexBytes += o.builtinIndexBytes
+	s.builtinIndexCount += o.builtinIndexCount
+	s.compositeIndexBytes += o.compositeIndexBytes
+	s.compositeIndexCount += o.compositeIndexCount
+}
+
+func (s *statEntry) bytes() int64 {
+	return s.entityBytes + s.builtinIndexBytes + s.compositeIndexBytes
+}
+
+// toPropertyMap renders this statEntry as the properties common to all of the
+// statistics kinds.
+func (s *statEntry) toPropertyMap(now time.Time) ds.PropertyMap {
+	return ds.PropertyMap{
+		"bytes":                 ds.MkProperty(s.bytes()),
+		"count":                 ds.MkProperty(s.count),
+		"timestamp":             ds.MkProperty(now),
+		"entity_bytes":          ds.MkProperty(s.entityBytes),
+		"builtin_index_bytes":   ds.MkProperty(s.builtinIndexBytes),
+		"builtin_index_count":   ds.MkProperty(s.builtinIndexCount),
+		"composite_index_bytes": ds.MkProperty(s.compositeIndexBytes),
+		"composite_index_count": ds.MkProperty(s.compositeIndexCount),
+	}
+}
+
+// nsStats is the collection of statistics for a single namespace.
+type nsStats struct {
+	total statEntry
+	kinds map[string]*statEntry
+}
+
+func (n *nsStats) kind(kind string) *statEntry {
+	if n.kinds == nil {
+		n.kinds = map[string]*statEntry{}
+	}
+	ret := n.kinds[kind]
+	if ret == nil {
+		ret = &statEntry{}
+		n.kinds[kind] = ret
+	}
+	return ret
+}
+
+// indexedValues returns the distinct indexed values of every property in pm,
+// mirroring the deduplication done by serialize.PropertySlice when index rows
+// are generated.
+func indexedValues(pm ds.PropertyMap) map[string]ds.PropertySlice {
+	ret := make(map[string]ds.PropertySlice, len(pm))
+	for name := range pm {
+		seen := map[string]struct{}{}
+		for _, v := range pm.Slice(name) {
+			if v.IndexSetting() == ds.NoIndex {
+				continue
+			}
+			data := string(serialize.ToBytes(v))
+			if _, ok := seen[data]; ok {
+				continue
+			}
+			seen[data] = struct{}{}
+			ret[name] = append(ret[name], v)
+		}
+	}
+	return ret
+}
+
+// entityStats estimates the storage used by a single entity and its index
+// rows.
+//
+// Byte figures are computed with EstimateSize, following
+// https://cloud.google.com/appengine/articles/storage_breakdown. Built-in
+// index rows are one row in the kind index plus one ascending and one
+// descending row per indexed value. Composite index rows are counted by
+// permuting the entity's values over the index columns, exactly like
+// indexRowGen.permute does.
+func entityStats(key *ds.Key, pm ds.PropertyMap, compIdx []*ds.IndexDefinition) *statEntry {
+	keySize := key.EstimateSize()
+	ret := &statEntry{
+		count:       1,
+		entityBytes: keySize + pm.EstimateSize(),
+	}
+
+	vals := indexedValues(pm)
+
+	// Kind index.
+	ret.builtinIndexCount++
+	ret.builtinIndexBytes += keySize
+
+	// Single property indexes (ascending and descending).
+	for name, vs := range vals {
+		for i := range vs {
+			ret.builtinIndexCount += 2
+			ret.builtinIndexBytes += 2 * (keySize + int64(len(name)) + vs[i].EstimateSize())
+		}
+	}
+
+	for _, idx := range compIdx {
+		if idx.Kind != "" && idx.Kind != key.Kind() {
+			continue
+		}
+
+		// rows is the number of index rows this entity generates, and colBytes is
+		// the sum of all of the values' sizes for each column.
+		rows := int64(1)
+		colCounts := make([]int64, 0, len(idx.SortBy)+1)
+		colBytes := make([]int64, 0, len(idx.SortBy)+1)
+		if idx.Ancestor {
+			n, b := int64(0), int64(0)
+			for k := key; k != nil; k = k.Parent() {
+				n++
+				b += k.EstimateSize()
+			}
+			colCounts = append(colCounts, n)
+			colBytes = append(colBytes, b)
+		}
+		matches := true
+		for _, col := range idx.SortBy {
+			// The normalized index definitions end with the __key__ column. Every
+			// row has the key, which is accounted for below.
+			if col.Property == "__key__" {
+				continue
+			}
+			vs := vals[col.Property]
+			if len(vs) == 0 {
+				matches = false
+				break
+			}
+			b := int64(0)
+			for i := range vs {
+				b += vs[i].EstimateSize()
+			}
+			colCounts = append(colCounts, int64(len(vs)))
+			colBytes = append(colBytes, b)
+		}
+		if !matches {
+			continue
+		}
+		for _, n := range colCounts {
+			rows *= n
+		}
+
+		// Every value in a column appears in (rows / values in that column) rows.
+		size := rows * keySize
+		for i, b := range colBytes {
+			size += b * (rows / colCounts[i])
+		}
+		ret.compositeIndexCount += rows
+		ret.compositeIndexBytes += size
+	}
+	return ret
+}
+
+// computeStats computes per-namespace statistics for all user entities in
+// store.
+func computeStats(store memStore, aid string) map[string]*nsStats {
+	var compIdx []*ds.IndexDefinition
+	walkCompIdxs(store, nil, func(i *ds.IndexDefinition) bool {
+		compIdx = append(compIdx, i)
+		return true
+	})
+
+	ret := map[string]*nsStats{}
+	for _, ns := range namespaces(store) {
+		ents := store.GetCollection("ents:" + ns)
+		if ents == nil {
+			continue
+		}
+
+		kctx := ds.MkKeyContext(aid, ns)
+		stats := &nsStats{}
+		ents.ForEachItem(func(ik, iv []byte) bool {
+			prop, err := serialize.ReadProperty(bytes.NewBuffer(ik), serialize.WithoutContext, kctx)
+			memoryCorruption(err)
+			k := prop.Value().(*ds.Key)
+
+			// Skip __entity_group__ and friends, as well as previously-computed
+			// statistics.
+			for cur := k; cur != nil; cur = cur.Parent() {
+				if isSpecialKind(cur.Kind()) {
+					return true
+				}
+			}
+
+			pm, err := readPropMap(iv)
+			memoryCorruption(err)
+			stripSpecialProps(pm)
+
+			es := entityStats(k, pm, compIdx)
+			stats.total.add(es)
+			stats.kind(k.Kind()).add(es)
+			return true
+		})
+		ret[ns] = stats
+	}
+	return ret
+}
+
+// clearStatsLocked removes all statistics entities from the namespace ns.
+//
+// Must be called with d.rwlock and d.headLock held for writing.
+func (d *dataStoreData) clearStatsLocked(ns string) {
+	ents := d.head.GetCollection("ents:" + ns)
+	if ents == nil {
+		return
+	}
+
+	kctx := ds.MkKeyContext(d.aid, ns)
+	var stale []*ds.Key
+	ents.ForEachItem(func(ik, _ []byte) bool {
+		prop, err := serialize.ReadProperty(bytes.NewBuffer(ik), serialize.WithoutContext, kctx)
+		memoryCorruption(err)
+		if k := prop.Value().(*ds.Key); isStatKind(k.Kind()) {
+			stale = append(stale, k)
+		}
+		return true
+	})
+
+	for _, k := range stale {
+		d.setInternalLocked(k, nil)
+	}
+}
+
+// setInternalLocked writes (or, if pm is nil, deletes) an entity which is
+// maintained by the datastore itself, updating the indexes accordingly.
+//
+// Unlike putMulti, this doesn't touch the entity group version and doesn't add
+// special properties like __scatter__.
+//
+// Must be called with d.rwlock and d.headLock held for writing.
+func (d *dataStoreData) setInternalLocked(key *ds.Key, pm ds.PropertyMap) {
+	ents := d.head.GetOrCreateCollection("ents:" + key.Namespace())
+	keyBlob := keyBytes(key)
+
+	var oldPM ds.PropertyMap
+	if old := ents.Get(keyBlob); old != nil {
+		var err error
+		oldPM, err = readPropMap(old)
+		memoryCorruption(err)
+	}
+
+	if pm == nil {
+		if oldPM != nil {
+			ents.Delete(keyBlob)
+			updateIndexes(d.head, key, oldPM, nil)
+		}
+		return
+	}
+	ents.Set(keyBlob, serialize.ToBytesWithContext(pm))
+	updateIndexes(d.head, key, oldPM, pm)
+}
+
+// refreshStats recomputes the datastore statistics entities from the current
+// state of the datastore.
+//
+// In production the statistics are computed periodically in the background,
+// and so lag behind the actual data. This implementation mirrors that: the
+// statistics entities only change when refreshStats is called.
+func (d *dataStoreData) refreshStats(now time.Time) {
+	d.rwlock.Lock()
+	defer d.rwlock.Unlock()
+	d.headLock.Lock()
+	defer d.headLock.Unlock()
+
+	now = ds.RoundTime(now.UTC())
+	stats := computeStats(d.head.Snapshot(), d.aid)
+
+	for _, ns := range namespaces(d.head.Snapshot()) {
+		d.clearStatsLocked(ns)
+	}
+
+	nsNames := make([]string, 0, len(stats))
+	for ns, s := range stats {
+		if s.total.count > 0 {
+			nsNames = append(nsNames, ns)
+		}
+	}
+	sort.Strings(nsNames)
+
+	global := &nsStats{}
+	rootKC := ds.MkKeyContext(d.aid, "")
+	for _, ns := range nsNames {
+		s := stats[ns]
+		kctx := ds.MkKeyContext(d.aid, ns)
+
+		global.total.add(&s.total)
+		d.setInternalLocked(kctx.MakeKey(statNsTotalKind, statTotalName), s.total.toPropertyMap(now))
+
+		for kind, ks := range s.kinds {
+			global.kind(kind).add(ks)
+
+			pm := ks.toPropertyMap(now)
+			pm["kind_name"] = ds.MkProperty(kind)
+			d.setInternalLocked(kctx.MakeKey(statNsKindKind, kind), pm)
+		}
+
+		// Like the __namespace__ metadata, the default namespace is identified by
+		// the integer ID 1.
+		var nsKey *ds.Key
+		if ns == "" {
+			nsKey = rootKC.MakeKey(statNamespaceKind, 1)
+		} else {
+			nsKey = rootKC.MakeKey(statNamespaceKind, ns)
+		}
+		pm := s.total.toPropertyMap(now)
+		pm["subject_namespace"] = ds.MkProperty(ns)
+		d.setInternalLocked(nsKey, pm)
+	}
+
+	if len(nsNames) == 0 {
+		return
+	}
+
+	d.setInternalLocked(rootKC.MakeKey(statTotalKind, statTotalName), global.total.toPropertyMap(now))
+	for kind, ks := range global.kinds {
+		pm := ks.toPropertyMap(now)
+		pm["kind_name"] = ds.MkProperty(kind)
+		d.setInternalLocked(rootKC.MakeKey(statKindKind, kind), pm)
+	}
+}
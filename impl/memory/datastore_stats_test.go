@@ -0,0 +1,167 @@
+// Copyright 2018 The LUCI Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package memory
+
+import (
+	"testing"
+	"time"
+
+	ds "go.chromium.org/gae/service/datastore"
+	infoS "go.chromium.org/gae/service/info"
+
+	"go.chromium.org/luci/common/clock/testclock"
+
+	"golang.org/x/net/context"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestDatastoreStats(t *testing.T) {
+	t.Parallel()
+
+	Convey("Testable.RefreshStats", t, func() {
+		now := time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)
+		c, tc := testclock.UseTime(context.Background(), now)
+		c = Use(c)
+		ds.GetTestable(c).Consistent(true)
+
+		getStat := func(c context.Context, kind string, id interface{}) ds.PropertyMap {
+			pm := ds.PropertyMap{"$key": ds.MkPropertyNI(ds.MakeKey(c, kind, id))}
+			if err := ds.Get(c, pm); err != nil {
+				So(err, ShouldEqual, ds.ErrNoSuchEntity)
+				return nil
+			}
+			delete(pm, "$key")
+			return pm
+		}
+		intProp := func(pm ds.PropertyMap, name string) int64 {
+			return pm.Slice(name)[0].Value().(int64)
+		}
+
+		fooKey := ds.MakeKey(c, "Foo", 1)
+		foo := ds.PropertyMap{
+			"Val":  ds.MkProperty(10),
+			"Tags": ds.PropertySlice{ds.MkProperty("a"), ds.MkProperty("b"), ds.MkProperty("a")},
+			"Note": ds.MkPropertyNI("not indexed"),
+		}
+		fooStored := foo.Clone()
+		fooStored["$key"] = ds.MkPropertyNI(fooKey)
+		So(ds.Put(c, fooStored), ShouldBeNil)
+
+		barKey := ds.MakeKey(infoS.MustNamespace(c, "ns"), "Bar", "hi")
+		bar := ds.PropertyMap{"Val": ds.MkProperty(1)}
+		barStored := bar.Clone()
+		barStored["$key"] = ds.MkPropertyNI(barKey)
+		So(ds.Put(infoS.MustNamespace(c, "ns"), barStored), ShouldBeNil)
+
+		Convey("stats are absent until refreshed", func() {
+			So(getStat(c, "__Stat_Total__", "total_entity_usage"), ShouldBeNil)
+			So(getStat(c, "__Stat_Kind__", "Foo"), ShouldBeNil)
+		})
+
+		Convey("computes per-kind and total figures", func() {
+			ds.GetTestable(c).RefreshStats()
+
+			fooKind := getStat(c, "__Stat_Kind__", "Foo")
+			So(fooKind, ShouldNotBeNil)
+			So(fooKind.Slice("kind_name")[0].Value(), ShouldEqual, "Foo")
+			So(fooKind.Slice("timestamp")[0].Value(), ShouldResemble, now)
+			So(intProp(fooKind, "count"), ShouldEqual, 1)
+			So(intProp(fooKind, "entity_bytes"), ShouldEqual, fooKey.EstimateSize()+foo.EstimateSize())
+			// Kind row, plus 2 rows for each of Val=10, Tags="a" and Tags="b".
+			So(intProp(fooKind, "builtin_index_count"), ShouldEqual, 7)
+			So(intProp(fooKind, "composite_index_count"), ShouldEqual, 0)
+			So(intProp(fooKind, "bytes"), ShouldEqual,
+				intProp(fooKind, "entity_bytes")+intProp(fooKind, "builtin_index_bytes"))
+
+			total := getStat(c, "__Stat_Total__", "total_entity_usage")
+			So(intProp(total, "count"), ShouldEqual, 2)
+			So(intProp(total, "entity_bytes"), ShouldEqual,
+				fooKey.EstimateSize()+foo.EstimateSize()+barKey.EstimateSize()+bar.EstimateSize())
+
+			defNS := getStat(c, "__Stat_Namespace__", 1)
+			So(defNS.Slice("subject_namespace")[0].Value(), ShouldEqual, "")
+			So(intProp(defNS, "count"), ShouldEqual, 1)
+
+			nsNS := getStat(c, "__Stat_Namespace__", "ns")
+			So(intProp(nsNS, "count"), ShouldEqual, 1)
+
+			nsc := infoS.MustNamespace(c, "ns")
+			So(intProp(getStat(nsc, "__Stat_Ns_Total__", "total_entity_usage"), "count"), ShouldEqual, 1)
+			So(intProp(getStat(nsc, "__Stat_Ns_Kind__", "Bar"), "count"), ShouldEqual, 1)
+			So(getStat(nsc, "__Stat_Ns_Kind__", "Foo"), ShouldBeNil)
+
+			Convey("stats are queryable", func() {
+				var kinds []string
+				So(ds.Run(c, ds.NewQuery("__Stat_Kind__").Order("-bytes"), func(pm ds.PropertyMap) {
+					kinds = append(kinds, pm.Slice("kind_name")[0].Value().(string))
+				}), ShouldBeNil)
+				So(kinds, ShouldResemble, []string{"Foo", "Bar"})
+			})
+
+			Convey("stats don't count themselves", func() {
+				tc.Add(time.Hour)
+				ds.GetTestable(c).RefreshStats()
+
+				total := getStat(c, "__Stat_Total__", "total_entity_usage")
+				So(intProp(total, "count"), ShouldEqual, 2)
+				So(total.Slice("timestamp")[0].Value(), ShouldResemble, now.Add(time.Hour))
+			})
+
+			Convey("stats lag until refreshed", func() {
+				So(ds.Delete(nsc, barKey), ShouldBeNil)
+				So(intProp(getStat(c, "__Stat_Total__", "total_entity_usage"), "count"), ShouldEqual, 2)
+
+				ds.GetTestable(c).RefreshStats()
+				So(intProp(getStat(c, "__Stat_Total__", "total_entity_usage"), "count"), ShouldEqual, 1)
+				So(getStat(c, "__Stat_Kind__", "Bar"), ShouldBeNil)
+				So(getStat(c, "__Stat_Namespace__", "ns"), ShouldBeNil)
+				So(getStat(nsc, "__Stat_Ns_Total__", "total_entity_usage"), ShouldBeNil)
+			})
+		})
+
+		Convey("counts composite index rows", func() {
+			ds.GetTestable(c).AddIndexes(&ds.IndexDefinition{
+				Kind: "Foo",
+				SortBy: []ds.IndexColumn{
+					{Property: "Val"},
+					{Property: "Tags", Descending: true},
+				},
+			})
+			ds.GetTestable(c).RefreshStats()
+
+			val, tagA, tagB := ds.MkProperty(10), ds.MkProperty("a"), ds.MkProperty("b")
+			compositeBytes := 2*fooKey.EstimateSize() +
+				2*val.EstimateSize() +
+				tagA.EstimateSize() + tagB.EstimateSize()
+			fooKind := getStat(c, "__Stat_Kind__", "Foo")
+			So(intProp(fooKind, "composite_index_count"), ShouldEqual, 2)
+			So(intProp(fooKind, "composite_index_bytes"), ShouldEqual, compositeBytes)
+			So(intProp(fooKind, "bytes"), ShouldEqual,
+				intProp(fooKind, "entity_bytes")+intProp(fooKind, "builtin_index_bytes")+compositeBytes)
+
+			So(intProp(getStat(c, "__Stat_Kind__", "Bar"), "composite_index_count"), ShouldEqual, 0)
+
+			total := getStat(c, "__Stat_Total__", "total_entity_usage")
+			So(intProp(total, "composite_index_count"), ShouldEqual, 2)
+			So(intProp(total, "composite_index_bytes"), ShouldEqual, compositeBytes)
+			So(intProp(total, "bytes"), ShouldEqual,
+				intProp(total, "entity_bytes")+intProp(total, "builtin_index_bytes")+compositeBytes)
+
+			nsc := infoS.MustNamespace(c, "ns")
+			So(intProp(getStat(nsc, "__Stat_Ns_Total__", "total_entity_usage"), "composite_index_count"), ShouldEqual, 0)
+		})
+	})
+}
@@ -26,6 +26,7 @@ import (
 	ds "go.chromium.org/gae/service/datastore"
 	"go.chromium.org/gae/service/datastore/serialize"
 	infoS "go.chromium.org/gae/service/info"
+	tq "go.chromium.org/gae/service/taskqueue"
 
 	"golang.org/x/net/context"
 
@@ -707,6 +708,90 @@ func TestDatastoreSingleReadWriter(t *testing.T) {
 			// Approximately "even" distribution within [1, 100] range.
 			So(ids, ShouldResemble, []int64{43, 55, 99, 23, 17})
 		})
+
+		Convey("SplitQuery", func() {
+			for i := 0; i < 200; i++ {
+				So(ds.Put(c, &Foo{Val: i % 2}), ShouldBeNil)
+			}
+			ds.GetTestable(c).CatchupIndexes()
+
+			collect := func(qs []*ds.Query) (ids []int64) {
+				for _, q := range qs {
+					So(ds.Run(c, q, func(k *ds.Key) {
+						ids = append(ids, k.IntID())
+					}), ShouldBeNil)
+				}
+				return
+			}
+
+			Convey("covers the original query", func() {
+				q := ds.NewQuery("Foo")
+				qs, err := ds.SplitQuery(c, q, 4)
+				So(err, ShouldBeNil)
+				So(len(qs), ShouldEqual, 4)
+
+				ids := collect(qs)
+				So(len(ids), ShouldEqual, 200)
+				for i := range ids {
+					So(ids[i], ShouldEqual, i+1)
+				}
+
+				// Shards are reasonably balanced.
+				for _, sq := range qs {
+					count, err := ds.Count(c, sq)
+					So(err, ShouldBeNil)
+					So(count, ShouldBeBetween, 20, 80)
+				}
+			})
+
+			Convey("preserves filters", func() {
+				q := ds.NewQuery("Foo").Eq("Val", 1).
+					Gt("__key__", ds.MakeKey(c, "Foo", 50)).
+					Lte("__key__", ds.MakeKey(c, "Foo", 150))
+				qs, err := ds.SplitQuery(c, q, 3)
+				So(err, ShouldBeNil)
+				So(len(qs), ShouldEqual, 3)
+
+				var expected []int64
+				So(ds.Run(c, q, func(k *ds.Key) {
+					expected = append(expected, k.IntID())
+				}), ShouldBeNil)
+				So(len(expected), ShouldEqual, 50)
+				So(collect(qs), ShouldResemble, expected)
+			})
+
+			Convey("n <= 1 returns the query as-is", func() {
+				q := ds.NewQuery("Foo")
+				qs, err := ds.SplitQuery(c, q, 1)
+				So(err, ShouldBeNil)
+				So(qs, ShouldResemble, []*ds.Query{q})
+			})
+
+			Convey("small kinds produce fewer shards", func() {
+				So(ds.Put(c, ds.PropertyMap{
+					"$key": ds.MkPropertyNI(ds.MakeKey(c, "Tiny", 1)),
+				}), ShouldBeNil)
+				ds.GetTestable(c).CatchupIndexes()
+
+				qs, err := ds.SplitQuery(c, ds.NewQuery("Tiny"), 10)
+				So(err, ShouldBeNil)
+				So(len(qs), ShouldBeLessThanOrEqualTo, 2)
+			})
+
+			Convey("rejects unsplittable queries", func() {
+				_, err := ds.SplitQuery(c, ds.NewQuery(""), 2)
+				So(err, ShouldErrLike, "kindless")
+
+				_, err = ds.SplitQuery(c, ds.NewQuery("Foo").Gt("Val", 1), 2)
+				So(err, ShouldErrLike, "inequality filter on \"Val\"")
+
+				_, err = ds.SplitQuery(c, ds.NewQuery("Foo").Order("Val"), 2)
+				So(err, ShouldErrLike, "sort order")
+
+				_, err = ds.SplitQuery(c, ds.NewQuery("Foo").Limit(10), 2)
+				So(err, ShouldErrLike, "limit")
+			})
+		})
 	})
 }
 
@@ -864,6 +949,345 @@ func TestAddIndexes(t *testing.T) {
 	})
 }
 
+func TestSnapshotRestore(t *testing.T) {
+	t.Parallel()
+
+	Convey("Test Testable.Snapshot/Restore", t, func() {
+		c := Use(context.Background())
+		tst := ds.GetTestable(c)
+		tst.Consistent(true)
+
+		So(ds.Put(c, []*Foo{{ID: 1, Val: 1}, {ID: 2, Val: 2}}), ShouldBeNil)
+		snap := tst.Snapshot()
+
+		vals := func() (ret []int) {
+			So(ds.Run(c, ds.NewQuery("Foo").Order("Val"), func(f *Foo) {
+				ret = append(ret, f.Val)
+			}), ShouldBeNil)
+			return
+		}
+
+		Convey("restores entities, indexes and versions", func() {
+			So(ds.Put(c, &Foo{ID: 1, Val: 10}), ShouldBeNil)
+			So(ds.Put(c, &Foo{ID: 3, Val: 3}), ShouldBeNil)
+			So(ds.Delete(c, ds.MakeKey(c, "Foo", 2)), ShouldBeNil)
+			So(vals(), ShouldResemble, []int{3, 10})
+
+			tst.Restore(snap)
+			So(vals(), ShouldResemble, []int{1, 2})
+			So(ds.Get(c, &Foo{ID: 3}), ShouldEqual, ds.ErrNoSuchEntity)
+
+			So(testGetMeta(c, ds.MakeKey(c, "Foo", 1)), ShouldEqual, 1)
+		})
+
+		Convey("can be restored many times", func() {
+			for i := 0; i < 3; i++ {
+				So(ds.Put(c, &Foo{ID: 5, Val: 5 + i}), ShouldBeNil)
+				So(vals(), ShouldResemble, []int{1, 2, 5 + i})
+				tst.Restore(snap)
+				So(vals(), ShouldResemble, []int{1, 2})
+			}
+		})
+
+		Convey("restores ID allocation and compound indexes", func() {
+			allocate := func() int64 {
+				keys := ds.NewIncompleteKeys(c, 1, "Bar", nil)
+				So(ds.AllocateIDs(c, keys), ShouldBeNil)
+				return keys[0].IntID()
+			}
+			firstID := allocate()
+
+			tst.AddIndexes(&ds.IndexDefinition{
+				Kind:   "Foo",
+				SortBy: []ds.IndexColumn{{Property: "Val"}, {Property: "Name"}},
+			})
+			q := ds.NewQuery("Foo").Eq("Val", 2).Gte("Name", "")
+			So(ds.Run(c, q, func(*Foo) {}), ShouldBeNil)
+
+			tst.Restore(snap)
+			So(ds.Run(c, q, func(*Foo) {}), ShouldErrLike, "Insufficient indexes")
+
+			So(allocate(), ShouldEqual, firstID)
+		})
+
+		Convey("restores the index snapshot when eventually consistent", func() {
+			tst.Consistent(false)
+			snap := tst.Snapshot()
+
+			So(ds.Put(c, &Foo{ID: 3, Val: 3}), ShouldBeNil)
+			tst.CatchupIndexes()
+			So(vals(), ShouldResemble, []int{1, 2, 3})
+
+			tst.Restore(snap)
+			So(vals(), ShouldResemble, []int{1, 2})
+		})
+	})
+}
+
+func TestIDAllocationPolicy(t *testing.T) {
+	t.Parallel()
+
+	Convey("SetIDAllocationPolicy", t, func() {
+		c := Use(context.Background())
+		tst := ds.GetTestable(c)
+
+		putIDs := func(n int) []int64 {
+			foos := make([]*Foo, n)
+			for i := range foos {
+				foos[i] = &Foo{Val: i}
+			}
+			So(ds.Put(c, foos), ShouldBeNil)
+			ids := make([]int64, n)
+			for i, f := range foos {
+				ids[i] = f.ID
+			}
+			return ids
+		}
+
+		allocIDs := func(n int, parent *ds.Key) []int64 {
+			keys := ds.NewIncompleteKeys(c, n, "Foo", parent)
+			So(ds.AllocateIDs(c, keys), ShouldBeNil)
+			ids := make([]int64, n)
+			for i, k := range keys {
+				So(k.Parent(), ShouldResemble, parent)
+				ids[i] = k.IntID()
+			}
+			return ids
+		}
+
+		Convey("is sequential by default", func() {
+			So(putIDs(3), ShouldResemble, []int64{1, 2, 3})
+			So(allocIDs(2, nil), ShouldResemble, []int64{4, 5})
+		})
+
+		Convey("ScatteredIDs", func() {
+			tst.SetIDAllocationPolicy(ds.ScatteredIDs)
+			ids := append(putIDs(50), allocIDs(50, ds.MakeKey(c, "Parent", 1))...)
+
+			seen := map[int64]bool{}
+			sorted := true
+			for i, id := range ids {
+				So(id, ShouldBeBetween, 0, int64(1)<<53)
+				So(seen[id], ShouldBeFalse)
+				seen[id] = true
+				if i > 0 && i < 50 && id < ids[i-1] {
+					sorted = false
+				}
+			}
+			So(sorted, ShouldBeFalse)
+
+			Convey("and back to sequential", func() {
+				tst.SetIDAllocationPolicy(ds.SequentialIDs)
+				So(putIDs(1), ShouldResemble, []int64{1})
+			})
+		})
+
+		Convey("SeededIDs is reproducible", func() {
+			tst.SetIDAllocationPolicy(ds.SeededIDs(42))
+			first := append(putIDs(5), allocIDs(5, nil)...)
+
+			c = Use(context.Background())
+			tst = ds.GetTestable(c)
+			tst.SetIDAllocationPolicy(ds.SeededIDs(42))
+			So(append(putIDs(5), allocIDs(5, nil)...), ShouldResemble, first)
+
+			tst.SetIDAllocationPolicy(ds.SeededIDs(43))
+			So(putIDs(5), ShouldNotResemble, first[:5])
+		})
+
+		Convey("scattered IDs skip existing entities", func() {
+			tst.SetIDAllocationPolicy(ds.SeededIDs(1))
+			taken := putIDs(1)[0]
+			So(ds.Put(c, &Foo{ID: taken, Val: 100}), ShouldBeNil)
+
+			tst.SetIDAllocationPolicy(ds.SeededIDs(1))
+			So(putIDs(1)[0], ShouldNotEqual, taken)
+		})
+	})
+}
+
+func TestConsistencyPolicy(t *testing.T) {
+	t.Parallel()
+
+	Convey("SetConsistencyPolicy", t, func() {
+		c := Use(context.Background())
+		tst := ds.GetTestable(c)
+
+		count := func(c context.Context) int64 {
+			n, err := ds.Count(c, ds.NewQuery("Foo"))
+			So(err, ShouldBeNil)
+			return n
+		}
+
+		Convey("StrongConsistency", func() {
+			tst.SetConsistencyPolicy(ds.StrongConsistency)
+			So(ds.Put(c, &Foo{ID: 1}), ShouldBeNil)
+			So(count(c), ShouldEqual, 1)
+		})
+
+		Convey("ManualConsistency", func() {
+			tst.SetConsistencyPolicy(ds.ManualConsistency)
+			So(ds.Put(c, &Foo{ID: 1}), ShouldBeNil)
+			So(count(c), ShouldEqual, 0)
+			tst.CatchupIndexes()
+			So(count(c), ShouldEqual, 1)
+		})
+
+		Convey("RandomConsistency", func() {
+			Convey("with probability 1 applies writes before the next query", func() {
+				tst.SetConsistencyPolicy(ds.RandomConsistency(1, 0))
+				So(ds.Put(c, &Foo{ID: 1}), ShouldBeNil)
+				So(count(c), ShouldEqual, 1)
+				So(ds.Delete(c, ds.MakeKey(c, "Foo", 1)), ShouldBeNil)
+				So(count(c), ShouldEqual, 0)
+			})
+
+			Convey("with probability 0 waits for CatchupIndexes", func() {
+				tst.SetConsistencyPolicy(ds.RandomConsistency(0, 0))
+				So(ds.Put(c, &Foo{ID: 1}), ShouldBeNil)
+				So(count(c), ShouldEqual, 0)
+				So(count(c), ShouldEqual, 0)
+				tst.CatchupIndexes()
+				So(count(c), ShouldEqual, 1)
+			})
+
+			Convey("doesn't affect ancestor queries and gets", func() {
+				tst.SetConsistencyPolicy(ds.RandomConsistency(0, 0))
+				parent := ds.MakeKey(c, "Parent", 1)
+				So(ds.Put(c, &Foo{ID: 1, Parent: parent}), ShouldBeNil)
+				So(ds.Get(c, &Foo{ID: 1, Parent: parent}), ShouldBeNil)
+				n, err := ds.Count(c, ds.NewQuery("Foo").Ancestor(parent))
+				So(err, ShouldBeNil)
+				So(n, ShouldEqual, 1)
+			})
+
+			// run puts 10 entity groups of two entities each, and returns the
+			// query counts until all of them are visible.
+			run := func(c context.Context, seed int64) []int64 {
+				ds.GetTestable(c).SetConsistencyPolicy(ds.RandomConsistency(0.3, seed))
+				for i := int64(1); i <= 10; i++ {
+					parent := ds.MakeKey(c, "Parent", i)
+					So(ds.Put(c, []*Foo{{ID: 1, Parent: parent}, {ID: 2, Parent: parent}}), ShouldBeNil)
+				}
+				var counts []int64
+				for len(counts) < 100 {
+					n := count(c)
+					counts = append(counts, n)
+					if n == 20 {
+						break
+					}
+				}
+				return counts
+			}
+
+			Convey("applies writes gradually, by entity group", func() {
+				counts := run(c, 1)
+				So(counts[len(counts)-1], ShouldEqual, 20)
+				So(len(counts), ShouldBeGreaterThan, 1)
+				for i, n := range counts {
+					So(n%2, ShouldEqual, 0)
+					if i > 0 {
+						So(n, ShouldBeGreaterThanOrEqualTo, counts[i-1])
+					}
+				}
+			})
+
+			Convey("is reproducible", func() {
+				So(run(Use(context.Background()), 5), ShouldResemble, run(c, 5))
+			})
+
+			Convey("builds new indexes over visible writes", func() {
+				tst.SetConsistencyPolicy(ds.RandomConsistency(0, 0))
+				So(ds.Put(c, &Foo{ID: 1, Val: 1, Name: "a"}), ShouldBeNil)
+				tst.CatchupIndexes()
+				So(ds.Put(c, &Foo{ID: 2, Val: 1, Name: "b"}), ShouldBeNil)
+
+				tst.AddIndexes(&ds.IndexDefinition{
+					Kind:   "Foo",
+					SortBy: []ds.IndexColumn{{Property: "Val"}, {Property: "Name"}},
+				})
+				var names []string
+				q := ds.NewQuery("Foo").Eq("Val", 1).Gte("Name", "a")
+				So(ds.Run(c, q, func(f *Foo) { names = append(names, f.Name) }), ShouldBeNil)
+				So(names, ShouldResemble, []string{"a"})
+
+				tst.CatchupIndexes()
+				names = nil
+				So(ds.Run(c, q, func(f *Foo) { names = append(names, f.Name) }), ShouldBeNil)
+				So(names, ShouldResemble, []string{"a", "b"})
+			})
+		})
+
+		Convey("Consistent switches away from RandomConsistency", func() {
+			tst.SetConsistencyPolicy(ds.RandomConsistency(0, 0))
+			tst.Consistent(true)
+			So(ds.Put(c, &Foo{ID: 1}), ShouldBeNil)
+			So(count(c), ShouldEqual, 1)
+		})
+
+		Convey("RandomConsistency rejects bad probabilities", func() {
+			So(func() { ds.RandomConsistency(1.5, 0) }, ShouldPanic)
+		})
+	})
+}
+
+func TestReadOnlyTransactions(t *testing.T) {
+	t.Parallel()
+
+	Convey("Read-only transactions", t, func() {
+		c := Use(context.Background())
+		So(ds.Put(c, &Foo{ID: 1, Val: 1}), ShouldBeNil)
+		ro := &ds.TransactionOptions{ReadOnly: true}
+
+		Convey("can read", func() {
+			So(ds.RunInTransaction(c, func(c context.Context) error {
+				f := &Foo{ID: 1}
+				So(ds.Get(c, f), ShouldBeNil)
+				So(f.Val, ShouldEqual, 1)
+				return nil
+			}, ro), ShouldBeNil)
+		})
+
+		Convey("reject mutations", func() {
+			So(ds.RunInTransaction(c, func(c context.Context) error {
+				So(ds.Put(c, &Foo{ID: 1, Val: 2}), ShouldErrLike, "read-only transaction")
+				So(ds.Put(c, &Foo{Val: 2}), ShouldErrLike, "read-only transaction")
+				So(ds.Delete(c, ds.MakeKey(c, "Foo", 1)), ShouldErrLike, "read-only transaction")
+				So(ds.AllocateIDs(c, ds.NewIncompleteKeys(c, 1, "Foo", nil)), ShouldErrLike, "read-only transaction")
+				So(tq.Add(c, "", &tq.Task{}), ShouldErrLike, "read-only transaction")
+				return nil
+			}, ro), ShouldBeNil)
+
+			f := &Foo{ID: 1}
+			So(ds.Get(c, f), ShouldBeNil)
+			So(f.Val, ShouldEqual, 1)
+			So(tq.GetTestable(c).GetScheduledTasks()["default"], ShouldBeEmpty)
+		})
+
+		Convey("never conflict or retry", func() {
+			ds.GetTestable(c).SetTransactionRetryCount(2)
+			attempts := 0
+			So(ds.RunInTransaction(c, func(ic context.Context) error {
+				attempts++
+				So(ds.Get(ic, &Foo{ID: 1}), ShouldBeNil)
+				// A concurrent write to the entity group which was read.
+				So(ds.Put(c, &Foo{ID: 1, Val: 2}), ShouldBeNil)
+				return nil
+			}, ro), ShouldBeNil)
+			So(attempts, ShouldEqual, 1)
+
+			Convey("unlike read-write ones", func() {
+				attempts = 0
+				So(ds.RunInTransaction(c, func(c context.Context) error {
+					attempts++
+					return nil
+				}, nil), ShouldBeNil)
+				So(attempts, ShouldEqual, 3)
+			})
+		})
+	})
+}
+
 func TestConcurrentTxn(t *testing.T) {
 	t.Parallel()
 
@@ -0,0 +1,242 @@
+// Copyright 2018 The LUCI Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dsapi
+
+import (
+	"strings"
+	"time"
+
+	"github.com/golang/protobuf/ptypes"
+	structpb "github.com/golang/protobuf/ptypes/struct"
+	pb "google.golang.org/genproto/googleapis/datastore/v1"
+	"google.golang.org/genproto/googleapis/type/latlng"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"go.chromium.org/gae/service/blobstore"
+	ds "go.chromium.org/gae/service/datastore"
+)
+
+// entityKeyProperty is the name under which the key of an embedded entity is
+// kept in its PropertyMap, like impl/cloud does.
+const entityKeyProperty = "__key__"
+
+func invalidArgument(format string, args ...interface{}) error {
+	return status.Errorf(codes.InvalidArgument, format, args...)
+}
+
+// keyToGAE converts a v1 key of the given project. Only the last element of its
+// path may be incomplete.
+func keyToGAE(project string, k *pb.Key) (*ds.Key, error) {
+	if k == nil || len(k.Path) == 0 {
+		return nil, invalidArgument("a key must have a non-empty path")
+	}
+	if p := k.PartitionId.GetProjectId(); p != "" && p != project {
+		return nil, invalidArgument("mismatched project %q in key, expected %q", p, project)
+	}
+
+	toks := make([]ds.KeyTok, len(k.Path))
+	for i, e := range k.Path {
+		if e.Kind == "" {
+			return nil, invalidArgument("a key path element must have a kind")
+		}
+		toks[i].Kind = e.Kind
+		switch id := e.IdType.(type) {
+		case *pb.Key_PathElement_Id:
+			toks[i].IntID = id.Id
+		case *pb.Key_PathElement_Name:
+			toks[i].StringID = id.Name
+		default:
+			if i != len(k.Path)-1 {
+				return nil, invalidArgument("only the last element of a key path may be incomplete")
+			}
+		}
+	}
+	return ds.MkKeyContext(project, k.PartitionId.GetNamespaceId()).NewKeyToks(toks), nil
+}
+
+func keyToProto(k *ds.Key) *pb.Key {
+	aid, ns, toks := k.Split()
+	ret := &pb.Key{
+		PartitionId: &pb.PartitionId{ProjectId: aid, NamespaceId: ns},
+		Path:        make([]*pb.Key_PathElement, len(toks)),
+	}
+	for i, tok := range toks {
+		e := &pb.Key_PathElement{Kind: tok.Kind}
+		switch {
+		case tok.StringID != "":
+			e.IdType = &pb.Key_PathElement_Name{Name: tok.StringID}
+		case tok.IntID != 0:
+			e.IdType = &pb.Key_PathElement_Id{Id: tok.IntID}
+		}
+		ret.Path[i] = e
+	}
+	return ret
+}
+
+// entityToGAE converts a v1 entity to a PropertyMap. If key is true, the
+// entity must have a key, which is stored in its "$key" field. Otherwise its
+// key, if any, is stored as entityKeyProperty, like for embedded entities.
+func entityToGAE(project string, e *pb.Entity, key bool) (ds.PropertyMap, error) {
+	pm := make(ds.PropertyMap, len(e.GetProperties())+1)
+	switch {
+	case key && e.GetKey() == nil:
+		return nil, invalidArgument("an entity must have a key")
+	case e.GetKey() != nil:
+		k, err := keyToGAE(project, e.Key)
+		if err != nil {
+			return nil, err
+		}
+		if key {
+			pm["$key"] = ds.MkPropertyNI(k)
+		} else {
+			pm[entityKeyProperty] = ds.MkPropertyNI(k)
+		}
+	}
+
+	for name, v := range e.GetProperties() {
+		if name == "" || strings.HasPrefix(name, "$") {
+			return nil, invalidArgument("unsupported property name %q", name)
+		}
+		arr, ok := v.ValueType.(*pb.Value_ArrayValue)
+		if !ok {
+			prop, err := valueToGAE(project, v)
+			if err != nil {
+				return nil, err
+			}
+			pm[name] = prop
+			continue
+		}
+		slice := make(ds.PropertySlice, len(arr.ArrayValue.GetValues()))
+		for i, v := range arr.ArrayValue.GetValues() {
+			var err error
+			if slice[i], err = valueToGAE(project, v); err != nil {
+				return nil, err
+			}
+		}
+		pm[name] = slice
+	}
+	return pm, nil
+}
+
+func valueToGAE(project string, v *pb.Value) (prop ds.Property, err error) {
+	var val interface{}
+	switch t := v.ValueType.(type) {
+	case nil, *pb.Value_NullValue:
+	case *pb.Value_BooleanValue:
+		val = t.BooleanValue
+	case *pb.Value_IntegerValue:
+		val = t.IntegerValue
+	case *pb.Value_DoubleValue:
+		val = t.DoubleValue
+	case *pb.Value_TimestampValue:
+		tm, err := ptypes.Timestamp(t.TimestampValue)
+		if err != nil {
+			return prop, invalidArgument("bad timestamp value: %s", err)
+		}
+		val = tm
+	case *pb.Value_KeyValue:
+		if val, err = keyToGAE(project, t.KeyValue); err != nil {
+			return
+		}
+	case *pb.Value_StringValue:
+		val = t.StringValue
+	case *pb.Value_BlobValue:
+		val = t.BlobValue
+	case *pb.Value_GeoPointValue:
+		val = ds.GeoPoint{Lat: t.GeoPointValue.GetLatitude(), Lng: t.GeoPointValue.GetLongitude()}
+	case *pb.Value_EntityValue:
+		if val, err = entityToGAE(project, t.EntityValue, false); err != nil {
+			return
+		}
+	case *pb.Value_ArrayValue:
+		return prop, invalidArgument("array values can't be nested")
+	default:
+		return prop, invalidArgument("unsupported value type %T", t)
+	}
+
+	is := ds.ShouldIndex
+	if v.ExcludeFromIndexes {
+		is = ds.NoIndex
+	}
+	if err = prop.SetValue(val, is); err != nil {
+		err = invalidArgument("%s", err)
+	}
+	return
+}
+
+// entityToProto converts a PropertyMap to a v1 entity with the given key.
+// Meta fields are skipped.
+func entityToProto(key *ds.Key, pm ds.PropertyMap) *pb.Entity {
+	ret := &pb.Entity{Properties: make(map[string]*pb.Value, len(pm))}
+	if key != nil {
+		ret.Key = keyToProto(key)
+	}
+	for name, pdata := range pm {
+		if strings.HasPrefix(name, "$") {
+			continue
+		}
+		switch t := pdata.(type) {
+		case ds.Property:
+			ret.Properties[name] = valueToProto(t)
+		case ds.PropertySlice:
+			vals := make([]*pb.Value, len(t))
+			for i, prop := range t {
+				vals[i] = valueToProto(prop)
+			}
+			ret.Properties[name] = &pb.Value{ValueType: &pb.Value_ArrayValue{
+				ArrayValue: &pb.ArrayValue{Values: vals},
+			}}
+		}
+	}
+	return ret
+}
+
+func valueToProto(prop ds.Property) *pb.Value {
+	ret := &pb.Value{ExcludeFromIndexes: prop.IndexSetting() == ds.NoIndex}
+	switch v := prop.Value().(type) {
+	case nil:
+		ret.ValueType = &pb.Value_NullValue{NullValue: structpb.NullValue_NULL_VALUE}
+	case bool:
+		ret.ValueType = &pb.Value_BooleanValue{BooleanValue: v}
+	case int64:
+		ret.ValueType = &pb.Value_IntegerValue{IntegerValue: v}
+	case float64:
+		ret.ValueType = &pb.Value_DoubleValue{DoubleValue: v}
+	case []byte:
+		ret.ValueType = &pb.Value_BlobValue{BlobValue: v}
+	case string:
+		ret.ValueType = &pb.Value_StringValue{StringValue: v}
+	case *ds.Key:
+		ret.ValueType = &pb.Value_KeyValue{KeyValue: keyToProto(v)}
+	case ds.GeoPoint:
+		ret.ValueType = &pb.Value_GeoPointValue{GeoPointValue: &latlng.LatLng{Latitude: v.Lat, Longitude: v.Lng}}
+	case ds.PropertyMap:
+		var key *ds.Key
+		if kp, ok := v[entityKeyProperty].(ds.Property); ok {
+			key, _ = kp.Value().(*ds.Key)
+		}
+		ent := entityToProto(key, v)
+		delete(ent.Properties, entityKeyProperty)
+		ret.ValueType = &pb.Value_EntityValue{EntityValue: ent}
+	case time.Time:
+		// Property times are always in the range of Timestamp.
+		ts, _ := ptypes.TimestampProto(v)
+		ret.ValueType = &pb.Value_TimestampValue{TimestampValue: ts}
+	case blobstore.Key:
+		ret.ValueType = &pb.Value_StringValue{StringValue: string(v)}
+	}
+	return ret
+}
@@ -0,0 +1,172 @@
+// Copyright 2018 The LUCI Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dsapi
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"unicode"
+
+	"github.com/golang/protobuf/jsonpb"
+	"github.com/golang/protobuf/proto"
+	pb "google.golang.org/genproto/googleapis/datastore/v1"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const protobufContentType = "application/x-protobuf"
+
+var _ http.Handler = (*Server)(nil)
+
+// httpStatus maps gRPC codes to HTTP status codes, like Google APIs do.
+var httpStatus = map[codes.Code]int{
+	codes.OK:                 http.StatusOK,
+	codes.InvalidArgument:    http.StatusBadRequest,
+	codes.FailedPrecondition: http.StatusBadRequest,
+	codes.NotFound:           http.StatusNotFound,
+	codes.AlreadyExists:      http.StatusConflict,
+	codes.Aborted:            http.StatusConflict,
+	codes.Unimplemented:      http.StatusNotImplemented,
+	codes.DeadlineExceeded:   http.StatusGatewayTimeout,
+}
+
+// ServeHTTP implements the HTTP API of Cloud Datastore v1, where methods are
+// called with a POST to /v1/projects/<project ID>:<method>, like
+// /v1/projects/my-project:runQuery. The request and response bodies are JSON, or binary protobuf if the request
+// has the Content-Type "application/x-protobuf".
+//
+// Like the emulator, it also answers "Ok" to GET /, for health checks.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/" && r.Method == "GET" {
+		w.Write([]byte("Ok\n"))
+		return
+	}
+
+	path := strings.TrimPrefix(r.URL.Path, "/v1/projects/")
+	i := strings.LastIndexByte(path, ':')
+	if path == r.URL.Path || i < 0 {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != "POST" {
+		http.Error(w, "only POST is supported", http.StatusMethodNotAllowed)
+		return
+	}
+	project, method := path[:i], path[i+1:]
+	binary := r.Header.Get("Content-Type") == protobufContentType
+
+	var req proto.Message
+	var call func() (proto.Message, error)
+	c := r.Context()
+	switch method {
+	case "lookup":
+		in := &pb.LookupRequest{}
+		req, call = in, func() (proto.Message, error) { in.ProjectId = project; return s.Lookup(c, in) }
+	case "runQuery":
+		in := &pb.RunQueryRequest{}
+		req, call = in, func() (proto.Message, error) { in.ProjectId = project; return s.RunQuery(c, in) }
+	case "beginTransaction":
+		in := &pb.BeginTransactionRequest{}
+		req, call = in, func() (proto.Message, error) { in.ProjectId = project; return s.BeginTransaction(c, in) }
+	case "commit":
+		in := &pb.CommitRequest{}
+		req, call = in, func() (proto.Message, error) { in.ProjectId = project; return s.Commit(c, in) }
+	case "rollback":
+		in := &pb.RollbackRequest{}
+		req, call = in, func() (proto.Message, error) { in.ProjectId = project; return s.Rollback(c, in) }
+	case "allocateIds":
+		in := &pb.AllocateIdsRequest{}
+		req, call = in, func() (proto.Message, error) { in.ProjectId = project; return s.AllocateIds(c, in) }
+	case "reserveIds":
+		in := &pb.ReserveIdsRequest{}
+		req, call = in, func() (proto.Message, error) { in.ProjectId = project; return s.ReserveIds(c, in) }
+	default:
+		writeHTTPError(w, status.Errorf(codes.NotFound, "unknown method %q", method))
+		return
+	}
+
+	if err := readMessage(r, binary, req); err != nil {
+		writeHTTPError(w, invalidArgument("bad request body: %s", err))
+		return
+	}
+	resp, err := call()
+	if err != nil {
+		writeHTTPError(w, err)
+		return
+	}
+
+	if binary {
+		out, err := proto.Marshal(resp)
+		if err != nil {
+			writeHTTPError(w, err)
+			return
+		}
+		w.Header().Set("Content-Type", protobufContentType)
+		w.Write(out)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	(&jsonpb.Marshaler{}).Marshal(w, resp)
+}
+
+func readMessage(r *http.Request, binary bool, msg proto.Message) error {
+	if !binary {
+		return (&jsonpb.Unmarshaler{AllowUnknownFields: true}).Unmarshal(r.Body, msg)
+	}
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return err
+	}
+	return proto.Unmarshal(body, msg)
+}
+
+// writeHTTPError writes err like Google APIs do, as a JSON object with the
+// status code, the message and the name of the gRPC code.
+func writeHTTPError(w http.ResponseWriter, err error) {
+	st, _ := status.FromError(grpcError(err))
+	code, ok := httpStatus[st.Code()]
+	if !ok {
+		code = http.StatusInternalServerError
+	}
+
+	type httpError struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+		Status  string `json:"status"`
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(map[string]httpError{
+		"error": {code, st.Message(), codeName(st.Code())},
+	})
+}
+
+// codeName returns the canonical name of a gRPC code, like "INVALID_ARGUMENT".
+func codeName(code codes.Code) string {
+	var buf bytes.Buffer
+	prevLower := false
+	for _, r := range code.String() {
+		isUpper := unicode.IsUpper(r)
+		if isUpper && prevLower {
+			buf.WriteByte('_')
+		}
+		buf.WriteRune(unicode.ToUpper(r))
+		prevLower = !isUpper
+	}
+	return buf.String()
+}
@@ -0,0 +1,127 @@
+// Copyright 2018 The LUCI Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dsapi
+
+import (
+	pb "google.golang.org/genproto/googleapis/datastore/v1"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	ds "go.chromium.org/gae/service/datastore"
+	"go.chromium.org/gae/service/info"
+
+	"golang.org/x/net/context"
+)
+
+type mutationOp int
+
+const (
+	opInsert mutationOp = iota
+	opUpdate
+	opUpsert
+	opDelete
+)
+
+// mutation is a validated pb.Mutation.
+type mutation struct {
+	op  mutationOp
+	key *ds.Key
+	// pm is the entity to write, with its key in "$key", or nil for deletions.
+	pm ds.PropertyMap
+}
+
+func mutationsToGAE(project string, muts []*pb.Mutation) ([]mutation, error) {
+	ret := make([]mutation, len(muts))
+	for i, m := range muts {
+		var ent *pb.Entity
+		switch op := m.Operation.(type) {
+		case *pb.Mutation_Insert:
+			ret[i].op, ent = opInsert, op.Insert
+		case *pb.Mutation_Update:
+			ret[i].op, ent = opUpdate, op.Update
+		case *pb.Mutation_Upsert:
+			ret[i].op, ent = opUpsert, op.Upsert
+		case *pb.Mutation_Delete:
+			key, err := keyToGAE(project, op.Delete)
+			if err != nil {
+				return nil, err
+			}
+			if key.IsIncomplete() {
+				return nil, invalidArgument("can't delete the incomplete key %s", key)
+			}
+			ret[i] = mutation{op: opDelete, key: key}
+			continue
+		default:
+			return nil, invalidArgument("unsupported mutation %T", op)
+		}
+
+		pm, err := entityToGAE(project, ent, true)
+		if err != nil {
+			return nil, err
+		}
+		ret[i].pm = pm
+		key := pm["$key"].(ds.Property)
+		ret[i].key = key.Value().(*ds.Key)
+		if ret[i].op == opUpdate && ret[i].key.IsIncomplete() {
+			return nil, invalidArgument("can't update the incomplete key %s", ret[i].key)
+		}
+	}
+	return ret, nil
+}
+
+// applyMutations applies muts in order in c, and returns their results. The
+// mutations may be in any namespace.
+//
+// Insertions fail if the entity already exists, and updates if it doesn't.
+// Outside of transactions, the mutations aren't atomic, like in production.
+func applyMutations(c context.Context, muts []mutation) ([]*pb.MutationResult, error) {
+	ret := make([]*pb.MutationResult, len(muts))
+	for i, m := range muts {
+		ret[i] = &pb.MutationResult{}
+
+		c, err := info.Namespace(c, m.key.Namespace())
+		if err != nil {
+			return nil, err
+		}
+
+		if m.op == opDelete {
+			if err := ds.Delete(c, m.key); err != nil && err != ds.ErrNoSuchEntity {
+				return nil, err
+			}
+			continue
+		}
+
+		if (m.op == opInsert && !m.key.IsIncomplete()) || m.op == opUpdate {
+			ex, err := ds.Exists(c, m.key)
+			if err != nil {
+				return nil, err
+			}
+			switch {
+			case m.op == opInsert && ex.All():
+				return nil, status.Errorf(codes.AlreadyExists, "entity already exists: %s", m.key)
+			case m.op == opUpdate && !ex.All():
+				return nil, status.Errorf(codes.NotFound, "no entity to update: %s", m.key)
+			}
+		}
+
+		if err := ds.Put(c, m.pm); err != nil {
+			return nil, err
+		}
+		if m.key.IsIncomplete() {
+			ret[i].Key = keyToProto(ds.KeyForObj(c, m.pm))
+		}
+	}
+	return ret, nil
+}
@@ -0,0 +1,282 @@
+// Copyright 2018 The LUCI Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dsapi
+
+import (
+	"sort"
+
+	pb "google.golang.org/genproto/googleapis/datastore/v1"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	ds "go.chromium.org/gae/service/datastore"
+	"go.chromium.org/gae/service/info"
+
+	"golang.org/x/net/context"
+)
+
+// maxBatchSize is the maximum number of results returned by a single RunQuery
+// call. Clients fetch the rest of the results with more calls.
+const maxBatchSize = 300
+
+// RunQuery implements pb.DatastoreServer.
+func (s *Server) RunQuery(_ context.Context, req *pb.RunQueryRequest) (*pb.RunQueryResponse, error) {
+	c, err := s.project(req.ProjectId)
+	if err != nil {
+		return nil, err
+	}
+	q := req.GetQuery()
+	if q == nil {
+		return nil, status.Errorf(codes.Unimplemented, "GQL queries are not supported")
+	}
+	if p := req.PartitionId.GetProjectId(); p != "" && p != req.ProjectId {
+		return nil, invalidArgument("mismatched project %q in partition, expected %q", p, req.ProjectId)
+	}
+
+	c, done, err := s.readContext(c, req.ReadOptions)
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+	if c, err = info.Namespace(c, req.PartitionId.GetNamespaceId()); err != nil {
+		return nil, invalidArgument("%s", err)
+	}
+
+	dq, err := queryToGAE(c, req.ProjectId, q)
+	if err != nil {
+		return nil, err
+	}
+	if req.ReadOptions.GetReadConsistency() == pb.ReadOptions_EVENTUAL {
+		dq = dq.EventualConsistency(true)
+	}
+	fq, err := dq.Finalize()
+	if err != nil {
+		return nil, invalidArgument("%s", err)
+	}
+
+	batch, err := runQuery(c, fq, q)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return &pb.RunQueryResponse{Batch: batch, Query: q}, nil
+}
+
+// queryToGAE converts a v1 query, without its offset and limit (see runQuery).
+func queryToGAE(c context.Context, project string, q *pb.Query) (*ds.Query, error) {
+	if len(q.Kind) > 1 {
+		return nil, invalidArgument("queries may have at most one kind")
+	}
+	dq := ds.NewQuery("")
+	if len(q.Kind) == 1 {
+		dq = dq.Kind(q.Kind[0].Name)
+	}
+
+	var err error
+	if dq, err = filterToGAE(project, dq, q.Filter); err != nil {
+		return nil, err
+	}
+
+	for _, o := range q.Order {
+		name := o.Property.GetName()
+		if o.Direction == pb.PropertyOrder_DESCENDING {
+			name = "-" + name
+		}
+		dq = dq.Order(name)
+	}
+
+	proj := make([]string, len(q.Projection))
+	for i, p := range q.Projection {
+		proj[i] = p.Property.GetName()
+	}
+	switch {
+	case len(proj) == 1 && proj[0] == "__key__":
+		dq = dq.KeysOnly(true)
+	case len(proj) > 0:
+		dq = dq.Project(proj...)
+	}
+
+	if len(q.DistinctOn) > 0 {
+		distinct := make([]string, len(q.DistinctOn))
+		for i, p := range q.DistinctOn {
+			distinct[i] = p.GetName()
+		}
+		if !sameNames(distinct, proj) {
+			return nil, status.Errorf(codes.Unimplemented, "only distinct on all of the projected properties is supported")
+		}
+		dq = dq.Distinct(true)
+	}
+
+	if len(q.StartCursor) > 0 {
+		cur, err := decodeCursor(c, q.StartCursor)
+		if err != nil {
+			return nil, err
+		}
+		dq = dq.Start(cur)
+	}
+	if len(q.EndCursor) > 0 {
+		cur, err := decodeCursor(c, q.EndCursor)
+		if err != nil {
+			return nil, err
+		}
+		dq = dq.End(cur)
+	}
+	return dq, nil
+}
+
+func decodeCursor(c context.Context, b []byte) (ds.Cursor, error) {
+	cur, err := ds.DecodeCursor(c, string(b))
+	if err != nil {
+		return nil, invalidArgument("bad cursor: %s", err)
+	}
+	return cur, nil
+}
+
+func sameNames(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	a = append([]string(nil), a...)
+	b = append([]string(nil), b...)
+	sort.Strings(a)
+	sort.Strings(b)
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func filterToGAE(project string, dq *ds.Query, f *pb.Filter) (*ds.Query, error) {
+	switch t := f.GetFilterType().(type) {
+	case nil:
+		return dq, nil
+
+	case *pb.Filter_CompositeFilter:
+		if t.CompositeFilter.Op != pb.CompositeFilter_AND {
+			return nil, invalidArgument("unsupported composite filter operator %s", t.CompositeFilter.Op)
+		}
+		for _, sub := range t.CompositeFilter.Filters {
+			var err error
+			if dq, err = filterToGAE(project, dq, sub); err != nil {
+				return nil, err
+			}
+		}
+		return dq, nil
+
+	case *pb.Filter_PropertyFilter:
+		pf := t.PropertyFilter
+		name := pf.Property.GetName()
+		if _, ok := pf.Value.GetValueType().(*pb.Value_ArrayValue); ok {
+			return nil, invalidArgument("can't filter on an array value")
+		}
+		prop, err := valueToGAE(project, pf.Value)
+		if err != nil {
+			return nil, err
+		}
+		v := prop.Value()
+
+		switch pf.Op {
+		case pb.PropertyFilter_EQUAL:
+			return dq.Eq(name, v), nil
+		case pb.PropertyFilter_LESS_THAN:
+			return dq.Lt(name, v), nil
+		case pb.PropertyFilter_LESS_THAN_OR_EQUAL:
+			return dq.Lte(name, v), nil
+		case pb.PropertyFilter_GREATER_THAN:
+			return dq.Gt(name, v), nil
+		case pb.PropertyFilter_GREATER_THAN_OR_EQUAL:
+			return dq.Gte(name, v), nil
+		case pb.PropertyFilter_HAS_ANCESTOR:
+			anc, ok := v.(*ds.Key)
+			if name != "__key__" || !ok {
+				return nil, invalidArgument("ancestor filters must be on __key__, with a key")
+			}
+			return dq.Ancestor(anc), nil
+		default:
+			return nil, invalidArgument("unsupported property filter operator %s", pf.Op)
+		}
+
+	default:
+		return nil, invalidArgument("unsupported filter %T", t)
+	}
+}
+
+// runQuery runs fq, and returns the next batch of results of q.
+//
+// The offset and limit of q are applied here, rather than by fq, to report how
+// many results were skipped, and whether there are more results past the
+// limit.
+func runQuery(c context.Context, fq *ds.FinalizedQuery, q *pb.Query) (*pb.QueryResultBatch, error) {
+	limit := int32(-1)
+	if q.Limit != nil {
+		limit = q.Limit.Value
+	}
+	batchSize := int32(maxBatchSize)
+	if limit >= 0 && limit < batchSize {
+		batchSize = limit
+	}
+	offset := q.Offset
+
+	ret := &pb.QueryResultBatch{
+		EntityResultType: pb.EntityResult_FULL,
+		EndCursor:        q.StartCursor,
+	}
+	switch {
+	case fq.KeysOnly():
+		ret.EntityResultType = pb.EntityResult_KEY_ONLY
+	case len(fq.Project()) > 0:
+		ret.EntityResultType = pb.EntityResult_PROJECTION
+	}
+
+	more := false
+	err := ds.Raw(c).Run(fq, func(key *ds.Key, pm ds.PropertyMap, getCursor ds.CursorCB) error {
+		if offset == 0 && int32(len(ret.EntityResults)) == batchSize {
+			more = true
+			return ds.Stop
+		}
+		cur, err := getCursor()
+		if err != nil {
+			return err
+		}
+		if offset > 0 {
+			offset--
+			ret.SkippedResults++
+			ret.SkippedCursor = []byte(cur.String())
+			return nil
+		}
+		ret.EndCursor = []byte(cur.String())
+		ret.EntityResults = append(ret.EntityResults, &pb.EntityResult{
+			Entity: entityToProto(key, pm),
+			Cursor: ret.EndCursor,
+		})
+		return nil
+	})
+	if err != nil && err != ds.Stop {
+		return nil, err
+	}
+
+	switch {
+	case more && (limit < 0 || int32(len(ret.EntityResults)) < limit):
+		ret.MoreResults = pb.QueryResultBatch_NOT_FINISHED
+	case more:
+		ret.MoreResults = pb.QueryResultBatch_MORE_RESULTS_AFTER_LIMIT
+	case len(q.EndCursor) > 0:
+		ret.MoreResults = pb.QueryResultBatch_MORE_RESULTS_AFTER_CURSOR
+	default:
+		ret.MoreResults = pb.QueryResultBatch_NO_MORE_RESULTS
+	}
+	return ret, nil
+}
@@ -0,0 +1,473 @@
+// Copyright 2018 The LUCI Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package dsapi serves in-memory datastores (see impl/memory) over the Cloud
+// Datastore v1 API, as a local replacement for the Cloud Datastore emulator.
+//
+// Server implements the gRPC service, which the Cloud client libraries use
+// when DATASTORE_EMULATOR_HOST is set, and the equivalent HTTP API, with
+// JSON or binary protobuf bodies. See tools/ds-emulator for a command which
+// serves both on the same port.
+//
+// Every project gets its own in-memory datastore, created on first use.
+// Unlike the default of impl/memory, these are strongly consistent and create
+// the composite indexes queries need automatically, like the emulator does.
+// Use Server.Project to change that, or to set up their contents.
+package dsapi
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	pb "google.golang.org/genproto/googleapis/datastore/v1"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"go.chromium.org/gae/impl/memory"
+	ds "go.chromium.org/gae/service/datastore"
+	"go.chromium.org/gae/service/info"
+
+	"go.chromium.org/luci/common/clock"
+	"go.chromium.org/luci/common/errors"
+
+	"golang.org/x/net/context"
+)
+
+// TransactionTimeout is how long a transaction may stay open before it's
+// rolled back, like in production.
+const TransactionTimeout = 270 * time.Second
+
+// Server implements the Cloud Datastore v1 API (pb.DatastoreServer) on top of
+// in-memory datastores.
+type Server struct {
+	// Methods this doesn't implement yet, like RunAggregationQuery, return
+	// codes.Unimplemented.
+	pb.UnimplementedDatastoreServer
+
+	base context.Context
+
+	mu       sync.Mutex
+	projects map[string]context.Context
+	txns     map[string]*txn
+	nextTxn  int64
+}
+
+var _ pb.DatastoreServer = (*Server)(nil)
+
+// New returns a Server whose in-memory datastores are installed in c.
+//
+// c must not already have a memory datastore installed; its clock is used for
+// transaction timeouts.
+func New(c context.Context) *Server {
+	return &Server{
+		base:     c,
+		projects: map[string]context.Context{},
+		txns:     map[string]*txn{},
+	}
+}
+
+// Project returns a context with the in-memory datastore of the given project
+// installed, creating it if needed.
+func (s *Server) Project(project string) context.Context {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	c, ok := s.projects[project]
+	if !ok {
+		c = memory.UseWithAppID(s.base, project)
+		tst := ds.GetTestable(c)
+		tst.Consistent(true)
+		tst.AutoIndex(true)
+		s.projects[project] = c
+	}
+	return c
+}
+
+func (s *Server) project(project string) (context.Context, error) {
+	if project == "" {
+		return nil, invalidArgument("the project ID is required")
+	}
+	return s.Project(project), nil
+}
+
+// byNamespace calls cb once per namespace of keys, with c switched to that
+// namespace and the indexes of its keys.
+//
+// Unlike the contexts of the datastore service, which are bound to a
+// namespace, Cloud Datastore requests may span namespaces.
+func byNamespace(c context.Context, keys []*ds.Key, cb func(c context.Context, idxs []int) error) error {
+	var nss []string
+	idxs := map[string][]int{}
+	for i, k := range keys {
+		ns := k.Namespace()
+		if _, ok := idxs[ns]; !ok {
+			nss = append(nss, ns)
+		}
+		idxs[ns] = append(idxs[ns], i)
+	}
+	for _, ns := range nss {
+		nc, err := info.Namespace(c, ns)
+		if err != nil {
+			return err
+		}
+		if err := cb(nc, idxs[ns]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// txn is an open transaction.
+//
+// The v1 API begins and commits transactions in separate calls, so each one
+// runs in a goroutine of its own, in ds.RunInTransaction, until it's ended.
+type txn struct {
+	readOnly bool
+
+	// mu serializes the operations in the transaction.
+	mu sync.Mutex
+	// c is the context of the transaction, set before ready is closed.
+	c     context.Context
+	ready chan struct{}
+
+	// end receives the function to commit the transaction with, or nil to roll
+	// it back.
+	end chan func(context.Context) error
+	// done is closed once the transaction is over, and err is set.
+	done chan struct{}
+	err  error
+}
+
+var errRolledBack = errors.New("transaction rolled back")
+
+func (s *Server) beginTxn(c context.Context, opts *ds.TransactionOptions) (string, error) {
+	t := &txn{
+		readOnly: opts.ReadOnly,
+		ready:    make(chan struct{}),
+		end:      make(chan func(context.Context) error),
+		done:     make(chan struct{}),
+	}
+
+	s.mu.Lock()
+	s.nextTxn++
+	id := fmt.Sprintf("txn-%d", s.nextTxn)
+	s.txns[id] = t
+	s.mu.Unlock()
+
+	go func() {
+		defer func() {
+			s.mu.Lock()
+			delete(s.txns, id)
+			s.mu.Unlock()
+			close(t.done)
+		}()
+
+		t.err = ds.RunInTransaction(c, func(c context.Context) error {
+			t.c = c
+			close(t.ready)
+			select {
+			case f := <-t.end:
+				if f == nil {
+					return errRolledBack
+				}
+				return f(c)
+			case <-clock.After(c, TransactionTimeout):
+				return errors.New("transaction expired")
+			}
+		}, opts)
+	}()
+
+	select {
+	case <-t.ready:
+		return id, nil
+	case <-t.done:
+		return "", t.err
+	}
+}
+
+// getTxn returns the open transaction with the given ID.
+func (s *Server) getTxn(id []byte) (*txn, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if t := s.txns[string(id)]; t != nil {
+		return t, nil
+	}
+	return nil, invalidArgument("invalid transaction %q: it doesn't exist, or has ended or expired", id)
+}
+
+// finish ends the transaction with f (see txn.end), and returns the result of
+// ds.RunInTransaction.
+func (t *txn) finish(f func(context.Context) error) error {
+	select {
+	case t.end <- f:
+	case <-t.done:
+	}
+	<-t.done
+	return t.err
+}
+
+// readContext returns the context to read in, given the read options of a
+// request, and a function to call once done with it.
+func (s *Server) readContext(c context.Context, ro *pb.ReadOptions) (context.Context, func(), error) {
+	if id := ro.GetTransaction(); id != nil {
+		t, err := s.getTxn(id)
+		if err != nil {
+			return nil, nil, err
+		}
+		t.mu.Lock()
+		return t.c, t.mu.Unlock, nil
+	}
+	return c, func() {}, nil
+}
+
+// Lookup implements pb.DatastoreServer.
+func (s *Server) Lookup(_ context.Context, req *pb.LookupRequest) (*pb.LookupResponse, error) {
+	c, err := s.project(req.ProjectId)
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]*ds.Key, len(req.Keys))
+	for i, k := range req.Keys {
+		if keys[i], err = keyToGAE(req.ProjectId, k); err != nil {
+			return nil, err
+		}
+		if keys[i].IsIncomplete() {
+			return nil, invalidArgument("can't look up the incomplete key %s", keys[i])
+		}
+	}
+
+	c, done, err := s.readContext(c, req.ReadOptions)
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+
+	pms := make([]ds.PropertyMap, len(keys))
+	for i, k := range keys {
+		pms[i] = ds.PropertyMap{"$key": ds.MkPropertyNI(k)}
+	}
+	errs := make([]error, len(keys))
+	err = byNamespace(c, keys, func(c context.Context, idxs []int) error {
+		batch := make([]ds.PropertyMap, len(idxs))
+		for j, i := range idxs {
+			batch[j] = pms[i]
+		}
+		err := ds.Get(c, batch)
+		if merr, ok := err.(errors.MultiError); ok {
+			for j, i := range idxs {
+				errs[i] = merr[j]
+			}
+			return nil
+		}
+		return err
+	})
+	if err != nil {
+		return nil, grpcError(err)
+	}
+
+	resp := &pb.LookupResponse{}
+	for i, k := range keys {
+		res := &pb.EntityResult{}
+		switch errs[i] {
+		case nil:
+			res.Entity = entityToProto(k, pms[i])
+			resp.Found = append(resp.Found, res)
+		case ds.ErrNoSuchEntity:
+			res.Entity = &pb.Entity{Key: keyToProto(k)}
+			resp.Missing = append(resp.Missing, res)
+		default:
+			return nil, grpcError(errs[i])
+		}
+	}
+	return resp, nil
+}
+
+// BeginTransaction implements pb.DatastoreServer.
+func (s *Server) BeginTransaction(_ context.Context, req *pb.BeginTransactionRequest) (*pb.BeginTransactionResponse, error) {
+	c, err := s.project(req.ProjectId)
+	if err != nil {
+		return nil, err
+	}
+	// Transactions are never retried: the client does that.
+	opts := &ds.TransactionOptions{Attempts: 1}
+	if req.TransactionOptions.GetReadOnly() != nil {
+		opts.ReadOnly = true
+	}
+	id, err := s.beginTxn(c, opts)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return &pb.BeginTransactionResponse{Transaction: []byte(id)}, nil
+}
+
+// Rollback implements pb.DatastoreServer.
+func (s *Server) Rollback(_ context.Context, req *pb.RollbackRequest) (*pb.RollbackResponse, error) {
+	if _, err := s.project(req.ProjectId); err != nil {
+		return nil, err
+	}
+	t, err := s.getTxn(req.Transaction)
+	if err != nil {
+		return nil, err
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if err := t.finish(nil); err != errRolledBack {
+		return nil, grpcError(err)
+	}
+	return &pb.RollbackResponse{}, nil
+}
+
+// Commit implements pb.DatastoreServer.
+func (s *Server) Commit(_ context.Context, req *pb.CommitRequest) (*pb.CommitResponse, error) {
+	c, err := s.project(req.ProjectId)
+	if err != nil {
+		return nil, err
+	}
+	muts, err := mutationsToGAE(req.ProjectId, req.Mutations)
+	if err != nil {
+		return nil, err
+	}
+
+	resp := &pb.CommitResponse{}
+	apply := func(c context.Context) (err error) {
+		resp.MutationResults, err = applyMutations(c, muts)
+		return
+	}
+
+	switch req.Mode {
+	case pb.CommitRequest_TRANSACTIONAL:
+		t, err := s.getTxn(req.GetTransaction())
+		if err != nil {
+			return nil, err
+		}
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		if t.readOnly && len(muts) > 0 {
+			t.finish(nil)
+			return nil, invalidArgument("can't write in a read-only transaction")
+		}
+		err = t.finish(apply)
+		if err != nil {
+			return nil, grpcError(err)
+		}
+
+	case pb.CommitRequest_NON_TRANSACTIONAL:
+		if req.GetTransaction() != nil {
+			return nil, invalidArgument("non-transactional commits can't have a transaction")
+		}
+		if err := apply(c); err != nil {
+			return nil, grpcError(err)
+		}
+
+	default:
+		return nil, invalidArgument("unsupported commit mode %s", req.Mode)
+	}
+	return resp, nil
+}
+
+// AllocateIds implements pb.DatastoreServer.
+func (s *Server) AllocateIds(_ context.Context, req *pb.AllocateIdsRequest) (*pb.AllocateIdsResponse, error) {
+	c, err := s.project(req.ProjectId)
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]*ds.Key, len(req.Keys))
+	for i, k := range req.Keys {
+		if keys[i], err = keyToGAE(req.ProjectId, k); err != nil {
+			return nil, err
+		}
+		if !keys[i].IsIncomplete() {
+			return nil, invalidArgument("can't allocate an ID for the complete key %s", keys[i])
+		}
+	}
+	err = byNamespace(c, keys, func(c context.Context, idxs []int) error {
+		batch := make([]*ds.Key, len(idxs))
+		for j, i := range idxs {
+			batch[j] = keys[i]
+		}
+		if err := ds.AllocateIDs(c, batch); err != nil {
+			return err
+		}
+		for j, i := range idxs {
+			keys[i] = batch[j]
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, grpcError(err)
+	}
+
+	resp := &pb.AllocateIdsResponse{Keys: make([]*pb.Key, len(keys))}
+	for i, k := range keys {
+		resp.Keys[i] = keyToProto(k)
+	}
+	return resp, nil
+}
+
+// ReserveIds implements pb.DatastoreServer.
+//
+// The memory datastore never allocates IDs of existing entities, so reserving
+// IDs only validates the keys.
+func (s *Server) ReserveIds(_ context.Context, req *pb.ReserveIdsRequest) (*pb.ReserveIdsResponse, error) {
+	if _, err := s.project(req.ProjectId); err != nil {
+		return nil, err
+	}
+	for _, k := range req.Keys {
+		key, err := keyToGAE(req.ProjectId, k)
+		if err != nil {
+			return nil, err
+		}
+		if key.IsIncomplete() {
+			return nil, invalidArgument("can't reserve the incomplete key %s", key)
+		}
+	}
+	return &pb.ReserveIdsResponse{}, nil
+}
+
+// grpcError converts an error of the datastore service to a gRPC status error,
+// with the code Cloud Datastore would use.
+func grpcError(err error) error {
+	if merr, ok := err.(errors.MultiError); ok {
+		for _, e := range merr {
+			if e != nil {
+				err = e
+				break
+			}
+		}
+	}
+	if _, ok := status.FromError(err); ok {
+		return err
+	}
+
+	code := codes.Unknown
+	switch e := errors.Unwrap(err); {
+	case e == ds.ErrConcurrentTransaction:
+		code = codes.Aborted
+	case ds.IsErrInvalidKey(err), ds.IsErrBadRequest(err):
+		code = codes.InvalidArgument
+	default:
+		switch e := e.(type) {
+		case *memory.ErrMissingIndex, *memory.ErrIndexNotServing:
+			code = codes.FailedPrecondition
+		case interface{ IsTimeout() bool }:
+			// The memory datastore times out writes to contended entity groups,
+			// which Cloud Datastore reports as ABORTED.
+			if e.IsTimeout() {
+				code = codes.Aborted
+			}
+		}
+	}
+	return status.Error(code, err.Error())
+}
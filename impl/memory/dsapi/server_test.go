@@ -0,0 +1,265 @@
+// Copyright 2018 The LUCI Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dsapi
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/datastore"
+	"google.golang.org/api/option"
+	pb "google.golang.org/genproto/googleapis/datastore/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"go.chromium.org/gae/impl/cloud"
+	ds "go.chromium.org/gae/service/datastore"
+
+	"go.chromium.org/luci/common/clock"
+	"go.chromium.org/luci/common/clock/testclock"
+
+	"golang.org/x/net/context"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+const project = "test-app"
+
+// timeoutError is like the memory datastore's contention errors.
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "timeout" }
+func (timeoutError) IsTimeout() bool { return true }
+
+func TestServer(t *testing.T) {
+	t.Parallel()
+
+	Convey("Server", t, func() {
+		c, _ := testclock.UseTime(context.Background(), testclock.TestRecentTimeUTC)
+		srv := New(c)
+		mem := srv.Project(project)
+
+		Convey("over gRPC, with the Cloud client", func() {
+			gs := grpc.NewServer()
+			pb.RegisterDatastoreServer(gs, srv)
+			l, err := net.Listen("tcp", "localhost:0")
+			So(err, ShouldBeNil)
+			go gs.Serve(l)
+			defer gs.Stop()
+
+			conn, err := grpc.Dial(l.Addr().String(), grpc.WithInsecure())
+			So(err, ShouldBeNil)
+			defer conn.Close()
+			client, err := datastore.NewClient(c, project, option.WithGRPCConn(conn))
+			So(err, ShouldBeNil)
+			c := (&cloud.ConfigLite{ProjectID: project, DS: client}).Use(c)
+
+			Convey("entities round-trip", func() {
+				pm := ds.PropertyMap{
+					"$key":   ds.MkPropertyNI(ds.MakeKey(c, "Thing", "a")),
+					"Int":    ds.MkProperty(1),
+					"Str":    ds.MkPropertyNI("hi"),
+					"Bytes":  ds.MkPropertyNI([]byte("bytes")),
+					"Time":   ds.MkProperty(testclock.TestRecentTimeUTC),
+					"Key":    ds.MkProperty(ds.MakeKey(c, "Other", 1)),
+					"Geo":    ds.MkProperty(ds.GeoPoint{Lat: 1, Lng: 2}),
+					"Multi":  ds.PropertySlice{ds.MkProperty(true), ds.MkProperty(2.5)},
+					"Nil":    ds.MkProperty(nil),
+					"Nested": ds.MkPropertyNI(ds.PropertyMap{"Inner": ds.MkPropertyNI("x")}),
+				}
+				So(ds.Put(c, pm), ShouldBeNil)
+
+				stored := ds.PropertyMap{"$key": ds.MkPropertyNI(ds.MakeKey(mem, "Thing", "a"))}
+				So(ds.Get(mem, stored), ShouldBeNil)
+				So(stored.Slice("Multi"), ShouldResemble, pm.Slice("Multi"))
+				So(stored["Str"], ShouldResemble, pm["Str"])
+				So(stored["Nested"], ShouldResemble, pm["Nested"])
+
+				got := ds.PropertyMap{"$key": ds.MkPropertyNI(ds.MakeKey(c, "Thing", "a"))}
+				So(ds.Get(c, got), ShouldBeNil)
+				So(got, ShouldResemble, pm)
+			})
+
+			Convey("missing entities", func() {
+				So(ds.Get(c, ds.PropertyMap{"$key": ds.MkPropertyNI(ds.MakeKey(c, "Thing", "missing"))}),
+					ShouldEqual, ds.ErrNoSuchEntity)
+			})
+
+			Convey("IDs are allocated", func() {
+				pm := ds.PropertyMap{"$kind": ds.MkPropertyNI("Thing")}
+				So(ds.Put(c, pm), ShouldBeNil)
+				key := ds.KeyForObj(c, pm)
+				So(key.IntID(), ShouldNotEqual, 0)
+				So(ds.Get(mem, ds.PropertyMap{"$key": ds.MkPropertyNI(ds.MakeKey(mem, "Thing", key.IntID()))}), ShouldBeNil)
+
+				keys := ds.NewIncompleteKeys(c, 2, "Thing", nil)
+				So(ds.AllocateIDs(c, keys), ShouldBeNil)
+				So(keys[0].IntID(), ShouldNotEqual, keys[1].IntID())
+			})
+
+			Convey("queries", func() {
+				for i := int64(1); i <= 700; i++ {
+					So(ds.Put(mem, ds.PropertyMap{
+						"$key": ds.MkPropertyNI(ds.MakeKey(mem, "Item", i)),
+						"Val":  ds.MkProperty(i % 10),
+					}), ShouldBeNil)
+				}
+
+				Convey("span several batches", func() {
+					n, err := ds.Count(c, ds.NewQuery("Item"))
+					So(err, ShouldBeNil)
+					So(n, ShouldEqual, 700)
+				})
+
+				Convey("with filters, orders, offsets and limits", func() {
+					q := ds.NewQuery("Item").Gte("Val", 8).Order("-Val", "__key__").Offset(5).Limit(3)
+					var keys []*ds.Key
+					So(ds.GetAll(c, q, &keys), ShouldBeNil)
+					So(keys, ShouldResemble, []*ds.Key{
+						ds.MakeKey(c, "Item", 59),
+						ds.MakeKey(c, "Item", 69),
+						ds.MakeKey(c, "Item", 79),
+					})
+				})
+
+				Convey("with cursors", func() {
+					q := ds.NewQuery("Item").Eq("Val", 3).Limit(2)
+					var cur ds.Cursor
+					So(ds.Run(c, q, func(pm ds.PropertyMap, cb ds.CursorCB) (err error) {
+						cur, err = cb()
+						return
+					}), ShouldBeNil)
+
+					var keys []*ds.Key
+					So(ds.GetAll(c, q.Start(cur), &keys), ShouldBeNil)
+					So(keys, ShouldResemble, []*ds.Key{ds.MakeKey(c, "Item", 23), ds.MakeKey(c, "Item", 33)})
+				})
+			})
+
+			Convey("transactions", func() {
+				key := ds.MakeKey(c, "Counter", 1)
+				incr := func(c context.Context) error {
+					pm := ds.PropertyMap{"$key": ds.MkPropertyNI(key)}
+					if err := ds.Get(c, pm); err != nil && err != ds.ErrNoSuchEntity {
+						return err
+					}
+					n := int64(0)
+					if vals := pm.Slice("N"); len(vals) > 0 {
+						n = vals[0].Value().(int64)
+					}
+					pm["N"] = ds.MkProperty(n + 1)
+					return ds.Put(c, pm)
+				}
+				counter := func() int64 {
+					pm := ds.PropertyMap{"$key": ds.MkPropertyNI(ds.MakeKey(mem, "Counter", 1))}
+					So(ds.Get(mem, pm), ShouldBeNil)
+					return pm.Slice("N")[0].Value().(int64)
+				}
+
+				Convey("commit", func() {
+					So(ds.RunInTransaction(c, incr, nil), ShouldBeNil)
+					So(ds.RunInTransaction(c, incr, nil), ShouldBeNil)
+					So(counter(), ShouldEqual, 2)
+				})
+
+				Convey("roll back", func() {
+					So(ds.RunInTransaction(c, incr, nil), ShouldBeNil)
+					fail := errors.New("fail")
+					So(ds.RunInTransaction(c, func(c context.Context) error {
+						So(incr(c), ShouldBeNil)
+						return fail
+					}, nil), ShouldEqual, fail)
+					So(counter(), ShouldEqual, 1)
+
+					srv.mu.Lock()
+					defer srv.mu.Unlock()
+					So(srv.txns, ShouldBeEmpty)
+				})
+			})
+		})
+
+		Convey("over HTTP", func() {
+			hs := httptest.NewServer(srv)
+			defer hs.Close()
+
+			call := func(method, body string) (int, map[string]interface{}) {
+				resp, err := http.Post(hs.URL+"/v1/projects/"+project+":"+method, "application/json", strings.NewReader(body))
+				So(err, ShouldBeNil)
+				defer resp.Body.Close()
+				var ret map[string]interface{}
+				So(json.NewDecoder(resp.Body).Decode(&ret), ShouldBeNil)
+				return resp.StatusCode, ret
+			}
+
+			code, _ := call("commit", `{
+				"mode": "NON_TRANSACTIONAL",
+				"mutations": [{"insert": {
+					"key": {"path": [{"kind": "Thing", "name": "a"}]},
+					"properties": {"Val": {"integerValue": "3"}}
+				}}]
+			}`)
+			So(code, ShouldEqual, http.StatusOK)
+
+			pm := ds.PropertyMap{"$key": ds.MkPropertyNI(ds.MakeKey(mem, "Thing", "a"))}
+			So(ds.Get(mem, pm), ShouldBeNil)
+			So(pm["Val"], ShouldResemble, ds.MkProperty(3))
+
+			code, resp := call("lookup", `{"keys": [{"path": [{"kind": "Thing", "name": "a"}]}]}`)
+			So(code, ShouldEqual, http.StatusOK)
+			So(resp["found"], ShouldHaveLength, 1)
+
+			Convey("with errors", func() {
+				code, resp := call("commit", `{
+					"mode": "NON_TRANSACTIONAL",
+					"mutations": [{"insert": {"key": {"path": [{"kind": "Thing", "name": "a"}]}}}]
+				}`)
+				So(code, ShouldEqual, http.StatusConflict)
+				So(resp["error"].(map[string]interface{})["status"], ShouldEqual, "ALREADY_EXISTS")
+			})
+		})
+
+		Convey("errors map to gRPC codes", func() {
+			So(status.Code(grpcError(ds.ErrConcurrentTransaction)), ShouldEqual, codes.Aborted)
+			So(status.Code(grpcError(timeoutError{})), ShouldEqual, codes.Aborted)
+			So(status.Code(grpcError(ds.MakeErrBadRequest("entity is too big").Err())),
+				ShouldEqual, codes.InvalidArgument)
+			So(status.Code(grpcError(ds.MakeErrInvalidKey("bad key").Err())),
+				ShouldEqual, codes.InvalidArgument)
+			So(status.Code(grpcError(errors.New("boom"))), ShouldEqual, codes.Unknown)
+		})
+
+		Convey("transactions expire", func() {
+			tc := testclock.New(testclock.TestRecentTimeUTC)
+			srv := New(clock.Set(context.Background(), tc))
+			tc.SetTimerCallback(func(time.Duration, clock.Timer) { tc.Add(TransactionTimeout) })
+
+			resp, err := srv.BeginTransaction(c, &pb.BeginTransactionRequest{ProjectId: project})
+			So(err, ShouldBeNil)
+			_, err = srv.Commit(c, &pb.CommitRequest{
+				ProjectId:           project,
+				Mode:                pb.CommitRequest_TRANSACTIONAL,
+				TransactionSelector: &pb.CommitRequest_Transaction{Transaction: resp.Transaction},
+			})
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
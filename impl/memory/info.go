@@ -99,6 +99,20 @@ func (gi *giImpl) DefaultVersionHostname() string {
 	return fmt.Sprintf("%s.example.com", gi.appID)
 }
 
+// IsTimeoutError mirrors appengine.IsTimeoutError, so that it recognizes the
+// timeouts simulated by the datastore (see Testable.SetContentionPolicy).
+func (gi *giImpl) IsTimeoutError(err error) bool {
+	if err == context.DeadlineExceeded {
+		return true
+	}
+	if t, ok := err.(interface {
+		IsTimeout() bool
+	}); ok {
+		return t.IsTimeout()
+	}
+	return false
+}
+
 func (gi *giImpl) IsDevAppServer() bool {
 	return true
 }
@@ -17,6 +17,7 @@ package memory
 import (
 	"testing"
 
+	ds "go.chromium.org/gae/service/datastore"
 	"go.chromium.org/gae/service/info"
 	"golang.org/x/net/context"
 
@@ -42,5 +43,9 @@ func TestMustNamespace(t *testing.T) {
 		// Derive inner context, "override" applies.
 		c = info.MustNamespace(c, "valid_namespace_name")
 		So(info.RequestID(c), ShouldEqual, "override")
+
+		So(info.IsTimeoutError(c, context.DeadlineExceeded), ShouldBeTrue)
+		So(info.IsTimeoutError(c, errTooMuchContention), ShouldBeTrue)
+		So(info.IsTimeoutError(c, ds.ErrNoSuchEntity), ShouldBeFalse)
 	})
 }
@@ -15,7 +15,9 @@
 package memory
 
 import (
-	"encoding/binary"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
@@ -130,6 +132,27 @@ func (m *memcacheData) delItemLocked(k string) {
 	}
 }
 
+// setCounterLocked sets the item with the key to the decimal value val, which
+// is how counters are stored. The item keeps the flags and the expiration time
+// of cur, the current item, if it's not nil.
+func (m *memcacheData) setCounterLocked(now time.Time, key string, cur *mcDataItem, val uint64) {
+	itm := &mcItem{key: key, value: []byte(strconv.FormatUint(val, 10))}
+	if cur == nil {
+		m.setItemLocked(now, itm)
+		return
+	}
+	itm.flags = cur.flags
+	exp := cur.expiration
+	m.setItemLocked(now, itm)
+	m.items[key].expiration = exp
+}
+
+// parseCounter parses the decimal value of a counter. Like memcached, it
+// ignores trailing spaces, which decrementing may leave.
+func parseCounter(value []byte) (uint64, error) {
+	return strconv.ParseUint(strings.TrimRight(string(value), " "), 10, 64)
+}
+
 func (m *memcacheData) reset() {
 	m.stats = mc.Statistics{}
 	m.items = map[string]*mcDataItem{}
@@ -325,15 +348,16 @@ func (m *memcacheImpl) Increment(key string, delta int64, initialValue *uint64)
 	defer m.data.lock.Unlock()
 
 	cur := uint64(0)
-	switch item, err := m.data.retrieveLocked(now, key); {
+	item, err := m.data.retrieveLocked(now, key)
+	switch {
 	case err == mc.ErrCacheMiss && initialValue != nil:
 		cur = *initialValue
 	case err != nil:
 		return 0, err
-	case len(item.value) != 8:
-		return 0, errors.New("memcache Increment: got invalid current value")
 	default:
-		cur = binary.LittleEndian.Uint64(item.value)
+		if cur, err = parseCounter(item.value); err != nil {
+			return 0, errors.New("memcache Increment: got invalid current value")
+		}
 	}
 
 	if delta < 0 {
@@ -346,10 +370,7 @@ func (m *memcacheImpl) Increment(key string, delta int64, initialValue *uint64)
 		cur += uint64(delta)
 	}
 
-	newval := make([]byte, 8)
-	binary.LittleEndian.PutUint64(newval, cur)
-	m.data.setItemLocked(now, m.NewItem(key).SetValue(newval))
-
+	m.data.setCounterLocked(now, key, item, cur)
 	return cur, nil
 }
 
@@ -360,3 +381,39 @@ func (m *memcacheImpl) Stats() (*mc.Statistics, error) {
 	ret := m.data.stats
 	return &ret, nil
 }
+
+// MemcacheItems returns the unexpired items of the memory memcache of c, in the
+// current namespace of c, sorted by key. Unlike items retrieved with Get, their
+// Expiration is the time they have left to live, or 0 if they never expire.
+//
+// This is meant for inspecting the memcache, e.g. in a development console.
+// c must have the memory memcache installed (see Use), without filters.
+func MemcacheItems(c context.Context) []mc.Item {
+	impl, ok := mc.Raw(c).(*memcacheImpl)
+	if !ok {
+		panic(errors.New("memory.MemcacheItems: no unfiltered memory memcache in context"))
+	}
+	m := impl.data
+	now := clock.Now(c)
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	keys := make([]string, 0, len(m.items))
+	for key := range m.items {
+		if m.hasItemLocked(now, key) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	ret := make([]mc.Item, len(keys))
+	for i, key := range keys {
+		itm := m.items[key].toUserItem(key)
+		if exp := m.items[key].expiration; !exp.IsZero() {
+			itm.expiration = exp.Sub(now)
+		}
+		ret[i] = itm
+	}
+	return ret
+}
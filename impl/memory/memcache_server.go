@@ -0,0 +1,410 @@
+// Copyright 2018 The LUCI Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package memory
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	mc "go.chromium.org/gae/service/memcache"
+
+	"go.chromium.org/luci/common/clock"
+	"go.chromium.org/luci/common/errors"
+
+	"golang.org/x/net/context"
+)
+
+const (
+	// maxMemcacheKeyLen and maxMemcacheValueLen are memcached's default limits.
+	maxMemcacheKeyLen   = 250
+	maxMemcacheValueLen = 1 << 20
+
+	// relativeExpirationLimit is the largest expiration time which memcached
+	// treats as relative to now. Larger ones are Unix times.
+	relativeExpirationLimit = 60 * 60 * 24 * 30
+)
+
+// MemcacheServer serves the memory memcache of a context over the memcached
+// ASCII protocol, so that memcached clients (like the one of impl/cloud) can be
+// tested without a memcached binary.
+//
+// It implements the get, gets, set, add, cas, delete, incr, decr, touch,
+// flush_all, stats, version and quit commands. Like memcache.Increment, incr
+// and decr operate on decimal values.
+type MemcacheServer struct {
+	c    context.Context
+	data *memcacheData
+
+	mu        sync.Mutex
+	closed    bool
+	listeners map[net.Listener]struct{}
+	conns     map[net.Conn]struct{}
+}
+
+// NewMemcacheServer returns a MemcacheServer for the memcache of c, in the
+// current namespace of c. c must have the memory memcache installed (see Use),
+// without filters.
+func NewMemcacheServer(c context.Context) *MemcacheServer {
+	impl, ok := mc.Raw(c).(*memcacheImpl)
+	if !ok {
+		panic(errors.New("memory.NewMemcacheServer: no unfiltered memory memcache in context"))
+	}
+	return &MemcacheServer{
+		c:         c,
+		data:      impl.data,
+		listeners: map[net.Listener]struct{}{},
+		conns:     map[net.Conn]struct{}{},
+	}
+}
+
+// Serve accepts connections on l and serves them, until l fails or the server
+// is closed.
+func (s *MemcacheServer) Serve(l net.Listener) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return errors.New("memory: MemcacheServer closed")
+	}
+	s.listeners[l] = struct{}{}
+	s.mu.Unlock()
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			delete(s.listeners, l)
+			if s.closed {
+				return nil
+			}
+			return err
+		}
+
+		s.mu.Lock()
+		if s.closed {
+			s.mu.Unlock()
+			conn.Close()
+			return nil
+		}
+		s.conns[conn] = struct{}{}
+		s.mu.Unlock()
+
+		go func() {
+			s.serveConn(conn)
+			conn.Close()
+
+			s.mu.Lock()
+			delete(s.conns, conn)
+			s.mu.Unlock()
+		}()
+	}
+}
+
+// Close closes all of the listeners and connections of the server.
+func (s *MemcacheServer) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.closed = true
+	for l := range s.listeners {
+		l.Close()
+	}
+	for conn := range s.conns {
+		conn.Close()
+	}
+	return nil
+}
+
+// mcCommand is a parsed command line.
+type mcCommand struct {
+	name    string
+	args    []string
+	noreply bool
+}
+
+func (s *MemcacheServer) serveConn(rw io.ReadWriter) {
+	r := bufio.NewReader(rw)
+	w := bufio.NewWriter(rw)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		cmd := mcCommand{}
+		if fields := strings.Fields(line); len(fields) > 0 {
+			cmd.name, cmd.args = fields[0], fields[1:]
+		}
+		if n := len(cmd.args); n > 0 && cmd.args[n-1] == "noreply" {
+			cmd.args, cmd.noreply = cmd.args[:n-1], true
+		}
+
+		var resp string
+		switch cmd.name {
+		case "get", "gets":
+			s.get(w, cmd.name == "gets", cmd.args)
+		case "set", "add", "cas":
+			resp = s.store(r, cmd)
+		case "delete":
+			resp = s.delete(cmd.args)
+		case "incr", "decr":
+			resp = s.incr(cmd.name == "decr", cmd.args)
+		case "touch":
+			resp = s.touch(cmd.args)
+		case "flush_all":
+			s.data.lock.Lock()
+			s.data.reset()
+			s.data.lock.Unlock()
+			resp = "OK"
+		case "stats":
+			s.stats(w)
+		case "version":
+			resp = "VERSION 1.4.0"
+		case "quit":
+			w.Flush()
+			return
+		default:
+			resp = "ERROR"
+		}
+
+		if resp != "" && !cmd.noreply {
+			fmt.Fprintf(w, "%s\r\n", resp)
+		}
+		// Pipelined commands are answered together.
+		if r.Buffered() == 0 {
+			if err := w.Flush(); err != nil {
+				return
+			}
+		}
+	}
+}
+
+const badFormat = "CLIENT_ERROR bad command line format"
+
+func validMemcacheKey(key string) bool {
+	return len(key) <= maxMemcacheKeyLen
+}
+
+// expiration converts a memcached expiration time to a relative expiration,
+// like mc.Item's.
+func (s *MemcacheServer) expiration(now time.Time, exptime int64) time.Duration {
+	switch {
+	case exptime == 0:
+		return 0
+	case exptime > relativeExpirationLimit:
+		if d := time.Unix(exptime, 0).Sub(now); d > 0 {
+			return d
+		}
+	case exptime > 0:
+		return time.Duration(exptime) * time.Second
+	}
+	// The item expires right away.
+	return -time.Second
+}
+
+func (s *MemcacheServer) get(w io.Writer, withCAS bool, keys []string) {
+	now := clock.Now(s.c)
+	for _, key := range keys {
+		s.data.lock.Lock()
+		itm, err := s.data.retrieveLocked(now, key)
+		var value []byte
+		var flags uint32
+		var casID uint64
+		if err == nil {
+			value, flags, casID = itm.value, itm.flags, itm.casID
+		}
+		s.data.lock.Unlock()
+		if err != nil {
+			continue
+		}
+
+		if withCAS {
+			fmt.Fprintf(w, "VALUE %s %d %d %d\r\n", key, flags, len(value), casID)
+		} else {
+			fmt.Fprintf(w, "VALUE %s %d %d\r\n", key, flags, len(value))
+		}
+		w.Write(value)
+		io.WriteString(w, "\r\n")
+	}
+	io.WriteString(w, "END\r\n")
+}
+
+func (s *MemcacheServer) store(r *bufio.Reader, cmd mcCommand) string {
+	// <command> <key> <flags> <exptime> <bytes> [<cas unique>]
+	nargs := 4
+	if cmd.name == "cas" {
+		nargs = 5
+	}
+	if len(cmd.args) != nargs {
+		return "ERROR"
+	}
+	size, err := strconv.Atoi(cmd.args[3])
+	if err != nil || size < 0 {
+		return badFormat
+	}
+	// The data block must be read even if the command is otherwise bad.
+	data := make([]byte, size+2)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return ""
+	}
+	if string(data[size:]) != "\r\n" {
+		// Skip the rest of the line too, or it would be read as a command.
+		if data[size+1] != '\n' {
+			if _, err := r.ReadString('\n'); err != nil {
+				return ""
+			}
+		}
+		return "CLIENT_ERROR bad data chunk"
+	}
+	data = data[:size]
+
+	key := cmd.args[0]
+	flags, err1 := strconv.ParseUint(cmd.args[1], 10, 32)
+	exptime, err2 := strconv.ParseInt(cmd.args[2], 10, 64)
+	var casID uint64
+	var err3 error
+	if cmd.name == "cas" {
+		casID, err3 = strconv.ParseUint(cmd.args[4], 10, 64)
+	}
+	if err1 != nil || err2 != nil || err3 != nil || !validMemcacheKey(key) {
+		return badFormat
+	}
+	if size > maxMemcacheValueLen {
+		return "SERVER_ERROR object too large for cache"
+	}
+
+	now := clock.Now(s.c)
+	itm := &mcItem{key: key, value: data, flags: uint32(flags), expiration: s.expiration(now, exptime)}
+
+	s.data.lock.Lock()
+	defer s.data.lock.Unlock()
+	switch cmd.name {
+	case "add":
+		if s.data.hasItemLocked(now, key) {
+			return "NOT_STORED"
+		}
+	case "cas":
+		cur, err := s.data.retrieveLocked(now, key)
+		switch {
+		case err != nil:
+			return "NOT_FOUND"
+		case cur.casID != casID:
+			return "EXISTS"
+		}
+	}
+	s.data.setItemLocked(now, itm)
+	return "STORED"
+}
+
+func (s *MemcacheServer) delete(args []string) string {
+	// delete <key> [0]
+	if len(args) == 0 || len(args) > 2 || (len(args) == 2 && args[1] != "0") {
+		return badFormat
+	}
+	now := clock.Now(s.c)
+
+	s.data.lock.Lock()
+	defer s.data.lock.Unlock()
+	if !s.data.hasItemLocked(now, args[0]) {
+		return "NOT_FOUND"
+	}
+	s.data.delItemLocked(args[0])
+	return "DELETED"
+}
+
+func (s *MemcacheServer) incr(decr bool, args []string) string {
+	// incr|decr <key> <value>
+	if len(args) != 2 {
+		return "ERROR"
+	}
+	delta, err := strconv.ParseUint(args[1], 10, 64)
+	if err != nil {
+		return "CLIENT_ERROR invalid numeric delta argument"
+	}
+	key := args[0]
+	now := clock.Now(s.c)
+
+	s.data.lock.Lock()
+	defer s.data.lock.Unlock()
+	cur, err := s.data.retrieveLocked(now, key)
+	if err != nil {
+		return "NOT_FOUND"
+	}
+	val, err := parseCounter(cur.value)
+	if err != nil {
+		return "CLIENT_ERROR cannot increment or decrement non-numeric value"
+	}
+
+	switch {
+	case !decr:
+		// Like in memcached, this wraps around.
+		val += delta
+	case delta > val:
+		val = 0
+	default:
+		val -= delta
+	}
+
+	s.data.setCounterLocked(now, key, cur, val)
+	return strconv.FormatUint(val, 10)
+}
+
+func (s *MemcacheServer) touch(args []string) string {
+	// touch <key> <exptime>
+	if len(args) != 2 {
+		return "ERROR"
+	}
+	exptime, err := strconv.ParseInt(args[1], 10, 64)
+	if err != nil {
+		return badFormat
+	}
+	now := clock.Now(s.c)
+
+	s.data.lock.Lock()
+	defer s.data.lock.Unlock()
+	if !s.data.hasItemLocked(now, args[0]) {
+		return "NOT_FOUND"
+	}
+	exp := time.Time{}
+	if d := s.expiration(now, exptime); d != 0 {
+		exp = now.Add(d).Truncate(time.Second)
+	}
+	s.data.items[args[0]].expiration = exp
+	return "TOUCHED"
+}
+
+func (s *MemcacheServer) stats(w io.Writer) {
+	s.data.lock.Lock()
+	st := s.data.stats
+	s.data.lock.Unlock()
+
+	for _, stat := range []struct {
+		name  string
+		value uint64
+	}{
+		{"curr_items", st.Items},
+		{"bytes", st.Bytes},
+		{"get_hits", st.Hits},
+		{"get_misses", st.Misses},
+	} {
+		fmt.Fprintf(w, "STAT %s %d\r\n", stat.name, stat.value)
+	}
+	io.WriteString(w, "END\r\n")
+}
@@ -0,0 +1,132 @@
+// Copyright 2018 The LUCI Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package memory
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	mc "go.chromium.org/gae/service/memcache"
+
+	"go.chromium.org/luci/common/clock/testclock"
+
+	"golang.org/x/net/context"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestMemcacheServer(t *testing.T) {
+	t.Parallel()
+
+	Convey("MemcacheServer", t, func() {
+		c, tc := testclock.UseTime(context.Background(), testclock.TestRecentTimeUTC)
+		c = Use(c)
+		srv := NewMemcacheServer(c)
+
+		client, server := net.Pipe()
+		go srv.serveConn(server)
+		defer client.Close()
+		r := bufio.NewReader(client)
+
+		// do sends a request and reads the given number of response lines.
+		// The deadline is in real time: it makes a protocol mismatch fail the
+		// test instead of hanging it.
+		do := func(req string, lines int) string {
+			So(client.SetDeadline(time.Now().Add(10*time.Second)), ShouldBeNil)
+			_, err := fmt.Fprint(client, req)
+			So(err, ShouldBeNil)
+			var resp []string
+			for i := 0; i < lines; i++ {
+				line, err := r.ReadString('\n')
+				So(err, ShouldBeNil)
+				resp = append(resp, line)
+			}
+			return strings.Join(resp, "")
+		}
+
+		Convey("stores and retrieves items", func() {
+			So(do("set a 42 0 5\r\nhello\r\n", 1), ShouldEqual, "STORED\r\n")
+			So(do("get a missing\r\n", 3), ShouldEqual, "VALUE a 42 5\r\nhello\r\nEND\r\n")
+
+			itm, err := mc.GetKey(c, "a")
+			So(err, ShouldBeNil)
+			So(itm.Value(), ShouldResemble, []byte("hello"))
+			So(itm.Flags(), ShouldEqual, 42)
+
+			So(do("add a 0 0 1\r\nx\r\n", 1), ShouldEqual, "NOT_STORED\r\n")
+			So(do("add b 0 0 1\r\nx\r\n", 1), ShouldEqual, "STORED\r\n")
+			So(do("delete b\r\n", 1), ShouldEqual, "DELETED\r\n")
+			So(do("delete b\r\n", 1), ShouldEqual, "NOT_FOUND\r\n")
+		})
+
+		Convey("compares and swaps", func() {
+			So(do("set a 0 0 1\r\nx\r\n", 1), ShouldEqual, "STORED\r\n")
+			var casID uint64
+			_, err := fmt.Sscanf(do("gets a\r\n", 3), "VALUE a 0 1 %d", &casID)
+			So(err, ShouldBeNil)
+
+			So(do(fmt.Sprintf("cas a 0 0 1 %d\r\ny\r\n", casID+1), 1), ShouldEqual, "EXISTS\r\n")
+			So(do(fmt.Sprintf("cas a 0 0 1 %d\r\ny\r\n", casID), 1), ShouldEqual, "STORED\r\n")
+			So(do(fmt.Sprintf("cas a 0 0 1 %d\r\nz\r\n", casID), 1), ShouldEqual, "EXISTS\r\n")
+			So(do("cas b 0 0 1 1\r\nz\r\n", 1), ShouldEqual, "NOT_FOUND\r\n")
+		})
+
+		Convey("increments decimal values", func() {
+			So(do("set n 7 0 2\r\n10\r\n", 1), ShouldEqual, "STORED\r\n")
+			So(do("incr n 5\r\n", 1), ShouldEqual, "15\r\n")
+			So(do("decr n 20\r\n", 1), ShouldEqual, "0\r\n")
+			So(do("incr n 18446744073709551615\r\n", 1), ShouldEqual, "18446744073709551615\r\n")
+			So(do("incr n 2\r\n", 1), ShouldEqual, "1\r\n")
+			So(do("get n\r\n", 3), ShouldEqual, "VALUE n 7 1\r\n1\r\nEND\r\n")
+
+			So(do("incr missing 1\r\n", 1), ShouldEqual, "NOT_FOUND\r\n")
+			So(do("set s 0 0 3\r\nabc\r\n", 1), ShouldEqual, "STORED\r\n")
+			So(do("incr s 1\r\n", 1), ShouldStartWith, "CLIENT_ERROR")
+		})
+
+		Convey("expires items", func() {
+			So(do("set a 0 10 1\r\nx\r\n", 1), ShouldEqual, "STORED\r\n")
+			abs := testclock.TestRecentTimeUTC.Add(20 * time.Second).Unix()
+			So(do(fmt.Sprintf("set b 0 %d 1\r\nx\r\n", abs), 1), ShouldEqual, "STORED\r\n")
+			So(do("set c 0 -1 1\r\nx\r\n", 1), ShouldEqual, "STORED\r\n")
+			So(do("get c\r\n", 1), ShouldEqual, "END\r\n")
+
+			tc.Add(15 * time.Second)
+			So(do("get a\r\n", 1), ShouldEqual, "END\r\n")
+			So(do("get b\r\n", 3), ShouldEqual, "VALUE b 0 1\r\nx\r\nEND\r\n")
+
+			So(do("touch b 100\r\n", 1), ShouldEqual, "TOUCHED\r\n")
+			tc.Add(15 * time.Second)
+			So(do("get b\r\n", 3), ShouldEqual, "VALUE b 0 1\r\nx\r\nEND\r\n")
+		})
+
+		Convey("handles noreply, flush_all and stats", func() {
+			So(do("set a 0 0 1 noreply\r\nx\r\nget a\r\n", 3), ShouldEqual, "VALUE a 0 1\r\nx\r\nEND\r\n")
+			So(do("stats\r\n", 5), ShouldContainSubstring, "STAT curr_items 1\r\n")
+			So(do("flush_all\r\n", 1), ShouldEqual, "OK\r\n")
+			So(do("get a\r\n", 1), ShouldEqual, "END\r\n")
+		})
+
+		Convey("rejects bad requests", func() {
+			So(do("bogus\r\n", 1), ShouldEqual, "ERROR\r\n")
+			So(do("set a 0 0 1\r\nxyz\r\n", 1), ShouldEqual, "CLIENT_ERROR bad data chunk\r\n")
+			So(do(fmt.Sprintf("set %s 0 0 1\r\nx\r\n", strings.Repeat("k", 251)), 1), ShouldStartWith, "CLIENT_ERROR")
+		})
+	})
+}
@@ -133,6 +133,21 @@ func TestMemcache(t *testing.T) {
 				So(err, ShouldBeNil)
 				So(val, ShouldEqual, 9)
 
+				Convey("stores decimal values", func() {
+					itm, err := mc.GetKey(c, "num")
+					So(err, ShouldBeNil)
+					So(itm.Value(), ShouldResemble, []byte("9"))
+
+					So(mc.Set(c, mc.NewItem(c, "num").SetValue([]byte("41")).SetFlags(5)), ShouldBeNil)
+					val, err = mc.IncrementExisting(c, "num", 1)
+					So(err, ShouldBeNil)
+					So(val, ShouldEqual, 42)
+
+					itm, err = mc.GetKey(c, "num")
+					So(err, ShouldBeNil)
+					So(itm.Flags(), ShouldEqual, 5)
+				})
+
 				Convey("Increment again", func() {
 					val, err = mc.Increment(c, "num", 7, 2)
 					So(err, ShouldBeNil)
@@ -232,6 +247,21 @@ func TestMemcache(t *testing.T) {
 			So(getItm, ShouldResemble, testItem)
 		})
 
+		Convey("MemcacheItems lists the unexpired items", func() {
+			So(mc.Set(c,
+				mc.NewItem(c, "b").SetValue([]byte("2")).SetExpiration(10*time.Second),
+				mc.NewItem(c, "a").SetValue([]byte("1")).SetFlags(7),
+				mc.NewItem(c, "c").SetValue([]byte("3")).SetExpiration(time.Second),
+			), ShouldBeNil)
+			tc.Add(4 * time.Second)
+
+			So(MemcacheItems(c), ShouldResemble, []mc.Item{
+				&mcItem{key: "a", value: []byte("1"), flags: 7, CasID: 2},
+				&mcItem{key: "b", value: []byte("2"), expiration: 6 * time.Second, CasID: 1},
+			})
+			So(MemcacheItems(info.MustNamespace(c, "other")), ShouldBeEmpty)
+		})
+
 		Convey("When adding an item to an unset namespace", func() {
 			So(info.GetNamespace(c), ShouldEqual, "")
 
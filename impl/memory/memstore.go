@@ -16,11 +16,11 @@ package memory
 
 import (
 	"bytes"
+	"fmt"
+	"sort"
+	"sync"
 
 	"go.chromium.org/gae/service/datastore"
-
-	"github.com/luci/gtreap"
-	"go.chromium.org/luci/common/data/treapstore"
 )
 
 type storeEntry struct {
@@ -28,14 +28,6 @@ type storeEntry struct {
 	value []byte
 }
 
-// storeEntryCompare is a gtreap.Compare function for *storeEntry.
-func storeEntryCompare(a, b interface{}) int {
-	// TODO(dnj): Investigate optimizing this by removing the type assertions,
-	// either by explicitly tailoring gtreap / treapstore to use []byte or by
-	// optimizing via special-case interface.
-	return bytes.Compare(a.(*storeEntry).key, b.(*storeEntry).key)
-}
-
 func memStoreCollide(o, n memCollection, f func(k, ov, nv []byte)) {
 	var oldIter, newIter memIterator
 	if o != nil {
@@ -100,12 +92,22 @@ type memStore interface {
 	GetOrCreateCollection(name string) memCollection
 	Snapshot() memStore
 
+	// Fork returns a new read/write store with the same contents as this one.
+	// Subsequent modifications of either store don't affect the other.
+	Fork() memStore
+
 	IsReadOnly() bool
 }
 
 // memIterator is an iterator over a memStore's contents.
+//
+// The entries it returns must not be modified.
 type memIterator interface {
 	Next() *storeEntry
+
+	// Seek moves the iterator to the first entry whose key is >= pivot. It's
+	// cheaper than making a new iterator.
+	Seek(pivot []byte)
 }
 
 // memVisitor is a callback for ForEachItem.
@@ -124,18 +126,30 @@ type memCollection interface {
 	IsReadOnly() bool
 }
 
+// memStoreImpl is a copy-on-write store of named collections, each of which
+// is a persistent btree.
+//
+// Because the btrees are persistent, both Snapshot and Fork are cheap: they
+// only copy the collection roots.
 type memStoreImpl struct {
-	s *treapstore.Store
+	readOnly bool
+
+	// lock protects colls and names.
+	lock  sync.RWMutex
+	colls map[string]*memCollectionImpl
+	// names is the sorted list of collection names. It's never modified in place,
+	// so it may be shared between stores.
+	names []string
 }
 
 var _ memStore = (*memStoreImpl)(nil)
 
 func (*memStoreImpl) ImATestingSnapshot() {}
 
-func (ms *memStoreImpl) IsReadOnly() bool { return ms.s.IsReadOnly() }
+func (ms *memStoreImpl) IsReadOnly() bool { return ms.readOnly }
 
 func newMemStore() memStore {
-	ret := memStore(&memStoreImpl{treapstore.New()})
+	ret := memStore(&memStoreImpl{colls: map[string]*memCollectionImpl{}})
 	if *logMemCollectionFolder != "" {
 		ret = wrapTracingMemStore(ret)
 	}
@@ -143,85 +157,177 @@ func newMemStore() memStore {
 }
 
 func (ms *memStoreImpl) Snapshot() memStore {
-	if ms.s.IsReadOnly() {
+	if ms.readOnly {
 		return ms
 	}
-	return &memStoreImpl{ms.s.Snapshot()}
+	return ms.clone(true)
+}
+
+func (ms *memStoreImpl) Fork() memStore { return ms.clone(false) }
+
+func (ms *memStoreImpl) clone(readOnly bool) *memStoreImpl {
+	ms.lock.RLock()
+	defer ms.lock.RUnlock()
+
+	ret := &memStoreImpl{
+		readOnly: readOnly,
+		colls:    make(map[string]*memCollectionImpl, len(ms.colls)),
+		names:    ms.names,
+	}
+	for name, coll := range ms.colls {
+		ret.colls[name] = &memCollectionImpl{
+			name:     name,
+			readOnly: readOnly,
+			tree:     coll.cloneTree(),
+		}
+	}
+	return ret
 }
 
 func (ms *memStoreImpl) GetCollection(name string) memCollection {
-	coll := ms.s.GetCollection(name)
-	if coll == nil {
-		return nil
+	ms.lock.RLock()
+	defer ms.lock.RUnlock()
+	if coll := ms.colls[name]; coll != nil {
+		return coll
 	}
-	return &memCollectionImpl{coll}
+	return nil
 }
 
 func (ms *memStoreImpl) GetOrCreateCollection(name string) memCollection {
-	coll := ms.s.GetCollection(name)
+	if coll := ms.GetCollection(name); coll != nil {
+		return coll
+	}
+	if ms.readOnly {
+		panic(fmt.Errorf("attempting to create collection %q in a read-only store", name))
+	}
+
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	coll := ms.colls[name]
 	if coll == nil {
-		coll = ms.s.CreateCollection(name, storeEntryCompare)
+		coll = &memCollectionImpl{name: name, tree: newBtree()}
+		ms.colls[name] = coll
+
+		i := sort.SearchStrings(ms.names, name)
+		names := make([]string, 0, len(ms.names)+1)
+		names = append(names, ms.names[:i]...)
+		names = append(names, name)
+		ms.names = append(names, ms.names[i:]...)
 	}
-	return &memCollectionImpl{coll}
+	return coll
 }
 
-func (ms *memStoreImpl) GetCollectionNames() []string { return ms.s.GetCollectionNames() }
+func (ms *memStoreImpl) GetCollectionNames() []string {
+	ms.lock.RLock()
+	defer ms.lock.RUnlock()
+	return ms.names
+}
 
 type memIteratorImpl struct {
-	base *gtreap.Iterator
+	root *btreeNode
+	it   btreeIterator
 }
 
-func (it *memIteratorImpl) Next() *storeEntry {
-	v, ok := it.base.Next()
-	if !ok {
-		return nil
-	}
-	return v.(*storeEntry)
-}
+func (it *memIteratorImpl) Next() *storeEntry { return it.it.next() }
+
+func (it *memIteratorImpl) Seek(pivot []byte) { it.it.seek(it.root, pivot) }
 
 type memCollectionImpl struct {
-	c *treapstore.Collection
+	name     string
+	readOnly bool
+
+	// lock protects tree. It's not needed for read-only collections, which are
+	// never modified.
+	lock sync.RWMutex
+	tree btree
 }
 
 var _ memCollection = (*memCollectionImpl)(nil)
 
-func (mc *memCollectionImpl) Name() string     { return mc.c.Name() }
-func (mc *memCollectionImpl) IsReadOnly() bool { return mc.c.IsReadOnly() }
+func (mc *memCollectionImpl) Name() string     { return mc.name }
+func (mc *memCollectionImpl) IsReadOnly() bool { return mc.readOnly }
+
+// cloneTree returns a clone of the collection's tree.
+func (mc *memCollectionImpl) cloneTree() btree {
+	if mc.readOnly {
+		return mc.tree
+	}
+	// Cloning changes the owner of the tree's nodes.
+	mc.lock.Lock()
+	defer mc.lock.Unlock()
+	return mc.tree.clone()
+}
+
+// lockForWrite locks the collection for modification.
+func (mc *memCollectionImpl) lockForWrite() {
+	if mc.readOnly {
+		panic(fmt.Errorf("attempting to modify read-only collection %q", mc.name))
+	}
+	mc.lock.Lock()
+}
+
+// rlock locks the collection for reading, until the returned function is
+// called. The nodes of a r/w collection's tree are modified in place, so they
+// must not be used after that.
+func (mc *memCollectionImpl) rlock() func() {
+	if mc.readOnly {
+		return func() {}
+	}
+	mc.lock.RLock()
+	return mc.lock.RUnlock
+}
 
 func (mc *memCollectionImpl) Get(k []byte) []byte {
-	if ent := mc.c.Get(storeKey(k)); ent != nil {
-		return ent.(*storeEntry).value
+	defer mc.rlock()()
+	if ent := mc.tree.get(k); ent != nil {
+		return ent.value
 	}
 	return nil
 }
 
 func (mc *memCollectionImpl) MinItem() *storeEntry {
-	ent, _ := mc.c.Min().(*storeEntry)
-	return ent
+	defer mc.rlock()()
+	if ent := mc.tree.min(); ent != nil {
+		cpy := *ent
+		return &cpy
+	}
+	return nil
 }
 
-func (mc *memCollectionImpl) Set(k, v []byte) { mc.c.Put(&storeEntry{k, v}) }
-func (mc *memCollectionImpl) Delete(k []byte) { mc.c.Delete(storeKey(k)) }
+func (mc *memCollectionImpl) Set(k, v []byte) {
+	mc.lockForWrite()
+	defer mc.lock.Unlock()
+	mc.tree.set(k, v)
+}
+
+func (mc *memCollectionImpl) Delete(k []byte) {
+	mc.lockForWrite()
+	defer mc.lock.Unlock()
+	mc.tree.delete(k)
+}
 
 func (mc *memCollectionImpl) Iterator(target []byte) memIterator {
-	if !mc.c.IsReadOnly() {
+	if !mc.readOnly {
 		// We prevent this to ensure our internal logic, not because it's actually
 		// an invalid operation.
 		panic("attempting to get Iterator from r/w memCollection")
 	}
-	return &memIteratorImpl{mc.c.Iterator(storeKey(target))}
+	it := &memIteratorImpl{root: mc.tree.root}
+	it.Seek(target)
+	return it
 }
 
 func (mc *memCollectionImpl) ForEachItem(fn memVisitor) {
-	mc.c.VisitAscend(storeKey(nil), func(it gtreap.Item) bool {
-		ent := it.(*storeEntry)
+	// Visit a clone, so that fn may modify the collection.
+	t := mc.cloneTree()
+	t.ascend(nil, func(ent *storeEntry) bool {
 		return fn(ent.key, ent.value)
 	})
 }
 
-func storeKey(k []byte) *storeEntry { return &storeEntry{k, nil} }
-
 // nilIterator is a memIterator that begins in a depleted state.
 type nilIterator struct{}
 
 func (it nilIterator) Next() *storeEntry { return nil }
+
+func (it nilIterator) Seek([]byte) {}
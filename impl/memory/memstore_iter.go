@@ -130,10 +130,13 @@ func (it *iterator) skip(targ []byte) {
 	if bytes.Compare(targ, it.start) < 0 {
 		targ = it.start
 	}
-	if it.base == nil || bytes.Compare(targ, it.lastKey) > 0 {
-		// If our skip target is >= our last key, then create a new Iterator
-		// starting from that target.
+	switch {
+	case it.base == nil:
 		it.base = it.def.c.Iterator(targ)
+	case bytes.Compare(targ, it.lastKey) > 0:
+		// If our skip target is >= our last key, then move the iterator to that
+		// target.
+		it.base.Seek(targ)
 	}
 }
 
@@ -138,3 +138,47 @@ func TestCollision(t *testing.T) {
 		}
 	})
 }
+
+func TestMemStore(t *testing.T) {
+	t.Parallel()
+
+	Convey("memStore", t, func() {
+		s := newMemStore()
+		s.GetOrCreateCollection("b").Set(cat(1), cat("one"))
+		s.GetOrCreateCollection("a").Set(cat(2), cat("two"))
+		So(s.GetCollectionNames(), ShouldResemble, []string{"a", "b"})
+		So(s.GetCollection("c"), ShouldBeNil)
+
+		Convey("Snapshot is read-only and isolated", func() {
+			snap := s.Snapshot()
+			So(snap.IsReadOnly(), ShouldBeTrue)
+			So(snap.Snapshot(), ShouldEqual, snap)
+
+			s.GetOrCreateCollection("b").Set(cat(1), cat("uno"))
+			s.GetOrCreateCollection("c").Set(cat(3), cat("three"))
+
+			So(snap.GetCollection("b").Get(cat(1)), ShouldResemble, cat("one"))
+			So(snap.GetCollection("c"), ShouldBeNil)
+			So(snap.GetCollectionNames(), ShouldResemble, []string{"a", "b"})
+			So(func() { snap.GetCollection("a").Set(cat(1), cat()) }, ShouldPanic)
+			So(func() { snap.GetOrCreateCollection("d") }, ShouldPanic)
+		})
+
+		Convey("Fork is writable and isolated", func() {
+			snap := s.Snapshot()
+			for _, src := range []memStore{s, snap} {
+				fork := src.Fork()
+				So(fork.IsReadOnly(), ShouldBeFalse)
+
+				fork.GetOrCreateCollection("a").Delete(cat(2))
+				fork.GetOrCreateCollection("z").Set(cat(4), cat("four"))
+				So(fork.GetCollection("a").Get(cat(2)), ShouldBeNil)
+				So(fork.GetCollectionNames(), ShouldResemble, []string{"a", "b", "z"})
+
+				So(src.GetCollection("a").Get(cat(2)), ShouldResemble, cat("two"))
+				So(src.GetCollection("z"), ShouldBeNil)
+				So(src.GetCollectionNames(), ShouldResemble, []string{"a", "b"})
+			}
+		})
+	})
+}
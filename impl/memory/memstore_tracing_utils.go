@@ -151,6 +151,13 @@ func (t *tracingMemStoreImpl) Snapshot() memStore {
 	return ret
 }
 
+func (t *tracingMemStoreImpl) Fork() memStore {
+	collName := fmt.Sprintf("coll%d", atomic.AddUint32(&logMemCounter, 1)-1)
+	ret := &tracingMemStoreImpl{t.i.Fork(), t.w, collName, 0, false}
+	t.w("%s := %s.Fork()", ret.ident(), t.ident())
+	return ret
+}
+
 func (t *tracingMemStoreImpl) IsReadOnly() bool {
 	return t.i.IsReadOnly()
 }
@@ -220,3 +227,8 @@ func (t *tracingMemIteratorImpl) Next() *storeEntry {
 	t.w(".Next() // Iterator #%d", t.num)
 	return t.i.Next()
 }
+
+func (t *tracingMemIteratorImpl) Seek(pivot []byte) {
+	t.w(".Seek(%#v) // Iterator #%d", pivot, t.num)
+	t.i.Seek(pivot)
+}
@@ -44,7 +44,8 @@ func TestRaceGetPut(t *testing.T) {
 
 				obj := pmap("$key", ds.MakeKey(c, "Obj", 1))
 				if err := ds.Get(c, obj); err != nil && err != ds.ErrNoSuchEntity {
-					t.Fatal("error get", err)
+					t.Error("error get", err)
+					return err
 				}
 				cur := int64(0)
 				if ps := obj.Slice("Value"); len(ps) > 0 {
@@ -58,7 +59,8 @@ func TestRaceGetPut(t *testing.T) {
 			}, &ds.TransactionOptions{Attempts: 200})
 
 			if err != nil {
-				t.Fatal("error during transaction", err)
+				t.Error("error during transaction", err)
+				return
 			}
 
 			atomic.AddInt32(&value, 1)
@@ -96,7 +98,8 @@ func TestRaceNonConflictingPuts(t *testing.T) {
 					"Value", 100))
 			}, nil)
 			if err != nil {
-				t.Fatal("error during transaction", err)
+				t.Error("error during transaction", err)
+				return
 			}
 			atomic.AddInt32(&num, 1)
 		}()
@@ -107,3 +110,56 @@ func TestRaceNonConflictingPuts(t *testing.T) {
 		t.Fatal("expected 100 runs, got", num)
 	}
 }
+
+func TestRaceConcurrentWritesAndQueries(t *testing.T) {
+	t.Parallel()
+
+	c := Use(context.Background())
+	ds.GetTestable(c).Consistent(true)
+
+	const writers, puts = 10, 20
+
+	wg := sync.WaitGroup{}
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			root := ds.MakeKey(c, "Root", i+1)
+			for j := 1; j <= puts; j++ {
+				err := ds.Put(c, pmap(
+					"$key", ds.NewKey(c, "Thing", "", int64(j), root), Next,
+					"Value", j))
+				if err != nil {
+					t.Error("error during put", err)
+					return
+				}
+			}
+		}(i)
+	}
+
+	// Queries read from snapshots, which must never see a partially applied put:
+	// every entity found in the index must also be there when fetched.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 50; i++ {
+			var things []ds.PropertyMap
+			if err := ds.GetAll(c, ds.NewQuery("Thing").Gte("Value", 1), &things); err != nil {
+				t.Error("error during query", err)
+				return
+			}
+		}
+	}()
+
+	wg.Wait()
+	<-done
+
+	count, err := ds.Count(c, ds.NewQuery("Thing"))
+	if err != nil {
+		t.Fatal("error during count", err)
+	}
+	if count != writers*puts {
+		t.Fatalf("expected %d entities, got %d", writers*puts, count)
+	}
+}
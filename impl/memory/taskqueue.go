@@ -205,6 +205,9 @@ func (t *taskqueueTxnImpl) AddMulti(tasks []*tq.Task, queueName string, cb tq.Ra
 	if err := assertTxnValid(t.ctx); err != nil {
 		return err
 	}
+	if err := assertTxnWritable(t.ctx); err != nil {
+		return err
+	}
 
 	// Reject the entire batch if at least one task is bad. That's how prod API
 	// behaves too.
@@ -28,7 +28,6 @@ import (
 	"golang.org/x/net/context"
 
 	prodConstraints "go.chromium.org/gae/impl/prod/constraints"
-	ds "go.chromium.org/gae/service/datastore"
 	tq "go.chromium.org/gae/service/taskqueue"
 )
 
@@ -375,7 +374,7 @@ func (t *taskQueueData) beginCommit(c context.Context, txnCtxObj memContextObj)
 	}
 }
 
-func (t *taskQueueData) mkTxn(*ds.TransactionOptions) memContextObj {
+func (t *taskQueueData) mkTxn(*txnOptions) memContextObj {
 	return &txnTaskQueueData{
 		parent: t,
 		anony:  tq.AnonymousQueueData{},
@@ -492,7 +491,7 @@ type txnTaskQueueData struct {
 
 var _ memContextObj = (*txnTaskQueueData)(nil)
 
-func (t *txnTaskQueueData) mkTxn(*ds.TransactionOptions) memContextObj {
+func (t *txnTaskQueueData) mkTxn(*txnOptions) memContextObj {
 	impossible(fmt.Errorf("cannot start nested transaction"))
 	return nil
 }
@@ -24,9 +24,17 @@ import (
 	"golang.org/x/net/context"
 )
 
+// errReadOnlyTxn is returned for mutations attempted in read-only
+// transactions.
+var errReadOnlyTxn = errors.New("cannot modify entities or add tasks in a read-only transaction")
+
 type transactionImpl struct {
 	// boolean 0 or 1, use atomic.*Int32 to access.
 	closed int32
+
+	// readOnly is true if the transaction was started with
+	// TransactionOptions.ReadOnly.
+	readOnly bool
 }
 
 func (ti *transactionImpl) close() error {
@@ -43,6 +51,13 @@ func (ti *transactionImpl) valid() error {
 	return nil
 }
 
+func (ti *transactionImpl) writable() error {
+	if ti.readOnly {
+		return errReadOnlyTxn
+	}
+	return nil
+}
+
 func assertTxnValid(c context.Context) error {
 	t := ds.CurrentTransaction(c)
 	if t == nil {
@@ -51,3 +66,12 @@ func assertTxnValid(c context.Context) error {
 
 	return t.(*transactionImpl).valid()
 }
+
+func assertTxnWritable(c context.Context) error {
+	t := ds.CurrentTransaction(c)
+	if t == nil {
+		return nil
+	}
+
+	return t.(*transactionImpl).writable()
+}
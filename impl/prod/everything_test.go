@@ -17,6 +17,7 @@
 package prod
 
 import (
+	"strings"
 	"testing"
 	"time"
 
@@ -291,6 +292,20 @@ func TestBasicDatastore(t *testing.T) {
 			So(ent["Time"], ShouldResemble, pm["Time"])
 		})
 
+		Convey("Put of a too big entity is a bad request", func() {
+			// The same as impl/memory with StrictLimits enabled.
+			pm := ds.PropertyMap{
+				"$key": mpNI(ds.MakeKey(ctx, "Huge", 1)),
+				"Blob": mpNI([]byte(strings.Repeat("x", 1<<20))),
+			}
+			err := ds.Put(ctx, pm)
+			So(ds.IsErrBadRequest(err), ShouldBeTrue)
+			So(ds.IsErrInvalidKey(err), ShouldBeFalse)
+
+			pm = ds.PropertyMap{"$key": mpNI(ds.MakeKey(ctx, "Huge", 1))}
+			So(ds.Get(ctx, pm), ShouldEqual, ds.ErrNoSuchEntity)
+		})
+
 		Convey("memcache: Set (nil) is the same as Set ([]byte{})", func() {
 			So(mc.Set(ctx, mc.NewItem(ctx, "bob")), ShouldBeNil) // normally would panic because Value is nil
 
@@ -15,6 +15,8 @@
 package prod
 
 import (
+	"reflect"
+
 	"go.chromium.org/gae/impl/prod/constraints"
 	ds "go.chromium.org/gae/service/datastore"
 
@@ -63,6 +65,31 @@ func fixMultiError(err error) error {
 	return err
 }
 
+// datastoreBadRequest is the datastore_v3 error code for BAD_REQUEST.
+const datastoreBadRequest = 1
+
+// fixBadRequest wraps the SDK's datastore BAD_REQUEST errors (returned e.g. for
+// entities over the size limits) in ds.ErrBadRequest, so that callers can test
+// for them with ds.IsErrBadRequest, like with the other implementations.
+//
+// The SDK's error type (internal.APIError) can't be imported, so its fields are
+// read with reflection.
+func fixBadRequest(err error) error {
+	v := reflect.ValueOf(err)
+	if v.Kind() != reflect.Ptr || v.Elem().Kind() != reflect.Struct {
+		return err
+	}
+	v = v.Elem()
+	service, code, detail := v.FieldByName("Service"), v.FieldByName("Code"), v.FieldByName("Detail")
+	if service.Kind() != reflect.String || code.Kind() != reflect.Int32 || detail.Kind() != reflect.String {
+		return err
+	}
+	if service.String() != "datastore_v3" || code.Int() != datastoreBadRequest {
+		return err
+	}
+	return ds.MakeErrBadRequest("%s", detail.String()).Err()
+}
+
 func idxCallbacker(err error, amt int, cb func(idx int, err error) error) error {
 	if err == nil {
 		for i := 0; i < amt; i++ {
@@ -76,13 +103,26 @@ func idxCallbacker(err error, amt int, cb func(idx int, err error) error) error
 	me, ok := err.(errors.MultiError)
 	if ok {
 		for i, err := range me {
-			if err := cb(i, err); err != nil {
+			if err := cb(i, fixBadRequest(err)); err != nil {
 				return err
 			}
 		}
 		return nil
 	}
-	return err
+	return fixBadRequest(err)
+}
+
+// errReadTime is returned for reads at a past time, which the App Engine
+// datastore API doesn't support.
+var errReadTime = errors.New("datastore: reads at a past time are not supported by impl/prod")
+
+// checkReadTime returns errReadTime if non-transactional reads in the user's
+// Context are at a past time (see ds.WithReadTime).
+func (d *rdsImpl) checkReadTime() error {
+	if !d.ps.inTxn && !ds.GetReadTime(d.userCtx).IsZero() {
+		return errReadTime
+	}
+	return nil
 }
 
 func (d *rdsImpl) AllocateIDs(keys []*ds.Key, cb ds.NewKeyCB) error {
@@ -141,6 +181,9 @@ func (d *rdsImpl) DeleteMulti(ks []*ds.Key, cb ds.DeleteMultiCB) error {
 }
 
 func (d *rdsImpl) GetMulti(keys []*ds.Key, _meta ds.MultiMetaGetter, cb ds.GetMultiCB) error {
+	if err := d.checkReadTime(); err != nil {
+		return err
+	}
 	vals := make([]datastore.PropertyLoadSaver, len(keys))
 	rkeys, err := dsMF2R(d.aeCtx, keys)
 	if err == nil {
@@ -260,6 +303,9 @@ func (d *rdsImpl) DecodeCursor(s string) (ds.Cursor, error) {
 }
 
 func (d *rdsImpl) Run(fq *ds.FinalizedQuery, cb ds.RawRunCB) error {
+	if err := d.checkReadTime(); err != nil {
+		return err
+	}
 	q, err := d.fixQuery(fq)
 	if err != nil {
 		return err
@@ -286,6 +332,9 @@ func (d *rdsImpl) Run(fq *ds.FinalizedQuery, cb ds.RawRunCB) error {
 }
 
 func (d *rdsImpl) Count(fq *ds.FinalizedQuery) (int64, error) {
+	if err := d.checkReadTime(); err != nil {
+		return 0, err
+	}
 	q, err := d.fixQuery(fq)
 	if err != nil {
 		return 0, err
@@ -307,6 +356,9 @@ func (d *rdsImpl) RunInTransaction(f func(c context.Context) error, opts *ds.Tra
 		XG: true,
 	}
 	if opts != nil {
+		if !opts.ReadTime.IsZero() {
+			return errReadTime
+		}
 		ropts.Attempts = opts.Attempts
 		ropts.ReadOnly = opts.ReadOnly
 	}
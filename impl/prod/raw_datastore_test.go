@@ -0,0 +1,76 @@
+// Copyright 2018 The LUCI Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package prod
+
+import (
+	"errors"
+	"testing"
+
+	ds "go.chromium.org/gae/service/datastore"
+
+	"google.golang.org/appengine"
+
+	. "github.com/smartystreets/goconvey/convey"
+	. "go.chromium.org/luci/common/testing/assertions"
+)
+
+// apiError has the same shape as the SDK's internal.APIError.
+type apiError struct {
+	Service string
+	Detail  string
+	Code    int32
+}
+
+func (e *apiError) Error() string { return e.Service + ": " + e.Detail }
+
+func TestFixBadRequest(t *testing.T) {
+	t.Parallel()
+
+	Convey("fixBadRequest", t, func() {
+		Convey("wraps datastore BAD_REQUEST errors", func() {
+			err := fixBadRequest(&apiError{"datastore_v3", "entity is too big", datastoreBadRequest})
+			So(ds.IsErrBadRequest(err), ShouldBeTrue)
+			So(err, ShouldErrLike, "entity is too big")
+		})
+
+		Convey("passes other errors through", func() {
+			for _, err := range []error{
+				nil,
+				ds.ErrNoSuchEntity,
+				errors.New("boom"),
+				&apiError{"datastore_v3", "timeout", 5},
+				&apiError{"memcache", "bad", datastoreBadRequest},
+			} {
+				So(fixBadRequest(err), ShouldEqual, err)
+			}
+		})
+
+		Convey("maps errors passed to callbacks", func() {
+			var got []error
+			err := idxCallbacker(
+				&apiError{"datastore_v3", "bad", datastoreBadRequest}, 1,
+				func(int, error) error { return nil })
+			So(ds.IsErrBadRequest(err), ShouldBeTrue)
+
+			me := appengine.MultiError{nil, &apiError{"datastore_v3", "bad", datastoreBadRequest}}
+			So(idxCallbacker(me, 2, func(_ int, err error) error {
+				got = append(got, err)
+				return nil
+			}), ShouldBeNil)
+			So(got[0], ShouldBeNil)
+			So(ds.IsErrBadRequest(got[1]), ShouldBeTrue)
+		})
+	})
+}
@@ -0,0 +1,205 @@
+// Copyright 2018 The LUCI Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package backup
+
+import (
+	"io"
+
+	ds "go.chromium.org/gae/service/datastore"
+	"go.chromium.org/gae/service/datastore/migrate"
+
+	"go.chromium.org/luci/common/clock"
+	"go.chromium.org/luci/common/errors"
+
+	"golang.org/x/net/context"
+)
+
+// DefaultBatchSize is the number of entities written per PutMulti by Import
+// if ImportOptions.BatchSize is 0.
+const DefaultBatchSize = 500
+
+// Export writes all entities returned by q to w, as a backup file.
+//
+// If q is nil, all of the entities in the current namespace of c are exported.
+// Entities with special kinds (like __entity_group__) are always skipped.
+//
+// The query only fetches the keys, and the entities are then fetched by key,
+// in batches of DefaultBatchSize, since some implementations don't keep the
+// app ID of Key property values in query results.
+//
+// Export returns the number of exported entities.
+func Export(c context.Context, w io.Writer, q *ds.Query) (int64, error) {
+	if q == nil {
+		q = ds.NewQuery("")
+	}
+	fq, err := q.KeysOnly(true).Finalize()
+	if err != nil {
+		return 0, err
+	}
+
+	kc := ds.GetKeyContext(c)
+	bw, err := NewWriter(w, Header{
+		AppID:     kc.AppID,
+		Namespace: kc.Namespace,
+		Time:      clock.Now(c),
+	})
+	if err != nil {
+		return 0, errors.Annotate(err, "writing header").Err()
+	}
+
+	raw := ds.Raw(c)
+	keys := make([]*ds.Key, 0, DefaultBatchSize)
+	flush := func() error {
+		if len(keys) == 0 {
+			return nil
+		}
+		// The batches of a large GetMulti may run in parallel, so the entities are
+		// written once it's done, in order.
+		vals := make([]ds.PropertyMap, len(keys))
+		lme := errors.NewLazyMultiError(len(keys))
+		err := raw.GetMulti(keys, nil, func(i int, pm ds.PropertyMap, err error) error {
+			if err != ds.ErrNoSuchEntity { // deleted since the query ran
+				vals[i] = pm
+				lme.Assign(i, err)
+			}
+			return nil
+		})
+		if err == nil {
+			err = lme.Get()
+		}
+		if err != nil {
+			return err
+		}
+		for i, pm := range vals {
+			if pm != nil {
+				if err := bw.Write(keys[i], pm); err != nil {
+					return err
+				}
+			}
+		}
+		keys = keys[:0]
+		return nil
+	}
+
+	err = raw.Run(fq, func(k *ds.Key, _ ds.PropertyMap, _ ds.CursorCB) error {
+		if k.LastTok().Special() {
+			return nil
+		}
+		keys = append(keys, k)
+		if len(keys) == DefaultBatchSize {
+			return flush()
+		}
+		return nil
+	})
+	if err == nil {
+		err = flush()
+	}
+	if err != nil {
+		return bw.Count(), errors.Annotate(err, "exporting %s", fq).Err()
+	}
+	return bw.Count(), bw.Close()
+}
+
+// ImportOptions controls the behavior of Import.
+type ImportOptions struct {
+	// AppID, if not empty, replaces the app ID of the backed up entities.
+	AppID string
+
+	// Namespace, if not nil, replaces the namespace of the backed up entities.
+	Namespace *string
+
+	// BatchSize is the maximum number of entities written with a single
+	// PutMulti. If 0, DefaultBatchSize is used.
+	BatchSize int
+}
+
+// Import reads a backup file from r, and puts all of its entities with raw.
+//
+// If opts asks for the app ID or namespace to be rewritten, the keys of the
+// entities are rewritten, as well as all Key property values (including ones
+// nested in PropertyMap values) which belonged to the backed up app ID and
+// namespace. Keys which point elsewhere are left untouched.
+//
+// Import returns the number of imported entities.
+func Import(raw ds.RawInterface, r io.Reader, opts *ImportOptions) (int64, error) {
+	if opts == nil {
+		opts = &ImportOptions{}
+	}
+	batchSize := opts.BatchSize
+	if batchSize <= 0 {
+		batchSize = DefaultBatchSize
+	}
+
+	br, err := NewReader(r)
+	if err != nil {
+		return 0, err
+	}
+	from := br.Header().KeyContext()
+	to := from
+	if opts.AppID != "" {
+		to.AppID = opts.AppID
+	}
+	if opts.Namespace != nil {
+		to.Namespace = *opts.Namespace
+	}
+
+	count := int64(0)
+	keys := make([]*ds.Key, 0, batchSize)
+	vals := make([]ds.PropertyMap, 0, batchSize)
+	flush := func() error {
+		if len(keys) == 0 {
+			return nil
+		}
+		lme := errors.NewLazyMultiError(len(keys))
+		err := raw.PutMulti(keys, vals, func(i int, _ *ds.Key, err error) error {
+			lme.Assign(i, err)
+			return nil
+		})
+		if err == nil {
+			err = lme.Get()
+		}
+		if err != nil {
+			return errors.Annotate(err, "putting entities %d-%d", count, count+int64(len(keys))).Err()
+		}
+		count += int64(len(keys))
+		keys, vals = keys[:0], vals[:0]
+		return nil
+	}
+
+	for {
+		key, pm, err := br.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return count, errors.Annotate(err, "reading entity %d", count+int64(len(keys))).Err()
+		}
+		if from != to {
+			key = migrate.RewriteKey(key, from, to)
+			pm = migrate.RewritePropertyMap(pm, from, to)
+		}
+		keys = append(keys, key)
+		vals = append(vals, pm)
+		if len(keys) == batchSize {
+			if err := flush(); err != nil {
+				return count, err
+			}
+		}
+	}
+	if err := flush(); err != nil {
+		return count, err
+	}
+	return count, nil
+}
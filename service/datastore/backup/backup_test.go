@@ -0,0 +1,164 @@
+// Copyright 2018 The LUCI Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package backup
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"testing"
+	"time"
+
+	"go.chromium.org/gae/impl/memory"
+	ds "go.chromium.org/gae/service/datastore"
+	"go.chromium.org/gae/service/info"
+
+	"go.chromium.org/luci/common/clock/testclock"
+
+	"golang.org/x/net/context"
+
+	. "github.com/smartystreets/goconvey/convey"
+	. "go.chromium.org/luci/common/testing/assertions"
+)
+
+func TestBackup(t *testing.T) {
+	t.Parallel()
+
+	Convey("Backup", t, func() {
+		now := time.Date(2018, 2, 3, 4, 5, 6, 0, time.UTC)
+		c, _ := testclock.UseTime(context.Background(), now)
+		c = memory.Use(c)
+		ds.GetTestable(c).Consistent(true)
+
+		other := ds.MkKeyContext("other-app", "")
+		mkEntity := func(c context.Context, i int) ds.PropertyMap {
+			parent := ds.MakeKey(c, "Parent", "p")
+			return ds.PropertyMap{
+				"$key":   ds.MkPropertyNI(ds.MakeKey(c, "Parent", "p", "Thing", i+1)),
+				"Int":    ds.MkProperty(i),
+				"Str":    ds.MkPropertyNI(fmt.Sprintf("thing %d", i)),
+				"Multi":  ds.PropertySlice{ds.MkProperty("a"), ds.MkProperty(1.5)},
+				"Time":   ds.MkProperty(now.Add(time.Duration(i) * time.Second)),
+				"Ref":    ds.MkProperty(parent),
+				"Remote": ds.MkProperty(other.MakeKey("Remote", 1)),
+				"Nested": ds.MkPropertyNI(ds.PropertyMap{
+					"Ref":   ds.MkProperty(parent),
+					"Bytes": ds.MkProperty([]byte("hi")),
+				}),
+			}
+		}
+
+		ents := make([]ds.PropertyMap, 10)
+		for i := range ents {
+			ents[i] = mkEntity(c, i)
+		}
+		So(ds.Put(c, ents), ShouldBeNil)
+
+		buf := &bytes.Buffer{}
+
+		Convey("round trips through a file", func() {
+			n, err := Export(c, buf, nil)
+			So(err, ShouldBeNil)
+			So(n, ShouldEqual, 10)
+
+			r, err := NewReader(bytes.NewReader(buf.Bytes()))
+			So(err, ShouldBeNil)
+			So(r.Header(), ShouldResemble, Header{
+				AppID:     "dev~app",
+				Namespace: "",
+				Time:      now,
+			})
+			count := 0
+			for {
+				k, pm, err := r.Next()
+				if err == io.EOF {
+					break
+				}
+				So(err, ShouldBeNil)
+				So(k.Kind(), ShouldEqual, "Thing")
+				So(pm["Int"], ShouldResemble, ds.MkProperty(k.IntID()-1))
+				count++
+			}
+			So(count, ShouldEqual, 10)
+
+			Convey("and imports into an empty datastore", func() {
+				c2 := memory.Use(context.Background())
+				n, err := Import(ds.Raw(c2), bytes.NewReader(buf.Bytes()), &ImportOptions{BatchSize: 3})
+				So(err, ShouldBeNil)
+				So(n, ShouldEqual, 10)
+
+				got := make([]ds.PropertyMap, 10)
+				for i := range got {
+					got[i] = ds.PropertyMap{"$key": ents[i]["$key"]}
+				}
+				So(ds.Get(c2, got), ShouldBeNil)
+				So(got, ShouldResemble, ents)
+			})
+
+			Convey("and imports with a different namespace", func() {
+				ns := "restored"
+				nc := info.MustNamespace(c, ns)
+				n, err := Import(ds.Raw(nc), bytes.NewReader(buf.Bytes()), &ImportOptions{Namespace: &ns})
+				So(err, ShouldBeNil)
+				So(n, ShouldEqual, 10)
+
+				for i := range ents {
+					got := ds.PropertyMap{"$key": ds.MkPropertyNI(ds.MakeKey(nc, "Parent", "p", "Thing", i+1))}
+					So(ds.Get(nc, got), ShouldBeNil)
+					So(got, ShouldResemble, mkEntity(nc, i))
+					// Keys into other apps are untouched.
+					So(got["Remote"], ShouldResemble, ds.MkProperty(other.MakeKey("Remote", 1)))
+				}
+			})
+		})
+
+		Convey("exports a query", func() {
+			q := ds.NewQuery("Thing").Gt("Int", 6)
+			n, err := Export(c, buf, q)
+			So(err, ShouldBeNil)
+			So(n, ShouldEqual, 3)
+		})
+
+		Convey("skips special entities", func() {
+			// The statistics entities are returned by kindless queries.
+			ds.GetTestable(c).RefreshStats()
+			total, err := ds.Count(c, ds.NewQuery(""))
+			So(err, ShouldBeNil)
+			So(total, ShouldBeGreaterThan, 10)
+
+			n, err := Export(c, buf, nil)
+			So(err, ShouldBeNil)
+			So(n, ShouldEqual, 10)
+		})
+
+		Convey("detects bad files", func() {
+			_, err := NewReader(bytes.NewReader([]byte("nope")))
+			So(err, ShouldEqual, ErrBadFormat)
+
+			_, err = Export(c, buf, nil)
+			So(err, ShouldBeNil)
+
+			truncated := buf.Bytes()[:buf.Len()-10]
+			_, err = Import(ds.Raw(c), bytes.NewReader(truncated), nil)
+			So(err, ShouldErrLike, "unexpected EOF")
+		})
+
+		Convey("Writer rejects incomplete keys", func() {
+			w, err := NewWriter(buf, Header{AppID: "app"})
+			So(err, ShouldBeNil)
+			So(w.Write(ds.NewIncompleteKeys(c, 1, "Thing", nil)[0], ds.PropertyMap{}), ShouldErrLike, "incomplete")
+		})
+	})
+}
@@ -0,0 +1,275 @@
+// Copyright 2018 The LUCI Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package backup implements a portable, streaming backup file format for
+// datastore entities, and functions to export entities into it and to import
+// them back.
+//
+// A backup file is:
+//
+//   magic ++ version ++ record(header) ++ record(entity)* ++ record()
+//
+// Where magic is the string "GAEDSBAK", version is a uvarint, and every record
+// is a uvarint length followed by that many bytes. The header record contains
+// the app ID and namespace the entities were exported from, and the time of
+// the export. Every entity record is a key (serialized without its context)
+// followed by its PropertyMap, both encoded with the serialize package. The
+// file is terminated with an empty record, which allows truncated files to be
+// detected.
+//
+// Both writing and reading are streaming, so backups of arbitrary size can be
+// processed with constant memory.
+package backup
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	ds "go.chromium.org/gae/service/datastore"
+	"go.chromium.org/gae/service/datastore/serialize"
+
+	"go.chromium.org/luci/common/data/cmpbin"
+)
+
+const (
+	magic = "GAEDSBAK"
+
+	// Version is the version of the file format written by this package.
+	Version = 1
+
+	// MaxRecordSize is the largest record that Reader is willing to read. It's
+	// much larger than the largest possible datastore entity.
+	MaxRecordSize = 64 * 1024 * 1024
+)
+
+// ErrBadFormat is returned by NewReader if the stream isn't a backup file.
+var ErrBadFormat = errors.New("backup: not a backup file")
+
+// Header describes the origin of a backup.
+type Header struct {
+	// AppID is the app ID the entities were exported from.
+	AppID string
+	// Namespace is the namespace the entities were exported from.
+	Namespace string
+	// Time is the time when the export began.
+	Time time.Time
+}
+
+// KeyContext returns the KeyContext of the backed up entities.
+func (h Header) KeyContext() ds.KeyContext {
+	return ds.MkKeyContext(h.AppID, h.Namespace)
+}
+
+// Writer writes a backup file.
+type Writer struct {
+	w     *bufio.Writer
+	buf   bytes.Buffer
+	count int64
+	err   error
+}
+
+// NewWriter writes the file preamble and h to w, and returns a Writer which
+// may be used to write entities.
+//
+// Close must be called to terminate the file.
+func NewWriter(w io.Writer, h Header) (*Writer, error) {
+	ret := &Writer{w: bufio.NewWriter(w)}
+	if _, err := ret.w.WriteString(magic); err != nil {
+		return nil, err
+	}
+	if err := ret.writeUvarint(Version); err != nil {
+		return nil, err
+	}
+
+	_, err := cmpbin.WriteString(&ret.buf, h.AppID)
+	if err == nil {
+		_, err = cmpbin.WriteString(&ret.buf, h.Namespace)
+	}
+	if err == nil {
+		err = serialize.WriteTime(&ret.buf, ds.RoundTime(h.Time.UTC()))
+	}
+	if err == nil {
+		err = ret.flushRecord()
+	}
+	if err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+func (w *Writer) writeUvarint(v uint64) error {
+	var tmp [binary.MaxVarintLen64]byte
+	_, err := w.w.Write(tmp[:binary.PutUvarint(tmp[:], v)])
+	return err
+}
+
+// flushRecord writes w.buf as a single record, and resets it.
+func (w *Writer) flushRecord() error {
+	if err := w.writeUvarint(uint64(w.buf.Len())); err != nil {
+		return err
+	}
+	_, err := w.w.Write(w.buf.Bytes())
+	w.buf.Reset()
+	return err
+}
+
+// Write writes a single entity.
+//
+// Metadata in pm (e.g. "$key") is not written.
+func (w *Writer) Write(key *ds.Key, pm ds.PropertyMap) error {
+	if w.err != nil {
+		return w.err
+	}
+	if key.IsIncomplete() {
+		return fmt.Errorf("backup: cannot write entity with incomplete key %s", key)
+	}
+
+	err := serialize.WriteKey(&w.buf, serialize.WithoutContext, key)
+	if err == nil {
+		err = serialize.WritePropertyMap(&w.buf, serialize.WithContext, pm)
+	}
+	if err == nil {
+		err = w.flushRecord()
+	}
+	if err != nil {
+		w.buf.Reset()
+		w.err = err
+		return err
+	}
+	w.count++
+	return nil
+}
+
+// Count returns the number of entities written so far.
+func (w *Writer) Count() int64 { return w.count }
+
+// Close terminates the backup file and flushes all buffered data. It doesn't
+// close the underlying io.Writer.
+func (w *Writer) Close() error {
+	if w.err != nil {
+		return w.err
+	}
+	w.err = errors.New("backup: Writer is closed")
+	if err := w.writeUvarint(0); err != nil {
+		return err
+	}
+	return w.w.Flush()
+}
+
+// Reader reads a backup file.
+type Reader struct {
+	r      *bufio.Reader
+	header Header
+	kc     ds.KeyContext
+	buf    []byte
+	done   bool
+}
+
+// NewReader reads the preamble and the header from r, and returns a Reader
+// which may be used to read the entities.
+func NewReader(r io.Reader) (*Reader, error) {
+	ret := &Reader{r: bufio.NewReader(r)}
+
+	m := make([]byte, len(magic))
+	if _, err := io.ReadFull(ret.r, m); err != nil || string(m) != magic {
+		return nil, ErrBadFormat
+	}
+	switch v, err := binary.ReadUvarint(ret.r); {
+	case err != nil:
+		return nil, ErrBadFormat
+	case v != Version:
+		return nil, fmt.Errorf("backup: unsupported version %d", v)
+	}
+
+	rec, err := ret.readRecord()
+	if err != nil {
+		return nil, err
+	}
+	buf := bytes.NewBuffer(rec)
+	if ret.header.AppID, _, err = cmpbin.ReadString(buf); err != nil {
+		return nil, fmt.Errorf("backup: bad header: %s", err)
+	}
+	if ret.header.Namespace, _, err = cmpbin.ReadString(buf); err != nil {
+		return nil, fmt.Errorf("backup: bad header: %s", err)
+	}
+	if ret.header.Time, err = serialize.ReadTime(buf); err != nil {
+		return nil, fmt.Errorf("backup: bad header: %s", err)
+	}
+	ret.kc = ret.header.KeyContext()
+	return ret, nil
+}
+
+// Header returns the backup's header.
+func (r *Reader) Header() Header { return r.header }
+
+// readRecord reads the next record. The returned slice is only valid until the
+// next call.
+func (r *Reader) readRecord() ([]byte, error) {
+	l, err := binary.ReadUvarint(r.r)
+	if err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	if l > MaxRecordSize {
+		return nil, fmt.Errorf("backup: record too large (%d bytes)", l)
+	}
+	if uint64(cap(r.buf)) < l {
+		r.buf = make([]byte, l)
+	}
+	r.buf = r.buf[:l]
+	if _, err := io.ReadFull(r.r, r.buf); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return r.buf, nil
+}
+
+// Next returns the next entity in the backup. Its key has the KeyContext of
+// the header.
+//
+// It returns io.EOF when all entities have been read, and
+// io.ErrUnexpectedEOF if the file was truncated.
+func (r *Reader) Next() (*ds.Key, ds.PropertyMap, error) {
+	if r.done {
+		return nil, nil, io.EOF
+	}
+	rec, err := r.readRecord()
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(rec) == 0 {
+		r.done = true
+		return nil, nil, io.EOF
+	}
+
+	buf := bytes.NewBuffer(rec)
+	key, err := serialize.ReadKey(buf, serialize.WithoutContext, r.kc)
+	if err != nil {
+		return nil, nil, fmt.Errorf("backup: bad entity key: %s", err)
+	}
+	pm, err := serialize.ReadPropertyMap(buf, serialize.WithContext, r.kc)
+	if err != nil {
+		return nil, nil, fmt.Errorf("backup: bad entity %s: %s", key, err)
+	}
+	return key, pm, nil
+}
@@ -32,6 +32,9 @@ func (tcf *checkFilter) RunInTransaction(f func(c context.Context) error, opts *
 	if f == nil {
 		return fmt.Errorf("datastore: RunInTransaction function is nil")
 	}
+	if opts != nil && !opts.ReadTime.IsZero() && !opts.ReadOnly {
+		return fmt.Errorf("datastore: transactions with a ReadTime must be ReadOnly")
+	}
 	return tcf.RawInterface.RunInTransaction(f, opts)
 }
 
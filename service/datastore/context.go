@@ -15,6 +15,8 @@
 package datastore
 
 import (
+	"time"
+
 	"go.chromium.org/gae/service/info"
 
 	"golang.org/x/net/context"
@@ -26,6 +28,7 @@ const (
 	rawDatastoreKey key = iota
 	rawDatastoreFilterKey
 	rawDatastoreBatchKey
+	readTimeKey
 )
 
 // RawFactory is the function signature for factory methods compatible with
@@ -137,3 +140,24 @@ func getBatching(c context.Context) (is, ok bool) {
 	is, ok = c.Value(rawDatastoreBatchKey).(bool)
 	return
 }
+
+// WithReadTime returns a Context in which non-transactional reads (Get, Run
+// and Count) see a snapshot of the datastore as it was at time t. Writes are
+// not affected. If t is zero, reads see the current state of the datastore.
+//
+// Reads in transactions ignore this; use TransactionOptions.ReadTime instead.
+//
+// Implementations only keep the history of the datastore for a limited time;
+// reads at times older than that fail.
+func WithReadTime(c context.Context, t time.Time) context.Context {
+	return context.WithValue(c, readTimeKey, t)
+}
+
+// GetReadTime returns the read time installed in c with WithReadTime, or the
+// zero time if there is none.
+//
+// This is meant for datastore implementations.
+func GetReadTime(c context.Context) time.Time {
+	t, _ := c.Value(readTimeKey).(time.Time)
+	return t
+}
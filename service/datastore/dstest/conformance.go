@@ -0,0 +1,534 @@
+// Copyright 2018 The LUCI Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dstest
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"go.chromium.org/gae/service/blobstore"
+	ds "go.chromium.org/gae/service/datastore"
+
+	"go.chromium.org/luci/common/errors"
+
+	"golang.org/x/net/context"
+)
+
+// Implementation is a datastore implementation, i.e. a RawInterface with any
+// filters on top of it, to be tested with RunConformance.
+type Implementation struct {
+	// New returns a context with a new, empty datastore installed.
+	//
+	// The datastore must have the ConformanceIndexes.
+	New func() context.Context
+
+	// Settle, if not nil, is called after the entities of a test are put and
+	// before it runs, to make them visible to queries. For example, it may
+	// catch up eventually consistent indexes.
+	Settle func(c context.Context)
+
+	// Capabilities are the known differences of the implementation.
+	Capabilities Capabilities
+}
+
+// Capabilities describe the known, accepted differences between datastore
+// implementations. The tests which can't pass because of them are skipped.
+//
+// The zero value describes the Cloud Datastore.
+type Capabilities struct {
+	// NoTransactions is true if the implementation doesn't support
+	// transactions.
+	NoTransactions bool
+
+	// TxnReadsOwnWrites is true if the reads in a transaction observe the
+	// transaction's own writes (like with filter/txnBuf), rather than the
+	// snapshot of the datastore taken when the transaction began.
+	TxnReadsOwnWrites bool
+
+	// NoNestedEntities is true if the implementation can't store properties
+	// whose values are entities (PTPropertyMap).
+	NoNestedEntities bool
+}
+
+// ConformanceIndexes are the compound indexes which RunConformance needs.
+var ConformanceIndexes = []*ds.IndexDefinition{
+	{Kind: "Item", SortBy: []ds.IndexColumn{{Property: "Group"}, {Property: "N"}}},
+}
+
+// RunConformance tests that the datastore implementation behaves like the
+// Cloud Datastore, running each behavior as a subtest of t with a new
+// datastore.
+//
+// Implementations and filters should pass it in their tests, with the
+// Capabilities describing their known differences.
+func RunConformance(t *testing.T, impl Implementation) {
+	for _, cc := range conformanceCases {
+		cc := cc
+		t.Run(cc.name, func(t *testing.T) {
+			c := impl.New()
+			if cc.fixtures != "" {
+				pms, err := ParseFixtures(c, []byte(cc.fixtures))
+				if err != nil {
+					t.Fatalf("bad fixtures: %s", err)
+				}
+				if err := ds.Put(c, pms); err != nil {
+					t.Fatalf("putting the fixtures: %s", err)
+				}
+			}
+			if impl.Settle != nil {
+				impl.Settle(c)
+			}
+			cc.test(t, c, impl.Capabilities)
+		})
+	}
+}
+
+// conformanceCase is a behavior tested by RunConformance.
+type conformanceCase struct {
+	name string
+	// fixtures, if not empty, are put (see ParseFixtures) before the test runs.
+	fixtures string
+	test     func(t *testing.T, c context.Context, caps Capabilities)
+}
+
+// itemFixtures are the entities of the query tests. Sorted by key, they are
+// Item/1, Item/2, ..., Item/5, Item/5/Item/6.
+const itemFixtures = `
+- key: Item/1
+  props:
+    Group: a
+    N: 1
+    Tags: [b, z]
+    Secret: {value: s, noindex: true}
+- key: Item/2
+  props: {Group: a, N: 2, Tags: [c]}
+- key: Item/3
+  props: {Group: b, N: 3, Tags: [c, d]}
+- key: Item/4
+  props: {Group: b, N: null}
+- key: Item/5
+  props: {Group: c}
+  children:
+  - key: Item/6
+    props: {Group: c, N: 6}
+`
+
+var conformanceCases = []conformanceCase{
+	// Entities.
+
+	{name: "PutGet/AllTypes", test: func(t *testing.T, c context.Context, _ Capabilities) {
+		pm := ds.PropertyMap{
+			"$key":    ds.MkPropertyNI(ds.MakeKey(c, "Thing", 1)),
+			"Int":     ds.MkProperty(-7),
+			"Float":   ds.MkProperty(2.5),
+			"Bool":    ds.MkProperty(true),
+			"String":  ds.MkProperty("hello"),
+			"Bytes":   ds.MkProperty([]byte{0, 1, 2}),
+			"Time":    ds.MkProperty(time.Date(2018, 1, 2, 3, 4, 5, 6007, time.UTC)),
+			"Null":    ds.MkProperty(nil),
+			"Geo":     ds.MkProperty(ds.GeoPoint{Lat: 1.5, Lng: -2.5}),
+			"Key":     ds.MkProperty(ds.MakeKey(c, "Other", "x", "Child", 2)),
+			"BlobKey": ds.MkProperty(blobstore.Key("blob")),
+			"NoIndex": ds.MkPropertyNI("not indexed"),
+			"Multi":   ds.PropertySlice{ds.MkProperty(3), ds.MkProperty("three"), ds.MkPropertyNI(3.0)},
+		}
+		mustNil(t, ds.Put(c, pm))
+		expectEqual(t, "entity", describe(get(t, c, ds.MakeKey(c, "Thing", 1))), describe(pm))
+	}},
+
+	{name: "PutGet/TimesAreRoundedToMicroseconds", test: func(t *testing.T, c context.Context, _ Capabilities) {
+		when := time.Date(2018, 1, 2, 3, 4, 5, 1500, time.UTC)
+		key := ds.MakeKey(c, "Thing", 1)
+		mustNil(t, ds.Put(c, ds.PropertyMap{"$key": ds.MkPropertyNI(key), "Time": ds.MkProperty(when)}))
+		got, ok := get(t, c, key).Slice("Time")[0].Value().(time.Time)
+		if want := when.Round(time.Microsecond); !ok || !got.Equal(want) {
+			t.Errorf("got %v, want %v", got, want)
+		}
+	}},
+
+	{name: "PutGet/NestedEntities", test: func(t *testing.T, c context.Context, caps Capabilities) {
+		if caps.NoNestedEntities {
+			t.Skip("nested entities are not supported")
+		}
+		pm := ds.PropertyMap{
+			"$key": ds.MkPropertyNI(ds.MakeKey(c, "Thing", 1)),
+			"Address": ds.MkPropertyNI(ds.PropertyMap{
+				"City": ds.MkProperty("Paris"),
+				"Zip":  ds.MkProperty(75001),
+			}),
+		}
+		mustNil(t, ds.Put(c, pm))
+		expectEqual(t, "entity", describe(get(t, c, ds.MakeKey(c, "Thing", 1))), describe(pm))
+	}},
+
+	{name: "PutGet/PutReplacesTheEntity", test: func(t *testing.T, c context.Context, _ Capabilities) {
+		key := ds.MakeKey(c, "Thing", 1)
+		mustNil(t, ds.Put(c, ds.PropertyMap{"$key": ds.MkPropertyNI(key), "A": ds.MkProperty(1), "B": ds.MkProperty(2)}))
+		mustNil(t, ds.Put(c, ds.PropertyMap{"$key": ds.MkPropertyNI(key), "A": ds.MkProperty(3)}))
+		expectEqual(t, "entity", describe(get(t, c, key)), []string{"A=PTInt(3)"})
+	}},
+
+	{name: "Get/MissingEntity", test: func(t *testing.T, c context.Context, _ Capabilities) {
+		pm := ds.PropertyMap{"$key": ds.MkPropertyNI(ds.MakeKey(c, "Thing", 1))}
+		expectEqual(t, "error", ds.Get(c, pm), ds.ErrNoSuchEntity)
+	}},
+
+	{name: "Get/SomeMissingEntities", fixtures: itemFixtures, test: func(t *testing.T, c context.Context, _ Capabilities) {
+		pms := []ds.PropertyMap{
+			{"$key": ds.MkPropertyNI(ds.MakeKey(c, "Item", 1))},
+			{"$key": ds.MkPropertyNI(ds.MakeKey(c, "Item", 100))},
+		}
+		expectEqual(t, "error", ds.Get(c, pms), errors.MultiError{nil, ds.ErrNoSuchEntity})
+		expectEqual(t, "Group", describe(pms[0])[0], `Group=PTString("a")`)
+
+		res, err := ds.Exists(c, ds.MakeKey(c, "Item", 1), ds.MakeKey(c, "Item", 100))
+		mustNil(t, err)
+		expectEqual(t, "exists", res.List(), ds.BoolList{true, false})
+	}},
+
+	{name: "Delete", fixtures: itemFixtures, test: func(t *testing.T, c context.Context, _ Capabilities) {
+		key := ds.MakeKey(c, "Item", 1)
+		mustNil(t, ds.Delete(c, key))
+		expectEqual(t, "error", ds.Get(c, ds.PropertyMap{"$key": ds.MkPropertyNI(key)}), ds.ErrNoSuchEntity)
+		// Deleting a missing entity is not an error.
+		mustNil(t, ds.Delete(c, key))
+	}},
+
+	{name: "Put/IncompleteKeys", test: func(t *testing.T, c context.Context, _ Capabilities) {
+		pms := []ds.PropertyMap{
+			{"$key": ds.MkPropertyNI(ds.NewIncompleteKeys(c, 1, "Thing", nil)[0]), "N": ds.MkProperty(1)},
+			{"$key": ds.MkPropertyNI(ds.NewIncompleteKeys(c, 1, "Thing", nil)[0]), "N": ds.MkProperty(2)},
+		}
+		mustNil(t, ds.Put(c, pms))
+		k1, k2 := ds.KeyForObj(c, pms[0]), ds.KeyForObj(c, pms[1])
+		if k1.IsIncomplete() || k2.IsIncomplete() || k1.Equal(k2) {
+			t.Fatalf("got keys %s and %s, want distinct complete keys", k1, k2)
+		}
+		expectEqual(t, "entity", describe(get(t, c, k2)), []string{"N=PTInt(2)"})
+	}},
+
+	{name: "AllocateIDs", test: func(t *testing.T, c context.Context, _ Capabilities) {
+		parent := ds.MakeKey(c, "Parent", 1)
+		keys := ds.NewIncompleteKeys(c, 3, "Thing", parent)
+		mustNil(t, ds.AllocateIDs(c, keys))
+		seen := map[int64]bool{}
+		for _, k := range keys {
+			if k.IsIncomplete() || !k.Parent().Equal(parent) || seen[k.IntID()] {
+				t.Fatalf("got keys %s, want distinct complete keys with parent %s", keys, parent)
+			}
+			seen[k.IntID()] = true
+		}
+		mustNil(t, ds.Put(c, ds.PropertyMap{"$key": ds.MkPropertyNI(keys[0]), "N": ds.MkProperty(1)}))
+		expectEqual(t, "entity", describe(get(t, c, keys[0])), []string{"N=PTInt(1)"})
+	}},
+
+	// Queries.
+
+	{name: "Query/OrderedByKey", fixtures: itemFixtures, test: func(t *testing.T, c context.Context, _ Capabilities) {
+		expectEqual(t, "IDs", queryIDs(t, c, ds.NewQuery("Item")), []int64{1, 2, 3, 4, 5, 6})
+	}},
+
+	{name: "Query/KeysOnly", fixtures: itemFixtures, test: func(t *testing.T, c context.Context, _ Capabilities) {
+		var keys []*ds.Key
+		mustNil(t, ds.GetAll(c, ds.NewQuery("Item").KeysOnly(true), &keys))
+		expectEqual(t, "IDs", ids(keys), []int64{1, 2, 3, 4, 5, 6})
+	}},
+
+	{name: "Query/EqualityOnMultipleValues", fixtures: itemFixtures, test: func(t *testing.T, c context.Context, _ Capabilities) {
+		// Any of the values of a property may match.
+		expectEqual(t, "IDs", queryIDs(t, c, ds.NewQuery("Item").Eq("Tags", "c")), []int64{2, 3})
+		// Each of the values of a filter must match.
+		expectEqual(t, "IDs", queryIDs(t, c, ds.NewQuery("Item").Eq("Tags", "c", "d")), []int64{3})
+		expectEqual(t, "IDs", queryIDs(t, c, ds.NewQuery("Item").Eq("Tags", "b", "c")), []int64(nil))
+	}},
+
+	{name: "Query/Inequality", fixtures: itemFixtures, test: func(t *testing.T, c context.Context, _ Capabilities) {
+		// Null sorts before all integers, and entities without N don't match.
+		expectEqual(t, "IDs", queryIDs(t, c, ds.NewQuery("Item").Gt("N", 1)), []int64{2, 3, 6})
+		expectEqual(t, "IDs", queryIDs(t, c, ds.NewQuery("Item").Gte("N", 2).Lt("N", 6)), []int64{2, 3})
+	}},
+
+	{name: "Query/KeyInequality", fixtures: itemFixtures, test: func(t *testing.T, c context.Context, _ Capabilities) {
+		q := ds.NewQuery("Item").Gt("__key__", ds.MakeKey(c, "Item", 3))
+		expectEqual(t, "IDs", queryIDs(t, c, q), []int64{4, 5, 6})
+	}},
+
+	{name: "Query/OrderOnMultipleValues", fixtures: itemFixtures, test: func(t *testing.T, c context.Context, _ Capabilities) {
+		// Ascending orders use the smallest value, descending ones the largest.
+		expectEqual(t, "IDs", queryIDs(t, c, ds.NewQuery("Item").Order("Tags")), []int64{1, 2, 3})
+		expectEqual(t, "IDs", queryIDs(t, c, ds.NewQuery("Item").Order("-Tags")), []int64{1, 3, 2})
+	}},
+
+	{name: "Query/Null", fixtures: itemFixtures, test: func(t *testing.T, c context.Context, _ Capabilities) {
+		// Null sorts first, and entities without N are not in the index.
+		expectEqual(t, "IDs", queryIDs(t, c, ds.NewQuery("Item").Order("N")), []int64{4, 1, 2, 3, 6})
+		expectEqual(t, "IDs", queryIDs(t, c, ds.NewQuery("Item").Eq("N", nil)), []int64{4})
+	}},
+
+	{name: "Query/UnindexedProperties", fixtures: itemFixtures, test: func(t *testing.T, c context.Context, _ Capabilities) {
+		expectEqual(t, "IDs", queryIDs(t, c, ds.NewQuery("Item").Eq("Secret", "s")), []int64(nil))
+	}},
+
+	{name: "Query/Ancestor", fixtures: itemFixtures, test: func(t *testing.T, c context.Context, _ Capabilities) {
+		// An ancestor query includes the ancestor itself.
+		q := ds.NewQuery("Item").Ancestor(ds.MakeKey(c, "Item", 5))
+		expectEqual(t, "IDs", queryIDs(t, c, q), []int64{5, 6})
+	}},
+
+	{name: "Query/CompoundIndex", fixtures: itemFixtures, test: func(t *testing.T, c context.Context, _ Capabilities) {
+		expectEqual(t, "IDs", queryIDs(t, c, ds.NewQuery("Item").Eq("Group", "a").Gt("N", 1)), []int64{2})
+		expectEqual(t, "IDs", queryIDs(t, c, ds.NewQuery("Item").Eq("Group", "b").Order("N")), []int64{4, 3})
+	}},
+
+	{name: "Query/MixedTypes", test: func(t *testing.T, c context.Context, _ Capabilities) {
+		vals := []interface{}{ds.MakeKey(c, "Other", 1), 1.5, "s", true, 7, nil}
+		for i, v := range vals {
+			mustNil(t, ds.Put(c, ds.PropertyMap{
+				"$key": ds.MkPropertyNI(ds.MakeKey(c, "Mixed", i+1)),
+				"V":    ds.MkProperty(v),
+			}))
+		}
+		// Values of different types sort by type: null, integers, booleans,
+		// strings, floats and keys.
+		expectEqual(t, "IDs", queryIDs(t, c, ds.NewQuery("Mixed").Order("V")), []int64{6, 5, 4, 3, 2, 1})
+	}},
+
+	{name: "Query/LimitOffset", fixtures: itemFixtures, test: func(t *testing.T, c context.Context, _ Capabilities) {
+		q := ds.NewQuery("Item").Order("N").Offset(1).Limit(2)
+		expectEqual(t, "IDs", queryIDs(t, c, q), []int64{1, 2})
+	}},
+
+	{name: "Query/Cursors", fixtures: itemFixtures, test: func(t *testing.T, c context.Context, _ Capabilities) {
+		q := ds.NewQuery("Item").Order("N")
+		var cursor ds.Cursor
+		n := 0
+		err := ds.Run(c, q, func(pm ds.PropertyMap, cb ds.CursorCB) error {
+			if n++; n < 2 {
+				return nil
+			}
+			var err error
+			cursor, err = cb()
+			if err != nil {
+				return err
+			}
+			return ds.Stop
+		})
+		mustNil(t, err)
+		if cursor == nil {
+			t.Fatal("got no cursor")
+		}
+		// The cursor is after the second result.
+		expectEqual(t, "IDs", queryIDs(t, c, q.Start(cursor)), []int64{2, 3, 6})
+		expectEqual(t, "IDs", queryIDs(t, c, q.End(cursor)), []int64{4, 1})
+	}},
+
+	{name: "Query/Count", fixtures: itemFixtures, test: func(t *testing.T, c context.Context, _ Capabilities) {
+		n, err := ds.Count(c, ds.NewQuery("Item"))
+		mustNil(t, err)
+		expectEqual(t, "count", n, int64(6))
+		n, err = ds.Count(c, ds.NewQuery("Item").Gt("N", 1))
+		mustNil(t, err)
+		expectEqual(t, "count", n, int64(3))
+	}},
+
+	{name: "Query/Projection", fixtures: itemFixtures, test: func(t *testing.T, c context.Context, _ Capabilities) {
+		// There is a result per value, and entities without the property are
+		// skipped, but explicit nulls aren't.
+		expectEqual(t, "results", projection(t, c, ds.NewQuery("Item").Project("Tags").Order("Tags"), "Tags"),
+			[]string{"1:b", "2:c", "3:c", "3:d", "1:z"})
+		expectEqual(t, "results", projection(t, c, ds.NewQuery("Item").Project("N").Order("N"), "N"),
+			[]string{"4:<nil>", "1:1", "2:2", "3:3", "6:6"})
+	}},
+
+	{name: "Query/Distinct", fixtures: itemFixtures, test: func(t *testing.T, c context.Context, _ Capabilities) {
+		expectEqual(t, "results", projection(t, c, ds.NewQuery("Item").Project("Tags").Distinct(true).Order("Tags"), "Tags"),
+			[]string{"1:b", "2:c", "3:d", "1:z"})
+	}},
+
+	// Transactions.
+
+	{name: "Transaction/Commit", test: func(t *testing.T, c context.Context, caps Capabilities) {
+		if caps.NoTransactions {
+			t.Skip("transactions are not supported")
+		}
+		key := ds.MakeKey(c, "Thing", 1)
+		err := ds.RunInTransaction(c, func(c context.Context) error {
+			if err := ds.Put(c, ds.PropertyMap{"$key": ds.MkPropertyNI(key), "N": ds.MkProperty(1)}); err != nil {
+				return err
+			}
+			// The write is not visible outside of the transaction until it commits.
+			pm := ds.PropertyMap{"$key": ds.MkPropertyNI(key)}
+			expectEqual(t, "error outside of the transaction", ds.Get(ds.WithoutTransaction(c), pm), ds.ErrNoSuchEntity)
+			return nil
+		}, nil)
+		mustNil(t, err)
+		expectEqual(t, "entity", describe(get(t, c, key)), []string{"N=PTInt(1)"})
+	}},
+
+	{name: "Transaction/Rollback", test: func(t *testing.T, c context.Context, caps Capabilities) {
+		if caps.NoTransactions {
+			t.Skip("transactions are not supported")
+		}
+		key := ds.MakeKey(c, "Thing", 1)
+		mustNil(t, ds.Put(c, ds.PropertyMap{"$key": ds.MkPropertyNI(key), "N": ds.MkProperty(1)}))
+		boom := errors.New("boom")
+		err := ds.RunInTransaction(c, func(c context.Context) error {
+			if err := ds.Put(c, ds.PropertyMap{"$key": ds.MkPropertyNI(key), "N": ds.MkProperty(2)}); err != nil {
+				return err
+			}
+			return boom
+		}, nil)
+		expectEqual(t, "error", err, boom)
+		expectEqual(t, "entity", describe(get(t, c, key)), []string{"N=PTInt(1)"})
+	}},
+
+	{name: "Transaction/Reads", test: func(t *testing.T, c context.Context, caps Capabilities) {
+		if caps.NoTransactions {
+			t.Skip("transactions are not supported")
+		}
+		key := ds.MakeKey(c, "Thing", 1)
+		mustNil(t, ds.Put(c, ds.PropertyMap{"$key": ds.MkPropertyNI(key), "N": ds.MkProperty(1)}))
+		want := []string{"N=PTInt(1)"}
+		if caps.TxnReadsOwnWrites {
+			want = []string{"N=PTInt(2)"}
+		}
+		err := ds.RunInTransaction(c, func(c context.Context) error {
+			if err := ds.Put(c, ds.PropertyMap{"$key": ds.MkPropertyNI(key), "N": ds.MkProperty(2)}); err != nil {
+				return err
+			}
+			expectEqual(t, "entity in the transaction", describe(get(t, c, key)), want)
+			return nil
+		}, nil)
+		mustNil(t, err)
+	}},
+
+	{name: "Transaction/Conflict", test: func(t *testing.T, c context.Context, caps Capabilities) {
+		if caps.NoTransactions {
+			t.Skip("transactions are not supported")
+		}
+		key := ds.MakeKey(c, "Thing", 1)
+		mustNil(t, ds.Put(c, ds.PropertyMap{"$key": ds.MkPropertyNI(key), "N": ds.MkProperty(1)}))
+		attempts := 0
+		err := ds.RunInTransaction(c, func(c context.Context) error {
+			attempts++
+			n := get(t, c, key).Slice("N")[0].Value().(int64)
+			if attempts == 1 {
+				// A concurrent write to the entity group makes the commit fail, and
+				// the transaction is retried.
+				pm := ds.PropertyMap{"$key": ds.MkPropertyNI(key), "N": ds.MkProperty(100)}
+				if err := ds.Put(ds.WithoutTransaction(c), pm); err != nil {
+					return err
+				}
+			}
+			return ds.Put(c, ds.PropertyMap{"$key": ds.MkPropertyNI(key), "N": ds.MkProperty(n + 1)})
+		}, &ds.TransactionOptions{Attempts: 2})
+		mustNil(t, err)
+		expectEqual(t, "attempts", attempts, 2)
+		expectEqual(t, "entity", describe(get(t, c, key)), []string{"N=PTInt(101)"})
+	}},
+}
+
+// mustNil fails the test if err is not nil.
+func mustNil(t *testing.T, err error) {
+	t.Helper()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+}
+
+// expectEqual fails the test if got is not deeply equal to want.
+func expectEqual(t *testing.T, what string, got, want interface{}) {
+	t.Helper()
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("%s: got %v, want %v", what, got, want)
+	}
+}
+
+// get returns the entity with the key.
+func get(t *testing.T, c context.Context, key *ds.Key) ds.PropertyMap {
+	t.Helper()
+	pm := ds.PropertyMap{"$key": ds.MkPropertyNI(key)}
+	mustNil(t, ds.Get(c, pm))
+	return pm
+}
+
+// describe returns the properties of pm as sorted "Name=Value" strings, with
+// a " (noindex)" suffix for unindexed values. Meta properties are skipped.
+//
+// Single values and slices of one value are described the same way, since
+// implementations don't preserve the difference.
+func describe(pm ds.PropertyMap) []string {
+	var ret []string
+	for name := range pm {
+		if strings.HasPrefix(name, "$") {
+			continue
+		}
+		for _, p := range pm.Slice(name) {
+			v := p.String()
+			if t, ok := p.Value().(time.Time); ok {
+				// Implementations may return times in different locations.
+				v = fmt.Sprintf("%s(%s)", p.Type(), t.UTC().Format(time.RFC3339Nano))
+			}
+			s := name + "=" + v
+			if p.IndexSetting() == ds.NoIndex {
+				s += " (noindex)"
+			}
+			ret = append(ret, s)
+		}
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+// ids returns the integer IDs of keys.
+func ids(keys []*ds.Key) []int64 {
+	var ret []int64
+	for _, k := range keys {
+		ret = append(ret, k.IntID())
+	}
+	return ret
+}
+
+// queryIDs returns the integer IDs of the keys of the entities returned by q.
+func queryIDs(t *testing.T, c context.Context, q *ds.Query) []int64 {
+	t.Helper()
+	var keys []*ds.Key
+	err := ds.Run(c, q, func(pm ds.PropertyMap) {
+		keys = append(keys, ds.KeyForObj(c, pm))
+	})
+	mustNil(t, err)
+	return ids(keys)
+}
+
+// projection returns the results of the projection query q as "ID:value"
+// strings, where value is the value of the projected property prop.
+func projection(t *testing.T, c context.Context, q *ds.Query, prop string) []string {
+	t.Helper()
+	var ret []string
+	err := ds.Run(c, q, func(pm ds.PropertyMap) {
+		// Projected values have their index type, e.g. times are integers.
+		_, v := pm.Slice(prop)[0].IndexTypeAndValue()
+		if b, ok := v.([]byte); ok {
+			v = string(b)
+		}
+		ret = append(ret, fmt.Sprintf("%d:%v", ds.KeyForObj(c, pm).IntID(), v))
+	})
+	mustNil(t, err)
+	return ret
+}
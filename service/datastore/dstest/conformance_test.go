@@ -0,0 +1,82 @@
+// Copyright 2018 The LUCI Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dstest
+
+import (
+	"testing"
+
+	"go.chromium.org/gae/filter/count"
+	"go.chromium.org/gae/filter/dscache"
+	"go.chromium.org/gae/filter/featureBreaker"
+	"go.chromium.org/gae/filter/txnBuf"
+	"go.chromium.org/gae/impl/memory"
+	ds "go.chromium.org/gae/service/datastore"
+
+	"golang.org/x/net/context"
+)
+
+// newMemory returns a context with a new memory datastore, which is
+// consistent and has the ConformanceIndexes and the DifferentialIndexes.
+func newMemory() context.Context {
+	c := memory.Use(context.Background())
+	t := ds.GetTestable(c)
+	t.Consistent(true)
+	t.AddIndexes(ConformanceIndexes...)
+	t.AddIndexes(DifferentialIndexes...)
+	return c
+}
+
+func TestConformance(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		name string
+		impl Implementation
+	}{
+		{"memory", Implementation{New: newMemory}},
+		{"txnBuf", Implementation{
+			New:          func() context.Context { return txnBuf.FilterRDS(newMemory()) },
+			Capabilities: Capabilities{TxnReadsOwnWrites: true},
+		}},
+		{"dscache", Implementation{
+			New: func() context.Context { return dscache.AlwaysFilterRDS(newMemory()) },
+		}},
+		{"count", Implementation{
+			New: func() context.Context {
+				c, _ := count.FilterRDS(newMemory())
+				return c
+			},
+		}},
+		{"featureBreaker", Implementation{
+			New: func() context.Context {
+				c, _ := featureBreaker.FilterRDS(newMemory(), nil)
+				return c
+			},
+		}},
+		{"all filters", Implementation{
+			New: func() context.Context {
+				c, _ := featureBreaker.FilterRDS(newMemory(), nil)
+				c, _ = count.FilterRDS(c)
+				return txnBuf.FilterRDS(dscache.AlwaysFilterRDS(c))
+			},
+			Capabilities: Capabilities{TxnReadsOwnWrites: true},
+		}},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			RunConformance(t, tc.impl)
+		})
+	}
+}
@@ -0,0 +1,1059 @@
+// Copyright 2018 The LUCI Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dstest
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	ds "go.chromium.org/gae/service/datastore"
+
+	"go.chromium.org/luci/common/errors"
+
+	"golang.org/x/net/context"
+)
+
+// The workloads of RunDifferential operate on a small, fixed key space, so
+// that their operations often touch the same entities: each of the entity
+// groups has a root entity, "Model/<group>", and some children,
+// "Model/<group>/Model/<id>".
+const (
+	modelKind      = "Model"
+	modelGroups    = 3
+	modelChildren  = 2
+	modelVals      = 4
+	modelWorkload  = 50
+	incompleteID   = -1
+	concurrentPath = "c"
+)
+
+// modelTags are the values of the Tag property of the workload entities.
+var modelTags = []string{"a", "b", "c"}
+
+// DifferentialIndexes are the compound indexes which RunDifferential needs.
+var DifferentialIndexes = []*ds.IndexDefinition{
+	{Kind: modelKind, Ancestor: true, SortBy: []ds.IndexColumn{{Property: "Val"}}},
+	{Kind: modelKind, Ancestor: true, SortBy: []ds.IndexColumn{{Property: "Tag"}}},
+}
+
+// errRollback is returned by the transactions of a workload to roll them back.
+var errRollback = errors.New("rollback")
+
+// Subject is a datastore implementation checked by RunDifferential against
+// a reference implementation.
+type Subject struct {
+	// Name identifies the subject in the test output.
+	Name string
+
+	// Implementation is the datastore implementation. Its datastore must be
+	// strongly consistent and have the DifferentialIndexes.
+	Implementation
+
+	// QueryBatchSize, if > 0, makes the queries outside of transactions run with
+	// RunBatch and CountBatch, in batches of this size.
+	QueryBatchSize int32
+}
+
+// DifferentialOptions configure RunDifferential.
+type DifferentialOptions struct {
+	// Seeds are the seeds of the workloads, one workload per seed.
+	Seeds []int64
+
+	// Ops is the number of top-level operations of each workload. If <= 0, 50
+	// is used.
+	Ops int
+}
+
+// RunDifferential runs the same randomly generated workloads against the
+// reference implementation and against each of the subjects, and fails the
+// test if a subject observes anything different from the reference.
+//
+// The reference is usually the plain memory datastore, and the subjects are
+// the same datastore with filters on top of it. Like the Implementations of
+// RunConformance, the reference and the subjects must return a new datastore
+// from New, which RunDifferential uses for a single run of a workload. It
+// doesn't use their Settle functions, so the datastores must be strongly
+// consistent.
+//
+// The reference's transactions must not read their own writes. If a subject's
+// transactions do (see Capabilities), the reads of the reference in
+// transactions are adjusted to include the transaction's own writes.
+//
+// A divergence is reported with the seed of its workload and with the workload
+// minimized to the operations needed to reproduce it, which can be rerun with
+// Diff.
+func RunDifferential(t *testing.T, ref Implementation, subjects []Subject, opts DifferentialOptions) {
+	n := opts.Ops
+	if n <= 0 {
+		n = modelWorkload
+	}
+
+	for _, s := range subjects {
+		s := s
+		t.Run(s.Name, func(t *testing.T) {
+			for _, seed := range opts.Seeds {
+				w := GenerateWorkload(seed, n)
+				if s.Capabilities.NoTransactions {
+					w.Ops = withoutTransactions(w.Ops)
+				}
+				if Diff(ref, s, w) == nil {
+					continue
+				}
+				w = minimize(ref, s, w)
+				t.Errorf("seed %d: %s\nminimized workload:\n%s", seed, Diff(ref, s, w), w)
+			}
+		})
+	}
+}
+
+// Diff runs the workload against a new datastore of the reference and a new
+// datastore of the subject, and returns the first divergence of their
+// observations, or nil if there's none.
+func Diff(ref Implementation, s Subject, w Workload) *Divergence {
+	want := runWorkload(ref.New(), w, s.Capabilities.TxnReadsOwnWrites, 0)
+	got := runWorkload(s.New(), w, false, s.QueryBatchSize)
+
+	for i := 0; i < len(want) || i < len(got); i++ {
+		var a, b observation
+		if i < len(want) {
+			a = want[i]
+		}
+		if i < len(got) {
+			b = got[i]
+		}
+		if a.op != b.op || a.text != b.text {
+			return &Divergence{Reference: a.String(), Subject: b.String()}
+		}
+	}
+	return nil
+}
+
+// Divergence is the first difference between the observations of the reference
+// and of a subject running the same workload.
+type Divergence struct {
+	// Reference is the observation of the reference, as "<op>: <observation>",
+	// where op is the path of the operation in the workload (see
+	// Workload.String). It's empty if the reference had no more observations.
+	Reference string
+
+	// Subject is the observation of the subject, like Reference.
+	Subject string
+}
+
+func (d *Divergence) String() string {
+	return fmt.Sprintf("reference observed <%s>, subject observed <%s>", d.Reference, d.Subject)
+}
+
+// Workload is a sequence of datastore operations, generated from a seed by
+// GenerateWorkload.
+type Workload struct {
+	// Seed is the seed which the workload was generated from.
+	Seed int64
+
+	// Ops are the top-level operations of the workload.
+	Ops []Op
+}
+
+// String returns the operations of the workload, one per line, prefixed with
+// their paths: the top-level operations are numbered from 0, the operations of
+// a transaction or of a parallel operation are numbered from 0 after the path
+// of their parent, and the concurrent operations of a transaction are
+// numbered like "3.c0".
+func (w Workload) String() string {
+	buf := &bytes.Buffer{}
+	for i := range w.Ops {
+		w.Ops[i].format(buf, strconv.Itoa(i), "")
+	}
+	return buf.String()
+}
+
+// OpKind is a kind of workload operation.
+type OpKind int
+
+const (
+	// OpGet gets the entities of Keys.
+	OpGet OpKind = iota
+	// OpPut puts the Values with the Keys.
+	OpPut
+	// OpDelete deletes the entities of Keys.
+	OpDelete
+	// OpQuery runs the Query.
+	OpQuery
+	// OpTxn runs the Body in a transaction, with a single attempt. The
+	// Concurrent operations are run outside of the transaction after Split
+	// operations of the Body.
+	OpTxn
+	// OpParallel runs each operation of the Body in its own goroutine. The
+	// operations touch different entity groups.
+	OpParallel
+)
+
+// Op is an operation of a workload.
+type Op struct {
+	Kind OpKind
+
+	// Keys are the keys of OpGet, OpPut and OpDelete.
+	Keys []EntityKey
+	// Values are the entities of OpPut, one per key.
+	Values []Entity
+
+	// Query is the query of OpQuery.
+	Query QuerySpec
+
+	// Body are the operations of OpTxn and OpParallel.
+	Body []Op
+	// Concurrent are the operations of OpTxn run outside of its transaction.
+	Concurrent []Op
+	// Split is the number of operations of the Body of OpTxn which run before the
+	// Concurrent operations.
+	Split int
+	// Rollback makes OpTxn roll its transaction back, by returning an error.
+	Rollback bool
+}
+
+func (op *Op) format(buf *bytes.Buffer, path, indent string) {
+	fmt.Fprintf(buf, "%s%s: ", indent, path)
+	switch op.Kind {
+	case OpGet:
+		fmt.Fprintf(buf, "Get %s\n", keysString(op.Keys))
+	case OpPut:
+		puts := make([]string, len(op.Keys))
+		for i, k := range op.Keys {
+			puts[i] = fmt.Sprintf("%s=%s", k, op.Values[i])
+		}
+		fmt.Fprintf(buf, "Put %s\n", strings.Join(puts, ", "))
+	case OpDelete:
+		fmt.Fprintf(buf, "Delete %s\n", keysString(op.Keys))
+	case OpQuery:
+		fmt.Fprintf(buf, "Query %s\n", op.Query)
+	case OpTxn:
+		if op.Rollback {
+			buf.WriteString("RunInTransaction, rolled back\n")
+		} else {
+			buf.WriteString("RunInTransaction\n")
+		}
+		for i := 0; i <= len(op.Body); i++ {
+			if i == op.Split {
+				for j := range op.Concurrent {
+					op.Concurrent[j].format(buf, fmt.Sprintf("%s.%s%d", path, concurrentPath, j), indent+"  ")
+				}
+			}
+			if i < len(op.Body) {
+				op.Body[i].format(buf, fmt.Sprintf("%s.%d", path, i), indent+"  ")
+			}
+		}
+	case OpParallel:
+		buf.WriteString("Parallel\n")
+		for i := range op.Body {
+			op.Body[i].format(buf, fmt.Sprintf("%s.%d", path, i), indent+"  ")
+		}
+	}
+}
+
+// simplifications returns the variations of op with one thing less in them,
+// e.g. one key or one operation less, for minimizing workloads.
+func (op *Op) simplifications() []Op {
+	var ret []Op
+	if len(op.Keys) > 1 {
+		for i := range op.Keys {
+			s := *op
+			s.Keys = append(append([]EntityKey(nil), op.Keys[:i]...), op.Keys[i+1:]...)
+			if op.Values != nil {
+				s.Values = append(append([]Entity(nil), op.Values[:i]...), op.Values[i+1:]...)
+			}
+			ret = append(ret, s)
+		}
+	}
+	for i := range op.Body {
+		s := *op
+		s.Body = withoutOp(op.Body, i)
+		if s.Split > i {
+			s.Split--
+		}
+		ret = append(ret, s)
+	}
+	for i := range op.Body {
+		for _, simpler := range op.Body[i].simplifications() {
+			s := *op
+			s.Body = append([]Op(nil), op.Body...)
+			s.Body[i] = simpler
+			ret = append(ret, s)
+		}
+	}
+	for i := range op.Concurrent {
+		s := *op
+		s.Concurrent = withoutOp(op.Concurrent, i)
+		ret = append(ret, s)
+	}
+	if op.Rollback {
+		s := *op
+		s.Rollback = false
+		ret = append(ret, s)
+	}
+	if op.Kind == OpQuery {
+		if op.Query.Limit > 0 {
+			s := *op
+			s.Query.Limit = 0
+			ret = append(ret, s)
+		}
+		if op.Query.Filter != NoFilter {
+			s := *op
+			s.Query.Filter = NoFilter
+			s.Query.OrderByVal = false
+			ret = append(ret, s)
+		}
+	}
+	return ret
+}
+
+// withoutOp returns a copy of ops without the i-th operation.
+func withoutOp(ops []Op, i int) []Op {
+	return append(append([]Op(nil), ops[:i]...), ops[i+1:]...)
+}
+
+// withoutTransactions returns the operations which don't run transactions.
+func withoutTransactions(ops []Op) []Op {
+	var ret []Op
+	for _, op := range ops {
+		switch op.Kind {
+		case OpTxn:
+			continue
+		case OpParallel:
+			op.Body = withoutTransactions(op.Body)
+		}
+		ret = append(ret, op)
+	}
+	return ret
+}
+
+// EntityKey is the key of a workload entity: "Model/<Group>" if ID is 0,
+// "Model/<Group>/Model/<ID>" otherwise. If ID is -1, the key is an incomplete
+// key of a child of "Model/<Group>".
+type EntityKey struct {
+	Group int64
+	ID    int64
+}
+
+func (k EntityKey) String() string {
+	switch k.ID {
+	case 0:
+		return fmt.Sprintf("%s,%d", modelKind, k.Group)
+	case incompleteID:
+		return fmt.Sprintf("%s,%d/%s,?", modelKind, k.Group, modelKind)
+	default:
+		return fmt.Sprintf("%s,%d/%s,%d", modelKind, k.Group, modelKind, k.ID)
+	}
+}
+
+func (k EntityKey) key(c context.Context) *ds.Key {
+	root := ds.NewKey(c, modelKind, "", k.Group, nil)
+	switch k.ID {
+	case 0:
+		return root
+	case incompleteID:
+		return ds.NewKey(c, modelKind, "", 0, root)
+	default:
+		return ds.NewKey(c, modelKind, "", k.ID, root)
+	}
+}
+
+func keysString(keys []EntityKey) string {
+	ret := make([]string, len(keys))
+	for i, k := range keys {
+		ret[i] = k.String()
+	}
+	return strings.Join(ret, ", ")
+}
+
+// Entity is a workload entity. Val is indexed, Tags are the indexed values of
+// the Tag property (which is missing if there are none), and Note is
+// unindexed.
+type Entity struct {
+	Val  int64
+	Tags []string
+	Note string
+}
+
+func (e Entity) String() string {
+	return fmt.Sprintf("{Val: %d, Tag: %v, Note: %q}", e.Val, e.Tags, e.Note)
+}
+
+func (e Entity) propertyMap(key *ds.Key) ds.PropertyMap {
+	pm := ds.PropertyMap{
+		"$key": ds.MkPropertyNI(key),
+		"Val":  ds.MkProperty(e.Val),
+		"Note": ds.MkPropertyNI(e.Note),
+	}
+	if len(e.Tags) > 0 {
+		tags := make(ds.PropertySlice, len(e.Tags))
+		for i, tag := range e.Tags {
+			tags[i] = ds.MkProperty(tag)
+		}
+		pm["Tag"] = tags
+	}
+	return pm
+}
+
+// QueryFilter is the filter of a workload query.
+type QueryFilter int
+
+const (
+	// NoFilter doesn't filter the entities.
+	NoFilter QueryFilter = iota
+	// ValEqual returns the entities whose Val is the query's Val.
+	ValEqual
+	// ValAtLeast returns the entities whose Val is >= the query's Val. It's
+	// always used with OrderByVal.
+	ValAtLeast
+	// TagEqual returns the entities which have the query's Tag.
+	TagEqual
+)
+
+// QuerySpec is a query of a workload, on the Model kind.
+type QuerySpec struct {
+	// Ancestor, if not 0, restricts the query to an entity group.
+	Ancestor int64
+
+	Filter QueryFilter
+	Val    int64
+	Tag    string
+
+	// OrderByVal orders the entities by Val, and then by key. Otherwise they're
+	// ordered by key.
+	OrderByVal bool
+
+	// Limit, if > 0, limits the number of entities.
+	Limit int32
+
+	// KeysOnly makes the query a keys-only query.
+	KeysOnly bool
+
+	// Count makes the query count the entities.
+	Count bool
+}
+
+func (q QuerySpec) String() string {
+	parts := []string{modelKind}
+	if q.Ancestor != 0 {
+		parts = append(parts, fmt.Sprintf("ancestor=%s", EntityKey{Group: q.Ancestor}))
+	}
+	switch q.Filter {
+	case ValEqual:
+		parts = append(parts, fmt.Sprintf("Val=%d", q.Val))
+	case ValAtLeast:
+		parts = append(parts, fmt.Sprintf("Val>=%d", q.Val))
+	case TagEqual:
+		parts = append(parts, fmt.Sprintf("Tag=%s", q.Tag))
+	}
+	if q.OrderByVal {
+		parts = append(parts, "order=Val")
+	}
+	if q.Limit > 0 {
+		parts = append(parts, fmt.Sprintf("limit=%d", q.Limit))
+	}
+	if q.KeysOnly {
+		parts = append(parts, "keys-only")
+	}
+	if q.Count {
+		parts = append(parts, "count")
+	}
+	return strings.Join(parts, " ")
+}
+
+func (q QuerySpec) query(c context.Context) *ds.Query {
+	ret := ds.NewQuery(modelKind)
+	if q.Ancestor != 0 {
+		ret = ret.Ancestor(EntityKey{Group: q.Ancestor}.key(c))
+	}
+	switch q.Filter {
+	case ValEqual:
+		ret = ret.Eq("Val", q.Val)
+	case ValAtLeast:
+		ret = ret.Gte("Val", q.Val)
+	case TagEqual:
+		ret = ret.Eq("Tag", q.Tag)
+	}
+	if q.OrderByVal {
+		ret = ret.Order("Val")
+	}
+	if q.Limit > 0 {
+		ret = ret.Limit(q.Limit)
+	}
+	return ret.KeysOnly(q.KeysOnly)
+}
+
+// matches returns true iff the query returns the entity.
+func (q QuerySpec) matches(c context.Context, key *ds.Key, pm ds.PropertyMap) bool {
+	if q.Ancestor != 0 && !key.HasAncestor(EntityKey{Group: q.Ancestor}.key(c)) {
+		return false
+	}
+	switch q.Filter {
+	case ValEqual:
+		return entityVal(pm) == q.Val
+	case ValAtLeast:
+		return entityVal(pm) >= q.Val
+	case TagEqual:
+		for _, p := range pm.Slice("Tag") {
+			if p.Value() == q.Tag {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// less returns true iff the query returns the entity a before the entity b.
+func (q QuerySpec) less(a, b queryResult) bool {
+	if q.OrderByVal {
+		if va, vb := entityVal(a.pm), entityVal(b.pm); va != vb {
+			return va < vb
+		}
+	}
+	return a.key.Less(b.key)
+}
+
+func entityVal(pm ds.PropertyMap) int64 {
+	v, _ := pm.Slice("Val")[0].Value().(int64)
+	return v
+}
+
+// GenerateWorkload returns a random workload with n top-level operations. The
+// same seed always yields the same workload.
+func GenerateWorkload(seed int64, n int) Workload {
+	g := generator{rand.New(rand.NewSource(seed))}
+	w := Workload{Seed: seed}
+	for i := 0; i < n; i++ {
+		w.Ops = append(w.Ops, g.op())
+	}
+	return w
+}
+
+type generator struct {
+	*rand.Rand
+}
+
+func (g generator) op() Op {
+	switch n := g.Intn(100); {
+	case n < 20:
+		return Op{Kind: OpGet, Keys: g.keys(0)}
+	case n < 45:
+		return g.put(0, true)
+	case n < 55:
+		return Op{Kind: OpDelete, Keys: g.keys(0)}
+	case n < 75:
+		return Op{Kind: OpQuery, Query: g.query(0)}
+	case n < 95:
+		return g.txn(g.group(), true)
+	default:
+		return g.parallel()
+	}
+}
+
+func (g generator) group() int64 {
+	return 1 + g.Int63n(modelGroups)
+}
+
+// keys returns up to 4 distinct keys, in the group, or in any group if group is
+// 0.
+func (g generator) keys(group int64) []EntityKey {
+	var ret []EntityKey
+	seen := map[EntityKey]bool{}
+	for i, n := 0, 1+g.Intn(4); i < n; i++ {
+		k := EntityKey{Group: group, ID: g.Int63n(modelChildren + 1)}
+		if group == 0 {
+			k.Group = g.group()
+		}
+		if !seen[k] {
+			seen[k] = true
+			ret = append(ret, k)
+		}
+	}
+	return ret
+}
+
+// put returns an OpPut in the group, or in any group if group is 0. If
+// incomplete is true, one of the keys may be incomplete; there's never more
+// than one, so that the IDs don't depend on the order of the puts. Its
+// group's other children aren't put along with it either, since the ID it gets
+// may be one of theirs, and then the entity which is left would depend on the
+// order in which the put is applied.
+func (g generator) put(group int64, incomplete bool) Op {
+	op := Op{Kind: OpPut, Keys: g.keys(group)}
+	if incomplete && g.Intn(5) == 0 {
+		inc := EntityKey{Group: op.Keys[0].Group, ID: incompleteID}
+		keys := []EntityKey{inc}
+		for _, k := range op.Keys[1:] {
+			if k.Group != inc.Group || k.ID == 0 {
+				keys = append(keys, k)
+			}
+		}
+		op.Keys = keys
+	}
+	for range op.Keys {
+		op.Values = append(op.Values, g.entity())
+	}
+	return op
+}
+
+func (g generator) entity() Entity {
+	e := Entity{Val: g.Int63n(modelVals), Note: fmt.Sprintf("n%d", g.Intn(10))}
+	for _, tag := range modelTags {
+		if g.Intn(3) == 0 {
+			e.Tags = append(e.Tags, tag)
+		}
+	}
+	return e
+}
+
+// query returns a query in the group, or a query which may be in any group if
+// group is 0.
+func (g generator) query(group int64) QuerySpec {
+	q := QuerySpec{Ancestor: group}
+	if group == 0 && g.Intn(3) == 0 {
+		q.Ancestor = g.group()
+	}
+	switch g.Intn(4) {
+	case 0:
+		q.OrderByVal = g.Intn(2) == 0
+	case 1:
+		q.Filter, q.Val = ValEqual, g.Int63n(modelVals)
+	case 2:
+		q.Filter, q.Val, q.OrderByVal = ValAtLeast, g.Int63n(modelVals), true
+	case 3:
+		q.Filter, q.Tag = TagEqual, modelTags[g.Intn(len(modelTags))]
+	}
+	switch g.Intn(4) {
+	case 0:
+		q.KeysOnly = true
+	case 1:
+		q.Count = true
+	}
+	if !q.Count && g.Intn(2) == 0 {
+		q.Limit = 1 + g.Int31n(3)
+	}
+	return q
+}
+
+// txn returns an OpTxn in the group. If concurrent is true, it may have
+// concurrent operations, in the group or in others.
+func (g generator) txn(group int64, concurrent bool) Op {
+	op := Op{Kind: OpTxn, Rollback: g.Intn(8) == 0}
+	for i, n := 0, 1+g.Intn(5); i < n; i++ {
+		switch g.Intn(4) {
+		case 0:
+			op.Body = append(op.Body, Op{Kind: OpGet, Keys: g.keys(group)})
+		case 1:
+			op.Body = append(op.Body, g.put(group, false))
+		case 2:
+			op.Body = append(op.Body, Op{Kind: OpDelete, Keys: g.keys(group)})
+		case 3:
+			op.Body = append(op.Body, Op{Kind: OpQuery, Query: g.query(group)})
+		}
+	}
+
+	if concurrent && g.Intn(4) == 0 {
+		op.Split = g.Intn(len(op.Body) + 1)
+		for i, n := 0, 1+g.Intn(2); i < n; i++ {
+			other := group
+			if g.Intn(2) == 0 {
+				other = g.group()
+			}
+			if g.Intn(3) == 0 {
+				op.Concurrent = append(op.Concurrent, Op{Kind: OpDelete, Keys: g.keys(other)})
+			} else {
+				op.Concurrent = append(op.Concurrent, g.put(other, false))
+			}
+		}
+	}
+	return op
+}
+
+// parallel returns an OpParallel, whose operations are each in a different
+// entity group.
+func (g generator) parallel() Op {
+	op := Op{Kind: OpParallel}
+	groups := g.Perm(modelGroups)
+	for _, i := range groups[:2+g.Intn(modelGroups-1)] {
+		group := int64(i + 1)
+		switch g.Intn(5) {
+		case 0:
+			op.Body = append(op.Body, Op{Kind: OpGet, Keys: g.keys(group)})
+		case 1:
+			op.Body = append(op.Body, g.put(group, false))
+		case 2:
+			op.Body = append(op.Body, Op{Kind: OpQuery, Query: g.query(group)})
+		default:
+			op.Body = append(op.Body, g.txn(group, false))
+		}
+	}
+	return op
+}
+
+// minimize returns a smaller workload which still makes the subject diverge
+// from the reference, by removing and simplifying operations as long as the
+// divergence remains.
+func minimize(ref Implementation, s Subject, w Workload) Workload {
+	diverges := func(ops []Op) bool {
+		return Diff(ref, s, Workload{Seed: w.Seed, Ops: ops}) != nil
+	}
+
+	ops := w.Ops
+	for changed := true; changed; {
+		changed = false
+		for chunk := len(ops); chunk >= 1; chunk /= 2 {
+			for i := 0; i+chunk <= len(ops); {
+				cand := append(append([]Op(nil), ops[:i]...), ops[i+chunk:]...)
+				if diverges(cand) {
+					ops, changed = cand, true
+				} else {
+					i += chunk
+				}
+			}
+		}
+		for i := range ops {
+			for _, simpler := range ops[i].simplifications() {
+				cand := append([]Op(nil), ops...)
+				cand[i] = simpler
+				if diverges(cand) {
+					ops, changed = cand, true
+					break
+				}
+			}
+		}
+	}
+	return Workload{Seed: w.Seed, Ops: ops}
+}
+
+// observation is what a workload operation observed, e.g. the entities it got
+// or the error it returned.
+type observation struct {
+	op   string
+	text string
+
+	// detail, e.g. the error message, is only reported, not compared.
+	detail string
+}
+
+func (o observation) String() string {
+	if o.op == "" {
+		return ""
+	}
+	if o.detail != "" {
+		return fmt.Sprintf("%s: %s (%s)", o.op, o.text, o.detail)
+	}
+	return fmt.Sprintf("%s: %s", o.op, o.text)
+}
+
+// runWorkload runs the workload against the datastore of c, and returns what
+// its operations observed.
+//
+// If lift is true, the reads in transactions are adjusted to observe the
+// transaction's own writes. If batch is > 0, the queries outside of
+// transactions run in batches of that size.
+func runWorkload(c context.Context, w Workload, lift bool, batch int32) []observation {
+	r := &runner{lift: lift, batch: batch}
+	for i := range w.Ops {
+		r.run(c, strconv.Itoa(i), &w.Ops[i], nil)
+	}
+	return r.obs
+}
+
+type runner struct {
+	lift  bool
+	batch int32
+	obs   []observation
+}
+
+// txnState is the state of a transaction of a workload.
+type txnState struct {
+	// writes are the entities written by the transaction, by key, with nil
+	// values for deleted entities. They're only tracked if the runner lifts
+	// reads.
+	writes map[string]queryResult
+}
+
+type queryResult struct {
+	key *ds.Key
+	pm  ds.PropertyMap
+}
+
+func (r *runner) record(op, text string, err error) {
+	o := observation{op: op, text: text}
+	if err != nil {
+		o.text = errClass(err)
+		o.detail = err.Error()
+	}
+	r.obs = append(r.obs, o)
+}
+
+// run runs the operation in c, which is in the transaction txn, if it's not
+// nil.
+func (r *runner) run(c context.Context, path string, op *Op, txn *txnState) {
+	switch op.Kind {
+	case OpGet:
+		r.get(c, path, op, txn)
+	case OpPut:
+		r.put(c, path, op, txn)
+	case OpDelete:
+		r.delete(c, path, op, txn)
+	case OpQuery:
+		r.query(c, path, &op.Query, txn)
+	case OpTxn:
+		r.txn(c, path, op)
+	case OpParallel:
+		r.parallel(c, path, op)
+	}
+}
+
+func (r *runner) get(c context.Context, path string, op *Op, txn *txnState) {
+	pms := make([]ds.PropertyMap, len(op.Keys))
+	for i, k := range op.Keys {
+		pms[i] = ds.PropertyMap{"$key": ds.MkPropertyNI(k.key(c))}
+	}
+	err := ds.Get(c, pms)
+	for i, k := range op.Keys {
+		p := fmt.Sprintf("%s %s", path, k)
+		if w, ok := r.ownWrite(txn, k.key(c)); ok {
+			if w.pm == nil {
+				r.record(p, "", ds.ErrNoSuchEntity)
+			} else {
+				r.record(p, entityString(w.key, w.pm), nil)
+			}
+			continue
+		}
+		if err := elemErr(err, i); err != nil {
+			r.record(p, "", err)
+		} else {
+			r.record(p, entityString(ds.KeyForObj(c, pms[i]), pms[i]), nil)
+		}
+	}
+}
+
+func (r *runner) put(c context.Context, path string, op *Op, txn *txnState) {
+	pms := make([]ds.PropertyMap, len(op.Keys))
+	for i, k := range op.Keys {
+		pms[i] = op.Values[i].propertyMap(k.key(c))
+	}
+	err := ds.Put(c, pms)
+	for i, k := range op.Keys {
+		p := fmt.Sprintf("%s %s", path, k)
+		if err := elemErr(err, i); err != nil {
+			r.record(p, "", err)
+			continue
+		}
+		key := ds.KeyForObj(c, pms[i])
+		r.record(p, "put "+keyString(key), nil)
+		r.writeOwn(txn, key, pms[i])
+	}
+}
+
+func (r *runner) delete(c context.Context, path string, op *Op, txn *txnState) {
+	keys := make([]*ds.Key, len(op.Keys))
+	for i, k := range op.Keys {
+		keys[i] = k.key(c)
+	}
+	err := ds.Delete(c, keys)
+	for i, k := range op.Keys {
+		err := elemErr(err, i)
+		r.record(fmt.Sprintf("%s %s", path, k), "deleted", err)
+		if err == nil {
+			r.writeOwn(txn, keys[i], nil)
+		}
+	}
+}
+
+func (r *runner) query(c context.Context, path string, q *QuerySpec, txn *txnState) {
+	if r.lift && txn != nil && len(txn.writes) > 0 {
+		r.liftedQuery(c, path, q, txn)
+		return
+	}
+
+	// Cursors aren't supported in all transactions, so queries in transactions
+	// are never batched.
+	batch := r.batch
+	if txn != nil {
+		batch = 0
+	}
+
+	var results []string
+	var err error
+	switch {
+	case q.Count:
+		var n int64
+		if n, err = ds.CountBatch(c, batch, q.query(c)); err == nil {
+			results = append(results, fmt.Sprintf("count %d", n))
+		}
+	case q.KeysOnly:
+		err = ds.RunBatch(c, batch, q.query(c), func(k *ds.Key) {
+			results = append(results, keyString(k))
+		})
+	default:
+		err = ds.RunBatch(c, batch, q.query(c), func(pm ds.PropertyMap) {
+			results = append(results, entityString(ds.KeyForObj(c, pm), pm))
+		})
+	}
+	r.record(path, "["+strings.Join(results, "; ")+"]", err)
+}
+
+// liftedQuery runs the query in a transaction like query, but adjusts its
+// results to include the transaction's own writes.
+func (r *runner) liftedQuery(c context.Context, path string, q *QuerySpec, txn *txnState) {
+	// Get all of the entities, since some of them may be replaced.
+	full := *q
+	full.Limit, full.KeysOnly, full.Count = 0, false, false
+
+	var ents []queryResult
+	err := ds.Run(c, full.query(c), func(pm ds.PropertyMap) {
+		key := ds.KeyForObj(c, pm)
+		if _, ok := txn.writes[key.String()]; !ok {
+			ents = append(ents, queryResult{key, pm})
+		}
+	})
+	if err != nil {
+		r.record(path, "", err)
+		return
+	}
+	for _, w := range txn.writes {
+		if w.pm != nil && q.matches(c, w.key, w.pm) {
+			ents = append(ents, w)
+		}
+	}
+	sort.Slice(ents, func(i, j int) bool { return q.less(ents[i], ents[j]) })
+	if q.Limit > 0 && len(ents) > int(q.Limit) {
+		ents = ents[:q.Limit]
+	}
+
+	var results []string
+	switch {
+	case q.Count:
+		results = append(results, fmt.Sprintf("count %d", len(ents)))
+	case q.KeysOnly:
+		for _, e := range ents {
+			results = append(results, keyString(e.key))
+		}
+	default:
+		for _, e := range ents {
+			results = append(results, entityString(e.key, e.pm))
+		}
+	}
+	r.record(path, "["+strings.Join(results, "; ")+"]", nil)
+}
+
+func (r *runner) txn(c context.Context, path string, op *Op) {
+	concurrent := func() {
+		for i := range op.Concurrent {
+			r.run(c, fmt.Sprintf("%s.%s%d", path, concurrentPath, i), &op.Concurrent[i], nil)
+		}
+	}
+
+	err := ds.RunInTransaction(c, func(tc context.Context) error {
+		txn := &txnState{writes: map[string]queryResult{}}
+		for i := range op.Body {
+			if i == op.Split {
+				concurrent()
+			}
+			r.run(tc, fmt.Sprintf("%s.%d", path, i), &op.Body[i], txn)
+		}
+		if op.Split >= len(op.Body) {
+			concurrent()
+		}
+		if op.Rollback {
+			return errRollback
+		}
+		return nil
+	}, &ds.TransactionOptions{Attempts: 1})
+	r.record(path, "committed", err)
+}
+
+func (r *runner) parallel(c context.Context, path string, op *Op) {
+	branches := make([]*runner, len(op.Body))
+	var wg sync.WaitGroup
+	for i := range op.Body {
+		i := i
+		branches[i] = &runner{lift: r.lift, batch: r.batch}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			branches[i].run(c, fmt.Sprintf("%s.%d", path, i), &op.Body[i], nil)
+		}()
+	}
+	wg.Wait()
+
+	for _, b := range branches {
+		r.obs = append(r.obs, b.obs...)
+	}
+}
+
+// ownWrite returns the transaction's own write of the entity, if the runner
+// lifts reads.
+func (r *runner) ownWrite(txn *txnState, key *ds.Key) (queryResult, bool) {
+	if !r.lift || txn == nil {
+		return queryResult{}, false
+	}
+	w, ok := txn.writes[key.String()]
+	return w, ok
+}
+
+// writeOwn records the transaction's own write of the entity, if the runner
+// lifts reads. pm is nil for deletions.
+func (r *runner) writeOwn(txn *txnState, key *ds.Key, pm ds.PropertyMap) {
+	if r.lift && txn != nil {
+		txn.writes[key.String()] = queryResult{key, pm}
+	}
+}
+
+// elemErr returns the error of the i-th element of a multi-element call.
+func elemErr(err error, i int) error {
+	if me, ok := err.(errors.MultiError); ok {
+		return me[i]
+	}
+	return err
+}
+
+// errClass describes the error, for comparing errors whose messages may differ
+// between implementations.
+func errClass(err error) string {
+	switch errors.Unwrap(err) {
+	case ds.ErrNoSuchEntity:
+		return "no such entity"
+	case ds.ErrConcurrentTransaction:
+		return "concurrent transaction"
+	case errRollback:
+		return "rolled back"
+	default:
+		return "error"
+	}
+}
+
+// keyString returns the path of the key, like "Model,1/Model,2".
+func keyString(k *ds.Key) string {
+	_, _, toks := k.Split()
+	parts := make([]string, len(toks))
+	for i, t := range toks {
+		parts[i] = fmt.Sprintf("%s,%d", t.Kind, t.IntID)
+	}
+	return strings.Join(parts, "/")
+}
+
+func entityString(key *ds.Key, pm ds.PropertyMap) string {
+	return fmt.Sprintf("%s {%s}", keyString(key), strings.Join(describe(pm), ", "))
+}
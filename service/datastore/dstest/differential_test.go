@@ -0,0 +1,143 @@
+// Copyright 2018 The LUCI Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dstest
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"go.chromium.org/gae/filter/dscache"
+	"go.chromium.org/gae/filter/txnBuf"
+	ds "go.chromium.org/gae/service/datastore"
+
+	"golang.org/x/net/context"
+)
+
+// newBatching returns a context like newMemory, whose datastore has small
+// batch sizes, so that the multi-entity operations are split into batches.
+func newBatching() context.Context {
+	c := newMemory()
+	if err := ds.GetTestable(c).SetConstraints(&ds.Constraints{
+		MaxGetSize:    2,
+		MaxPutSize:    2,
+		MaxDeleteSize: 2,
+	}); err != nil {
+		panic(err)
+	}
+	return c
+}
+
+func TestDifferential(t *testing.T) {
+	t.Parallel()
+
+	var seeds []int64
+	for seed := int64(1); seed <= 20; seed++ {
+		seeds = append(seeds, seed)
+	}
+
+	RunDifferential(t, Implementation{New: newMemory}, []Subject{
+		{
+			Name: "txnBuf",
+			Implementation: Implementation{
+				New:          func() context.Context { return txnBuf.FilterRDS(newMemory()) },
+				Capabilities: Capabilities{TxnReadsOwnWrites: true},
+			},
+		},
+		{
+			Name: "dscache",
+			Implementation: Implementation{
+				New: func() context.Context { return dscache.AlwaysFilterRDS(newMemory()) },
+			},
+		},
+		{
+			Name:           "batching",
+			Implementation: Implementation{New: newBatching},
+			QueryBatchSize: 2,
+		},
+		{
+			Name: "all filters",
+			Implementation: Implementation{
+				New:          func() context.Context { return txnBuf.FilterRDS(dscache.AlwaysFilterRDS(newBatching())) },
+				Capabilities: Capabilities{TxnReadsOwnWrites: true},
+			},
+			QueryBatchSize: 2,
+		},
+	}, DifferentialOptions{Seeds: seeds})
+}
+
+func TestGenerateWorkload(t *testing.T) {
+	t.Parallel()
+
+	a, b := GenerateWorkload(42, 100), GenerateWorkload(42, 100)
+	if !reflect.DeepEqual(a, b) {
+		t.Errorf("workloads of the same seed differ:\n%s\n%s", a, b)
+	}
+	if c := GenerateWorkload(43, 100); reflect.DeepEqual(a, c) {
+		t.Errorf("workloads of different seeds are the same:\n%s", a)
+	}
+}
+
+func TestDiff(t *testing.T) {
+	t.Parallel()
+
+	w := Workload{Ops: []Op{
+		{Kind: OpPut, Keys: []EntityKey{{Group: 1, ID: 1}}, Values: []Entity{{Val: 1}}},
+		{Kind: OpTxn, Body: []Op{
+			{Kind: OpPut, Keys: []EntityKey{{Group: 1, ID: 1}}, Values: []Entity{{Val: 2}}},
+			{Kind: OpGet, Keys: []EntityKey{{Group: 1, ID: 1}}},
+			{Kind: OpQuery, Query: QuerySpec{Ancestor: 1, Filter: ValEqual, Val: 2}},
+		}},
+	}}
+	mem := Implementation{New: newMemory}
+	newTxnBuf := func() context.Context { return txnBuf.FilterRDS(newMemory()) }
+
+	t.Run("same", func(t *testing.T) {
+		if d := Diff(mem, Subject{Name: "memory", Implementation: mem}, w); d != nil {
+			t.Errorf("unexpected divergence: %s", d)
+		}
+	})
+
+	t.Run("reads own writes", func(t *testing.T) {
+		// Transactions of txnBuf read their own writes, unlike memory's.
+		d := Diff(mem, Subject{Name: "txnBuf", Implementation: Implementation{New: newTxnBuf}}, w)
+		if d == nil {
+			t.Fatal("no divergence")
+		}
+		if !strings.HasPrefix(d.Reference, "1.1 Model,1/Model,1: ") || !strings.Contains(d.Reference, "Val=PTInt(1)") {
+			t.Errorf("unexpected divergence: %s", d)
+		}
+
+		buf := Subject{Name: "txnBuf", Implementation: Implementation{
+			New:          newTxnBuf,
+			Capabilities: Capabilities{TxnReadsOwnWrites: true},
+		}}
+		if d := Diff(mem, buf, w); d != nil {
+			t.Errorf("unexpected divergence: %s", d)
+		}
+	})
+
+	t.Run("minimize", func(t *testing.T) {
+		w := w
+		w.Ops = append([]Op{
+			{Kind: OpPut, Keys: []EntityKey{{Group: 2}}, Values: []Entity{{Val: 3}}},
+			{Kind: OpGet, Keys: []EntityKey{{Group: 2}, {Group: 3}}},
+		}, w.Ops...)
+		got := minimize(mem, Subject{Name: "txnBuf", Implementation: Implementation{New: newTxnBuf}}, w)
+		if len(got.Ops) != 1 || got.Ops[0].Kind != OpTxn || len(got.Ops[0].Body) != 2 {
+			t.Errorf("unexpected minimized workload:\n%s", got)
+		}
+	})
+}
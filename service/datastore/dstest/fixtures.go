@@ -0,0 +1,607 @@
+// Copyright 2018 The LUCI Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package dstest contains helpers for testing code which uses the datastore.
+//
+// LoadFixtures puts entities described in a human-editable YAML (or JSON, which
+// is a subset of YAML) file into the datastore. A fixture file is a list of
+// entities:
+//
+//	# fixtures.yaml
+//	- key: User/alice              # Kind/id/Kind/id..., integer ids are IntIDs
+//	  props:
+//	    Name: Alice                # string
+//	    Age: 30                    # int
+//	    Score: 4.5                 # float
+//	    Admin: true                # bool
+//	    Nickname: null             # null
+//	    Tags: [a, b]               # multiple values
+//	    Joined: {time: "2018-01-02T03:04:05Z"}
+//	    Friend: {key: User/bob}    # same namespace as the entity
+//	    Home: {geo: {lat: 1.5, lng: -2.5}}
+//	    Avatar: {bytes: aGVsbG8=}  # base64
+//	    Bio: {value: "...", noindex: true}
+//	  children:                    # keys are relative to the parent
+//	  - key: Setting/theme
+//	    props: {Value: dark}
+//	- key: [User, "42"]            # list form, to force a string id
+//	  namespace: other
+//
+// Typed values are maps with exactly one of the type names "value" (type
+// inferred as for plain values), "int", "float", "string", "bool", "null",
+// "time" (RFC 3339), "key", "geo", "bytes", "blobkey" or "entity" (a nested
+// map of properties), and optionally "noindex: true". A "key" value may also
+// have a "namespace" to point to an entity in another namespace.
+//
+// DumpFixtures writes the entire contents of a datastore in the same format, so
+// fixtures can be regenerated from a live (e.g. impl/memory) datastore.
+//
+// RunConformance is a conformance suite for datastore implementations and
+// filters: it tests that they behave like the Cloud Datastore, e.g. with
+// regard to query ordering, cursors, projections and transactions, except for
+// their declared Capabilities.
+//
+// RunDifferential complements it for filters: it runs random, reproducible
+// workloads of gets, puts, deletes, queries and (concurrent) transactions
+// against a reference datastore and against filter stacks on top of it, and
+// reports any divergence with a minimized workload.
+package dstest
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.chromium.org/gae/service/blobstore"
+	ds "go.chromium.org/gae/service/datastore"
+	"go.chromium.org/gae/service/datastore/meta"
+	"go.chromium.org/gae/service/info"
+
+	"go.chromium.org/luci/common/errors"
+
+	"golang.org/x/net/context"
+	"gopkg.in/yaml.v2"
+)
+
+// fixtureEntity is a single entity in a fixture file.
+type fixtureEntity struct {
+	Key       interface{}            `yaml:"key"`
+	Namespace string                 `yaml:"namespace"`
+	Props     map[string]interface{} `yaml:"props"`
+	Children  []*fixtureEntity       `yaml:"children"`
+}
+
+// LoadFixtures reads the fixture file at path and puts all of its entities
+// into the datastore in c.
+func LoadFixtures(c context.Context, path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	pms, err := ParseFixtures(c, data)
+	if err != nil {
+		return errors.Annotate(err, "loading %q", path).Err()
+	}
+
+	// The datastore only accepts keys in the namespace of the context, so the
+	// entities are put one namespace at a time.
+	var namespaces []string
+	byNamespace := map[string][]ds.PropertyMap{}
+	for _, pm := range pms {
+		ns := ds.GetMetaDefault(pm, "key", (*ds.Key)(nil)).(*ds.Key).Namespace()
+		if _, ok := byNamespace[ns]; !ok {
+			namespaces = append(namespaces, ns)
+		}
+		byNamespace[ns] = append(byNamespace[ns], pm)
+	}
+	for _, ns := range namespaces {
+		nc, err := info.Namespace(c, ns)
+		if err != nil {
+			return errors.Annotate(err, "loading %q", path).Err()
+		}
+		if err := ds.Put(nc, byNamespace[ns]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ParseFixtures parses fixture data, and returns the described entities. Keys
+// are created in the app ID of c, and, unless the fixture says otherwise, in
+// the namespace of c.
+func ParseFixtures(c context.Context, data []byte) ([]ds.PropertyMap, error) {
+	var ents []*fixtureEntity
+	if err := yaml.Unmarshal(data, &ents); err != nil {
+		return nil, errors.Annotate(err, "bad fixture data").Err()
+	}
+
+	var ret []ds.PropertyMap
+	var parse func(ents []*fixtureEntity, kc ds.KeyContext, parent *ds.Key) error
+	parse = func(ents []*fixtureEntity, kc ds.KeyContext, parent *ds.Key) error {
+		for i, e := range ents {
+			ekc := kc
+			if e.Namespace != "" {
+				if parent != nil && e.Namespace != kc.Namespace {
+					return fmt.Errorf("entity %d: a child must be in the namespace of its parent", i)
+				}
+				ekc.Namespace = e.Namespace
+			}
+
+			key, err := parseKey(ekc, e.Key, parent)
+			if err != nil {
+				return errors.Annotate(err, "entity %d", i).Err()
+			}
+			pm, err := parseProps(ekc, e.Props)
+			if err != nil {
+				return errors.Annotate(err, "entity %s", key).Err()
+			}
+			pm.SetMeta("key", key)
+			ret = append(ret, pm)
+
+			if len(e.Children) > 0 {
+				if key.IsIncomplete() {
+					return fmt.Errorf("entity %s: an incomplete key can't have children", key)
+				}
+				if err := parse(e.Children, ekc, key); err != nil {
+					return errors.Annotate(err, "in children of %s", key).Err()
+				}
+			}
+		}
+		return nil
+	}
+	if err := parse(ents, ds.GetKeyContext(c), nil); err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+// parseKey parses a key in path form ("Kind/id/Kind/id") or list form
+// ([Kind, id, Kind, id]). If the path has an odd number of elements, the key
+// is incomplete.
+func parseKey(kc ds.KeyContext, spec interface{}, parent *ds.Key) (*ds.Key, error) {
+	var elems []interface{}
+	switch t := spec.(type) {
+	case string:
+		for i, e := range strings.Split(t, "/") {
+			if i%2 == 1 {
+				if id, err := strconv.ParseInt(e, 10, 64); err == nil {
+					elems = append(elems, id)
+					continue
+				}
+			}
+			elems = append(elems, e)
+		}
+	case []interface{}:
+		elems = t
+	case nil:
+		return nil, errors.New("missing key")
+	default:
+		return nil, fmt.Errorf("bad key %v: must be a string or a list", spec)
+	}
+
+	var toks []ds.KeyTok
+	if parent != nil {
+		_, _, toks = parent.Split()
+	}
+	for i := 0; i < len(elems); i += 2 {
+		kind, ok := elems[i].(string)
+		if !ok || kind == "" {
+			return nil, fmt.Errorf("bad key %v: bad kind %v", spec, elems[i])
+		}
+		tok := ds.KeyTok{Kind: kind}
+		if i+1 < len(elems) {
+			switch id := elems[i+1].(type) {
+			case string:
+				tok.StringID = id
+			default:
+				intID, ok := toInt(id)
+				if !ok {
+					return nil, fmt.Errorf("bad key %v: bad id %v", spec, id)
+				}
+				tok.IntID = intID
+			}
+		}
+		toks = append(toks, tok)
+	}
+	if len(toks) == 0 {
+		return nil, errors.New("empty key")
+	}
+
+	key := kc.NewKeyToks(toks)
+	if !key.PartialValid(kc) {
+		return nil, fmt.Errorf("invalid key %s", key)
+	}
+	return key, nil
+}
+
+func parseProps(kc ds.KeyContext, props map[string]interface{}) (ds.PropertyMap, error) {
+	pm := make(ds.PropertyMap, len(props))
+	for name, v := range props {
+		if list, ok := v.([]interface{}); ok {
+			ps := make(ds.PropertySlice, len(list))
+			for i, item := range list {
+				var err error
+				if ps[i], err = parseValue(kc, item); err != nil {
+					return nil, errors.Annotate(err, "property %q", name).Err()
+				}
+			}
+			pm[name] = ps
+			continue
+		}
+		p, err := parseValue(kc, v)
+		if err != nil {
+			return nil, errors.Annotate(err, "property %q", name).Err()
+		}
+		pm[name] = p
+	}
+	return pm, nil
+}
+
+// typeNames are the names of the typed value fields.
+var typeNames = []string{
+	"value", "int", "float", "string", "bool", "null",
+	"time", "key", "geo", "bytes", "blobkey", "entity",
+}
+
+func parseValue(kc ds.KeyContext, v interface{}) (ds.Property, error) {
+	typed, ok := v.(map[interface{}]interface{})
+	if !ok {
+		return mkProperty(plainValue(v), ds.ShouldIndex)
+	}
+
+	fields := make(map[string]interface{}, len(typed))
+	for k, fv := range typed {
+		fields[fmt.Sprint(k)] = fv
+	}
+
+	is := ds.ShouldIndex
+	if ni, ok := fields["noindex"]; ok {
+		b, ok := ni.(bool)
+		if !ok {
+			return ds.Property{}, fmt.Errorf("bad noindex %v", ni)
+		}
+		if b {
+			is = ds.NoIndex
+		}
+		delete(fields, "noindex")
+	}
+
+	typ := ""
+	for _, name := range typeNames {
+		if _, ok := fields[name]; ok {
+			if typ != "" {
+				return ds.Property{}, fmt.Errorf("value has both %q and %q", typ, name)
+			}
+			typ = name
+		}
+	}
+	if typ == "" {
+		return ds.Property{}, fmt.Errorf("value %v has no type", v)
+	}
+	val := fields[typ]
+	delete(fields, typ)
+
+	if typ == "key" {
+		if ns, ok := fields["namespace"]; ok {
+			if kc.Namespace, ok = ns.(string); !ok {
+				return ds.Property{}, fmt.Errorf("bad namespace %v", ns)
+			}
+			delete(fields, "namespace")
+		}
+	}
+	if len(fields) > 0 {
+		return ds.Property{}, fmt.Errorf("unexpected fields %v in %s value", fields, typ)
+	}
+
+	switch typ {
+	case "value":
+		return mkProperty(plainValue(val), is)
+
+	case "int":
+		if i, ok := toInt(val); ok {
+			return mkProperty(i, is)
+		}
+
+	case "float":
+		switch t := val.(type) {
+		case float64:
+			return mkProperty(t, is)
+		default:
+			if i, ok := toInt(val); ok {
+				return mkProperty(float64(i), is)
+			}
+		}
+
+	case "string":
+		if s, ok := val.(string); ok {
+			return mkProperty(s, is)
+		}
+
+	case "bool":
+		if b, ok := val.(bool); ok {
+			return mkProperty(b, is)
+		}
+
+	case "null":
+		return mkProperty(nil, is)
+
+	case "time":
+		if s, ok := val.(string); ok {
+			t, err := time.Parse(time.RFC3339Nano, s)
+			if err != nil {
+				return ds.Property{}, err
+			}
+			return mkProperty(t.UTC(), is)
+		}
+
+	case "key":
+		k, err := parseKey(kc, val, nil)
+		if err != nil {
+			return ds.Property{}, err
+		}
+		return mkProperty(k, is)
+
+	case "geo":
+		if m, ok := val.(map[interface{}]interface{}); ok && len(m) == 2 {
+			lat, latOK := toFloat(m["lat"])
+			lng, lngOK := toFloat(m["lng"])
+			if latOK && lngOK {
+				return mkProperty(ds.GeoPoint{Lat: lat, Lng: lng}, is)
+			}
+		}
+
+	case "bytes":
+		if s, ok := val.(string); ok {
+			b, err := base64.StdEncoding.DecodeString(s)
+			if err != nil {
+				return ds.Property{}, errors.Annotate(err, "bad base64").Err()
+			}
+			return mkProperty(b, is)
+		}
+
+	case "blobkey":
+		if s, ok := val.(string); ok {
+			return mkProperty(blobstore.Key(s), is)
+		}
+
+	case "entity":
+		props := map[string]interface{}{}
+		switch m := val.(type) {
+		case nil:
+		case map[interface{}]interface{}:
+			for k, v := range m {
+				props[fmt.Sprint(k)] = v
+			}
+		default:
+			return ds.Property{}, fmt.Errorf("bad entity value %v", val)
+		}
+		pm, err := parseProps(kc, props)
+		if err != nil {
+			return ds.Property{}, err
+		}
+		return mkProperty(pm, is)
+	}
+
+	return ds.Property{}, fmt.Errorf("bad %s value %v", typ, val)
+}
+
+// plainValue converts a YAML scalar into a property value.
+func plainValue(v interface{}) interface{} {
+	if i, ok := toInt(v); ok {
+		return i
+	}
+	return v
+}
+
+func mkProperty(v interface{}, is ds.IndexSetting) (p ds.Property, err error) {
+	err = p.SetValue(v, is)
+	return
+}
+
+func toInt(v interface{}) (int64, bool) {
+	switch t := v.(type) {
+	case int:
+		return int64(t), true
+	case int64:
+		return t, true
+	case uint64:
+		if t <= math.MaxInt64 {
+			return int64(t), true
+		}
+	}
+	return 0, false
+}
+
+func toFloat(v interface{}) (float64, bool) {
+	if f, ok := v.(float64); ok {
+		return f, true
+	}
+	if i, ok := toInt(v); ok {
+		return float64(i), true
+	}
+	return 0, false
+}
+
+// DumpFixtures writes every entity in the datastore in c, in every namespace,
+// to w in the fixture format. Entities of special kinds (like
+// __entity_group__) are skipped.
+//
+// Like any other query, this is only as consistent as the datastore's indexes;
+// with impl/memory, call Testable.CatchupIndexes first.
+func DumpFixtures(c context.Context, w io.Writer) error {
+	var namespaces meta.NamespacesCollector
+	if err := meta.Namespaces(c, namespaces.Callback); err != nil {
+		return errors.Annotate(err, "listing namespaces").Err()
+	}
+
+	var pms []ds.PropertyMap
+	for _, ns := range namespaces {
+		nc, err := info.Namespace(c, ns)
+		if err != nil {
+			return err
+		}
+		// The entities are fetched by key, since some implementations don't keep
+		// the namespace of Key property values in query results.
+		var keys []*ds.Key
+		if err := ds.GetAll(nc, ds.NewQuery("").KeysOnly(true), &keys); err != nil {
+			return errors.Annotate(err, "dumping namespace %q", ns).Err()
+		}
+		nsPMs := make([]ds.PropertyMap, 0, len(keys))
+		for _, k := range keys {
+			if !k.LastTok().Special() {
+				nsPMs = append(nsPMs, ds.PropertyMap{"$key": ds.MkPropertyNI(k)})
+			}
+		}
+		if err := ds.Get(nc, nsPMs); err != nil {
+			return errors.Annotate(err, "dumping namespace %q", ns).Err()
+		}
+		pms = append(pms, nsPMs...)
+	}
+	return WriteFixtures(w, pms)
+}
+
+// WriteFixtures writes pms to w in the fixture format. Every PropertyMap must
+// have a "$key".
+func WriteFixtures(w io.Writer, pms []ds.PropertyMap) error {
+	ents := make([]yaml.MapSlice, len(pms))
+	for i, pm := range pms {
+		key, ok := ds.GetMetaDefault(pm, "key", (*ds.Key)(nil)).(*ds.Key)
+		if !ok || key == nil {
+			return fmt.Errorf("entity %d has no $key", i)
+		}
+		ent := yaml.MapSlice{{Key: "key", Value: dumpKey(key)}}
+		if ns := key.Namespace(); ns != "" {
+			ent = append(ent, yaml.MapItem{Key: "namespace", Value: ns})
+		}
+		if props := dumpProps(pm, key.Namespace()); len(props) > 0 {
+			ent = append(ent, yaml.MapItem{Key: "props", Value: props})
+		}
+		ents[i] = ent
+	}
+
+	data, err := yaml.Marshal(ents)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	return err
+}
+
+// dumpKey renders key in path form, or, if some string ID can't be
+// represented in path form, in list form.
+func dumpKey(key *ds.Key) interface{} {
+	_, _, toks := key.Split()
+	path := make([]string, 0, 2*len(toks))
+	list := make([]interface{}, 0, 2*len(toks))
+	pathOK := true
+	for _, t := range toks {
+		path = append(path, t.Kind)
+		list = append(list, t.Kind)
+		switch {
+		case t.StringID != "":
+			if _, err := strconv.ParseInt(t.StringID, 10, 64); err == nil || strings.Contains(t.StringID, "/") {
+				pathOK = false
+			}
+			path = append(path, t.StringID)
+			list = append(list, t.StringID)
+		case t.IntID != 0:
+			path = append(path, strconv.FormatInt(t.IntID, 10))
+			list = append(list, t.IntID)
+		}
+		if strings.Contains(t.Kind, "/") {
+			pathOK = false
+		}
+	}
+	if pathOK {
+		return strings.Join(path, "/")
+	}
+	return list
+}
+
+func dumpProps(pm ds.PropertyMap, ns string) yaml.MapSlice {
+	names := make([]string, 0, len(pm))
+	for name := range pm {
+		if !strings.HasPrefix(name, "$") {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	ret := make(yaml.MapSlice, len(names))
+	for i, name := range names {
+		var v interface{}
+		switch t := pm[name].(type) {
+		case ds.Property:
+			v = dumpValue(&t, ns)
+		case ds.PropertySlice:
+			list := make([]interface{}, len(t))
+			for j := range t {
+				list[j] = dumpValue(&t[j], ns)
+			}
+			v = list
+		}
+		ret[i] = yaml.MapItem{Key: name, Value: v}
+	}
+	return ret
+}
+
+func dumpValue(p *ds.Property, ns string) interface{} {
+	typ, val := "", p.Value()
+	switch p.Type() {
+	case ds.PTFloat:
+		if f := val.(float64); f == math.Trunc(f) || math.IsInf(f, 0) || math.IsNaN(f) {
+			// Would be read back as an int (or not at all).
+			typ = "float"
+		}
+	case ds.PTTime:
+		typ, val = "time", val.(time.Time).UTC().Format(time.RFC3339Nano)
+	case ds.PTBytes:
+		typ, val = "bytes", base64.StdEncoding.EncodeToString(val.([]byte))
+	case ds.PTGeoPoint:
+		gp := val.(ds.GeoPoint)
+		typ, val = "geo", yaml.MapSlice{{Key: "lat", Value: gp.Lat}, {Key: "lng", Value: gp.Lng}}
+	case ds.PTBlobKey:
+		typ, val = "blobkey", string(val.(blobstore.Key))
+	case ds.PTPropertyMap:
+		typ, val = "entity", dumpProps(val.(ds.PropertyMap), ns)
+	case ds.PTKey:
+		k := val.(*ds.Key)
+		ret := yaml.MapSlice{{Key: "key", Value: dumpKey(k)}}
+		if k.Namespace() != ns {
+			ret = append(ret, yaml.MapItem{Key: "namespace", Value: k.Namespace()})
+		}
+		if p.IndexSetting() == ds.NoIndex {
+			ret = append(ret, yaml.MapItem{Key: "noindex", Value: true})
+		}
+		return ret
+	}
+
+	if typ == "" {
+		if p.IndexSetting() == ds.ShouldIndex {
+			return val
+		}
+		typ = "value"
+	}
+	ret := yaml.MapSlice{{Key: typ, Value: val}}
+	if p.IndexSetting() == ds.NoIndex {
+		ret = append(ret, yaml.MapItem{Key: "noindex", Value: true})
+	}
+	return ret
+}
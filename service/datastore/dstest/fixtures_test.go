@@ -0,0 +1,214 @@
+// Copyright 2018 The LUCI Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dstest
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"go.chromium.org/gae/impl/memory"
+	"go.chromium.org/gae/service/blobstore"
+	ds "go.chromium.org/gae/service/datastore"
+	"go.chromium.org/gae/service/info"
+
+	"golang.org/x/net/context"
+
+	. "github.com/smartystreets/goconvey/convey"
+	. "go.chromium.org/luci/common/testing/assertions"
+)
+
+const fixtureYAML = `
+- key: User/alice
+  props:
+    Name: Alice
+    Age: 30
+    Score: 4.5
+    Admin: true
+    Nickname: null
+    Tags: [a, b]
+    Joined: {time: "2018-01-02T03:04:05Z"}
+    Friend: {key: User/bob}
+    Elsewhere: {key: [User, "42"], namespace: other}
+    Home: {geo: {lat: 1.5, lng: -2.5}}
+    Avatar: {bytes: aGVsbG8=}
+    Blob: {blobkey: some-blob}
+    Bio: {value: long text, noindex: true}
+    Weight: {float: 70}
+    Address: {entity: {City: Paris}}
+  children:
+  - key: Setting/theme
+    props: {Value: dark}
+- key: [User, "42"]
+  namespace: other
+  props:
+    Name: Forty-two
+`
+
+func TestFixtures(t *testing.T) {
+	t.Parallel()
+
+	Convey("Fixtures", t, func() {
+		c := memory.Use(context.Background())
+		ds.GetTestable(c).Consistent(true)
+		other := info.MustNamespace(c, "other")
+
+		Convey("ParseFixtures", func() {
+			pms, err := ParseFixtures(c, []byte(fixtureYAML))
+			So(err, ShouldBeNil)
+			So(pms, ShouldHaveLength, 3)
+
+			alice := pms[0]
+			So(alice, ShouldResemble, ds.PropertyMap{
+				"$key":      ds.MkPropertyNI(ds.MakeKey(c, "User", "alice")),
+				"Name":      ds.MkProperty("Alice"),
+				"Age":       ds.MkProperty(30),
+				"Score":     ds.MkProperty(4.5),
+				"Admin":     ds.MkProperty(true),
+				"Nickname":  ds.MkProperty(nil),
+				"Tags":      ds.PropertySlice{ds.MkProperty("a"), ds.MkProperty("b")},
+				"Joined":    ds.MkProperty(time.Date(2018, 1, 2, 3, 4, 5, 0, time.UTC)),
+				"Friend":    ds.MkProperty(ds.MakeKey(c, "User", "bob")),
+				"Elsewhere": ds.MkProperty(ds.MakeKey(other, "User", "42")),
+				"Home":      ds.MkProperty(ds.GeoPoint{Lat: 1.5, Lng: -2.5}),
+				"Avatar":    ds.MkProperty([]byte("hello")),
+				"Blob":      ds.MkProperty(blobstore.Key("some-blob")),
+				"Bio":       ds.MkPropertyNI("long text"),
+				"Weight":    ds.MkProperty(70.0),
+				"Address":   ds.MkProperty(ds.PropertyMap{"City": ds.MkProperty("Paris")}),
+			})
+
+			So(pms[1], ShouldResemble, ds.PropertyMap{
+				"$key":  ds.MkPropertyNI(ds.MakeKey(c, "User", "alice", "Setting", "theme")),
+				"Value": ds.MkProperty("dark"),
+			})
+			So(pms[2], ShouldResemble, ds.PropertyMap{
+				"$key": ds.MkPropertyNI(ds.MakeKey(other, "User", "42")),
+				"Name": ds.MkProperty("Forty-two"),
+			})
+		})
+
+		Convey("ParseFixtures accepts JSON", func() {
+			pms, err := ParseFixtures(c, []byte(`[
+  {"key": "Thing/1", "props": {"Val": {"int": 5, "noindex": true}}},
+  {"key": "Thing"}
+]`))
+			So(err, ShouldBeNil)
+			So(pms, ShouldResemble, []ds.PropertyMap{
+				{
+					"$key": ds.MkPropertyNI(ds.MakeKey(c, "Thing", 1)),
+					"Val":  ds.MkPropertyNI(5),
+				},
+				{
+					"$key": ds.MkPropertyNI(ds.NewIncompleteKeys(c, 1, "Thing", nil)[0]),
+				},
+			})
+		})
+
+		Convey("ParseFixtures errors", func() {
+			bad := func(data string) error {
+				_, err := ParseFixtures(c, []byte(data))
+				return err
+			}
+			So(bad(`{not: a list}`), ShouldErrLike, "bad fixture data")
+			So(bad(`[{props: {A: 1}}]`), ShouldErrLike, "missing key")
+			So(bad(`[{key: __Special__/1}]`), ShouldErrLike, "invalid key")
+			So(bad(`[{key: [1, 2]}]`), ShouldErrLike, "bad kind")
+			So(bad(`[{key: A/1, props: {B: {}}}]`), ShouldErrLike, "has no type")
+			So(bad(`[{key: A/1, props: {B: {int: 1, string: x}}}]`), ShouldErrLike, "both")
+			So(bad(`[{key: A/1, props: {B: {int: x}}}]`), ShouldErrLike, `bad int value x`)
+			So(bad(`[{key: A/1, props: {B: {time: yesterday}}}]`), ShouldErrLike, "cannot parse")
+			So(bad(`[{key: A/1, props: {B: {int: 1, color: red}}}]`), ShouldErrLike, "unexpected fields")
+			So(bad(`[{key: A, children: [{key: B/1}]}]`), ShouldErrLike, "incomplete key can't have children")
+			So(bad(`[{key: A/1, children: [{key: B/1, namespace: x}]}]`), ShouldErrLike, "namespace of its parent")
+		})
+
+		Convey("LoadFixtures", func() {
+			dir, err := ioutil.TempDir("", "dstest")
+			So(err, ShouldBeNil)
+			defer os.RemoveAll(dir)
+
+			path := filepath.Join(dir, "fixtures.yaml")
+			So(ioutil.WriteFile(path, []byte(fixtureYAML), 0644), ShouldBeNil)
+			So(LoadFixtures(c, path), ShouldBeNil)
+
+			setting := ds.PropertyMap{"$key": ds.MkPropertyNI(ds.MakeKey(c, "User", "alice", "Setting", "theme"))}
+			So(ds.Get(c, setting), ShouldBeNil)
+			So(setting["Value"], ShouldResemble, ds.MkProperty("dark"))
+
+			fortyTwo := ds.PropertyMap{"$key": ds.MkPropertyNI(ds.MakeKey(other, "User", "42"))}
+			So(ds.Get(other, fortyTwo), ShouldBeNil)
+
+			So(LoadFixtures(c, filepath.Join(dir, "missing.yaml")), ShouldNotBeNil)
+
+			Convey("DumpFixtures round-trips", func() {
+				buf := &bytes.Buffer{}
+				So(DumpFixtures(c, buf), ShouldBeNil)
+
+				loaded, err := ParseFixtures(c, buf.Bytes())
+				So(err, ShouldBeNil)
+				So(loaded, ShouldHaveLength, 3)
+
+				want, err := ParseFixtures(c, []byte(fixtureYAML))
+				So(err, ShouldBeNil)
+				byKey := map[string]ds.PropertyMap{}
+				for _, pm := range loaded {
+					byKey[ds.GetMetaDefault(pm, "key", nil).(*ds.Key).String()] = pm
+				}
+				for _, pm := range want {
+					So(byKey[ds.GetMetaDefault(pm, "key", nil).(*ds.Key).String()], ShouldResemble, pm)
+				}
+			})
+		})
+
+		Convey("WriteFixtures", func() {
+			buf := &bytes.Buffer{}
+			So(WriteFixtures(buf, []ds.PropertyMap{
+				{
+					"$key":  ds.MkPropertyNI(ds.MakeKey(c, "A", "1", "B", 2)),
+					"Float": ds.MkProperty(2.0),
+					"Str":   ds.MkPropertyNI("hi"),
+					"Ref":   ds.MkPropertyNI(ds.MakeKey(other, "C", "x")),
+				},
+				{
+					"$key": ds.MkPropertyNI(ds.MakeKey(other, "A", "x")),
+				},
+			}), ShouldBeNil)
+			So(buf.String(), ShouldEqual, `- key:
+  - A
+  - "1"
+  - B
+  - 2
+  props:
+    Float:
+      float: 2
+    Ref:
+      key: C/x
+      namespace: other
+      noindex: true
+    Str:
+      value: hi
+      noindex: true
+- key: A/x
+  namespace: other
+`)
+
+			So(WriteFixtures(buf, []ds.PropertyMap{{"A": ds.MkProperty(1)}}), ShouldErrLike, "has no $key")
+		})
+	})
+}
@@ -76,6 +76,20 @@ func (cfg Config) Query(c context.Context, q *ds.Query) (n int, err error) {
 		q = ds.NewQuery("")
 	}
 
+	err = ds.Run(c, q, func(pm ds.PropertyMap) error {
+		key := ds.GetMetaDefault(pm, "key", nil).(*ds.Key)
+		if !cfg.WithSpecial && strings.HasPrefix(key.Kind(), "__") && strings.HasSuffix(key.Kind(), "__") {
+			return nil
+		}
+		amt, err := cfg.Entity(key, pm)
+		n += amt
+		return err
+	})
+	return
+}
+
+// Entity dumps a single entity, formatted like Query formats them.
+func (cfg Config) Entity(key *ds.Key, pm ds.PropertyMap) (n int, err error) {
 	out := cfg.OutStream
 	if out == nil {
 		out = os.Stdout
@@ -119,40 +133,33 @@ func (cfg Config) Query(c context.Context, q *ds.Query) (n int, err error) {
 		return prnt("\n  ]\n")
 	}
 
-	err = ds.Run(c, q, func(pm ds.PropertyMap) error {
-		key := ds.GetMetaDefault(pm, "key", nil).(*ds.Key)
-		if !cfg.WithSpecial && strings.HasPrefix(key.Kind(), "__") && strings.HasSuffix(key.Kind(), "__") {
-			return nil
-		}
-		if err := prnt("\n%s:\n", key); err != nil {
-			return err
-		}
-		pm, _ = pm.Save(false)
-
-		// See if we have a KindFilter for this
-		if flt, ok := cfg.KindFilters[key.Kind()]; ok {
-			if kindOut := flt(key, pm); kindOut != "" {
-				for _, l := range strings.Split(kindOut, "\n") {
-					if err := prnt("  %s\n", l); err != nil {
-						return err
-					}
+	if err = prnt("\n%s:\n", key); err != nil {
+		return
+	}
+	pm, _ = pm.Save(false)
+
+	// See if we have a KindFilter for this
+	if flt, ok := cfg.KindFilters[key.Kind()]; ok {
+		if kindOut := flt(key, pm); kindOut != "" {
+			for _, l := range strings.Split(kindOut, "\n") {
+				if err = prnt("  %s\n", l); err != nil {
+					return
 				}
-				return nil
 			}
+			return
 		}
+	}
 
-		keys := make([]string, 0, len(pm))
-		for k := range pm {
-			keys = append(keys, k)
-		}
-		sort.Strings(keys)
-		for _, k := range keys {
-			if err := prop(key.Kind(), k, pm[k]); err != nil {
-				return err
-			}
+	keys := make([]string, 0, len(pm))
+	for k := range pm {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		if err = prop(key.Kind(), k, pm[k]); err != nil {
+			return
 		}
-		return nil
-	})
+	}
 	return
 }
 
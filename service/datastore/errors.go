@@ -27,6 +27,10 @@ type stopErr struct{}
 
 func (stopErr) Error() string { return "stop iteration" }
 
+type badRequestErr struct{}
+
+func (badRequestErr) Error() string { return "datastore: bad request" }
+
 // These errors are returned by various datastore.Interface methods.
 var (
 	ErrNoSuchEntity          = datastore.ErrNoSuchEntity
@@ -35,6 +39,11 @@ var (
 	// Stop is understood by various services to stop iterative processes. Examples
 	// include datastore.Interface.Run's callback.
 	Stop = stopErr{}
+
+	// ErrBadRequest is wrapped by the errors returned for requests which the
+	// datastore refuses to execute, e.g. puts of entities over the production
+	// size limits. Use IsErrBadRequest to test for it.
+	ErrBadRequest error = badRequestErr{}
 )
 
 // MakeErrInvalidKey returns an errors.Annotator instance that wraps an invalid
@@ -48,6 +57,16 @@ func MakeErrInvalidKey(reason string, args ...interface{}) *errors.Annotator {
 // error.
 func IsErrInvalidKey(err error) bool { return errors.Unwrap(err) == datastore.ErrInvalidKey }
 
+// MakeErrBadRequest returns an errors.Annotator instance that wraps
+// ErrBadRequest. Calling IsErrBadRequest on this Annotator or its derivatives
+// will return true.
+func MakeErrBadRequest(reason string, args ...interface{}) *errors.Annotator {
+	return errors.Annotate(ErrBadRequest, reason, args...)
+}
+
+// IsErrBadRequest tests if a given error is a wrapped ErrBadRequest error.
+func IsErrBadRequest(err error) bool { return errors.Unwrap(err) == ErrBadRequest }
+
 // IsErrNoSuchEntity tests if an error is ErrNoSuchEntity,
 // or is a MultiError that contains ErrNoSuchEntity and no other errors.
 func IsErrNoSuchEntity(err error) (found bool) {
@@ -0,0 +1,582 @@
+// Copyright 2018 The LUCI Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package datastore
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.chromium.org/gae/service/blobstore"
+)
+
+// ParseGQL parses a Cloud Datastore GQL query into a Query.
+//
+// It supports the subset of GQL which Query can represent, and so which
+// FinalizedQuery.GQL emits: projections (with DISTINCT), keys-only queries,
+// a kind, conjunctions of =, <, <=, >, >=, IS NULL and HAS ANCESTOR filters,
+// orders, LIMIT and OFFSET. Literals may be numbers, strings, TRUE, FALSE,
+// NULL, KEY, DATETIME, BLOB, BLOBKEY and GEOPOINT values. Bindings (like @1)
+// and cursors are not supported.
+//
+// KEY literals without DATASET or NAMESPACE arguments use the ones of kc.
+func ParseGQL(kc KeyContext, gql string) (*Query, error) {
+	p := &gqlParser{kc: kc, s: gql}
+	p.next()
+	q, err := p.parseQuery()
+	if err != nil {
+		return nil, fmt.Errorf("bad GQL at offset %d: %s", p.tok.pos, err)
+	}
+	return q, nil
+}
+
+type gqlTokenKind int
+
+const (
+	gqlEOF gqlTokenKind = iota
+	gqlName
+	gqlQuotedName
+	gqlString
+	gqlNumber
+	gqlPunct
+	gqlError
+)
+
+type gqlToken struct {
+	kind gqlTokenKind
+	text string
+	pos  int
+}
+
+// gqlParser is a recursive descent parser with one token of lookahead, tok.
+// pos is the offset in s right after tok.
+type gqlParser struct {
+	kc  KeyContext
+	s   string
+	pos int
+	tok gqlToken
+}
+
+func isGQLNameStart(c byte) bool {
+	return c == '_' || c == '$' || ('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z')
+}
+
+func isGQLNameChar(c byte) bool {
+	return isGQLNameStart(c) || c == '.' || ('0' <= c && c <= '9')
+}
+
+func isGQLDigit(c byte) bool {
+	return '0' <= c && c <= '9'
+}
+
+// next lexes the next token into p.tok.
+func (p *gqlParser) next() {
+	for p.pos < len(p.s) && strings.IndexByte(" \t\r\n", p.s[p.pos]) >= 0 {
+		p.pos++
+	}
+	start := p.pos
+	tok := func(kind gqlTokenKind, text string) {
+		p.tok = gqlToken{kind, text, start}
+	}
+	if p.pos == len(p.s) {
+		tok(gqlEOF, "")
+		return
+	}
+
+	switch c := p.s[p.pos]; {
+	case isGQLNameStart(c):
+		for p.pos < len(p.s) && isGQLNameChar(p.s[p.pos]) {
+			p.pos++
+		}
+		tok(gqlName, p.s[start:p.pos])
+
+	case c == '`':
+		s, err := p.lexQuoted(c)
+		if err != nil {
+			tok(gqlError, err.Error())
+			return
+		}
+		tok(gqlQuotedName, s)
+
+	case c == '\'' || c == '"':
+		s, err := p.lexQuoted(c)
+		if err != nil {
+			tok(gqlError, err.Error())
+			return
+		}
+		tok(gqlString, s)
+
+	case isGQLDigit(c) || c == '-' || c == '+':
+		p.pos++
+		for p.pos < len(p.s) {
+			c := p.s[p.pos]
+			if !isGQLDigit(c) && c != '.' && c != 'e' && c != 'E' &&
+				!((c == '-' || c == '+') && (p.s[p.pos-1] == 'e' || p.s[p.pos-1] == 'E')) {
+				break
+			}
+			p.pos++
+		}
+		tok(gqlNumber, p.s[start:p.pos])
+
+	case strings.HasPrefix(p.s[p.pos:], "<=") || strings.HasPrefix(p.s[p.pos:], ">=") ||
+		strings.HasPrefix(p.s[p.pos:], "!="):
+		p.pos += 2
+		tok(gqlPunct, p.s[start:p.pos])
+
+	case strings.IndexByte(",()*=<>", c) >= 0:
+		p.pos++
+		tok(gqlPunct, p.s[start:p.pos])
+
+	default:
+		tok(gqlError, fmt.Sprintf("unexpected character %q", c))
+	}
+}
+
+// lexQuoted lexes a string or name quoted with q. The quote may be escaped
+// with a backslash or by doubling it.
+func (p *gqlParser) lexQuoted(q byte) (string, error) {
+	buf := []byte(nil)
+	for p.pos++; p.pos < len(p.s); p.pos++ {
+		c := p.s[p.pos]
+		switch {
+		case c == q && p.pos+1 < len(p.s) && p.s[p.pos+1] == q:
+			buf = append(buf, q)
+			p.pos++
+
+		case c == q:
+			p.pos++
+			return string(buf), nil
+
+		case c == '\\' && p.pos+1 < len(p.s):
+			p.pos++
+			switch e := p.s[p.pos]; e {
+			case '0':
+				buf = append(buf, 0)
+			case 'b':
+				buf = append(buf, '\b')
+			case 'n':
+				buf = append(buf, '\n')
+			case 'r':
+				buf = append(buf, '\r')
+			case 't':
+				buf = append(buf, '\t')
+			case 'Z':
+				buf = append(buf, '\x1A')
+			default:
+				buf = append(buf, e)
+			}
+
+		default:
+			buf = append(buf, c)
+		}
+	}
+	return "", fmt.Errorf("unterminated %c", q)
+}
+
+// isKeyword returns true iff the current token is the given keyword. Keywords
+// are case insensitive, and quoted names are never keywords.
+func (p *gqlParser) isKeyword(kw string) bool {
+	return p.tok.kind == gqlName && strings.EqualFold(p.tok.text, kw)
+}
+
+func (p *gqlParser) isPunct(s string) bool {
+	return p.tok.kind == gqlPunct && p.tok.text == s
+}
+
+func (p *gqlParser) unexpected() error {
+	switch p.tok.kind {
+	case gqlEOF:
+		return fmt.Errorf("unexpected end of query")
+	case gqlError:
+		return fmt.Errorf("%s", p.tok.text)
+	}
+	return fmt.Errorf("unexpected %q", p.tok.text)
+}
+
+func (p *gqlParser) expectKeyword(kw string) error {
+	if !p.isKeyword(kw) {
+		return p.unexpected()
+	}
+	p.next()
+	return nil
+}
+
+func (p *gqlParser) expectPunct(s string) error {
+	if !p.isPunct(s) {
+		return p.unexpected()
+	}
+	p.next()
+	return nil
+}
+
+func (p *gqlParser) parseName() (string, error) {
+	if p.tok.kind != gqlName && p.tok.kind != gqlQuotedName {
+		return "", p.unexpected()
+	}
+	name := p.tok.text
+	p.next()
+	return name, nil
+}
+
+func (p *gqlParser) parseInt32() (int32, error) {
+	if p.tok.kind != gqlNumber {
+		return 0, p.unexpected()
+	}
+	v, err := strconv.ParseInt(p.tok.text, 10, 32)
+	if err != nil {
+		return 0, err
+	}
+	p.next()
+	return int32(v), nil
+}
+
+func (p *gqlParser) parseQuery() (*Query, error) {
+	q := NewQuery("")
+	if err := p.expectKeyword("SELECT"); err != nil {
+		return nil, err
+	}
+
+	if p.isPunct("*") {
+		p.next()
+	} else {
+		distinct := false
+		if p.isKeyword("DISTINCT") {
+			distinct = true
+			p.next()
+		}
+		var proj []string
+		for {
+			name, err := p.parseName()
+			if err != nil {
+				return nil, err
+			}
+			proj = append(proj, name)
+			if !p.isPunct(",") {
+				break
+			}
+			p.next()
+		}
+		if len(proj) == 1 && proj[0] == "__key__" && !distinct {
+			q = q.KeysOnly(true)
+		} else {
+			q = q.Project(proj...).Distinct(distinct)
+		}
+	}
+
+	if p.isKeyword("FROM") {
+		p.next()
+		kind, err := p.parseName()
+		if err != nil {
+			return nil, err
+		}
+		q = q.Kind(kind)
+	}
+
+	if p.isKeyword("WHERE") {
+		p.next()
+		for {
+			var err error
+			if q, err = p.parseCondition(q); err != nil {
+				return nil, err
+			}
+			if !p.isKeyword("AND") {
+				break
+			}
+			p.next()
+		}
+	}
+
+	if p.isKeyword("ORDER") {
+		p.next()
+		if err := p.expectKeyword("BY"); err != nil {
+			return nil, err
+		}
+		for {
+			name, err := p.parseName()
+			if err != nil {
+				return nil, err
+			}
+			switch {
+			case p.isKeyword("DESC"):
+				name = "-" + name
+				p.next()
+			case p.isKeyword("ASC"):
+				p.next()
+			}
+			q = q.Order(name)
+			if !p.isPunct(",") {
+				break
+			}
+			p.next()
+		}
+	}
+
+	if p.isKeyword("LIMIT") {
+		p.next()
+		limit, err := p.parseInt32()
+		if err != nil {
+			return nil, err
+		}
+		q = q.Limit(limit)
+	}
+	if p.isKeyword("OFFSET") {
+		p.next()
+		offset, err := p.parseInt32()
+		if err != nil {
+			return nil, err
+		}
+		q = q.Offset(offset)
+	}
+
+	if p.tok.kind != gqlEOF {
+		return nil, p.unexpected()
+	}
+	return q, nil
+}
+
+func (p *gqlParser) parseCondition(q *Query) (*Query, error) {
+	name, err := p.parseName()
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case p.isKeyword("IS"):
+		p.next()
+		if err := p.expectKeyword("NULL"); err != nil {
+			return nil, err
+		}
+		return q.Eq(name, nil), nil
+
+	case p.isKeyword("HAS"):
+		p.next()
+		if err := p.expectKeyword("ANCESTOR"); err != nil {
+			return nil, err
+		}
+		v, err := p.parseValue()
+		if err != nil {
+			return nil, err
+		}
+		anc, ok := v.(*Key)
+		if name != "__key__" || !ok {
+			return nil, fmt.Errorf("HAS ANCESTOR needs __key__ and a KEY")
+		}
+		return q.Ancestor(anc), nil
+	}
+
+	if p.tok.kind != gqlPunct {
+		return nil, p.unexpected()
+	}
+	op := p.tok.text
+	p.next()
+	v, err := p.parseValue()
+	if err != nil {
+		return nil, err
+	}
+	switch op {
+	case "=":
+		return q.Eq(name, v), nil
+	case "<":
+		return q.Lt(name, v), nil
+	case "<=":
+		return q.Lte(name, v), nil
+	case ">":
+		return q.Gt(name, v), nil
+	case ">=":
+		return q.Gte(name, v), nil
+	}
+	return nil, fmt.Errorf("unsupported operator %q", op)
+}
+
+func (p *gqlParser) parseValue() (interface{}, error) {
+	tok := p.tok
+	switch tok.kind {
+	case gqlString:
+		p.next()
+		return tok.text, nil
+
+	case gqlNumber:
+		p.next()
+		if strings.ContainsAny(tok.text, ".eE") {
+			return strconv.ParseFloat(tok.text, 64)
+		}
+		return strconv.ParseInt(tok.text, 10, 64)
+
+	case gqlName:
+		switch fn := strings.ToUpper(tok.text); fn {
+		case "TRUE", "FALSE":
+			p.next()
+			return fn == "TRUE", nil
+		case "NULL":
+			p.next()
+			return nil, nil
+		case "KEY":
+			p.next()
+			return p.parseKey()
+		case "DATETIME":
+			p.next()
+			return p.parseDatetime()
+		case "BLOB", "BLOBKEY":
+			p.next()
+			s, err := p.parseStringArg()
+			if err != nil {
+				return nil, err
+			}
+			if fn == "BLOBKEY" {
+				return blobstore.Key(s), nil
+			}
+			if b, err := base64.URLEncoding.DecodeString(s); err == nil {
+				return b, nil
+			}
+			return base64.StdEncoding.DecodeString(s)
+		case "GEOPOINT":
+			p.next()
+			return p.parseGeoPoint()
+		}
+	}
+	return nil, p.unexpected()
+}
+
+// parseStringArg parses a parenthesized string, like ("foo").
+func (p *gqlParser) parseStringArg() (string, error) {
+	if err := p.expectPunct("("); err != nil {
+		return "", err
+	}
+	if p.tok.kind != gqlString {
+		return "", p.unexpected()
+	}
+	s := p.tok.text
+	p.next()
+	return s, p.expectPunct(")")
+}
+
+func (p *gqlParser) parseKey() (*Key, error) {
+	if err := p.expectPunct("("); err != nil {
+		return nil, err
+	}
+	kc := p.kc
+	if p.isKeyword("DATASET") {
+		p.next()
+		var err error
+		if kc.AppID, err = p.parseStringArg(); err != nil {
+			return nil, err
+		}
+		kc.Namespace = ""
+		if err := p.expectPunct(","); err != nil {
+			return nil, err
+		}
+	}
+	if p.isKeyword("NAMESPACE") {
+		p.next()
+		var err error
+		if kc.Namespace, err = p.parseStringArg(); err != nil {
+			return nil, err
+		}
+		if err := p.expectPunct(","); err != nil {
+			return nil, err
+		}
+	}
+
+	var elems []interface{}
+	for {
+		// Kinds may be names or strings.
+		var kind string
+		if p.tok.kind == gqlString {
+			kind = p.tok.text
+			p.next()
+		} else {
+			var err error
+			if kind, err = p.parseName(); err != nil {
+				return nil, err
+			}
+		}
+		if err := p.expectPunct(","); err != nil {
+			return nil, err
+		}
+		switch p.tok.kind {
+		case gqlString:
+			elems = append(elems, kind, p.tok.text)
+		case gqlNumber:
+			id, err := strconv.ParseInt(p.tok.text, 10, 64)
+			if err != nil {
+				return nil, err
+			}
+			elems = append(elems, kind, id)
+		default:
+			return nil, p.unexpected()
+		}
+		p.next()
+
+		if !p.isPunct(",") {
+			break
+		}
+		p.next()
+	}
+	if err := p.expectPunct(")"); err != nil {
+		return nil, err
+	}
+	return kc.MakeKey(elems...), nil
+}
+
+// parseDatetime parses the argument of DATETIME, which may be quoted or not
+// (like FinalizedQuery.GQL emits it).
+func (p *gqlParser) parseDatetime() (time.Time, error) {
+	if !p.isPunct("(") {
+		return time.Time{}, p.unexpected()
+	}
+	end := strings.IndexByte(p.s[p.pos:], ')')
+	if end < 0 {
+		return time.Time{}, fmt.Errorf("unterminated DATETIME")
+	}
+	arg := strings.TrimSpace(p.s[p.pos : p.pos+end])
+	if len(arg) >= 2 && (arg[0] == '\'' || arg[0] == '"') && arg[len(arg)-1] == arg[0] {
+		arg = arg[1 : len(arg)-1]
+	}
+	p.pos += end
+	p.next()
+	if err := p.expectPunct(")"); err != nil {
+		return time.Time{}, err
+	}
+	t, err := time.Parse(time.RFC3339Nano, arg)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return t.UTC(), nil
+}
+
+func (p *gqlParser) parseGeoPoint() (GeoPoint, error) {
+	var coords [2]float64
+	for i := range coords {
+		sep := "("
+		if i > 0 {
+			sep = ","
+		}
+		if err := p.expectPunct(sep); err != nil {
+			return GeoPoint{}, err
+		}
+		if p.tok.kind != gqlNumber {
+			return GeoPoint{}, p.unexpected()
+		}
+		v, err := strconv.ParseFloat(p.tok.text, 64)
+		if err != nil {
+			return GeoPoint{}, err
+		}
+		coords[i] = v
+		p.next()
+	}
+	return GeoPoint{Lat: coords[0], Lng: coords[1]}, p.expectPunct(")")
+}
@@ -0,0 +1,75 @@
+// Copyright 2018 The LUCI Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package datastore
+
+import (
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+	. "go.chromium.org/luci/common/testing/assertions"
+)
+
+func TestParseGQL(t *testing.T) {
+	t.Parallel()
+
+	kc := MkKeyContext("s~aid", "ns")
+
+	Convey("ParseGQL", t, func() {
+		Convey("parses the GQL which queries emit", func() {
+			for _, tc := range queryTests {
+				if tc.gql == "" || tc.assertion != nil {
+					continue
+				}
+				q, err := ParseGQL(kc, tc.gql)
+				So(err, ShouldBeNil)
+				fq, err := q.Finalize()
+				So(err, ShouldBeNil)
+				So(fq.GQL(), ShouldEqual, tc.gql)
+			}
+		})
+
+		Convey("parses queries", func() {
+			q, err := ParseGQL(kc, "select distinct A, `b c` from Foo where A > 1.5 and `b c` = 'it''s' "+
+				"and __key__ has ancestor KEY(Parent, 'x') and D = DATETIME('2018-01-02T03:04:05Z') "+
+				"and E is null order by A desc, `b c` LIMIT 10 OFFSET 5")
+			So(err, ShouldBeNil)
+			So(q, ShouldResemble, NewQuery("Foo").Project("A", "b c").Distinct(true).
+				Gt("A", 1.5).Eq("b c", "it's").Ancestor(kc.MakeKey("Parent", "x")).
+				Eq("D", time.Date(2018, 1, 2, 3, 4, 5, 0, time.UTC)).Eq("E", nil).
+				Order("-A", "b c").Limit(10).Offset(5))
+
+			q, err = ParseGQL(kc, `SELECT __key__ WHERE K = KEY(DATASET("app"), "Kind", -1) AND B = BLOB("aGk=")`)
+			So(err, ShouldBeNil)
+			So(q, ShouldResemble, NewQuery("").KeysOnly(true).
+				Eq("K", MkKeyContext("app", "").MakeKey("Kind", -1)).Eq("B", []byte("hi")))
+		})
+
+		Convey("rejects bad queries", func() {
+			for gql, msg := range map[string]string{
+				"":                                "unexpected end of query",
+				"SELECT * FROM Foo WHERE":         "unexpected end of query",
+				"SELECT * FROM Foo LIMIT x":       `unexpected "x"`,
+				"SELECT * WHERE A != 1":           "unsupported operator",
+				"SELECT * WHERE A = 'x":           "unterminated '",
+				"SELECT * WHERE A HAS ANCESTOR 1": "HAS ANCESTOR needs __key__",
+				"SELECT * FROM Foo extra":         `unexpected "extra"`,
+			} {
+				_, err := ParseGQL(kc, gql)
+				So(err, ShouldErrLike, msg)
+			}
+		})
+	})
+}
@@ -0,0 +1,53 @@
+// Copyright 2018 The LUCI Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package mapper implements a resumable datastore mapper on top of the
+// taskqueue service.
+//
+// A mapper applies a function to every entity matched by a query. This is
+// useful for migrations, backfills, re-indexing and the like, where the
+// amount of data is too large to be processed in a single request.
+//
+// A job is split into shards with datastore.SplitQuery. Each shard is
+// processed by a chain of taskqueue tasks: every task processes one batch of
+// keys, saves a cursor checkpoint in the shard's state entity and enqueues the
+// next task (transactionally, together with the checkpoint). This makes the
+// processing resumable at any point: if a task fails, the taskqueue retries it
+// from the last checkpoint.
+//
+// Launching a job is atomic too: the job, its shards and a kickoff task, which
+// starts the shards' task chains, are created in a single transaction.
+//
+// Usage:
+//
+//   var ctl = &mapper.Controller{Path: "/internal/tasks/mapper"}
+//
+//   func init() {
+//     ctl.Register(&mapper.Mapper{
+//       Name:  "add-owner",
+//       Query: ds.NewQuery("Thing"),
+//       Map: func(c context.Context, keys []*ds.Key) error {
+//         ...
+//       },
+//     })
+//   }
+//
+//   // Install a handler for ctl.Path which calls ctl.HandleTask with the
+//   // request body.
+//
+//   jobID, err := ctl.Launch(c, "add-owner")
+//
+// Jobs may be paused, resumed and aborted via the Controller, and their
+// progress may be observed with Controller.Status.
+package mapper
@@ -0,0 +1,375 @@
+// Copyright 2018 The LUCI Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mapper
+
+import (
+	"fmt"
+	"sync"
+
+	ds "go.chromium.org/gae/service/datastore"
+	"go.chromium.org/gae/service/info"
+	tq "go.chromium.org/gae/service/taskqueue"
+
+	"go.chromium.org/luci/common/clock"
+	"go.chromium.org/luci/common/errors"
+
+	"golang.org/x/net/context"
+)
+
+const (
+	// DefaultShards is the number of shards used if Mapper.Shards is 0.
+	DefaultShards = 8
+
+	// MaxShards is the maximum Mapper.Shards. A job is launched in a single
+	// transaction, which may touch at most 25 entity groups: the job's, and one
+	// per shard.
+	MaxShards = 24
+
+	// DefaultBatchSize is the number of keys processed per task if
+	// Mapper.BatchSize is 0.
+	DefaultBatchSize = 100
+
+	// MaxTransactionalBatchSize is the maximum BatchSize of a Transactional
+	// mapper. A transaction may touch at most 25 entity groups, one of which
+	// is the shard's state entity.
+	MaxTransactionalBatchSize = 24
+)
+
+// MapFunc is applied to every batch of keys matched by a Mapper's query.
+//
+// If the Mapper is Transactional, c is a transactional context, and the
+// mapping is committed atomically together with the shard's checkpoint.
+//
+// If MapFunc returns an error, the batch is retried by the taskqueue. Since a
+// non-transactional batch may be retried after partially succeeding, MapFunc
+// should be idempotent.
+type MapFunc func(c context.Context, keys []*ds.Key) error
+
+// Mapper describes a mapping operation. Mappers are registered with a
+// Controller, and then launched by name.
+type Mapper struct {
+	// Name is the unique name of this mapper.
+	Name string
+
+	// Query selects the entities to map over. It is run keys-only, in the
+	// namespace of the context passed to Controller.Launch. It must be a query
+	// accepted by datastore.SplitQuery.
+	Query *ds.Query
+
+	// Map is applied to every batch of keys.
+	Map MapFunc
+
+	// Shards is the maximum number of shards to split Query into. Fewer shards
+	// may be used if there are few entities. If 0, DefaultShards is used. It
+	// must be <= MaxShards.
+	Shards int
+
+	// BatchSize is the maximum number of keys passed to Map in a single call.
+	// If 0, DefaultBatchSize (or MaxTransactionalBatchSize, if Transactional)
+	// is used.
+	BatchSize int
+
+	// Transactional, if true, runs every Map call in a transaction together
+	// with the shard checkpoint.
+	Transactional bool
+}
+
+func (m *Mapper) batchSize() int {
+	switch {
+	case m.BatchSize > 0:
+		return m.BatchSize
+	case m.Transactional:
+		return MaxTransactionalBatchSize
+	default:
+		return DefaultBatchSize
+	}
+}
+
+// Controller manages mapper jobs. It holds the registry of Mappers, and
+// knows how to route their tasks.
+//
+// The zero value is usable, but a Path should be set.
+type Controller struct {
+	// Queue is the taskqueue to use. If empty, the "default" queue is used.
+	Queue string
+
+	// Path is the URL path that the tasks are POSTed to. The handler at this path
+	// must call HandleTask with the request body.
+	Path string
+
+	lock    sync.RWMutex
+	mappers map[string]*Mapper
+}
+
+// Register adds a Mapper to the Controller.
+//
+// It panics if the Mapper is invalid or if a Mapper with the same name is
+// already registered.
+func (ctl *Controller) Register(m *Mapper) {
+	switch {
+	case m.Name == "":
+		panic("mapper: Mapper.Name is required")
+	case m.Query == nil:
+		panic(fmt.Errorf("mapper: %q: Mapper.Query is required", m.Name))
+	case m.Map == nil:
+		panic(fmt.Errorf("mapper: %q: Mapper.Map is required", m.Name))
+	case m.Shards > MaxShards:
+		panic(fmt.Errorf("mapper: %q: Shards must be <= %d", m.Name, MaxShards))
+	case m.Transactional && m.BatchSize > MaxTransactionalBatchSize:
+		panic(fmt.Errorf("mapper: %q: transactional BatchSize must be <= %d",
+			m.Name, MaxTransactionalBatchSize))
+	}
+
+	ctl.lock.Lock()
+	defer ctl.lock.Unlock()
+	if _, ok := ctl.mappers[m.Name]; ok {
+		panic(fmt.Errorf("mapper: %q is already registered", m.Name))
+	}
+	if ctl.mappers == nil {
+		ctl.mappers = map[string]*Mapper{}
+	}
+	ctl.mappers[m.Name] = m
+}
+
+func (ctl *Controller) getMapper(name string) (*Mapper, error) {
+	ctl.lock.RLock()
+	defer ctl.lock.RUnlock()
+	if m, ok := ctl.mappers[name]; ok {
+		return m, nil
+	}
+	return nil, fmt.Errorf("mapper: no mapper named %q", name)
+}
+
+// Launch starts a new job for the Mapper with the given name, and returns its
+// ID.
+//
+// The job, its shards and the task which starts the shards' task chains are
+// created in a single transaction, so if Launch fails, there's no job.
+//
+// The job's query runs in the current namespace of c.
+func (ctl *Controller) Launch(c context.Context, name string) (JobID, error) {
+	m, err := ctl.getMapper(name)
+	if err != nil {
+		return 0, err
+	}
+
+	shards := m.Shards
+	if shards <= 0 {
+		shards = DefaultShards
+	}
+	queries, err := ds.SplitQuery(c, m.Query, shards)
+	if err != nil {
+		return 0, errors.Annotate(err, "splitting query for mapper %q", name).Err()
+	}
+
+	orig, err := m.Query.Finalize()
+	if err != nil {
+		return 0, err
+	}
+	now := clock.Now(c).UTC()
+	states := make([]*Shard, len(queries))
+	for i, q := range queries {
+		fq, err := q.Finalize()
+		if err != nil {
+			return 0, err
+		}
+		states[i] = &Shard{
+			Index:   i,
+			Low:     extraBound(orig, fq, true),
+			High:    extraBound(orig, fq, false),
+			State:   StateRunning,
+			Updated: now,
+		}
+	}
+
+	var job *Job
+	err = ds.RunInTransaction(c, func(c context.Context) error {
+		job = &Job{
+			Mapper:    name,
+			Namespace: info.GetNamespace(c),
+			State:     StateRunning,
+			Shards:    len(states),
+			Created:   now,
+			Updated:   now,
+		}
+		if err := ds.Put(c, job); err != nil {
+			return errors.Annotate(err, "creating job").Err()
+		}
+		for i, s := range states {
+			s.ID, s.Job = shardID(job.ID, i), job.ID
+		}
+		if err := ds.Put(c, states); err != nil {
+			return errors.Annotate(err, "creating shards").Err()
+		}
+		if err := tq.Add(c, ctl.Queue, ctl.makeKickoffTask(job)); err != nil {
+			return errors.Annotate(err, "enqueuing kickoff task").Err()
+		}
+		return nil
+	}, nil)
+	if err != nil {
+		return 0, err
+	}
+	return job.ID, nil
+}
+
+// extraBound returns the lower (or upper) __key__ bound which SplitQuery added
+// to sub, or nil if sub's bound is the same as orig's.
+func extraBound(orig, sub *ds.FinalizedQuery, low bool) *ds.Key {
+	get := (*ds.FinalizedQuery).IneqFilterHigh
+	if low {
+		get = (*ds.FinalizedQuery).IneqFilterLow
+	}
+	_, subOp, subVal := get(sub)
+	if subOp == "" {
+		return nil
+	}
+	_, origOp, origVal := get(orig)
+	if origOp == subOp && origVal.Equal(&subVal) {
+		return nil
+	}
+	return subVal.Value().(*ds.Key)
+}
+
+// Status returns the current progress of the job.
+func (ctl *Controller) Status(c context.Context, id JobID) (*Status, error) {
+	job := &Job{ID: id}
+	if err := ds.Get(c, job); err != nil {
+		return nil, errors.Annotate(err, "loading job %d", id).Err()
+	}
+	shards, err := getShards(c, job)
+	if err != nil {
+		return nil, errors.Annotate(err, "loading shards of job %d", id).Err()
+	}
+
+	ret := &Status{Job: job, Shards: shards}
+	for _, s := range shards {
+		ret.Processed += s.Processed
+		if s.State.Finished() {
+			ret.ShardsFinished++
+		}
+	}
+	return ret, nil
+}
+
+// Pause pauses a running job. Tasks which are already enqueued will stop the
+// task chains of their shards without processing anything.
+func (ctl *Controller) Pause(c context.Context, id JobID) error {
+	return ctl.updateJob(c, id, func(job *Job) error {
+		if job.State != StateRunning {
+			return fmt.Errorf("mapper: cannot pause job %d in state %s", id, job.State)
+		}
+		job.State = StatePaused
+		return nil
+	})
+}
+
+// Resume restarts the task chains of a paused job from their last
+// checkpoints.
+func (ctl *Controller) Resume(c context.Context, id JobID) error {
+	var job *Job
+	err := ctl.updateJob(c, id, func(j *Job) error {
+		if j.State != StatePaused {
+			return fmt.Errorf("mapper: cannot resume job %d in state %s", id, j.State)
+		}
+		j.State = StateRunning
+		job = j
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// Restart every unfinished shard with a new generation, so that any task
+	// left over from before the pause is ignored.
+	for i := 0; i < job.Shards; i++ {
+		err := ctl.updateShard(c, job, i, func(s *Shard) (bool, error) {
+			if s.State.Finished() {
+				return false, nil
+			}
+			s.Generation++
+			return true, tq.Add(c, ctl.Queue, ctl.makeTask(job, s))
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Abort stops a job. Its shards are marked as aborted, and their pending tasks
+// are ignored.
+func (ctl *Controller) Abort(c context.Context, id JobID) error {
+	var job *Job
+	err := ctl.updateJob(c, id, func(j *Job) error {
+		if j.State.Finished() {
+			return fmt.Errorf("mapper: cannot abort job %d in state %s", id, j.State)
+		}
+		j.State = StateAborted
+		job = j
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for i := 0; i < job.Shards; i++ {
+		err := ctl.updateShard(c, job, i, func(s *Shard) (bool, error) {
+			if s.State.Finished() {
+				return false, nil
+			}
+			s.State = StateAborted
+			s.Generation++
+			return true, nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// updateJob transactionally applies cb to the job entity.
+func (ctl *Controller) updateJob(c context.Context, id JobID, cb func(*Job) error) error {
+	return ds.RunInTransaction(c, func(c context.Context) error {
+		job := &Job{ID: id}
+		if err := ds.Get(c, job); err != nil {
+			return errors.Annotate(err, "loading job %d", id).Err()
+		}
+		if err := cb(job); err != nil {
+			return err
+		}
+		job.Updated = clock.Now(c).UTC()
+		return ds.Put(c, job)
+	}, nil)
+}
+
+// updateShard transactionally applies cb to a shard entity. If cb returns
+// false, the shard isn't saved.
+func (ctl *Controller) updateShard(c context.Context, job *Job, index int, cb func(*Shard) (bool, error)) error {
+	return ds.RunInTransaction(c, func(c context.Context) error {
+		s := &Shard{ID: shardID(job.ID, index)}
+		if err := ds.Get(c, s); err != nil {
+			return errors.Annotate(err, "loading shard %s", s.ID).Err()
+		}
+		switch save, err := cb(s); {
+		case err != nil:
+			return err
+		case !save:
+			return nil
+		}
+		s.Updated = clock.Now(c).UTC()
+		return ds.Put(c, s)
+	}, nil)
+}
@@ -0,0 +1,376 @@
+// Copyright 2018 The LUCI Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mapper
+
+import (
+	"errors"
+	"testing"
+
+	"go.chromium.org/gae/filter/featureBreaker"
+	"go.chromium.org/gae/impl/memory"
+	ds "go.chromium.org/gae/service/datastore"
+	"go.chromium.org/gae/service/info"
+	tq "go.chromium.org/gae/service/taskqueue"
+
+	"golang.org/x/net/context"
+
+	. "github.com/smartystreets/goconvey/convey"
+	. "go.chromium.org/luci/common/testing/assertions"
+)
+
+type Thing struct {
+	ID  int64 `gae:"$id"`
+	Val int
+}
+
+func TestMapper(t *testing.T) {
+	t.Parallel()
+
+	Convey("Mapper", t, func() {
+		c := memory.Use(context.Background())
+		ds.GetTestable(c).Consistent(true)
+
+		putThings := func(c context.Context, n int) {
+			things := make([]*Thing, n)
+			for i := range things {
+				things[i] = &Thing{ID: int64(i + 1)}
+			}
+			So(ds.Put(c, things), ShouldBeNil)
+		}
+		getVals := func(c context.Context, n int) []int {
+			things := make([]*Thing, n)
+			for i := range things {
+				things[i] = &Thing{ID: int64(i + 1)}
+			}
+			So(ds.Get(c, things), ShouldBeNil)
+			vals := make([]int, n)
+			for i, t := range things {
+				vals[i] = t.Val
+			}
+			return vals
+		}
+		allEqual := func(n, v int) []int {
+			ret := make([]int, n)
+			for i := range ret {
+				ret[i] = v
+			}
+			return ret
+		}
+
+		ctl := &Controller{Path: "/internal/mapper"}
+
+		// runTasks executes the currently scheduled tasks (but not the ones they
+		// enqueue), and returns how many ran.
+		runTasks := func(c context.Context) (ran int, errs []error) {
+			for _, t := range tq.GetTestable(c).GetScheduledTasks()["default"] {
+				So(tq.Delete(c, "default", t), ShouldBeNil)
+				if err := ctl.HandleTask(c, t.Payload); err != nil {
+					errs = append(errs, err)
+				}
+				ran++
+			}
+			return
+		}
+		// runAll executes tasks until the queue is empty.
+		runAll := func(c context.Context) {
+			for {
+				ran, errs := runTasks(c)
+				So(errs, ShouldBeEmpty)
+				if ran == 0 {
+					return
+				}
+			}
+		}
+
+		increment := func(c context.Context, keys []*ds.Key) error {
+			things := make([]*Thing, len(keys))
+			for i, k := range keys {
+				things[i] = &Thing{ID: k.IntID()}
+			}
+			if err := ds.Get(c, things); err != nil {
+				return err
+			}
+			for _, t := range things {
+				t.Val++
+			}
+			return ds.Put(c, things)
+		}
+
+		Convey("maps over every entity", func() {
+			putThings(c, 200)
+			ctl.Register(&Mapper{
+				Name:      "inc",
+				Query:     ds.NewQuery("Thing"),
+				Map:       increment,
+				Shards:    4,
+				BatchSize: 16,
+			})
+
+			id, err := ctl.Launch(c, "inc")
+			So(err, ShouldBeNil)
+
+			st, err := ctl.Status(c, id)
+			So(err, ShouldBeNil)
+			So(st.Job.State, ShouldEqual, StateRunning)
+			So(st.Job.Shards, ShouldBeBetweenOrEqual, 2, 4)
+			So(st.Processed, ShouldEqual, 0)
+
+			runAll(c)
+			So(getVals(c, 200), ShouldResemble, allEqual(200, 1))
+
+			st, err = ctl.Status(c, id)
+			So(err, ShouldBeNil)
+			So(st.Job.State, ShouldEqual, StateSucceeded)
+			So(st.Processed, ShouldEqual, 200)
+			So(st.ShardsFinished, ShouldEqual, st.Job.Shards)
+		})
+
+		Convey("transactional batches", func() {
+			putThings(c, 50)
+			fail := true
+			ctl.Register(&Mapper{
+				Name:  "inc",
+				Query: ds.NewQuery("Thing"),
+				Map: func(c context.Context, keys []*ds.Key) error {
+					So(ds.CurrentTransaction(c), ShouldNotBeNil)
+					if err := increment(c, keys); err != nil {
+						return err
+					}
+					if fail {
+						fail = false
+						return errors.New("boom")
+					}
+					return nil
+				},
+				Shards:        1,
+				Transactional: true,
+			})
+
+			id, err := ctl.Launch(c, "inc")
+			So(err, ShouldBeNil)
+			ran, errs := runTasks(c) // the kickoff task
+			So(ran, ShouldEqual, 1)
+			So(errs, ShouldBeEmpty)
+
+			// The first batch fails, and nothing it did is committed.
+			tasks := tq.GetTestable(c).GetScheduledTasks()["default"]
+			So(tasks, ShouldHaveLength, 1)
+			for _, t := range tasks {
+				So(ctl.HandleTask(c, t.Payload), ShouldErrLike, "boom")
+			}
+			So(getVals(c, 50), ShouldResemble, allEqual(50, 0))
+
+			// Retrying the same task succeeds.
+			runAll(c)
+			So(getVals(c, 50), ShouldResemble, allEqual(50, 1))
+
+			st, err := ctl.Status(c, id)
+			So(err, ShouldBeNil)
+			So(st.Job.State, ShouldEqual, StateSucceeded)
+			So(st.Processed, ShouldEqual, 50)
+		})
+
+		Convey("pause and resume", func() {
+			putThings(c, 100)
+			ctl.Register(&Mapper{
+				Name:      "inc",
+				Query:     ds.NewQuery("Thing"),
+				Map:       increment,
+				Shards:    1,
+				BatchSize: 10,
+			})
+
+			id, err := ctl.Launch(c, "inc")
+			So(err, ShouldBeNil)
+			runTasks(c) // the kickoff task
+			runTasks(c)
+
+			So(ctl.Pause(c, id), ShouldBeNil)
+			So(ctl.Pause(c, id), ShouldErrLike, "cannot pause")
+			runAll(c)
+
+			st, err := ctl.Status(c, id)
+			So(err, ShouldBeNil)
+			So(st.Job.State, ShouldEqual, StatePaused)
+			So(st.Processed, ShouldEqual, 10)
+
+			So(ctl.Resume(c, id), ShouldBeNil)
+			runAll(c)
+			So(getVals(c, 100), ShouldResemble, allEqual(100, 1))
+
+			st, err = ctl.Status(c, id)
+			So(err, ShouldBeNil)
+			So(st.Job.State, ShouldEqual, StateSucceeded)
+			So(st.Processed, ShouldEqual, 100)
+		})
+
+		Convey("stale tasks are ignored after resume", func() {
+			putThings(c, 30)
+			ctl.Register(&Mapper{
+				Name:      "inc",
+				Query:     ds.NewQuery("Thing"),
+				Map:       increment,
+				Shards:    1,
+				BatchSize: 10,
+			})
+
+			id, err := ctl.Launch(c, "inc")
+			So(err, ShouldBeNil)
+
+			// Pause and resume before the kickoff task runs: the task it enqueues is
+			// stale, and the resumed one does the work.
+			So(ctl.Pause(c, id), ShouldBeNil)
+			So(ctl.Resume(c, id), ShouldBeNil)
+			So(tq.GetTestable(c).GetScheduledTasks()["default"], ShouldHaveLength, 2)
+
+			runAll(c)
+			So(getVals(c, 30), ShouldResemble, allEqual(30, 1))
+		})
+
+		Convey("abort", func() {
+			putThings(c, 100)
+			ctl.Register(&Mapper{
+				Name:      "inc",
+				Query:     ds.NewQuery("Thing"),
+				Map:       increment,
+				Shards:    1,
+				BatchSize: 10,
+			})
+
+			id, err := ctl.Launch(c, "inc")
+			So(err, ShouldBeNil)
+			runTasks(c) // the kickoff task
+			runTasks(c)
+
+			So(ctl.Abort(c, id), ShouldBeNil)
+			runAll(c)
+
+			st, err := ctl.Status(c, id)
+			So(err, ShouldBeNil)
+			So(st.Job.State, ShouldEqual, StateAborted)
+			So(st.Shards[0].State, ShouldEqual, StateAborted)
+			So(st.Processed, ShouldEqual, 10)
+
+			So(ctl.Abort(c, id), ShouldErrLike, "cannot abort")
+			So(ctl.Resume(c, id), ShouldErrLike, "cannot resume")
+		})
+
+		Convey("runs in the launching namespace", func() {
+			nc := info.MustNamespace(c, "ns")
+			putThings(nc, 20)
+			putThings(c, 20)
+			ctl.Register(&Mapper{
+				Name:  "inc",
+				Query: ds.NewQuery("Thing"),
+				Map:   increment,
+			})
+
+			// The task queue is namespaced too, so the tasks are in "ns".
+			id, err := ctl.Launch(nc, "inc")
+			So(err, ShouldBeNil)
+			runAll(nc)
+
+			So(getVals(nc, 20), ShouldResemble, allEqual(20, 1))
+			So(getVals(c, 20), ShouldResemble, allEqual(20, 0))
+
+			st, err := ctl.Status(nc, id)
+			So(err, ShouldBeNil)
+			So(st.Job.State, ShouldEqual, StateSucceeded)
+		})
+
+		Convey("empty query", func() {
+			ctl.Register(&Mapper{
+				Name:  "inc",
+				Query: ds.NewQuery("Thing"),
+				Map:   increment,
+			})
+			id, err := ctl.Launch(c, "inc")
+			So(err, ShouldBeNil)
+			runAll(c)
+
+			st, err := ctl.Status(c, id)
+			So(err, ShouldBeNil)
+			So(st.Job.State, ShouldEqual, StateSucceeded)
+			So(st.Job.Shards, ShouldEqual, 1)
+		})
+
+		Convey("a failed launch leaves no job behind", func() {
+			putThings(c, 20)
+			ctl.Register(&Mapper{
+				Name:  "inc",
+				Query: ds.NewQuery("Thing"),
+				Map:   increment,
+			})
+			countKind := func(kind string) int64 {
+				n, err := ds.Count(c, ds.NewQuery(kind))
+				So(err, ShouldBeNil)
+				return n
+			}
+
+			fc, fb := featureBreaker.FilterTQ(c, nil)
+			fb.BreakFeatures(errors.New("queue is down"), "AddMulti")
+			_, err := ctl.Launch(fc, "inc")
+			So(err, ShouldErrLike, "queue is down")
+			So(countKind("mapper.Job"), ShouldEqual, 0)
+			So(countKind("mapper.Shard"), ShouldEqual, 0)
+			So(tq.GetTestable(c).GetScheduledTasks()["default"], ShouldBeEmpty)
+
+			Convey("and a failed kickoff is retried", func() {
+				fb.UnbreakFeatures("AddMulti")
+				id, err := ctl.Launch(fc, "inc")
+				So(err, ShouldBeNil)
+
+				fb.BreakFeatures(errors.New("queue is down"), "AddMulti")
+				tasks := tq.GetTestable(c).GetScheduledTasks()["default"]
+				So(tasks, ShouldHaveLength, 1)
+				for _, t := range tasks {
+					So(ctl.HandleTask(fc, t.Payload), ShouldErrLike, "queue is down")
+				}
+
+				fb.UnbreakFeatures("AddMulti")
+				runAll(c)
+				So(getVals(c, 20), ShouldResemble, allEqual(20, 1))
+
+				st, err := ctl.Status(c, id)
+				So(err, ShouldBeNil)
+				So(st.Job.State, ShouldEqual, StateSucceeded)
+			})
+		})
+
+		Convey("bad registrations", func() {
+			So(func() { ctl.Register(&Mapper{}) }, ShouldPanic)
+			So(func() {
+				ctl.Register(&Mapper{
+					Name:          "x",
+					Query:         ds.NewQuery("Thing"),
+					Map:           increment,
+					Transactional: true,
+					BatchSize:     100,
+				})
+			}, ShouldPanic)
+			So(func() {
+				ctl.Register(&Mapper{
+					Name:   "y",
+					Query:  ds.NewQuery("Thing"),
+					Map:    increment,
+					Shards: MaxShards + 1,
+				})
+			}, ShouldPanic)
+
+			_, err := ctl.Launch(c, "missing")
+			So(err, ShouldErrLike, "no mapper named")
+		})
+	})
+}
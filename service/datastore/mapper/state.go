@@ -0,0 +1,146 @@
+// Copyright 2018 The LUCI Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mapper
+
+import (
+	"fmt"
+	"time"
+
+	ds "go.chromium.org/gae/service/datastore"
+
+	"golang.org/x/net/context"
+)
+
+// JobID identifies a mapper job.
+type JobID int64
+
+// State is the state of a Job or a Shard.
+type State int
+
+const (
+	// StateRunning means that the job (or shard) is being processed.
+	StateRunning State = iota
+	// StatePaused means that the job was paused via Controller.Pause. It may be
+	// resumed with Controller.Resume.
+	StatePaused
+	// StateSucceeded means that all entities were processed.
+	StateSucceeded
+	// StateAborted means that the job was aborted via Controller.Abort.
+	StateAborted
+)
+
+func (s State) String() string {
+	switch s {
+	case StateRunning:
+		return "Running"
+	case StatePaused:
+		return "Paused"
+	case StateSucceeded:
+		return "Succeeded"
+	case StateAborted:
+		return "Aborted"
+	default:
+		return fmt.Sprintf("State(%d)", int(s))
+	}
+}
+
+// Finished returns true if no more processing will happen in this state.
+func (s State) Finished() bool {
+	return s == StateSucceeded || s == StateAborted
+}
+
+// Job is the datastore entity describing a single run of a Mapper.
+type Job struct {
+	_kind string `gae:"$kind,mapper.Job"`
+
+	ID JobID `gae:"$id"`
+
+	// Mapper is the name of the Mapper this job runs.
+	Mapper string
+	// Namespace is the namespace the job's query runs in.
+	Namespace string
+	// State is the job's state.
+	State State
+	// Shards is the number of shards the query was split into.
+	Shards int
+
+	Created time.Time
+	Updated time.Time
+}
+
+// Shard is the datastore entity holding the checkpoint of a single shard of a
+// Job.
+//
+// Shards are root entities, so that shards of the same job don't contend with
+// each other.
+type Shard struct {
+	_kind string `gae:"$kind,mapper.Shard"`
+
+	// ID is "<job ID>:<shard index>".
+	ID string `gae:"$id"`
+
+	Job   JobID
+	Index int
+
+	// Low and High are the __key__ bounds of this shard, in addition to the
+	// bounds of the mapper's query (Low inclusive, High exclusive). A nil bound
+	// means that the shard is unbounded on that side.
+	Low  *ds.Key `gae:",noindex"`
+	High *ds.Key `gae:",noindex"`
+
+	// State is the shard's state. A shard may be Running, Succeeded or Aborted;
+	// pausing is tracked on the Job.
+	State State
+
+	// Cursor is the query cursor to resume from. Empty means the beginning of
+	// the shard.
+	Cursor string `gae:",noindex"`
+
+	// Processed is the number of entities processed so far.
+	Processed int64
+
+	// Generation is incremented every time the shard's task chain advances (or
+	// is restarted by Resume). Tasks carry the generation they were created for,
+	// which allows stale and duplicate tasks to be ignored.
+	Generation int64
+
+	Updated time.Time
+}
+
+func shardID(job JobID, index int) string {
+	return fmt.Sprintf("%d:%d", job, index)
+}
+
+func getShards(c context.Context, job *Job) ([]*Shard, error) {
+	shards := make([]*Shard, job.Shards)
+	for i := range shards {
+		shards[i] = &Shard{ID: shardID(job.ID, i)}
+	}
+	if err := ds.Get(c, shards); err != nil {
+		return nil, err
+	}
+	return shards, nil
+}
+
+// Status is a snapshot of the progress of a Job.
+type Status struct {
+	Job    *Job
+	Shards []*Shard
+
+	// Processed is the total number of entities processed by all shards.
+	Processed int64
+	// ShardsFinished is the number of shards which are done processing.
+	ShardsFinished int
+}
@@ -0,0 +1,252 @@
+// Copyright 2018 The LUCI Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mapper
+
+import (
+	"encoding/json"
+	"net/http"
+
+	ds "go.chromium.org/gae/service/datastore"
+	"go.chromium.org/gae/service/info"
+	tq "go.chromium.org/gae/service/taskqueue"
+
+	"go.chromium.org/luci/common/clock"
+	"go.chromium.org/luci/common/errors"
+	log "go.chromium.org/luci/common/logging"
+
+	"golang.org/x/net/context"
+)
+
+// taskPayload is the JSON-encoded body of a task: either a shard task, or the
+// kickoff task of a job, which starts the task chains of its shards.
+type taskPayload struct {
+	Namespace  string `json:"ns"`
+	Job        JobID  `json:"job"`
+	Kickoff    bool   `json:"kickoff,omitempty"`
+	Shard      int    `json:"shard"`
+	Generation int64  `json:"gen"`
+}
+
+func (ctl *Controller) makeTask(job *Job, s *Shard) *tq.Task {
+	return ctl.newTask(&taskPayload{
+		Namespace:  job.Namespace,
+		Job:        job.ID,
+		Shard:      s.Index,
+		Generation: s.Generation,
+	})
+}
+
+func (ctl *Controller) makeKickoffTask(job *Job) *tq.Task {
+	return ctl.newTask(&taskPayload{
+		Namespace: job.Namespace,
+		Job:       job.ID,
+		Kickoff:   true,
+	})
+}
+
+func (ctl *Controller) newTask(p *taskPayload) *tq.Task {
+	payload, err := json.Marshal(p)
+	if err != nil {
+		panic(err) // impossible
+	}
+	h := make(http.Header)
+	h.Set("Content-Type", "application/json")
+	return &tq.Task{
+		Path:    ctl.Path,
+		Payload: payload,
+		Header:  h,
+		Method:  "POST",
+	}
+}
+
+// HandleTask processes a single task of a mapper job. payload is the body of
+// the task's request.
+//
+// If HandleTask returns an error, the task should be retried (i.e. the handler
+// should respond with an error status).
+func (ctl *Controller) HandleTask(c context.Context, payload []byte) error {
+	var p taskPayload
+	if err := json.Unmarshal(payload, &p); err != nil {
+		// Retrying won't help.
+		(log.Fields{log.ErrorKey: err}).Errorf(c, "mapper: dropping task with bad payload %q", payload)
+		return nil
+	}
+	c, err := info.Namespace(c, p.Namespace)
+	if err != nil {
+		(log.Fields{log.ErrorKey: err}).Errorf(c, "mapper: dropping task with bad namespace %q", p.Namespace)
+		return nil
+	}
+
+	job := &Job{ID: p.Job}
+	switch err := ds.Get(c, job); {
+	case err == ds.ErrNoSuchEntity:
+		return nil
+	case err != nil:
+		return errors.Annotate(err, "loading job %d", p.Job).Err()
+	case job.State != StateRunning:
+		// Paused or finished; Resume will start a new task chain if needed.
+		return nil
+	}
+
+	if p.Kickoff {
+		return ctl.kickoff(c, job)
+	}
+
+	m, err := ctl.getMapper(job.Mapper)
+	if err != nil {
+		return err
+	}
+
+	shard := &Shard{ID: shardID(job.ID, p.Shard)}
+	if err := ds.Get(c, shard); err != nil {
+		return errors.Annotate(err, "loading shard %s", shard.ID).Err()
+	}
+	if shard.Generation != p.Generation || shard.State != StateRunning {
+		// Stale or duplicate task.
+		return nil
+	}
+
+	keys, cursor, err := fetchBatch(c, m, shard)
+	if err != nil {
+		return errors.Annotate(err, "fetching batch for shard %s", shard.ID).Err()
+	}
+	done := len(keys) < m.batchSize()
+
+	if !m.Transactional && len(keys) > 0 {
+		if err := m.Map(c, keys); err != nil {
+			return errors.Annotate(err, "mapping shard %s", shard.ID).Err()
+		}
+	}
+
+	err = ds.RunInTransaction(c, func(c context.Context) error {
+		cur := &Shard{ID: shard.ID}
+		if err := ds.Get(c, cur); err != nil {
+			return err
+		}
+		if cur.Generation != p.Generation || cur.State != StateRunning {
+			// Someone (e.g. Abort) got here first.
+			return nil
+		}
+
+		if m.Transactional && len(keys) > 0 {
+			if err := m.Map(c, keys); err != nil {
+				return errors.Annotate(err, "mapping shard %s", shard.ID).Err()
+			}
+		}
+
+		cur.Processed += int64(len(keys))
+		cur.Generation++
+		cur.Updated = clock.Now(c).UTC()
+		if done {
+			cur.State = StateSucceeded
+		} else {
+			cur.Cursor = cursor
+			if err := tq.Add(c, ctl.Queue, ctl.makeTask(job, cur)); err != nil {
+				return err
+			}
+		}
+		return ds.Put(c, cur)
+	}, nil)
+	if err != nil || !done {
+		return err
+	}
+	return ctl.maybeFinishJob(c, job.ID)
+}
+
+// kickoff starts the task chains of the job's shards which haven't started
+// yet.
+//
+// The taskqueue may run it more than once. Then the extra tasks of a shard
+// are for the same generation, and all but the first to commit are ignored,
+// like stale tasks.
+func (ctl *Controller) kickoff(c context.Context, job *Job) error {
+	shards, err := getShards(c, job)
+	if err != nil {
+		return errors.Annotate(err, "loading shards of job %d", job.ID).Err()
+	}
+	var tasks []*tq.Task
+	for _, s := range shards {
+		if s.State == StateRunning && s.Generation == 0 {
+			tasks = append(tasks, ctl.makeTask(job, s))
+		}
+	}
+	if len(tasks) == 0 {
+		return nil
+	}
+	if err := tq.Add(c, ctl.Queue, tasks...); err != nil {
+		return errors.Annotate(err, "enqueuing shard tasks").Err()
+	}
+	return nil
+}
+
+// fetchBatch returns the next batch of keys for the shard, and the cursor to
+// continue from.
+func fetchBatch(c context.Context, m *Mapper, s *Shard) ([]*ds.Key, string, error) {
+	q := m.Query.KeysOnly(true).Limit(int32(m.batchSize()))
+	if s.Low != nil {
+		q = q.Gte("__key__", s.Low)
+	}
+	if s.High != nil {
+		q = q.Lt("__key__", s.High)
+	}
+	if s.Cursor != "" {
+		cur, err := ds.DecodeCursor(c, s.Cursor)
+		if err != nil {
+			return nil, "", errors.Annotate(err, "decoding cursor").Err()
+		}
+		q = q.Start(cur)
+	}
+
+	var keys []*ds.Key
+	var next ds.Cursor
+	err := ds.Run(c, q, func(k *ds.Key, gc ds.CursorCB) error {
+		keys = append(keys, k)
+		if len(keys) == m.batchSize() {
+			var err error
+			if next, err = gc(); err != nil {
+				return err
+			}
+			return ds.Stop
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	if next == nil {
+		return keys, "", nil
+	}
+	return keys, next.String(), nil
+}
+
+// maybeFinishJob marks the job as succeeded if all of its shards are done.
+func (ctl *Controller) maybeFinishJob(c context.Context, id JobID) error {
+	return ctl.updateJob(c, id, func(job *Job) error {
+		if job.State != StateRunning {
+			return nil
+		}
+		shards, err := getShards(ds.WithoutTransaction(c), job)
+		if err != nil {
+			return err
+		}
+		for _, s := range shards {
+			if !s.State.Finished() {
+				return nil
+			}
+		}
+		job.State = StateSucceeded
+		return nil
+	})
+}
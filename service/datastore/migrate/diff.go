@@ -0,0 +1,53 @@
+// Copyright 2018 The LUCI Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package migrate
+
+import (
+	"bytes"
+	"fmt"
+
+	ds "go.chromium.org/gae/service/datastore"
+)
+
+// Diff describes how a single destination entity would be changed by a
+// migration.
+type Diff struct {
+	// Key is the destination key.
+	Key *ds.Key
+	// Old is the current destination entity, or nil if it doesn't exist.
+	Old ds.PropertyMap
+	// New is the entity the migration would write.
+	New ds.PropertyMap
+}
+
+// String renders the Diff in a unified-diff-like format, one property per
+// line. Unchanged properties are omitted.
+func (d *Diff) String() string {
+	buf := &bytes.Buffer{}
+	if d.Old == nil {
+		fmt.Fprintf(buf, "+++ %s\n", d.Key)
+	} else {
+		fmt.Fprintf(buf, "*** %s\n", d.Key)
+	}
+	for _, pd := range ds.DiffPropertyMaps(d.Old, d.New) {
+		if len(pd.Before) > 0 {
+			fmt.Fprintf(buf, "- %s: %s\n", pd.Name, ds.FormatPropertySlice(pd.Before))
+		}
+		if len(pd.After) > 0 {
+			fmt.Fprintf(buf, "+ %s: %s\n", pd.Name, ds.FormatPropertySlice(pd.After))
+		}
+	}
+	return buf.String()
+}
@@ -0,0 +1,278 @@
+// Copyright 2018 The LUCI Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package migrate copies datastore entities between namespaces and apps.
+//
+// Moving an entity to another KeyContext (app ID and namespace) requires
+// rewriting not only its key, but also every Key value it holds which points
+// into the old KeyContext, including Keys nested in PropertyMap values.
+// Copy does that, in resumable batches, and can also run in a dry-run mode
+// which only reports what would change.
+package migrate
+
+import (
+	ds "go.chromium.org/gae/service/datastore"
+
+	"go.chromium.org/luci/common/errors"
+
+	"golang.org/x/net/context"
+)
+
+// DefaultBatchSize is the number of entities copied per batch if
+// Options.BatchSize is 0.
+const DefaultBatchSize = 200
+
+// Progress is reported to Options.Progress after every batch.
+type Progress struct {
+	// Copied is the number of entities copied (or, in dry-run mode, examined)
+	// so far, including the ones from previous runs reported in
+	// Options.Resume.
+	Copied int64
+
+	// Cursor is the source query cursor to pass to Options.Resume in order to
+	// continue after this batch. It's empty once the query is exhausted.
+	Cursor string
+}
+
+// Options controls the behavior of Copy.
+type Options struct {
+	// BatchSize is the number of entities read and written at a time. If 0,
+	// DefaultBatchSize is used.
+	BatchSize int
+
+	// Resume, if not nil, continues a previous run from the given checkpoint
+	// (as reported by Progress).
+	Resume *Progress
+
+	// Progress, if not nil, is called after every batch has been written. It
+	// may be used to persist a checkpoint. If it returns an error, Copy stops
+	// and returns that error.
+	Progress func(*Progress) error
+
+	// DryRun, if true, doesn't write anything. Instead, every destination
+	// entity which would be created or changed is reported to Diff.
+	DryRun bool
+
+	// Diff is called in DryRun mode for every destination entity which would
+	// change. If it returns an error, Copy stops and returns that error.
+	Diff func(*Diff) error
+}
+
+// Copy copies every entity matched by q in src to dst.
+//
+// src and dst are contexts whose datastore KeyContexts (app ID and namespace)
+// are the source and destination of the migration. The keys of the entities,
+// as well as every Key value which points into the source KeyContext, are
+// rewritten into the destination KeyContext. Entities of special kinds (like
+// __entity_group__) are skipped.
+//
+// Entities are copied in batches with non-transactional PutMulti calls. After
+// each batch Options.Progress is called with a checkpoint which may later be
+// passed as Options.Resume to continue an interrupted migration. Since a batch
+// may be written again when resuming, copying is idempotent rather than
+// exactly-once.
+//
+// Copy always copies every entity matched by q, so q must not have a limit or
+// an offset; such queries are rejected with an error. Use
+// Options.BatchSize to control how many entities are read at a time.
+//
+// Copy returns the final Progress.
+func Copy(src, dst context.Context, q *ds.Query, opts *Options) (*Progress, error) {
+	if opts == nil {
+		opts = &Options{}
+	}
+	batchSize := opts.BatchSize
+	if batchSize <= 0 {
+		batchSize = DefaultBatchSize
+	}
+
+	fq, err := q.Finalize()
+	if err != nil {
+		return nil, errors.Annotate(err, "bad query").Err()
+	}
+	if _, ok := fq.Limit(); ok {
+		return nil, errors.New("the query must not have a limit")
+	}
+	if _, ok := fq.Offset(); ok {
+		return nil, errors.New("the query must not have an offset")
+	}
+
+	from, to := ds.GetKeyContext(src), ds.GetKeyContext(dst)
+	prog := &Progress{}
+	if opts.Resume != nil {
+		*prog = *opts.Resume
+	}
+
+	q = q.Limit(int32(batchSize))
+	for {
+		bq := q
+		if prog.Cursor != "" {
+			cur, err := ds.DecodeCursor(src, prog.Cursor)
+			if err != nil {
+				return prog, errors.Annotate(err, "decoding cursor").Err()
+			}
+			bq = bq.Start(cur)
+		}
+
+		keys, vals, next, err := readBatch(src, bq, batchSize)
+		if err != nil {
+			return prog, errors.Annotate(err, "reading batch at %d", prog.Copied).Err()
+		}
+		for i := range keys {
+			keys[i] = RewriteKey(keys[i], from, to)
+			vals[i] = RewritePropertyMap(vals[i], from, to)
+		}
+
+		if opts.DryRun {
+			err = diffBatch(dst, keys, vals, opts.Diff)
+		} else {
+			err = putBatch(dst, keys, vals)
+		}
+		if err != nil {
+			return prog, errors.Annotate(err, "writing batch at %d", prog.Copied).Err()
+		}
+
+		prog.Copied += int64(len(keys))
+		prog.Cursor = next
+		if opts.Progress != nil {
+			if err := opts.Progress(prog); err != nil {
+				return prog, err
+			}
+		}
+		if next == "" {
+			return prog, nil
+		}
+	}
+}
+
+// readBatch reads up to n entities (skipping special ones) from q, and returns
+// them together with the cursor to continue from. The cursor is empty if q is
+// exhausted.
+//
+// The query only fetches the keys, and the entities are then fetched by key,
+// since some implementations don't keep the app ID of Key property values in
+// query results. Entities deleted in between are skipped.
+func readBatch(c context.Context, q *ds.Query, n int) ([]*ds.Key, []ds.PropertyMap, string, error) {
+	fq, err := q.KeysOnly(true).Finalize()
+	if err != nil {
+		return nil, nil, "", err
+	}
+
+	var keys []*ds.Key
+	var next ds.Cursor
+	seen := 0
+	err = ds.Raw(c).Run(fq, func(k *ds.Key, _ ds.PropertyMap, gc ds.CursorCB) error {
+		seen++
+		if !k.LastTok().Special() {
+			keys = append(keys, k)
+		}
+		if seen == n {
+			var err error
+			if next, err = gc(); err != nil {
+				return err
+			}
+			return ds.Stop
+		}
+		return nil
+	})
+	if err != nil && err != ds.Stop {
+		return nil, nil, "", err
+	}
+
+	var found []*ds.Key
+	var vals []ds.PropertyMap
+	if len(keys) > 0 {
+		got := make([]ds.PropertyMap, len(keys))
+		lme := errors.NewLazyMultiError(len(keys))
+		err = ds.Raw(c).GetMulti(keys, nil, func(i int, pm ds.PropertyMap, err error) error {
+			if err != ds.ErrNoSuchEntity {
+				got[i] = pm
+				lme.Assign(i, err)
+			}
+			return nil
+		})
+		if err == nil {
+			err = lme.Get()
+		}
+		if err != nil {
+			return nil, nil, "", err
+		}
+		for i, pm := range got {
+			if pm != nil {
+				found = append(found, keys[i])
+				vals = append(vals, pm)
+			}
+		}
+	}
+
+	if next == nil {
+		return found, vals, "", nil
+	}
+	return found, vals, next.String(), nil
+}
+
+// putBatch writes vals to c.
+func putBatch(c context.Context, keys []*ds.Key, vals []ds.PropertyMap) error {
+	if len(keys) == 0 {
+		return nil
+	}
+	lme := errors.NewLazyMultiError(len(keys))
+	err := ds.Raw(c).PutMulti(keys, vals, func(i int, _ *ds.Key, err error) error {
+		lme.Assign(i, err)
+		return nil
+	})
+	if err == nil {
+		err = lme.Get()
+	}
+	return err
+}
+
+// diffBatch reports every entity in vals which differs from its current
+// version in c.
+func diffBatch(c context.Context, keys []*ds.Key, vals []ds.PropertyMap, cb func(*Diff) error) error {
+	if len(keys) == 0 || cb == nil {
+		return nil
+	}
+
+	old := make([]ds.PropertyMap, len(keys))
+	for i, k := range keys {
+		old[i] = ds.PropertyMap{}
+		old[i].SetMeta("key", k)
+	}
+	if err := ds.Get(c, old); err != nil {
+		me, ok := err.(errors.MultiError)
+		if !ok {
+			return err
+		}
+		for i, err := range me {
+			switch err {
+			case nil:
+			case ds.ErrNoSuchEntity:
+				old[i] = nil
+			default:
+				return err
+			}
+		}
+	}
+
+	for i, k := range keys {
+		if old[i] != nil && len(ds.DiffPropertyMaps(old[i], vals[i])) == 0 {
+			continue
+		}
+		if err := cb(&Diff{Key: k, Old: old[i], New: vals[i]}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
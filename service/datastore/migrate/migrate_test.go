@@ -0,0 +1,226 @@
+// Copyright 2018 The LUCI Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package migrate
+
+import (
+	"errors"
+	"testing"
+
+	"go.chromium.org/gae/impl/memory"
+	ds "go.chromium.org/gae/service/datastore"
+	"go.chromium.org/gae/service/info"
+
+	"golang.org/x/net/context"
+
+	. "github.com/smartystreets/goconvey/convey"
+	. "go.chromium.org/luci/common/testing/assertions"
+)
+
+func TestRewrite(t *testing.T) {
+	t.Parallel()
+
+	Convey("RewritePropertyMap", t, func() {
+		from := ds.MkKeyContext("app", "a")
+		to := ds.MkKeyContext("app", "b")
+		elsewhere := ds.MkKeyContext("app", "c")
+
+		pm := ds.PropertyMap{
+			"$key":  ds.MkPropertyNI(from.MakeKey("Thing", 1)),
+			"Ref":   ds.MkProperty(from.MakeKey("Parent", "p", "Child", 2)),
+			"Other": ds.MkProperty(elsewhere.MakeKey("Thing", 1)),
+			"Multi": ds.PropertySlice{ds.MkProperty(from.MakeKey("A", 1)), ds.MkProperty(10)},
+			"Nested": ds.MkPropertyNI(ds.PropertyMap{
+				"Deep": ds.MkPropertyNI(ds.PropertyMap{
+					"Ref": ds.MkProperty(from.MakeKey("Deep", 1)),
+				}),
+			}),
+			"Str": ds.MkPropertyNI("hi"),
+		}
+
+		So(RewritePropertyMap(pm, from, to), ShouldResemble, ds.PropertyMap{
+			"$key":  ds.MkPropertyNI(to.MakeKey("Thing", 1)),
+			"Ref":   ds.MkProperty(to.MakeKey("Parent", "p", "Child", 2)),
+			"Other": ds.MkProperty(elsewhere.MakeKey("Thing", 1)),
+			"Multi": ds.PropertySlice{ds.MkProperty(to.MakeKey("A", 1)), ds.MkProperty(10)},
+			"Nested": ds.MkPropertyNI(ds.PropertyMap{
+				"Deep": ds.MkPropertyNI(ds.PropertyMap{
+					"Ref": ds.MkProperty(to.MakeKey("Deep", 1)),
+				}),
+			}),
+			"Str": ds.MkPropertyNI("hi"),
+		})
+
+		// The original is untouched.
+		So(pm["Ref"], ShouldResemble, ds.MkProperty(from.MakeKey("Parent", "p", "Child", 2)))
+	})
+}
+
+func TestCopy(t *testing.T) {
+	t.Parallel()
+
+	Convey("Copy", t, func() {
+		c := memory.Use(context.Background())
+		ds.GetTestable(c).Consistent(true)
+		src := info.MustNamespace(c, "src")
+		dst := info.MustNamespace(c, "dst")
+
+		mkThing := func(c context.Context, i int) ds.PropertyMap {
+			return ds.PropertyMap{
+				"$key":  ds.MkPropertyNI(ds.MakeKey(c, "Thing", i)),
+				"Val":   ds.MkProperty(i),
+				"Owner": ds.MkProperty(ds.MakeKey(c, "User", "bob")),
+				"Extra": ds.MkPropertyNI(ds.PropertyMap{
+					"Prev": ds.MkProperty(ds.MakeKey(c, "Thing", i+100)),
+				}),
+			}
+		}
+		for i := 1; i <= 10; i++ {
+			So(ds.Put(src, mkThing(src, i)), ShouldBeNil)
+		}
+		So(ds.Put(src, ds.PropertyMap{
+			"$key": ds.MkPropertyNI(ds.MakeKey(src, "User", "bob")),
+			"Name": ds.MkProperty("Bob"),
+		}), ShouldBeNil)
+
+		getThing := func(c context.Context, i int) ds.PropertyMap {
+			pm := ds.PropertyMap{"$key": ds.MkPropertyNI(ds.MakeKey(c, "Thing", i))}
+			if err := ds.Get(c, pm); err != nil {
+				So(err, ShouldEqual, ds.ErrNoSuchEntity)
+				return nil
+			}
+			return pm
+		}
+
+		Convey("copies everything and rewrites keys", func() {
+			var checkpoints []int64
+			prog, err := Copy(src, dst, ds.NewQuery(""), &Options{
+				BatchSize: 4,
+				Progress: func(p *Progress) error {
+					checkpoints = append(checkpoints, p.Copied)
+					return nil
+				},
+			})
+			So(err, ShouldBeNil)
+			So(prog.Copied, ShouldEqual, 11)
+			So(prog.Cursor, ShouldEqual, "")
+			So(checkpoints[len(checkpoints)-1], ShouldEqual, 11)
+
+			for i := 1; i <= 10; i++ {
+				So(getThing(dst, i), ShouldResemble, mkThing(dst, i))
+			}
+			user := ds.PropertyMap{"$key": ds.MkPropertyNI(ds.MakeKey(dst, "User", "bob"))}
+			So(ds.Get(dst, user), ShouldBeNil)
+		})
+
+		Convey("copies a query across apps", func() {
+			other := info.MustNamespace(memory.UseWithAppID(context.Background(), "dev~other"), "src")
+			prog, err := Copy(src, other, ds.NewQuery("Thing").Lte("Val", 5), nil)
+			So(err, ShouldBeNil)
+			So(prog.Copied, ShouldEqual, 5)
+
+			So(getThing(other, 5), ShouldResemble, mkThing(other, 5))
+			owner := getThing(other, 5)["Owner"].(ds.Property)
+			So(owner.Value().(*ds.Key).AppID(), ShouldEqual, "dev~other")
+		})
+
+		Convey("keeps keys into other apps", func() {
+			remote := ds.MkKeyContext("remote-app", "").MakeKey("Thing", 1)
+			thing := mkThing(src, 1)
+			thing["Remote"] = ds.MkProperty(remote)
+			So(ds.Put(src, thing), ShouldBeNil)
+
+			_, err := Copy(src, dst, ds.NewQuery("Thing"), nil)
+			So(err, ShouldBeNil)
+			So(getThing(dst, 1)["Remote"], ShouldResemble, ds.MkProperty(remote))
+		})
+
+		Convey("can be resumed", func() {
+			stop := errors.New("stop")
+			var last *Progress
+			_, err := Copy(src, dst, ds.NewQuery("Thing"), &Options{
+				BatchSize: 3,
+				Progress: func(p *Progress) error {
+					cpy := *p
+					last = &cpy
+					return stop
+				},
+			})
+			So(err, ShouldEqual, stop)
+			So(last.Copied, ShouldEqual, 3)
+			So(getThing(dst, 3), ShouldNotBeNil)
+			So(getThing(dst, 4), ShouldBeNil)
+
+			prog, err := Copy(src, dst, ds.NewQuery("Thing"), &Options{
+				BatchSize: 3,
+				Resume:    last,
+			})
+			So(err, ShouldBeNil)
+			So(prog.Copied, ShouldEqual, 10)
+			for i := 1; i <= 10; i++ {
+				So(getThing(dst, i), ShouldNotBeNil)
+			}
+		})
+
+		Convey("rejects limited queries", func() {
+			_, err := Copy(src, dst, ds.NewQuery("Thing").Limit(5), nil)
+			So(err, ShouldErrLike, "must not have a limit")
+			_, err = Copy(src, dst, ds.NewQuery("Thing").Offset(5), nil)
+			So(err, ShouldErrLike, "must not have an offset")
+			So(getThing(dst, 1), ShouldBeNil)
+		})
+
+		Convey("dry run reports a diff", func() {
+			var diffs []*Diff
+			opts := &Options{
+				DryRun: true,
+				Diff: func(d *Diff) error {
+					diffs = append(diffs, d)
+					return nil
+				},
+			}
+
+			prog, err := Copy(src, dst, ds.NewQuery("Thing"), opts)
+			So(err, ShouldBeNil)
+			So(prog.Copied, ShouldEqual, 10)
+			So(diffs, ShouldHaveLength, 10)
+			So(getThing(dst, 1), ShouldBeNil)
+
+			Convey("only for changed entities", func() {
+				_, err := Copy(src, dst, ds.NewQuery("Thing"), nil)
+				So(err, ShouldBeNil)
+
+				changed := mkThing(src, 2)
+				changed["Val"] = ds.MkProperty(200)
+				So(ds.Put(src, changed), ShouldBeNil)
+
+				diffs = nil
+				_, err = Copy(src, dst, ds.NewQuery("Thing"), opts)
+				So(err, ShouldBeNil)
+				So(diffs, ShouldHaveLength, 1)
+				So(diffs[0].Key, ShouldResemble, ds.MakeKey(dst, "Thing", 2))
+				So(diffs[0].String(), ShouldEqual, "*** dev~app:dst:/Thing,2\n"+
+					"- Val: 2\n"+
+					"+ Val: 200\n")
+			})
+		})
+
+		Convey("bad cursors", func() {
+			_, err := Copy(src, dst, ds.NewQuery("Thing"), &Options{
+				Resume: &Progress{Cursor: "garbage"},
+			})
+			So(err, ShouldErrLike, "decoding cursor")
+		})
+	})
+}
@@ -0,0 +1,75 @@
+// Copyright 2018 The LUCI Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package migrate
+
+import (
+	ds "go.chromium.org/gae/service/datastore"
+)
+
+// RewriteKey returns k moved to the KeyContext to, if k is in the KeyContext
+// from. Otherwise k is returned unchanged.
+func RewriteKey(k *ds.Key, from, to ds.KeyContext) *ds.Key {
+	if k == nil || *k.KeyContext() != from {
+		return k
+	}
+	_, _, toks := k.Split()
+	return to.NewKeyToks(toks)
+}
+
+// RewritePropertyMap returns a copy of pm where every Key value in the
+// KeyContext from is moved to the KeyContext to. Keys in nested PropertyMap
+// values are rewritten recursively.
+//
+// Metadata (e.g. "$key") is rewritten as well, if it's a Key.
+func RewritePropertyMap(pm ds.PropertyMap, from, to ds.KeyContext) ds.PropertyMap {
+	if pm == nil {
+		return nil
+	}
+	ret := make(ds.PropertyMap, len(pm))
+	for name, pdata := range pm {
+		switch t := pdata.(type) {
+		case ds.Property:
+			ret[name] = RewriteProperty(t, from, to)
+		case ds.PropertySlice:
+			ps := make(ds.PropertySlice, len(t))
+			for i := range t {
+				ps[i] = RewriteProperty(t[i], from, to)
+			}
+			ret[name] = ps
+		default:
+			ret[name] = pdata
+		}
+	}
+	return ret
+}
+
+// RewriteProperty returns p with its value rewritten as described in
+// RewritePropertyMap.
+func RewriteProperty(p ds.Property, from, to ds.KeyContext) ds.Property {
+	var v interface{}
+	switch p.Type() {
+	case ds.PTKey:
+		v = RewriteKey(p.Value().(*ds.Key), from, to)
+	case ds.PTPropertyMap:
+		v = RewritePropertyMap(p.Value().(ds.PropertyMap), from, to)
+	default:
+		return p
+	}
+	var ret ds.Property
+	if err := ret.SetValue(v, p.IndexSetting()); err != nil {
+		panic(err) // impossible, it's the same type
+	}
+	return ret
+}
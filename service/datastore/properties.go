@@ -685,6 +685,8 @@ func (p *Property) EstimateSize() int64 {
 		return 1 + int64(len(p.Value().([]byte)))
 	case PTKey:
 		return 1 + p.Value().(*Key).EstimateSize()
+	case PTPropertyMap:
+		return 1 + p.Value().(PropertyMap).EstimateSize()
 	}
 	panic(fmt.Errorf("Unknown property type: %s", p.Type().String()))
 }
@@ -0,0 +1,136 @@
+// Copyright 2018 The LUCI Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package datastore
+
+import (
+	"sort"
+	"strings"
+)
+
+// PropertyDiff describes how a single property differs between two versions
+// of an entity.
+type PropertyDiff struct {
+	Name string
+
+	// Before and After are the values of the property in the two versions.
+	// They are nil if the property is absent.
+	Before PropertySlice
+	After  PropertySlice
+}
+
+// DiffPropertyMaps compares two versions of an entity, either of which may be
+// nil, and returns the properties which differ, ordered by name. Meta
+// properties (like "$key") and the properties named in ignore are skipped.
+//
+// Two values are the same if they have the same type, the same index setting
+// and equal values. Unlike Property.Equal, this doesn't compare the index
+// representations, so e.g. a string and a []byte with the same contents
+// differ.
+func DiffPropertyMaps(before, after PropertyMap, ignore ...string) []*PropertyDiff {
+	var skip map[string]bool
+	if len(ignore) > 0 {
+		skip = make(map[string]bool, len(ignore))
+		for _, name := range ignore {
+			skip[name] = true
+		}
+	}
+
+	names := make([]string, 0, len(before)+len(after))
+	for name := range before {
+		names = append(names, name)
+	}
+	for name := range after {
+		if _, ok := before[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	var ret []*PropertyDiff
+	for _, name := range names {
+		if isMetaKey(name) || skip[name] {
+			continue
+		}
+		b, a := before.Slice(name), after.Slice(name)
+		if !propertySlicesIdentical(b, a) {
+			ret = append(ret, &PropertyDiff{Name: name, Before: b, After: a})
+		}
+	}
+	return ret
+}
+
+func propertySlicesIdentical(a, b PropertySlice) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !propertiesIdentical(&a[i], &b[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+func propertiesIdentical(a, b *Property) bool {
+	if a.Type() != b.Type() || a.IndexSetting() != b.IndexSetting() {
+		return false
+	}
+	if a.Type() == PTPropertyMap {
+		return len(DiffPropertyMaps(a.Value().(PropertyMap), b.Value().(PropertyMap))) == 0
+	}
+	return a.Equal(b)
+}
+
+// FormatPropertySlice renders property values for humans, e.g. in diffs.
+//
+// A single value is rendered as its GQL literal and several as a [list].
+// Nested entities are rendered as {name: value, ...}, and non-indexed values
+// are followed by "(noindex)". An empty slice is rendered as "(absent)".
+func FormatPropertySlice(ps PropertySlice) string {
+	switch len(ps) {
+	case 0:
+		return "(absent)"
+	case 1:
+		return formatProperty(&ps[0])
+	}
+	parts := make([]string, len(ps))
+	for i := range ps {
+		parts[i] = formatProperty(&ps[i])
+	}
+	return "[" + strings.Join(parts, ", ") + "]"
+}
+
+func formatProperty(p *Property) string {
+	var ret string
+	if p.Type() == PTPropertyMap {
+		pm := p.Value().(PropertyMap)
+		names := make([]string, 0, len(pm))
+		for name := range pm {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		parts := make([]string, len(names))
+		for i, name := range names {
+			parts[i] = name + ": " + FormatPropertySlice(pm.Slice(name))
+		}
+		ret = "{" + strings.Join(parts, ", ") + "}"
+	} else {
+		ret = p.GQL()
+	}
+	if p.IndexSetting() == NoIndex {
+		ret += " (noindex)"
+	}
+	return ret
+}
@@ -0,0 +1,97 @@
+// Copyright 2018 The LUCI Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package datastore
+
+import (
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestDiffPropertyMaps(t *testing.T) {
+	t.Parallel()
+
+	Convey("DiffPropertyMaps", t, func() {
+		Convey("equal maps have no diff", func() {
+			pm := PropertyMap{
+				"$key": MkProperty("ignored"),
+				"Val":  PropertySlice{MkProperty(1), MkPropertyNI("two")},
+				"Sub":  MkProperty(PropertyMap{"A": MkProperty(true)}),
+			}
+			other := PropertyMap{
+				"Val": PropertySlice{MkProperty(1), MkPropertyNI("two")},
+				"Sub": MkProperty(PropertyMap{"A": MkProperty(true)}),
+			}
+			So(DiffPropertyMaps(pm, other), ShouldBeEmpty)
+		})
+
+		Convey("types and index settings matter", func() {
+			before := PropertyMap{
+				"Str": MkProperty("abc"),
+				"Idx": MkProperty(1),
+			}
+			after := PropertyMap{
+				"Str": MkProperty([]byte("abc")),
+				"Idx": MkPropertyNI(1),
+			}
+			So(DiffPropertyMaps(before, after), ShouldResemble, []*PropertyDiff{
+				{Name: "Idx", Before: before.Slice("Idx"), After: after.Slice("Idx")},
+				{Name: "Str", Before: before.Slice("Str"), After: after.Slice("Str")},
+			})
+		})
+
+		Convey("reports added, removed and nested changes", func() {
+			before := PropertyMap{
+				"Gone": MkProperty(1),
+				"Sub":  MkProperty(PropertyMap{"A": MkProperty(true)}),
+			}
+			after := PropertyMap{
+				"New": MkProperty(2),
+				"Sub": MkProperty(PropertyMap{"A": MkProperty(false)}),
+			}
+			diffs := DiffPropertyMaps(before, after)
+			So(len(diffs), ShouldEqual, 3)
+			So(diffs[0].Name, ShouldEqual, "Gone")
+			So(diffs[0].After, ShouldBeNil)
+			So(diffs[1].Name, ShouldEqual, "New")
+			So(diffs[1].Before, ShouldBeNil)
+			So(diffs[2].Name, ShouldEqual, "Sub")
+		})
+
+		Convey("skips ignored properties", func() {
+			before := PropertyMap{"Val": MkProperty(1), "Mod": MkProperty(1)}
+			after := PropertyMap{"Val": MkProperty(1), "Mod": MkProperty(2)}
+			So(DiffPropertyMaps(before, after, "Mod"), ShouldBeEmpty)
+		})
+
+		Convey("handles nil maps", func() {
+			after := PropertyMap{"Val": MkProperty(1)}
+			So(DiffPropertyMaps(nil, nil), ShouldBeEmpty)
+			So(len(DiffPropertyMaps(nil, after)), ShouldEqual, 1)
+			So(len(DiffPropertyMaps(after, nil)), ShouldEqual, 1)
+		})
+	})
+
+	Convey("FormatPropertySlice", t, func() {
+		So(FormatPropertySlice(nil), ShouldEqual, "(absent)")
+		So(FormatPropertySlice(PropertySlice{MkProperty(10)}), ShouldEqual, "10")
+		So(FormatPropertySlice(PropertySlice{MkProperty("a"), MkPropertyNI(true)}),
+			ShouldEqual, `["a", true (noindex)]`)
+		So(FormatPropertySlice(PropertySlice{MkProperty(PropertyMap{
+			"B": MkProperty(2),
+			"A": MkProperty(1),
+		})}), ShouldEqual, "{A: 1, B: 2}")
+	})
+}
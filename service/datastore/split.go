@@ -0,0 +1,166 @@
+// Copyright 2018 The LUCI Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package datastore
+
+import (
+	"fmt"
+	"sort"
+
+	"golang.org/x/net/context"
+)
+
+// splitOversampling is the number of __scatter__ samples SplitQuery fetches
+// for every requested shard. More samples yield more evenly sized shards at the
+// cost of a bigger sampling query.
+//
+// This is the same factor used by the MapReduce library's key range splitter.
+const splitOversampling = 32
+
+// SplitQuery splits q into at most n queries which, taken together, return
+// exactly the same entities as q. Each returned query covers a contiguous
+// range of the key space, so the returned queries may be run in parallel (e.g.
+// one per shard of a mapper).
+//
+// The split points are chosen by sampling keys of q's kind ordered by the
+// special __scatter__ property, which the datastore maintains on a small
+// random subset of entities. If there are too few samples (e.g. the kind is
+// small), fewer than n queries are returned. A single-element slice containing
+// q is returned if q can't be usefully split.
+//
+// q must have a kind, and may only have an inequality filter on __key__ and
+// an ascending __key__ sort order. Projection queries, queries with
+// limits, offsets or cursors are not supported, since their results can't
+// be partitioned by key range.
+func SplitQuery(c context.Context, q *Query, n int) ([]*Query, error) {
+	fq, err := q.Finalize()
+	if err != nil {
+		return nil, err
+	}
+	if err := checkSplittable(fq); err != nil {
+		return nil, err
+	}
+	if n <= 1 {
+		return []*Query{q}, nil
+	}
+
+	// The sampling query only filters on kind: any additional filter would
+	// require a composite index with __scatter__ in it. Samples outside of q's
+	// key range are dropped below.
+	sq := NewQuery(fq.Kind()).Order("__scatter__").Limit(int32(n * splitOversampling))
+	var samples []*Key
+	if err := GetAll(c, sq, &samples); err != nil {
+		return nil, err
+	}
+
+	splits := splitPoints(fq, samples, n)
+	if len(splits) == 0 {
+		return []*Query{q}, nil
+	}
+
+	ret := make([]*Query, 0, len(splits)+1)
+	for i := 0; i <= len(splits); i++ {
+		sub := q
+		if i > 0 {
+			sub = sub.Gte("__key__", splits[i-1])
+		}
+		if i < len(splits) {
+			sub = sub.Lt("__key__", splits[i])
+		}
+		ret = append(ret, sub)
+	}
+	return ret, nil
+}
+
+// checkSplittable returns an error if fq can't be split by key range.
+func checkSplittable(fq *FinalizedQuery) error {
+	switch {
+	case fq.Kind() == "":
+		return fmt.Errorf("cannot split kindless query")
+	case fq.IneqFilterProp() != "" && fq.IneqFilterProp() != "__key__":
+		return fmt.Errorf("cannot split query with inequality filter on %q", fq.IneqFilterProp())
+	case len(fq.Project()) > 0:
+		return fmt.Errorf("cannot split projection query")
+	}
+	if _, ok := fq.Limit(); ok {
+		return fmt.Errorf("cannot split query with a limit")
+	}
+	if _, ok := fq.Offset(); ok {
+		return fmt.Errorf("cannot split query with an offset")
+	}
+	if start, end := fq.Bounds(); start != nil || end != nil {
+		return fmt.Errorf("cannot split query with cursors")
+	}
+	for _, o := range fq.Orders() {
+		if o.Property != "__key__" || o.Descending {
+			return fmt.Errorf("cannot split query with sort order %s", o)
+		}
+	}
+	return nil
+}
+
+// splitPoints picks up to n-1 evenly spaced keys from samples which lie
+// strictly inside of fq's key range. The returned keys are sorted and unique.
+func splitPoints(fq *FinalizedQuery, samples []*Key, n int) []*Key {
+	anc := fq.Ancestor()
+	_, lowOp, low := fq.IneqFilterLow()
+	_, highOp, high := fq.IneqFilterHigh()
+
+	inRange := func(k *Key) bool {
+		if anc != nil && !k.HasAncestor(anc) {
+			return false
+		}
+		// A split point equal to the lower bound would produce an empty first
+		// query, and one equal to the upper bound an empty last query.
+		if lowOp != "" && !low.Value().(*Key).Less(k) {
+			return false
+		}
+		if highOp != "" && !k.Less(high.Value().(*Key)) {
+			return false
+		}
+		return true
+	}
+
+	keys := make([]*Key, 0, len(samples))
+	for _, k := range samples {
+		if inRange(k) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].Less(keys[j]) })
+
+	// Deduplicate; samples can't really repeat, but be defensive.
+	uniq := keys[:0]
+	for _, k := range keys {
+		if len(uniq) == 0 || !uniq[len(uniq)-1].Equal(k) {
+			uniq = append(uniq, k)
+		}
+	}
+	keys = uniq
+
+	if len(keys) < n {
+		return keys
+	}
+
+	// Pick n-1 split points, spaced as evenly as possible over the samples.
+	ret := make([]*Key, 0, n-1)
+	stride := float64(len(keys)) / float64(n)
+	for i := 1; i < n; i++ {
+		k := keys[int(stride*float64(i))]
+		if len(ret) == 0 || !ret[len(ret)-1].Equal(k) {
+			ret = append(ret, k)
+		}
+	}
+	return ret
+}
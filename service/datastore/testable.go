@@ -14,18 +14,169 @@
 
 package datastore
 
+import (
+	"fmt"
+	"io"
+	"time"
+)
+
 // TestingSnapshot is an opaque implementation-defined snapshot type.
 type TestingSnapshot interface {
 	ImATestingSnapshot()
 }
 
+// IDAllocationPolicy controls how a testing datastore implementation picks IDs
+// for incomplete keys.
+//
+// Use one of SequentialIDs, ScatteredIDs or SeededIDs.
+type IDAllocationPolicy struct {
+	scattered bool
+	seeded    bool
+	seed      int64
+}
+
+var (
+	// SequentialIDs allocates consecutive IDs, starting at 1, separately for
+	// each entity group (or each kind, for root entities). This is the default.
+	SequentialIDs = IDAllocationPolicy{}
+
+	// ScatteredIDs allocates IDs at random from the whole 53-bit ID space, like
+	// the production datastore does for incomplete keys. The random sequence
+	// differs on every run; use SeededIDs to make it reproducible.
+	ScatteredIDs = IDAllocationPolicy{scattered: true}
+)
+
+// SeededIDs is like ScatteredIDs, except that the random sequence is seeded
+// with seed, so the same sequence of allocations yields the same IDs.
+func SeededIDs(seed int64) IDAllocationPolicy {
+	return IDAllocationPolicy{scattered: true, seeded: true, seed: seed}
+}
+
+// Scattered returns true iff IDs are allocated at random.
+func (p IDAllocationPolicy) Scattered() bool { return p.scattered }
+
+// Seed returns the seed of the random sequence of IDs, if the policy is
+// SeededIDs.
+func (p IDAllocationPolicy) Seed() (seed int64, ok bool) { return p.seed, p.seeded }
+
+// ConsistencyPolicy controls how a testing datastore implementation models
+// eventual consistency of non-ancestor queries.
+//
+// Use one of StrongConsistency, ManualConsistency or RandomConsistency.
+type ConsistencyPolicy struct {
+	strong      bool
+	random      bool
+	probability float64
+	seed        int64
+}
+
+var (
+	// StrongConsistency makes all queries always consistent. It is the same as
+	// Consistent(true).
+	StrongConsistency = ConsistencyPolicy{strong: true}
+
+	// ManualConsistency makes the indexes stale until they are caught up
+	// explicitly, with CatchupIndexes or SetIndexSnapshot. It is the same as
+	// Consistent(false), and is the default.
+	ManualConsistency = ConsistencyPolicy{}
+)
+
+// RandomConsistency models the eventual consistency of the High Replication
+// Datastore, like dev_appserver does: each write to an entity group becomes
+// visible to non-ancestor queries at random, with the given probability
+// (in [0, 1]) before each such query. Writes to the same entity group become
+// visible together.
+//
+// The random sequence is seeded with seed, so the same sequence of datastore
+// operations yields the same query results.
+func RandomConsistency(probability float64, seed int64) ConsistencyPolicy {
+	if probability < 0 || probability > 1 {
+		panic(fmt.Errorf("RandomConsistency: probability %v is not in [0, 1]", probability))
+	}
+	return ConsistencyPolicy{random: true, probability: probability, seed: seed}
+}
+
+// Strong returns true iff queries are always consistent.
+func (p ConsistencyPolicy) Strong() bool { return p.strong }
+
+// Random returns the parameters of the policy, if it is RandomConsistency.
+func (p ConsistencyPolicy) Random() (probability float64, seed int64, ok bool) {
+	return p.probability, p.seed, p.random
+}
+
+// ContentionPolicy describes how a testing datastore implementation simulates
+// the limited write rate of entity groups. See SetContentionPolicy.
+type ContentionPolicy struct {
+	// Window is the time span, measured with the context's clock, within which
+	// writes to the same entity group contend.
+	Window time.Duration
+
+	// MaxWrites is the number of writes to an entity group allowed within any
+	// Window. If <= 0, 1 is used.
+	MaxWrites int
+}
+
+// IndexState is the state of a compound index, as reported by
+// Testable.IndexStates.
+type IndexState string
+
+const (
+	// IndexBuilding means that the index was added, but it's still being built.
+	// Queries which need it fail.
+	IndexBuilding IndexState = "BUILDING"
+	// IndexServing means that the index is built and used by queries.
+	IndexServing IndexState = "SERVING"
+	// IndexError means that the index couldn't be built, e.g. because some
+	// entity would have too many index entries with it. Queries which need it
+	// fail, until it is deleted and added again.
+	IndexError IndexState = "ERROR"
+	// IndexDeleting means that the index is being deleted. Queries which need
+	// it fail.
+	IndexDeleting IndexState = "DELETING"
+)
+
+// IndexStatus describes a compound index and its state.
+type IndexStatus struct {
+	Index *IndexDefinition
+	State IndexState
+
+	// Progress is the fraction, in [0, 1], of the entities of the index's kind
+	// which were indexed so far. It is 1 for serving indexes.
+	Progress float64
+}
+
 // Testable is the testable interface for fake datastore implementations.
 type Testable interface {
 	// AddIndex adds the provided index.
-	// Blocks all datastore access while the index is built.
+	// Blocks all datastore access while the index is built, unless
+	// AsyncIndexBuilds is enabled.
 	// Panics if any of the IndexDefinition objects are not Compound()
 	AddIndexes(...*IndexDefinition)
 
+	// DeleteIndexes deletes the provided indexes. Deleting an index which
+	// doesn't exist does nothing.
+	// Panics if any of the IndexDefinition objects are not Compound()
+	DeleteIndexes(...*IndexDefinition)
+
+	// AsyncIndexBuilds controls whether AddIndexes and DeleteIndexes take
+	// effect right away (the default), or leave the indexes in the IndexBuilding
+	// (or IndexDeleting) state until StepIndexBuilds completes them, like the
+	// production datastore does in the background.
+	//
+	// Queries which need an index which isn't serving fail, so this can be used
+	// to test that code is deployed only once the indexes it needs are built.
+	AsyncIndexBuilds(bool)
+
+	// StepIndexBuilds makes progress on the pending index builds and deletions:
+	// each building index indexes up to n more entities of its kind, and becomes
+	// serving (or fails to build) once all of them are indexed. Deletions
+	// complete right away. If n <= 0, all of the pending operations complete.
+	StepIndexBuilds(n int)
+
+	// IndexStates returns the compound indexes and their states: the serving
+	// indexes first, then the others in the order they were added or deleted.
+	IndexStates() []IndexStatus
+
 	// TakeIndexSnapshot allows you to take a snapshot of the current index
 	// tables, which can be used later with SetIndexSnapshot.
 	TakeIndexSnapshot() TestingSnapshot
@@ -38,6 +189,22 @@ type Testable interface {
 	// still responsible for closing the snapshot after this call.
 	SetIndexSnapshot(TestingSnapshot)
 
+	// Snapshot takes a snapshot of the entire state of the datastore: entities,
+	// entity group versions, ID allocation state, compound index definitions and
+	// index tables. It can be used later with Restore.
+	//
+	// Unlike TakeIndexSnapshot, this is meant to reset the datastore to a known
+	// state, e.g. between the cases of a table-driven test. The implementation
+	// may make it cheap (e.g. by using copy-on-write data structures).
+	Snapshot() TestingSnapshot
+
+	// Restore resets the entire state of the datastore to the given snapshot,
+	// which must have been taken with Snapshot on the same datastore.
+	//
+	// A snapshot may be restored any number of times; changes made after a
+	// Restore don't affect the snapshot.
+	Restore(TestingSnapshot)
+
 	// CatchupIndexes catches the index table up to the current state of the
 	// datastore. This is equivalent to:
 	//   idxSnap := TakeIndexSnapshot()
@@ -60,6 +227,15 @@ type Testable interface {
 	// CatchupIndexes or use Take/SetIndexSnapshot to manipulate the index state.
 	Consistent(always bool)
 
+	// SetConsistencyPolicy selects the eventual consistency model of the
+	// testing implementation. It generalizes Consistent.
+	//
+	// With RandomConsistency, writes become visible to queries on their own,
+	// without calls to CatchupIndexes, so code can be fuzzed for its tolerance
+	// of eventual consistency. CatchupIndexes still makes all writes visible at
+	// once.
+	SetConsistencyPolicy(ConsistencyPolicy)
+
 	// AutoIndex controls the index creation behavior. If it is set to true, then
 	// any time the datastore encounters a missing index, it will silently create
 	// one and allow the query to succeed. If it's false, then the query will
@@ -92,9 +268,83 @@ type Testable interface {
 	// rely on queries over special properties.
 	ShowSpecialProperties(bool)
 
+	// SetIDAllocationPolicy sets how IDs are picked for incomplete keys, both by
+	// AllocateIDs and by Put. By default IDs are sequential.
+	//
+	// Code that (perhaps unknowingly) relies on the order of automatically
+	// allocated IDs works with sequential IDs, but not in production. Use
+	// ScatteredIDs or SeededIDs to catch it.
+	//
+	// Setting a policy restarts its random sequence, so e.g. setting
+	// SeededIDs(1) twice yields the same IDs twice.
+	SetIDAllocationPolicy(IDAllocationPolicy)
+
+	// SetReadTimeRetention sets for how long the history of the datastore is
+	// kept, for reads at a past time (see WithReadTime and
+	// TransactionOptions.ReadTime). Reads at times older than that, as measured
+	// with the context's clock, fail.
+	//
+	// By default it's zero, which disables the history, since keeping it costs
+	// memory for every write. Cloud Datastore keeps it for one hour.
+	SetReadTimeRetention(time.Duration)
+
+	// SetContentionPolicy enables the simulation of entity group contention:
+	// once an entity group has been written to MaxWrites times within the
+	// policy's Window, further writes to it fail, until the context's clock
+	// moves on. Committing a transaction fails with ErrConcurrentTransaction
+	// (and so is retried by RunInTransaction), and other writes fail with the
+	// timeout error of the production datastore (see info.IsTimeoutError).
+	//
+	// Production sustains about one write per second per entity group, which is
+	// modeled by &ContentionPolicy{Window: time.Second}. A batch of writes counts
+	// as one write to each entity group involved.
+	//
+	// If p is nil (the default), contention isn't simulated.
+	SetContentionPolicy(p *ContentionPolicy)
+
+	// StrictLimits enables enforcement of the production datastore limits, so
+	// that puts which production would reject fail, with errors satisfying
+	// IsErrBadRequest unless noted otherwise:
+	//   - entities over 1 MiB;
+	//   - indexed string or []byte values over 1500 bytes;
+	//   - entities with over 20000 index entries;
+	//   - keys over 6 KiB or with over 100 path elements, which fail with an
+	//     invalid key error (see IsErrInvalidKey);
+	//   - reserved property names, like __foo__.
+	//
+	// By default this is false, and entities of any size are accepted.
+	StrictLimits(bool)
+
 	// SetConstraints sets this instance's constraints. If the supplied
 	// constraints are invalid, an error will be returned.
 	//
 	// If c is nil, default constraints will be set.
 	SetConstraints(c *Constraints) error
+
+	// RefreshStats recomputes the datastore statistics entities (__Stat_Total__,
+	// __Stat_Kind__, __Stat_Namespace__ and the per-namespace __Stat_Ns_*__
+	// kinds) from the current contents of the datastore.
+	//
+	// In production these statistics are computed periodically in the
+	// background, and so they lag behind the actual data. The testing
+	// implementation mirrors this: the statistics entities are only updated when
+	// RefreshStats is called. Their timestamp is taken from the context's clock.
+	RefreshStats()
+
+	// Export writes the entire contents of the datastore to w: the entities of
+	// all namespaces, the entity group versions, the ID allocation state and the
+	// compound index definitions. The format is implementation-defined, but
+	// versioned, so that it may be loaded later with Import.
+	//
+	// Export is consistent: it reflects the state of the datastore at a single
+	// point in time.
+	Export(w io.Writer) error
+
+	// Import replaces the entire contents of the datastore with the data read
+	// from r, which must have been written by Export. The indexes are rebuilt
+	// from the loaded entities.
+	//
+	// If the data can't be loaded, an error is returned and the datastore is
+	// left unchanged.
+	Import(r io.Reader) error
 }
@@ -16,6 +16,10 @@
 
 package datastore
 
+import (
+	"time"
+)
+
 // GeoPoint represents a location as latitude/longitude in degrees.
 //
 // You probably shouldn't use these, but their inclusion here is so that the
@@ -37,8 +41,15 @@ type TransactionOptions struct {
 	// due to a conflicting transaction. If omitted, it defaults to 3.
 	Attempts int
 	// ReadOnly controls whether the transaction is a read only transaction.
-	// Read only transactions are potentially more efficient.
+	// Read only transactions are potentially more efficient. Mutations (and
+	// transactional task additions) within them fail.
 	ReadOnly bool
+	// ReadTime, if not zero, makes the transaction read a snapshot of the
+	// datastore as it was at that time. It requires ReadOnly.
+	//
+	// Implementations only keep the history of the datastore for a limited
+	// time; reads at times older than that fail.
+	ReadTime time.Time
 }
 
 // Toggle is a tri-state boolean (Auto/True/False), which allows structs
@@ -167,10 +167,9 @@ func CompareAndSwap(c context.Context, items ...Item) error {
 //
 // Underflow caps at 0, overflow wraps back to 0.
 //
-// The value is stored as little-endian uint64, see
-// "encoding/binary".LittleEndian. If the value is not exactly 8 bytes,
-// it's assumed to contain non-number data and this method will return an
-// error.
+// The value is stored as a decimal number, like in the Memcache service and in
+// memcached, and keeps its flags and expiration time. If the value is not
+// a decimal number, this method will return an error.
 func Increment(c context.Context, key string, delta int64, initialValue uint64) (uint64, error) {
 	return Raw(c).Increment(key, delta, &initialValue)
 }
@@ -0,0 +1,321 @@
+// Copyright 2018 The LUCI Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package mctest contains helpers for testing memcache implementations.
+//
+// RunConformance is a conformance suite for memcache implementations and
+// filters: it tests that every method of RawInterface behaves like in the
+// Memcache service, including the errors and the edge cases, except for the
+// declared Capabilities of the implementation.
+package mctest
+
+import (
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"go.chromium.org/gae/service/info"
+	mc "go.chromium.org/gae/service/memcache"
+
+	"go.chromium.org/luci/common/errors"
+
+	"golang.org/x/net/context"
+)
+
+// Implementation is a memcache implementation, i.e. a RawInterface with any
+// filters on top of it, to be tested with RunConformance.
+type Implementation struct {
+	// New returns a context with a new, empty memcache installed.
+	New func() context.Context
+
+	// Advance, if not nil, advances the clock of the memcache of c by d. The
+	// tests of expiration times are skipped if it's nil.
+	Advance func(c context.Context, d time.Duration)
+
+	// Capabilities are the known differences of the implementation.
+	Capabilities Capabilities
+}
+
+// Capabilities describe the known, accepted differences between memcache
+// implementations. The tests which can't pass because of them are skipped.
+//
+// The zero value describes the Memcache service.
+type Capabilities struct {
+	// NoStats is true if Stats always returns ErrNoStats, like memcached
+	// clients.
+	NoStats bool
+}
+
+// RunConformance tests that the memcache implementation behaves like the
+// Memcache service, running each behavior as a subtest of t with a new
+// memcache.
+func RunConformance(t *testing.T, impl Implementation) {
+	for _, cc := range conformanceCases {
+		cc := cc
+		t.Run(cc.name, func(t *testing.T) {
+			cc.test(t, impl.New(), impl)
+		})
+	}
+}
+
+// conformanceCase is a behavior tested by RunConformance.
+type conformanceCase struct {
+	name string
+	test func(t *testing.T, c context.Context, impl Implementation)
+}
+
+var conformanceCases = []conformanceCase{
+	{"SetGet", func(t *testing.T, c context.Context, _ Implementation) {
+		mustNil(t, mc.Set(c, mc.NewItem(c, "k").SetValue([]byte("v")).SetFlags(42).SetExpiration(time.Hour)))
+		itm := getItem(t, c, "k")
+		expectEqual(t, "key", itm.Key(), "k")
+		expectEqual(t, "value", string(itm.Value()), "v")
+		expectEqual(t, "flags", itm.Flags(), uint32(42))
+		// The expiration time is not retrieved.
+		expectEqual(t, "expiration", itm.Expiration(), time.Duration(0))
+
+		mustNil(t, mc.Set(c, mc.NewItem(c, "k").SetValue([]byte("w"))))
+		expectEqual(t, "value", string(getItem(t, c, "k").Value()), "w")
+	}},
+
+	{"SetGet/EmptyValue", func(t *testing.T, c context.Context, _ Implementation) {
+		mustNil(t, mc.Set(c, mc.NewItem(c, "k")))
+		expectEqual(t, "value length", len(getItem(t, c, "k").Value()), 0)
+	}},
+
+	{"SetGet/LongKey", func(t *testing.T, c context.Context, _ Implementation) {
+		long := strings.Repeat("k", 300)
+		mustNil(t, mc.Set(c, mc.NewItem(c, long).SetValue([]byte("v"))))
+		itm := getItem(t, c, long)
+		expectEqual(t, "key", itm.Key(), long)
+		expectEqual(t, "value", string(itm.Value()), "v")
+	}},
+
+	{"Get/Miss", func(t *testing.T, c context.Context, _ Implementation) {
+		_, err := mc.GetKey(c, "missing")
+		expectEqual(t, "error", err, mc.ErrCacheMiss)
+	}},
+
+	{"Get/Multi", func(t *testing.T, c context.Context, _ Implementation) {
+		mustNil(t, mc.Set(c, mc.NewItem(c, "a").SetValue([]byte("A"))))
+		items := []mc.Item{mc.NewItem(c, "a"), mc.NewItem(c, "missing")}
+		expectEqual(t, "error", mc.Get(c, items...), errors.MultiError{nil, mc.ErrCacheMiss})
+		expectEqual(t, "value", string(items[0].Value()), "A")
+	}},
+
+	{"Add", func(t *testing.T, c context.Context, _ Implementation) {
+		mustNil(t, mc.Add(c, mc.NewItem(c, "a").SetValue([]byte("1"))))
+		err := mc.Add(c, mc.NewItem(c, "a").SetValue([]byte("2")), mc.NewItem(c, "b").SetValue([]byte("3")))
+		expectEqual(t, "error", err, errors.MultiError{mc.ErrNotStored, nil})
+		expectEqual(t, "value", string(getItem(t, c, "a").Value()), "1")
+		expectEqual(t, "value", string(getItem(t, c, "b").Value()), "3")
+	}},
+
+	{"Delete", func(t *testing.T, c context.Context, _ Implementation) {
+		mustNil(t, mc.Set(c, mc.NewItem(c, "a").SetValue([]byte("A"))))
+		expectEqual(t, "error", mc.Delete(c, "a", "missing"), errors.MultiError{nil, mc.ErrCacheMiss})
+		_, err := mc.GetKey(c, "a")
+		expectEqual(t, "error", err, mc.ErrCacheMiss)
+	}},
+
+	{"CompareAndSwap", func(t *testing.T, c context.Context, _ Implementation) {
+		mustNil(t, mc.Set(c, mc.NewItem(c, "k").SetValue([]byte("1"))))
+		itm := getItem(t, c, "k")
+		mustNil(t, mc.CompareAndSwap(c, itm.SetValue([]byte("2"))))
+		expectEqual(t, "value", string(getItem(t, c, "k").Value()), "2")
+		// The item was changed by the CompareAndSwap itself.
+		expectEqual(t, "error", mc.CompareAndSwap(c, itm.SetValue([]byte("3"))), mc.ErrCASConflict)
+	}},
+
+	{"CompareAndSwap/Conflict", func(t *testing.T, c context.Context, _ Implementation) {
+		mustNil(t, mc.Set(c, mc.NewItem(c, "k").SetValue([]byte("1"))))
+		itm := getItem(t, c, "k")
+		mustNil(t, mc.Set(c, mc.NewItem(c, "k").SetValue([]byte("other"))))
+		expectEqual(t, "error", mc.CompareAndSwap(c, itm.SetValue([]byte("2"))), mc.ErrCASConflict)
+		expectEqual(t, "value", string(getItem(t, c, "k").Value()), "other")
+	}},
+
+	{"CompareAndSwap/Deleted", func(t *testing.T, c context.Context, _ Implementation) {
+		mustNil(t, mc.Set(c, mc.NewItem(c, "k").SetValue([]byte("1"))))
+		itm := getItem(t, c, "k")
+		mustNil(t, mc.Delete(c, "k"))
+		expectEqual(t, "error", mc.CompareAndSwap(c, itm.SetValue([]byte("2"))), mc.ErrNotStored)
+	}},
+
+	{"Increment", func(t *testing.T, c context.Context, _ Implementation) {
+		// A missing value is initialized before the delta is applied.
+		expectIncrement(t, c, "n", 7, 2, 9)
+		expectIncrement(t, c, "n", 7, 2, 16)
+		// The values are decimal.
+		expectEqual(t, "value", string(getItem(t, c, "n").Value()), "16")
+		mustNil(t, mc.Set(c, mc.NewItem(c, "n").SetValue([]byte("41"))))
+		expectIncrement(t, c, "n", 1, 0, 42)
+	}},
+
+	{"Increment/Negative", func(t *testing.T, c context.Context, _ Implementation) {
+		// Underflow is capped at 0, including when initializing.
+		expectIncrement(t, c, "n", -5, 3, 0)
+		expectIncrement(t, c, "n", 10, 0, 10)
+		expectIncrement(t, c, "n", -4, 0, 6)
+		expectIncrement(t, c, "n", -100, 0, 0)
+	}},
+
+	{"Increment/Overflow", func(t *testing.T, c context.Context, _ Implementation) {
+		// Overflow wraps around, including when initializing.
+		expectIncrement(t, c, "n", 10, math.MaxUint64, 9)
+		expectIncrement(t, c, "n", math.MaxInt64, 0, math.MaxInt64+9)
+		expectIncrement(t, c, "n", math.MaxInt64, 0, 7)
+	}},
+
+	{"Increment/Zero", func(t *testing.T, c context.Context, _ Implementation) {
+		expectIncrement(t, c, "n", 0, 1337, 1337)
+		nv, err := mc.IncrementExisting(c, "n", 0)
+		mustNil(t, err)
+		expectEqual(t, "value", nv, uint64(1337))
+	}},
+
+	{"Increment/KeepsFlags", func(t *testing.T, c context.Context, _ Implementation) {
+		mustNil(t, mc.Set(c, mc.NewItem(c, "n").SetValue([]byte("1")).SetFlags(5)))
+		expectIncrement(t, c, "n", 1, 0, 2)
+		expectEqual(t, "flags", getItem(t, c, "n").Flags(), uint32(5))
+	}},
+
+	{"IncrementExisting", func(t *testing.T, c context.Context, _ Implementation) {
+		_, err := mc.IncrementExisting(c, "n", 1)
+		expectEqual(t, "error", err, mc.ErrCacheMiss)
+
+		mustNil(t, mc.Set(c, mc.NewItem(c, "n").SetValue([]byte("10"))))
+		nv, err := mc.IncrementExisting(c, "n", -3)
+		mustNil(t, err)
+		expectEqual(t, "value", nv, uint64(7))
+	}},
+
+	{"Increment/NotANumber", func(t *testing.T, c context.Context, _ Implementation) {
+		mustNil(t, mc.Set(c, mc.NewItem(c, "n").SetValue([]byte("hello"))))
+		if _, err := mc.IncrementExisting(c, "n", 1); err == nil {
+			t.Error("incrementing a value which is not a number succeeded")
+		}
+		if _, err := mc.Increment(c, "n", 1, 0); err == nil {
+			t.Error("incrementing a value which is not a number succeeded")
+		}
+	}},
+
+	{"Flush", func(t *testing.T, c context.Context, _ Implementation) {
+		mustNil(t, mc.Set(c, mc.NewItem(c, "a").SetValue([]byte("A")), mc.NewItem(c, "b").SetValue([]byte("B"))))
+		mustNil(t, mc.Flush(c))
+		expectEqual(t, "error", mc.Get(c, mc.NewItem(c, "a"), mc.NewItem(c, "b")),
+			errors.MultiError{mc.ErrCacheMiss, mc.ErrCacheMiss})
+	}},
+
+	{"Namespaces", func(t *testing.T, c context.Context, _ Implementation) {
+		oc := info.MustNamespace(c, "other")
+		mustNil(t, mc.Set(c, mc.NewItem(c, "k").SetValue([]byte("default"))))
+		_, err := mc.GetKey(oc, "k")
+		expectEqual(t, "error", err, mc.ErrCacheMiss)
+
+		mustNil(t, mc.Set(oc, mc.NewItem(oc, "k").SetValue([]byte("other"))))
+		expectEqual(t, "value", string(getItem(t, c, "k").Value()), "default")
+		expectEqual(t, "value", string(getItem(t, oc, "k").Value()), "other")
+
+		expectIncrement(t, oc, "n", 1, 0, 1)
+		_, err = mc.IncrementExisting(c, "n", 1)
+		expectEqual(t, "error", err, mc.ErrCacheMiss)
+	}},
+
+	{"Stats", func(t *testing.T, c context.Context, impl Implementation) {
+		if impl.Capabilities.NoStats {
+			_, err := mc.Stats(c)
+			expectEqual(t, "error", err, mc.ErrNoStats)
+			return
+		}
+		mustNil(t, mc.Set(c, mc.NewItem(c, "a").SetValue([]byte("12")), mc.NewItem(c, "b").SetValue([]byte("3"))))
+		getItem(t, c, "a")
+		mc.GetKey(c, "missing")
+		stats, err := mc.Stats(c)
+		mustNil(t, err)
+		expectEqual(t, "items", stats.Items, uint64(2))
+		expectEqual(t, "bytes", stats.Bytes, uint64(3))
+		expectEqual(t, "hits", stats.Hits, uint64(1))
+		expectEqual(t, "byte hits", stats.ByteHits, uint64(2))
+		expectEqual(t, "misses", stats.Misses, uint64(1))
+	}},
+
+	{"Expiration", func(t *testing.T, c context.Context, impl Implementation) {
+		if impl.Advance == nil {
+			t.Skip("the clock can't be advanced")
+		}
+		mustNil(t, mc.Set(c,
+			mc.NewItem(c, "short").SetValue([]byte("1")).SetExpiration(10*time.Second),
+			mc.NewItem(c, "long").SetValue([]byte("2")).SetExpiration(time.Hour),
+			mc.NewItem(c, "never").SetValue([]byte("3"))))
+		impl.Advance(c, 5*time.Second)
+		getItem(t, c, "short")
+
+		impl.Advance(c, 10*time.Second)
+		_, err := mc.GetKey(c, "short")
+		expectEqual(t, "error", err, mc.ErrCacheMiss)
+		getItem(t, c, "long")
+		getItem(t, c, "never")
+
+		// An expired item can be added again.
+		mustNil(t, mc.Add(c, mc.NewItem(c, "short").SetValue([]byte("4"))))
+	}},
+
+	{"Expiration/Increment", func(t *testing.T, c context.Context, impl Implementation) {
+		if impl.Advance == nil {
+			t.Skip("the clock can't be advanced")
+		}
+		mustNil(t, mc.Set(c, mc.NewItem(c, "n").SetValue([]byte("1")).SetExpiration(10*time.Second)))
+		impl.Advance(c, 5*time.Second)
+		// Incrementing keeps the expiration time.
+		expectIncrement(t, c, "n", 1, 0, 2)
+		impl.Advance(c, 10*time.Second)
+		_, err := mc.IncrementExisting(c, "n", 1)
+		expectEqual(t, "error", err, mc.ErrCacheMiss)
+	}},
+}
+
+// mustNil fails the test if err is not nil.
+func mustNil(t *testing.T, err error) {
+	t.Helper()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+}
+
+// expectEqual fails the test if got is not deeply equal to want.
+func expectEqual(t *testing.T, what string, got, want interface{}) {
+	t.Helper()
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("%s: got %v, want %v", what, got, want)
+	}
+}
+
+// getItem returns the item with the key, which must exist.
+func getItem(t *testing.T, c context.Context, key string) mc.Item {
+	t.Helper()
+	itm, err := mc.GetKey(c, key)
+	mustNil(t, err)
+	return itm
+}
+
+// expectIncrement increments the key with Increment and checks the new value.
+func expectIncrement(t *testing.T, c context.Context, key string, delta int64, initialValue, want uint64) {
+	t.Helper()
+	nv, err := mc.Increment(c, key, delta, initialValue)
+	mustNil(t, err)
+	expectEqual(t, "new value", nv, want)
+}
@@ -0,0 +1,414 @@
+// Copyright 2018 The LUCI Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package tqtest contains helpers for testing task queue implementations.
+//
+// RunConformance is a conformance suite for task queue implementations and
+// filters: it tests that every method of RawInterface behaves like in the Task
+// Queue service, including task naming, tombstones, leases and the errors,
+// except for the declared Capabilities of the implementation.
+package tqtest
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	ds "go.chromium.org/gae/service/datastore"
+	"go.chromium.org/gae/service/info"
+	tq "go.chromium.org/gae/service/taskqueue"
+
+	"go.chromium.org/luci/common/clock"
+	"go.chromium.org/luci/common/errors"
+
+	"golang.org/x/net/context"
+)
+
+// PullQueue is the name of the pull queue which the task queues tested by
+// RunConformance must have.
+const PullQueue = "pull"
+
+// Implementation is a task queue implementation, i.e. a RawInterface with any
+// filters on top of it, to be tested with RunConformance.
+type Implementation struct {
+	// New returns a context with a new, empty task queue service installed,
+	// with the push queue "default" and the pull queue PullQueue.
+	New func() context.Context
+
+	// Advance, if not nil, advances the clock of the task queue service of c by
+	// d. The tests of lease expiration are skipped if it's nil.
+	Advance func(c context.Context, d time.Duration)
+
+	// Capabilities are the known differences of the implementation.
+	Capabilities Capabilities
+}
+
+// Capabilities describe the known, accepted differences between task queue
+// implementations. The tests which can't pass because of them are skipped.
+//
+// The zero value describes the Task Queue service.
+type Capabilities struct {
+	// NoTransactions is true if tasks can't be added in datastore transactions
+	// (see datastore.RunInTransaction).
+	NoTransactions bool
+}
+
+// RunConformance tests that the task queue implementation behaves like the
+// Task Queue service, running each behavior as a subtest of t with a new task
+// queue service.
+func RunConformance(t *testing.T, impl Implementation) {
+	for _, cc := range conformanceCases {
+		cc := cc
+		t.Run(cc.name, func(t *testing.T) {
+			cc.test(t, impl.New(), impl)
+		})
+	}
+}
+
+// conformanceCase is a behavior tested by RunConformance.
+type conformanceCase struct {
+	name string
+	test func(t *testing.T, c context.Context, impl Implementation)
+}
+
+var conformanceCases = []conformanceCase{
+	// Adding tasks.
+
+	{"Add/Defaults", func(t *testing.T, c context.Context, _ Implementation) {
+		now := clock.Now(c)
+		t1 := &tq.Task{Path: "/work", Payload: []byte("p")}
+		t2 := &tq.Task{}
+		mustNil(t, tq.Add(c, "default", t1, t2))
+		if t1.Name == "" || t2.Name == "" || t1.Name == t2.Name {
+			t.Errorf("got names %q and %q, want distinct generated names", t1.Name, t2.Name)
+		}
+		expectEqual(t, "method", t1.Method, "POST")
+		expectEqual(t, "path", t1.Path, "/work")
+		expectEqual(t, "payload", string(t1.Payload), "p")
+		// Tasks without a path are served by a path of the queue.
+		expectEqual(t, "path", t2.Path, "/_ah/queue/default")
+		if t1.ETA.Before(now) || t1.ETA.After(now.Add(time.Minute)) {
+			t.Errorf("got ETA %s, want about %s", t1.ETA, now)
+		}
+		expectTasks(t, c, "default", 2)
+	}},
+
+	{"Add/DefaultQueue", func(t *testing.T, c context.Context, _ Implementation) {
+		mustNil(t, tq.Add(c, "", &tq.Task{Path: "/work"}))
+		expectTasks(t, c, "default", 1)
+	}},
+
+	{"Add/ETA", func(t *testing.T, c context.Context, _ Implementation) {
+		now := clock.Now(c)
+		delayed := &tq.Task{Path: "/work", Delay: time.Hour}
+		eta := now.Add(2 * time.Hour).Truncate(time.Second)
+		scheduled := &tq.Task{Path: "/work", ETA: eta}
+		mustNil(t, tq.Add(c, "default", delayed, scheduled))
+
+		if want := now.Add(time.Hour); delayed.ETA.Before(want) || delayed.ETA.After(want.Add(time.Minute)) {
+			t.Errorf("got ETA %s, want about %s", delayed.ETA, want)
+		}
+		expectEqual(t, "delay", delayed.Delay, time.Duration(0))
+		if !scheduled.ETA.Equal(eta) {
+			t.Errorf("got ETA %s, want %s", scheduled.ETA, eta)
+		}
+	}},
+
+	{"Add/Named", func(t *testing.T, c context.Context, _ Implementation) {
+		mustNil(t, tq.Add(c, "default", &tq.Task{Name: "a", Path: "/work"}))
+		expectEqual(t, "error", tq.Add(c, "default", &tq.Task{Name: "a", Path: "/work"}), tq.ErrTaskAlreadyAdded)
+		// Task names are per queue.
+		mustNil(t, tq.Add(c, PullQueue, &tq.Task{Name: "a", Method: "PULL"}))
+	}},
+
+	{"Add/Tombstones", func(t *testing.T, c context.Context, _ Implementation) {
+		task := &tq.Task{Name: "a", Path: "/work"}
+		mustNil(t, tq.Add(c, "default", task))
+		mustNil(t, tq.Delete(c, "default", task))
+		// The names of deleted tasks can't be reused.
+		expectEqual(t, "error", tq.Add(c, "default", &tq.Task{Name: "a", Path: "/work"}), tq.ErrTaskAlreadyAdded)
+		expectTasks(t, c, "default", 0)
+	}},
+
+	{"Add/Batch", func(t *testing.T, c context.Context, _ Implementation) {
+		mustNil(t, tq.Add(c, "default", &tq.Task{Name: "a", Path: "/work"}))
+		err := tq.Add(c, "default", &tq.Task{Name: "a", Path: "/work"}, &tq.Task{Name: "b", Path: "/work"})
+		expectEqual(t, "error", err, errors.MultiError{tq.ErrTaskAlreadyAdded, nil})
+		expectTasks(t, c, "default", 2)
+	}},
+
+	{"Add/InvalidName", func(t *testing.T, c context.Context, _ Implementation) {
+		err := tq.Add(c, "default", &tq.Task{Name: "ok", Path: "/work"}, &tq.Task{Name: "not ok!", Path: "/work"})
+		if err == nil {
+			t.Fatal("adding a task with an invalid name succeeded")
+		}
+		// The whole batch is rejected.
+		expectTasks(t, c, "default", 0)
+	}},
+
+	{"Add/UnknownQueue", func(t *testing.T, c context.Context, _ Implementation) {
+		if err := tq.Add(c, "unknown", &tq.Task{Path: "/work"}); err == nil {
+			t.Error("adding a task to an unknown queue succeeded")
+		}
+	}},
+
+	{"Add/QueueMode", func(t *testing.T, c context.Context, _ Implementation) {
+		if err := tq.Add(c, "default", &tq.Task{Method: "PULL"}); err == nil {
+			t.Error("adding a pull task to a push queue succeeded")
+		}
+		if err := tq.Add(c, PullQueue, &tq.Task{Path: "/work"}); err == nil {
+			t.Error("adding a push task to a pull queue succeeded")
+		}
+	}},
+
+	{"Add/Namespace", func(t *testing.T, c context.Context, _ Implementation) {
+		task := &tq.Task{Path: "/work"}
+		mustNil(t, tq.Add(info.MustNamespace(c, "other"), "default", task))
+		expectEqual(t, "namespace header", task.Header.Get("X-AppEngine-Current-Namespace"), "other")
+	}},
+
+	// Deleting tasks.
+
+	{"Delete", func(t *testing.T, c context.Context, _ Implementation) {
+		task := &tq.Task{Path: "/work"}
+		mustNil(t, tq.Add(c, "default", task))
+		err := tq.Delete(c, "default", task, &tq.Task{Name: "unknown"})
+		merr, ok := err.(errors.MultiError)
+		if !ok || len(merr) != 2 || merr[0] != nil || merr[1] == nil {
+			t.Errorf("got error %v, want an error for the unknown task only", err)
+		}
+		expectTasks(t, c, "default", 0)
+		if err := tq.Delete(c, "default", task); err == nil {
+			t.Error("deleting a deleted task succeeded")
+		}
+	}},
+
+	{"Purge", func(t *testing.T, c context.Context, _ Implementation) {
+		mustNil(t, tq.Add(c, "default", &tq.Task{Path: "/work"}, &tq.Task{Path: "/work"}))
+		mustNil(t, tq.Purge(c, "default"))
+		expectTasks(t, c, "default", 0)
+		if err := tq.Purge(c, "unknown"); err == nil {
+			t.Error("purging an unknown queue succeeded")
+		}
+	}},
+
+	{"Stats", func(t *testing.T, c context.Context, _ Implementation) {
+		now := clock.Now(c).Truncate(time.Second)
+		mustNil(t, tq.Add(c, "default",
+			&tq.Task{Path: "/work", ETA: now.Add(2 * time.Hour)},
+			&tq.Task{Path: "/work", ETA: now.Add(time.Hour)}))
+		stats, err := tq.Stats(c, "default", "unknown")
+		merr, ok := err.(errors.MultiError)
+		if !ok || len(merr) != 2 || merr[0] != nil || merr[1] == nil {
+			t.Fatalf("got error %v, want an error for the unknown queue only", err)
+		}
+		expectEqual(t, "tasks", stats[0].Tasks, 2)
+		if !stats[0].OldestETA.Equal(now.Add(time.Hour)) {
+			t.Errorf("got oldest ETA %s, want %s", stats[0].OldestETA, now.Add(time.Hour))
+		}
+	}},
+
+	// Leasing tasks.
+
+	{"Lease", func(t *testing.T, c context.Context, _ Implementation) {
+		now := clock.Now(c).Truncate(time.Second)
+		addPullTasks(t, c, now, "a", "b", "c")
+		tasks, err := tq.Lease(c, 2, PullQueue, time.Minute)
+		mustNil(t, err)
+		// The oldest tasks are leased first.
+		expectEqual(t, "leased tasks", names(tasks), []string{"a", "b"})
+		expectEqual(t, "payload", string(tasks[0].Payload), "a")
+		if tasks[0].ETA.Before(clock.Now(c).Add(time.Minute).Truncate(time.Second)) {
+			t.Errorf("got ETA %s, want the end of the lease", tasks[0].ETA)
+		}
+
+		tasks, err = tq.Lease(c, 2, PullQueue, time.Minute)
+		mustNil(t, err)
+		expectEqual(t, "leased tasks", names(tasks), []string{"c"})
+		tasks, err = tq.Lease(c, 2, PullQueue, time.Minute)
+		mustNil(t, err)
+		expectEqual(t, "leased tasks", names(tasks), []string(nil))
+
+		if _, err := tq.Lease(c, 2, "default", time.Minute); err == nil {
+			t.Error("leasing from a push queue succeeded")
+		}
+	}},
+
+	{"Lease/NotReady", func(t *testing.T, c context.Context, _ Implementation) {
+		mustNil(t, tq.Add(c, PullQueue, &tq.Task{Name: "later", Method: "PULL", Delay: time.Hour}))
+		tasks, err := tq.Lease(c, 10, PullQueue, time.Minute)
+		mustNil(t, err)
+		expectEqual(t, "leased tasks", names(tasks), []string(nil))
+	}},
+
+	{"LeaseByTag", func(t *testing.T, c context.Context, _ Implementation) {
+		now := clock.Now(c).Truncate(time.Second)
+		mustNil(t, tq.Add(c, PullQueue,
+			&tq.Task{Name: "a", Method: "PULL", Tag: "x", ETA: now.Add(-3 * time.Second)},
+			&tq.Task{Name: "b", Method: "PULL", Tag: "y", ETA: now.Add(-2 * time.Second)},
+			&tq.Task{Name: "c", Method: "PULL", Tag: "x", ETA: now.Add(-1 * time.Second)}))
+		tasks, err := tq.LeaseByTag(c, 10, PullQueue, time.Minute, "y")
+		mustNil(t, err)
+		expectEqual(t, "leased tasks", names(tasks), []string{"b"})
+		// Without a tag, the tag of the oldest task is used.
+		tasks, err = tq.LeaseByTag(c, 10, PullQueue, time.Minute, "")
+		mustNil(t, err)
+		expectEqual(t, "leased tasks", names(tasks), []string{"a", "c"})
+	}},
+
+	{"ModifyLease", func(t *testing.T, c context.Context, _ Implementation) {
+		addPullTasks(t, c, clock.Now(c).Truncate(time.Second), "a")
+		tasks, err := tq.Lease(c, 1, PullQueue, time.Minute)
+		mustNil(t, err)
+		task := tasks[0]
+		stale := task.Duplicate()
+
+		mustNil(t, tq.ModifyLease(c, task, PullQueue, 2*time.Minute))
+		if !task.ETA.After(stale.ETA) {
+			t.Errorf("got ETA %s, want it after %s", task.ETA, stale.ETA)
+		}
+		// The ETA of the lease identifies it.
+		if err := tq.ModifyLease(c, stale, PullQueue, time.Minute); err == nil {
+			t.Error("modifying a lost lease succeeded")
+		}
+
+		// A lease of 0 releases the task.
+		mustNil(t, tq.ModifyLease(c, task, PullQueue, 0))
+		tasks, err = tq.Lease(c, 1, PullQueue, time.Minute)
+		mustNil(t, err)
+		expectEqual(t, "leased tasks", names(tasks), []string{"a"})
+
+		mustNil(t, tq.Delete(c, PullQueue, tasks[0]))
+		if err := tq.ModifyLease(c, tasks[0], PullQueue, time.Minute); err == nil {
+			t.Error("modifying the lease of a deleted task succeeded")
+		}
+	}},
+
+	{"Lease/Expiration", func(t *testing.T, c context.Context, impl Implementation) {
+		if impl.Advance == nil {
+			t.Skip("the clock can't be advanced")
+		}
+		addPullTasks(t, c, clock.Now(c).Truncate(time.Second), "a")
+		tasks, err := tq.Lease(c, 1, PullQueue, time.Minute)
+		mustNil(t, err)
+		lost := tasks[0]
+
+		impl.Advance(c, 61*time.Second)
+		if err := tq.ModifyLease(c, lost, PullQueue, time.Minute); err == nil {
+			t.Error("modifying an expired lease succeeded")
+		}
+		tasks, err = tq.Lease(c, 1, PullQueue, time.Minute)
+		mustNil(t, err)
+		expectEqual(t, "leased tasks", names(tasks), []string{"a"})
+	}},
+
+	// Transactions.
+
+	{"Transaction", func(t *testing.T, c context.Context, impl Implementation) {
+		if impl.Capabilities.NoTransactions {
+			t.Skip("transactions are not supported")
+		}
+		err := ds.RunInTransaction(c, func(c context.Context) error {
+			task := &tq.Task{Path: "/work"}
+			if err := tq.Add(c, "default", task); err != nil {
+				return err
+			}
+			if task.Name == "" {
+				t.Error("the task added in the transaction has no name")
+			}
+			// The task is added when the transaction commits.
+			expectTasks(t, ds.WithoutTransaction(c), "default", 0)
+			return nil
+		}, nil)
+		mustNil(t, err)
+		expectTasks(t, c, "default", 1)
+	}},
+
+	{"Transaction/Rollback", func(t *testing.T, c context.Context, impl Implementation) {
+		if impl.Capabilities.NoTransactions {
+			t.Skip("transactions are not supported")
+		}
+		boom := errors.New("boom")
+		err := ds.RunInTransaction(c, func(c context.Context) error {
+			if err := tq.Add(c, "default", &tq.Task{Path: "/work"}); err != nil {
+				return err
+			}
+			return boom
+		}, nil)
+		expectEqual(t, "error", err, boom)
+		expectTasks(t, c, "default", 0)
+	}},
+
+	{"Transaction/NamedTask", func(t *testing.T, c context.Context, impl Implementation) {
+		if impl.Capabilities.NoTransactions {
+			t.Skip("transactions are not supported")
+		}
+		err := ds.RunInTransaction(c, func(c context.Context) error {
+			return tq.Add(c, "default", &tq.Task{Name: "a", Path: "/work"})
+		}, nil)
+		if err == nil {
+			t.Error("adding a named task in a transaction succeeded")
+		}
+		expectTasks(t, c, "default", 0)
+	}},
+}
+
+// mustNil fails the test if err is not nil.
+func mustNil(t *testing.T, err error) {
+	t.Helper()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+}
+
+// expectEqual fails the test if got is not deeply equal to want.
+func expectEqual(t *testing.T, what string, got, want interface{}) {
+	t.Helper()
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("%s: got %v, want %v", what, got, want)
+	}
+}
+
+// expectTasks checks the number of tasks in the queue, with Stats.
+func expectTasks(t *testing.T, c context.Context, queue string, want int) {
+	t.Helper()
+	stats, err := tq.Stats(c, queue)
+	mustNil(t, err)
+	expectEqual(t, "number of tasks in "+queue, stats[0].Tasks, want)
+}
+
+// addPullTasks adds pull tasks with the names to PullQueue, in order of ETA,
+// all before now. Their payloads are their names.
+func addPullTasks(t *testing.T, c context.Context, now time.Time, names ...string) {
+	t.Helper()
+	tasks := make([]*tq.Task, len(names))
+	for i, name := range names {
+		tasks[i] = &tq.Task{
+			Name:    name,
+			Method:  "PULL",
+			Payload: []byte(name),
+			ETA:     now.Add(time.Duration(i-len(names)) * time.Second),
+		}
+	}
+	mustNil(t, tq.Add(c, PullQueue, tasks...))
+}
+
+// names returns the names of the tasks.
+func names(tasks []*tq.Task) []string {
+	var ret []string
+	for _, t := range tasks {
+		ret = append(ret, t.Name)
+	}
+	return ret
+}
@@ -0,0 +1,73 @@
+// Copyright 2018 The LUCI Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tqtest
+
+import (
+	"testing"
+	"time"
+
+	"go.chromium.org/gae/filter/count"
+	"go.chromium.org/gae/filter/featureBreaker"
+	"go.chromium.org/gae/impl/memory"
+	tq "go.chromium.org/gae/service/taskqueue"
+
+	"go.chromium.org/luci/common/clock"
+	"go.chromium.org/luci/common/clock/testclock"
+
+	"golang.org/x/net/context"
+)
+
+// newMemory returns a context with a new memory task queue service, which has
+// the PullQueue, and a test clock.
+func newMemory() context.Context {
+	c, _ := testclock.UseTime(context.Background(), testclock.TestTimeUTC)
+	c = memory.Use(c)
+	tq.GetTestable(c).CreatePullQueue(PullQueue)
+	return c
+}
+
+func advance(c context.Context, d time.Duration) {
+	clock.Get(c).(testclock.TestClock).Add(d)
+}
+
+func TestConformance(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		name string
+		impl Implementation
+	}{
+		{"memory", Implementation{New: newMemory, Advance: advance}},
+		{"count", Implementation{
+			New: func() context.Context {
+				c, _ := count.FilterTQ(newMemory())
+				return c
+			},
+			Advance: advance,
+		}},
+		{"featureBreaker", Implementation{
+			New: func() context.Context {
+				c, _ := featureBreaker.FilterTQ(newMemory(), nil)
+				return c
+			},
+			Advance: advance,
+		}},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			RunConformance(t, tc.impl)
+		})
+	}
+}
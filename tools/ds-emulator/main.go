@@ -0,0 +1,107 @@
+// Copyright 2018 The LUCI Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+	pb "google.golang.org/genproto/googleapis/datastore/v1"
+	"google.golang.org/grpc"
+
+	"go.chromium.org/gae/impl/memory/dsapi"
+
+	"golang.org/x/net/context"
+)
+
+const help = `Usage of %s:
+
+%s serves in-memory datastores over the Cloud Datastore v1 API, as a local
+replacement for the Cloud Datastore emulator. It serves both the gRPC and the
+HTTP API on the same port, and keeps one datastore per project, in memory only.
+
+  %s -addr localhost:8081
+
+Point the Cloud client libraries at it with:
+
+  export DATASTORE_EMULATOR_HOST=localhost:8081
+
+Options:
+`
+
+type app struct {
+	out io.Writer
+
+	addr string
+}
+
+func (a *app) parseArgs(fs *flag.FlagSet, args []string) error {
+	fs.SetOutput(a.out)
+	fs.Usage = func() {
+		fmt.Fprintf(a.out, help, args[0], args[0], args[0])
+		fs.PrintDefaults()
+	}
+
+	fs.StringVar(&a.addr, "addr", "localhost:8081", "The address to listen on.")
+
+	return fs.Parse(args[1:])
+}
+
+// handler returns a handler which serves gRPC requests with the gRPC service
+// of srv, and others with its HTTP API.
+func handler(srv *dsapi.Server) http.Handler {
+	gs := grpc.NewServer()
+	pb.RegisterDatastoreServer(gs, srv)
+
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ProtoMajor == 2 && strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc") {
+			gs.ServeHTTP(w, r)
+			return
+		}
+		srv.ServeHTTP(w, r)
+	})
+	// The client libraries talk gRPC to emulators over cleartext HTTP/2.
+	return h2c.NewHandler(h, &http2.Server{})
+}
+
+func (a *app) run(c context.Context) error {
+	l, err := net.Listen("tcp", a.addr)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(a.out, "export DATASTORE_EMULATOR_HOST=%s\n", l.Addr())
+	return (&http.Server{Handler: handler(dsapi.New(c))}).Serve(l)
+}
+
+func (a *app) main() {
+	if err := a.parseArgs(flag.NewFlagSet(os.Args[0], flag.ContinueOnError), os.Args); err != nil {
+		os.Exit(1)
+	}
+	if err := a.run(context.Background()); err != nil {
+		fmt.Fprintf(a.out, "error: %s\n", err)
+		os.Exit(2)
+	}
+}
+
+func main() {
+	(&app{out: os.Stderr}).main()
+}
@@ -0,0 +1,195 @@
+// Copyright 2018 The LUCI Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"cloud.google.com/go/datastore"
+
+	"go.chromium.org/gae/impl/cloud"
+	ds "go.chromium.org/gae/service/datastore"
+	"go.chromium.org/gae/service/datastore/migrate"
+	"go.chromium.org/gae/service/info"
+
+	"go.chromium.org/luci/common/errors"
+
+	"golang.org/x/net/context"
+)
+
+const help = `Usage of %s:
+
+%s copies Cloud Datastore entities from one project and/or namespace to
+another, rewriting every Key which points into the source project and
+namespace (including Keys nested in entity values).
+
+  %s -src-project my-app -src-namespace "" -dst-namespace tenant-1 -kind Thing
+
+With -dry-run, nothing is written; instead every destination entity which would
+be created or changed is printed as a diff.
+
+With -checkpoint, progress is saved to the given file after every batch, and
+an interrupted migration is resumed from it.
+
+Options:
+`
+
+type app struct {
+	out io.Writer
+
+	srcProject   string
+	srcNamespace string
+	dstProject   string
+	dstNamespace string
+	kind         string
+	batchSize    int
+	dryRun       bool
+	checkpoint   string
+}
+
+func (a *app) parseArgs(fs *flag.FlagSet, args []string) error {
+	fs.SetOutput(a.out)
+	fs.Usage = func() {
+		fmt.Fprintf(a.out, help, args[0], args[0], args[0])
+		fs.PrintDefaults()
+	}
+
+	fs.StringVar(&a.srcProject, "src-project", "", "The Cloud project to copy from (required).")
+	fs.StringVar(&a.srcNamespace, "src-namespace", "", "The namespace to copy from.")
+	fs.StringVar(&a.dstProject, "dst-project", "", "The Cloud project to copy to. Defaults to -src-project.")
+	fs.StringVar(&a.dstNamespace, "dst-namespace", "", "The namespace to copy to.")
+	fs.StringVar(&a.kind, "kind", "", "The kind to copy. If empty, all kinds are copied.")
+	fs.IntVar(&a.batchSize, "batch-size", migrate.DefaultBatchSize, "The number of entities per batch.")
+	fs.BoolVar(&a.dryRun, "dry-run", false, "Print the changes instead of writing them.")
+	fs.StringVar(&a.checkpoint, "checkpoint", "", "A file to save progress to, and resume from.")
+
+	if err := fs.Parse(args[1:]); err != nil {
+		return err
+	}
+	fail := errors.MultiError(nil)
+	if a.srcProject == "" {
+		fail = append(fail, errors.New("must specify -src-project"))
+	}
+	if a.dstProject == "" {
+		a.dstProject = a.srcProject
+	}
+	if a.srcProject == a.dstProject && a.srcNamespace == a.dstNamespace {
+		fail = append(fail, errors.New("source and destination are the same"))
+	}
+	if len(fail) > 0 {
+		for _, e := range fail {
+			fmt.Fprintln(a.out, "error:", e)
+		}
+		fmt.Fprintln(a.out)
+		fs.Usage()
+		return fail
+	}
+	return nil
+}
+
+// withProject returns a context with the cloud datastore of the given project
+// and namespace installed.
+func withProject(c context.Context, project, namespace string) (context.Context, error) {
+	client, err := datastore.NewClient(c, project)
+	if err != nil {
+		return nil, errors.Annotate(err, "creating datastore client for %q", project).Err()
+	}
+	c = (&cloud.ConfigLite{ProjectID: project, DS: client}).Use(c)
+	return info.Namespace(c, namespace)
+}
+
+func (a *app) loadCheckpoint() (*migrate.Progress, error) {
+	if a.checkpoint == "" {
+		return nil, nil
+	}
+	data, err := ioutil.ReadFile(a.checkpoint)
+	switch {
+	case os.IsNotExist(err):
+		return nil, nil
+	case err != nil:
+		return nil, err
+	}
+	p := &migrate.Progress{}
+	if err := json.Unmarshal(data, p); err != nil {
+		return nil, errors.Annotate(err, "bad checkpoint file %q", a.checkpoint).Err()
+	}
+	return p, nil
+}
+
+func (a *app) saveCheckpoint(p *migrate.Progress) error {
+	fmt.Fprintf(a.out, "copied %d entities\n", p.Copied)
+	if a.checkpoint == "" || a.dryRun {
+		return nil
+	}
+	data, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+	tmp := a.checkpoint + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, a.checkpoint)
+}
+
+func (a *app) run(c context.Context) error {
+	src, err := withProject(c, a.srcProject, a.srcNamespace)
+	if err != nil {
+		return err
+	}
+	dst, err := withProject(c, a.dstProject, a.dstNamespace)
+	if err != nil {
+		return err
+	}
+
+	resume, err := a.loadCheckpoint()
+	if err != nil {
+		return err
+	}
+	if resume != nil {
+		fmt.Fprintf(a.out, "resuming after %d entities\n", resume.Copied)
+	}
+
+	_, err = migrate.Copy(src, dst, ds.NewQuery(a.kind), &migrate.Options{
+		BatchSize: a.batchSize,
+		Resume:    resume,
+		Progress:  a.saveCheckpoint,
+		DryRun:    a.dryRun,
+		Diff: func(d *migrate.Diff) error {
+			_, err := fmt.Fprint(a.out, d)
+			return err
+		},
+	})
+	return err
+}
+
+func (a *app) main() {
+	if err := a.parseArgs(flag.NewFlagSet(os.Args[0], flag.ContinueOnError), os.Args); err != nil {
+		os.Exit(1)
+	}
+	if err := a.run(context.Background()); err != nil {
+		fmt.Fprintf(a.out, "error: %s\n", err)
+		os.Exit(2)
+	}
+}
+
+func main() {
+	(&app{out: os.Stderr}).main()
+}